@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// environmentUnchanged returns true if the given Puppet environment was successfully deployed with the current head of its branch and its Puppetfile only contains pinned module versions.
+// Modules with a branch or the latest Forge version can change without a change of the control repository, so these environments are never skipped.
+func environmentUnchanged(pe PuppetEnvironment) bool {
+	deployFile := filepath.Join(pe.targetDir, ".g10k-deploy.json")
+	if !fileExists(deployFile) {
+		return false
+	}
+	dr := readDeployResultFile(deployFile)
+	if !dr.DeploySuccess {
+		return false
+	}
+
+	if commit := branchCommit(pe); len(commit) == 0 || dr.Signature != commit {
+		return false
+	}
+
+	pf := filepath.Join(pe.targetDir, "Puppetfile")
+	if !fileExists(pf) {
+		return true
+	}
+	if dr.PuppetfileChecksum != getSha256sumFile(pf) {
+		return false
+	}
+	puppetfile := readPuppetfile(pf, pe.sa.PrivateKey, pe.source, pe.branch, pe.sa.ForceForgeVersions, false)
+	if module := floatingPuppetfileModule(puppetfile); len(module) > 0 {
+		Debugf("Not skipping environment " + pe.env + ", because module " + module + " of its Puppetfile is not pinned to a version")
+		return false
+	}
+	return true
+}
+
+// floatingPuppetfileModule returns the name of the first module of the Puppetfile that is not pinned to a fixed version or an empty string
+func floatingPuppetfileModule(pf Puppetfile) string {
+	reCommit := regexp.MustCompile(`^[0-9a-f]{40}$`)
+	for name, gm := range pf.gitModules {
+		if gm.local || len(gm.tag) > 0 || len(gm.commit) > 0 || reCommit.MatchString(gm.ref) {
+			continue
+		}
+		return name
+	}
+	for name, fm := range pf.forgeModules {
+		if fm.version == "latest" {
+			return name
+		}
+	}
+	return ""
+}
+
+// branchCommit returns the commit of the control repository branch of the given Puppet environment or an empty string if it can not be resolved
+func branchCommit(pe PuppetEnvironment) string {
+	revParseCmd := "git --git-dir " + pe.gitDir + " rev-parse --verify '" + pe.branch
+	if !config.GitObjectSyntaxNotSupported {
+		revParseCmd = revParseCmd + "^{object}'"
+	} else {
+		revParseCmd = revParseCmd + "'"
+	}
+	er := executeCommand(revParseCmd, config.Timeout, true)
+	if er.returnCode != 0 {
+		return ""
+	}
+	return strings.TrimSpace(er.stdout)
+}
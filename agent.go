@@ -0,0 +1,185 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultAgentInterval is how often g10k agent fetches the desired state if agent interval is not set
+const defaultAgentInterval = 5 * time.Minute
+
+// agentCommand periodically converges the agent basedir to the signed desired state that a primary g10k published with the publish setting,
+// e.g. g10k agent -config agent.yaml
+func agentCommand(args []string) {
+	fs := subcommandFlagSet("agent")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	once := fs.Bool("once", false, "converge only once and exit with 1 if that failed, e.g. for a cron job")
+	fs.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
+	fs.BoolVar(&verbose, "verbose", false, "log verbose output, defaults to false")
+	fs.Parse(args)
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " agent -config agent.yaml")
+	}
+	info = true
+	configFile = *configFileFlag
+	config = readConfigfile(configFile)
+	openLogOutputs()
+	if len(config.Agent.URL) == 0 {
+		Fatalf("Error: you need to configure the agent url of the published desired state in " + configFile)
+	}
+	interval := defaultAgentInterval
+	if len(config.Agent.Interval) > 0 {
+		interval, _ = time.ParseDuration(config.Agent.Interval)
+	}
+	handleTerminationSignals()
+
+	for {
+		err := convergeDesiredState()
+		if err != nil {
+			Warnf("WARNING: Could not converge to the desired state of " + config.Agent.URL + ": " + err.Error())
+		}
+		if *once {
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		for end := time.Now().Add(interval); time.Now().Before(end) && !deployCancelled(); {
+			time.Sleep(time.Second)
+		}
+		if deployCancelled() {
+			exitIfCancelled()
+			return
+		}
+	}
+}
+
+// convergeDesiredState downloads and verifies the desired state, deploys every environment whose version changed from its artifact and removes the environments that are not desired anymore.
+// The verified artifacts are kept in the cachedir, so that an environment can be deployed again without downloading it.
+func convergeDesiredState() error {
+	agentDir := checkDirAndCreate(filepath.Join(config.CacheDir, "agent"), "cachedir/agent")
+	stateFile := filepath.Join(agentDir, "desired-state.json")
+	stateURL := strings.TrimSuffix(config.Agent.URL, "/") + "/desired-state.json"
+	for _, download := range [][]string{{stateURL, stateFile}, {stateURL + ".sig", stateFile + ".sig"}} {
+		if er := executeCommand(downloadCommand(download[0], download[1]), config.Timeout, true); er.returnCode != 0 {
+			return errors.New("could not download " + download[0] + ": " + er.errorOutput())
+		}
+	}
+	if er := executeCommand(verifyCommand(stateFile), config.Timeout, true); er.returnCode != 0 {
+		return errors.New("invalid signature of " + stateURL + ": " + er.errorOutput())
+	}
+	var state DesiredState
+	content, err := ioutil.ReadFile(stateFile)
+	if err == nil {
+		err = json.Unmarshal(content, &state)
+	}
+	if err != nil {
+		return errors.New("could not parse " + stateURL + ": " + err.Error())
+	}
+
+	basedir := checkDirAndCreate(config.Agent.Basedir, "agent basedir")
+	deployedFile := filepath.Join(agentDir, "deployed.json")
+	deployed := make(map[string]string)
+	if content, err := ioutil.ReadFile(deployedFile); err == nil {
+		json.Unmarshal(content, &deployed)
+	}
+	desired := make(map[string]struct{})
+	var failed []string
+	for _, pe := range state.Environments {
+		if len(pe.Environment) == 0 || strings.ContainsAny(pe.Environment, "/\\") || strings.HasPrefix(pe.Environment, ".") {
+			Warnf("WARNING: Ignoring invalid environment name " + pe.Environment + " in " + stateURL)
+			continue
+		}
+		desired[pe.Environment] = empty
+		envDir := filepath.Join(basedir, pe.Environment)
+		if deployed[pe.Environment] == pe.Version && isDir(envDir) {
+			Debugf("Environment " + pe.Environment + " is already at version " + pe.Version)
+			continue
+		}
+		if deployCancelled() {
+			break
+		}
+		if err := deployPublishedEnvironment(pe, agentDir, basedir); err != nil {
+			Warnf("WARNING: Could not deploy environment " + pe.Environment + " version " + pe.Version + ": " + err.Error())
+			failed = append(failed, pe.Environment)
+			continue
+		}
+		deployed[pe.Environment] = pe.Version
+		Infof("Deployed environment " + pe.Environment + " version " + pe.Version)
+	}
+	for env := range deployed {
+		if _, ok := desired[env]; !ok && !deployCancelled() {
+			Infof("Removing environment " + env + ", because it is not part of the desired state anymore")
+			purgeDir(filepath.Join(basedir, env), "convergeDesiredState()")
+			purgeDir(filepath.Join(agentDir, "artifacts", env), "convergeDesiredState()")
+			delete(deployed, env)
+		}
+	}
+	writeStructJSONFile(deployedFile, deployed)
+	if len(failed) > 0 {
+		return errors.New("failed environment(s) " + strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// deployPublishedEnvironment downloads the artifact of the given environment unless it is already cached, verifies its checksum and
+// updates the environment in the basedir incrementally from it, removing every file that is not part of the artifact
+func deployPublishedEnvironment(pe PublishedEnvironment, agentDir string, basedir string) error {
+	if !strings.HasSuffix(pe.URL, ".tar.gz") {
+		return errors.New("only tar.gz artifacts are supported, but got " + pe.URL)
+	}
+	artifactDir := checkDirAndCreate(filepath.Join(agentDir, "artifacts", pe.Environment), "cachedir/agent/artifacts")
+	artifact := filepath.Join(artifactDir, pe.Version+".tar.gz")
+	if !fileExists(artifact) {
+		tmpFile := artifact + ".download"
+		if er := executeCommand(downloadCommand(pe.URL, tmpFile), config.Timeout, true); er.returnCode != 0 {
+			os.Remove(tmpFile)
+			return errors.New("could not download " + pe.URL + ": " + er.errorOutput())
+		}
+		checksum, err := fileSha256(tmpFile)
+		if err != nil || hex.EncodeToString(checksum) != pe.SHA256 {
+			os.Remove(tmpFile)
+			return errors.New("checksum mismatch of " + pe.URL)
+		}
+		if err := os.Rename(tmpFile, artifact); err != nil {
+			return err
+		}
+	}
+	// only the current version is kept in the cache
+	others, _ := filepath.Glob(filepath.Join(artifactDir, "*.tar.gz"))
+	for _, other := range others {
+		if other != artifact {
+			os.Remove(other)
+		}
+	}
+
+	f, err := os.Open(artifact)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gzipReader, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	// the artifact contains the content of the environment directory below its name
+	if err := ensureDir(filepath.Join(basedir, pe.Environment)); err != nil {
+		return err
+	}
+	extracted := unTarIncremental(gzipReader, basedir)
+	synced := make(map[string]struct{})
+	for path := range extracted {
+		if relPath := strings.TrimPrefix(path, pe.Environment+"/"); relPath != path {
+			synced[relPath] = empty
+		}
+	}
+	removeStaleContent(filepath.Join(basedir, pe.Environment), synced, nil)
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// annotationsPrinted is set once the GitHub Actions annotations of this g10k run are printed, so that a failure afterwards does not print them again
+	annotationsPrinted bool
+	rePuppetfilePath   = regexp.MustCompile(`(\S*Puppetfile)\b`)
+	reAnnotationEnv    = regexp.MustCompile(`Puppet environment '([^']+)'`)
+	reAnnotationLine   = regexp.MustCompile(`line: (.*)`)
+	reAnnotationModule = regexp.MustCompile(`\bmodule (?:name )?'?([\w/-]+)`)
+)
+
+// githubOutput returns true if g10k prints its failures as GitHub Actions workflow commands, so that they are shown inline on the Puppetfile of a pull request
+func githubOutput() bool {
+	return outputFormat == "github"
+}
+
+// printAnnotations prints an ::error workflow command for the error that aborted the g10k run and for every environment, module and source that failed with -keepgoing
+func printAnnotations(fatal string) {
+	if !githubOutput() || annotationsPrinted {
+		return
+	}
+	annotationsPrinted = true
+	printed := make(map[string]bool)
+	if len(fatal) > 0 {
+		printAnnotation(fatal, "", printed)
+	}
+	// no locking, as Fatalf can be called while the mutex is held
+	var envs []string
+	for env := range environmentFailures {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		printAnnotation(environmentFailures[env], env, printed)
+	}
+	for _, failures := range []map[string]string{moduleFailures, sourceFailures} {
+		var keys []string
+		for key := range failures {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			printAnnotation(failures[key], "", printed)
+		}
+	}
+}
+
+// printValidationAnnotations prints an ::error workflow command for every error of -validate
+func printValidationAnnotations() {
+	if !githubOutput() {
+		return
+	}
+	printed := make(map[string]bool)
+	for _, message := range validationMessages {
+		printAnnotation(message, "", printed)
+	}
+}
+
+// printAnnotation prints the ::error workflow command of the given error message, env is the Puppet environment it belongs to if it is not part of the message
+func printAnnotation(message string, env string, printed map[string]bool) {
+	message = strings.TrimSpace(message)
+	if printed[message] {
+		return
+	}
+	printed[message] = true
+	file, line := annotationLocation(message, env)
+	var properties []string
+	if len(file) > 0 {
+		properties = append(properties, "file="+escapeAnnotationProperty(file))
+		if line > 0 {
+			properties = append(properties, "line="+strconv.Itoa(line))
+		}
+	}
+	properties = append(properties, "title=g10k")
+	fmt.Fprintln(outputWriter, "::error "+strings.Join(properties, ",")+"::"+escapeAnnotationData(message))
+}
+
+// annotationLocation returns the file of the given error message relative to the current directory and its line, a Puppetfile outside of it is given relative to its control repository
+func annotationLocation(message string, env string) (string, int) {
+	if m := reAnnotationEnv.FindStringSubmatch(message); len(m) > 1 && len(env) == 0 {
+		env = m[1]
+	}
+	var pf string
+	if m := rePuppetfilePath.FindStringSubmatch(message); len(m) > 1 {
+		pf = m[1]
+	} else if pe, ok := puppetEnvironments[env]; ok && len(env) > 0 {
+		pf = filepath.Join(pe.targetDir, "Puppetfile")
+	} else if pfMode {
+		pf = pfLocation
+	}
+	if len(pf) == 0 || !fileExists(pf) {
+		if len(configFile) > 0 && strings.Contains(message, configFile) {
+			return annotationPath(configFile, configFile), 0
+		}
+		return "", 0
+	}
+
+	line := 0
+	if m := reAnnotationLine.FindStringSubmatch(message); len(m) > 1 {
+		line = puppetfileStatementLine(pf, strings.TrimSpace(m[1]))
+	}
+	if m := reAnnotationModule.FindStringSubmatch(message); len(m) > 1 && line == 0 {
+		module := m[1]
+		if strings.Count(module, "-") > 0 && !strings.Contains(module, "/") {
+			// Forge modules are given as author-name
+			module = strings.Replace(module, "-", "/", 1)
+		}
+		line, _ = puppetfileStatement(pf, module)
+		if line == 0 {
+			line, _ = puppetfileStatement(pf, m[1])
+		}
+	}
+	return annotationPath(pf, "Puppetfile"), line
+}
+
+// annotationPath returns the given file relative to the current directory or the fallback if it is outside of it
+func annotationPath(file string, fallback string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fallback
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return fallback
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fallback
+	}
+	return rel
+}
+
+// puppetfileStatementLine returns the line of the Puppetfile at which the given statement starts, the statement is joined from all its lines like preparePuppetfile does
+func puppetfileStatementLine(pf string, statement string) int {
+	file, err := os.Open(pf)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	joined, start, number := "", 0, 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		number++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.Split(line, "#")[0])
+		if len(joined) == 0 {
+			start = number
+		}
+		joined += line
+		if strings.HasSuffix(line, ",") {
+			continue
+		}
+		if strings.TrimSpace(joined) == statement {
+			return start
+		}
+		joined = ""
+	}
+	return 0
+}
+
+// escapeAnnotationData escapes the message of a workflow command
+func escapeAnnotationData(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// escapeAnnotationProperty escapes a property of a workflow command
+func escapeAnnotationProperty(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A", ":", "%3A", ",", "%2C").Replace(s)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// boltModuleDir is the directory of a Bolt project into which Bolt installs the modules of its Puppetfile, the modules directory is reserved for the local modules of the project
+const boltModuleDir = ".modules"
+
+// isBoltProject returns true if the given directory is a Bolt project, i.e. it contains a bolt-project.yaml
+func isBoltProject(dir string) bool {
+	return fileExists(filepath.Join(dir, "bolt-project.yaml"))
+}
+
+// boltPuppetfile makes the modules of the given Puppetfile content of a Bolt project default to the .modules directory like Bolt does, unless the Puppetfile sets its own moduledir
+func boltPuppetfile(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		if reModuledir.MatchString(line) {
+			return content
+		}
+	}
+	return "moduledir '" + boltModuleDir + "'\n" + content
+}
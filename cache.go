@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// CacheComponent is the size of one part of the cachedir in the output of g10k cache info
+type CacheComponent struct {
+	Name    string `json:"name"`
+	Dir     string `json:"dir"`
+	Entries int    `json:"entries"`
+	Size    int64  `json:"size"`
+}
+
+// cacheComponents returns the parts of the cachedir that g10k cache clean and g10k cache prune remove, the other files of the cachedir are the state of g10k
+func cacheComponents() []CacheComponent {
+	return []CacheComponent{
+		{Name: "control repositories", Dir: config.EnvCacheDir},
+		{Name: "git modules", Dir: config.ModulesCacheDir},
+		{Name: "Forge modules", Dir: config.ForgeCacheDir},
+		{Name: "module store", Dir: extractedModulesDir()},
+	}
+}
+
+// cacheSize returns the size of the files below the given path, hardlinked files are only counted once
+func cacheSize(path string, inodes map[uint64]bool) int64 {
+	var size int64
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			if inodes[st.Ino] {
+				return nil
+			}
+			inodes[st.Ino] = true
+		}
+		size += info.Size()
+		return nil
+	})
+	return size
+}
+
+// cacheInfo returns the number of entries and the size of every component of the cachedir and of the rest of it as other
+func cacheInfo() []CacheComponent {
+	inodes := make(map[uint64]bool)
+	components := cacheComponents()
+	known := make(map[string]bool)
+	for i, component := range components {
+		known[component.Dir] = true
+		entries, _ := ioutil.ReadDir(component.Dir)
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), ".") {
+				components[i].Entries++
+			}
+		}
+		components[i].Size = cacheSize(component.Dir, inodes)
+	}
+	other := CacheComponent{Name: "other", Dir: config.CacheDir}
+	entries, _ := ioutil.ReadDir(config.CacheDir)
+	for _, entry := range entries {
+		path := filepath.Join(config.CacheDir, entry.Name())
+		if known[path] {
+			continue
+		}
+		other.Entries++
+		other.Size += cacheSize(path, inodes)
+	}
+	return append(components, other)
+}
+
+// referencedCacheEntries returns the paths of the cachedir that the deployed Puppet environments of the current config still need for their next deploy,
+// a Forge module without a resolved version keeps all of its releases
+func referencedCacheEntries() map[string]bool {
+	referenced := make(map[string]bool)
+	for source := range config.Sources {
+		referenced[filepath.Join(config.EnvCacheDir, source+".git")] = true
+	}
+	for _, es := range environmentStatuses() {
+		envDir := filepath.Join(config.Sources[es.Source].Basedir, es.Environment)
+		content, err := ioutil.ReadFile(filepath.Join(envDir, ".g10k-manifest.json"))
+		if err != nil {
+			Fatalf("Error: Not pruning the cachedir, because environment " + es.Environment + " has no deploy manifest, deploy it with g10k first")
+		}
+		var manifest DeployManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			Fatalf("Error: Not pruning the cachedir, because the deploy manifest of environment " + es.Environment + " could not be parsed: " + err.Error())
+		}
+		for _, m := range manifest.Modules {
+			switch m.Type {
+			case "git":
+				referenced[filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(m.Source, "/", "_", -1), ":", "-", -1))] = true
+				referenced[filepath.Join(extractedModulesDir(), m.Resolved)] = true
+			case "forge":
+				moduleName := strings.Replace(m.Name, "/", "-", -1)
+				referenced[filepath.Join(config.ForgeCacheDir, moduleName)] = true
+				if len(m.Resolved) > 0 {
+					referenced[filepath.Join(config.ForgeCacheDir, moduleName+"-"+m.Resolved)] = true
+				} else {
+					referenced[filepath.Join(config.ForgeCacheDir, moduleName+"-*")] = true
+				}
+			}
+		}
+	}
+	return referenced
+}
+
+// forgeCacheEntryReferenced returns true if the given release, archive or latest file in the Forge cachedir belongs to a referenced Forge module
+func forgeCacheEntryReferenced(path string, referenced map[string]bool) bool {
+	path = strings.TrimSuffix(path, ".tar.gz")
+	for _, suffix := range []string{"-latest-last-checked", "-latest"} {
+		if strings.HasSuffix(path, suffix) {
+			return referenced[strings.TrimSuffix(path, suffix)]
+		}
+	}
+	if referenced[path] {
+		return true
+	}
+	for entry := range referenced {
+		if strings.HasSuffix(entry, "-*") && strings.HasPrefix(path, strings.TrimSuffix(entry, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCacheEntry removes the given entry of the cachedir or only prints it with -dryrun and returns its size
+func removeCacheEntry(path string) int64 {
+	size := cacheSize(path, make(map[uint64]bool))
+	if dryRun {
+		fmt.Println("Would remove " + path + " (" + formatBytes(size) + ")")
+		return size
+	}
+	Debugf("Removing " + path + " (" + formatBytes(size) + ")")
+	purgeDir(path, "removeCacheEntry()")
+	return size
+}
+
+// cacheCommand shows the size of the cachedir per component, removes all cached repositories and modules or only the ones the deployed environments do not use anymore,
+// e.g. g10k cache info -config test.yaml or g10k cache prune -config test.yaml -dryrun
+func cacheCommand(args []string) {
+	fs := subcommandFlagSet("cache")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	fs.BoolVar(&dryRun, "dryrun", false, "only print the entries that clean or prune would remove")
+	fs.StringVar(&outputFormat, "output", "text", "format of the output: text or json")
+	fs.StringVar(&runLockParam, "runlock", "", "what to do if a g10k run holds the lock in the cachedir: wait, fail or none, overrides the run_lock setting (default \"wait\")")
+	fs.Parse(args)
+	// allow the flags before and after the action
+	action := ""
+	if fs.NArg() > 0 {
+		action = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	outputCommand = "cache"
+	setupOutput()
+	if (action != "info" && action != "clean" && action != "prune") || fs.NArg() > 0 {
+		Fatalf("Error: you need to specify what to do with the cachedir: info, clean or prune\nExample call: " + os.Args[0] + " cache info -config test.yaml or " + os.Args[0] + " cache prune -config test.yaml -dryrun")
+	}
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " cache " + action + " -config test.yaml")
+	}
+
+	config = loadConfig(*configFileFlag)
+
+	if action == "info" {
+		components := cacheInfo()
+		if jsonOutput() {
+			printOutput(CacheOutput{Command: "cache", CacheDir: config.CacheDir, Components: components})
+			return
+		}
+		var total int64
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "COMPONENT\tDIRECTORY\tENTRIES\tSIZE")
+		for _, component := range components {
+			fmt.Fprintln(tw, component.Name+"\t"+component.Dir+"\t"+strconv.Itoa(component.Entries)+"\t"+formatBytes(component.Size))
+			total += component.Size
+		}
+		fmt.Fprintln(tw, "total\t"+config.CacheDir+"\t\t"+formatBytes(total))
+		tw.Flush()
+		return
+	}
+
+	// a running deploy must not lose the repositories and modules it is using
+	if !dryRun && !acquireRunLock() {
+		return
+	}
+	output := CacheOutput{Command: "cache", CacheDir: config.CacheDir, Removed: []string{}}
+	var referenced map[string]bool
+	if action == "prune" {
+		referenced = referencedCacheEntries()
+	}
+	for _, component := range cacheComponents() {
+		if component.Dir == extractedModulesDir() && config.ModuleStore {
+			// the deployed environments link to the module store, so only its garbage collection may remove the modules that are not used anymore
+			garbageCollectModuleStore()
+			continue
+		}
+		entries, _ := ioutil.ReadDir(component.Dir)
+		for _, entry := range entries {
+			path := filepath.Join(component.Dir, entry.Name())
+			if strings.HasPrefix(entry.Name(), ".") {
+				// temporary directories of a concurrent g10k run
+				continue
+			}
+			if action == "prune" {
+				if component.Dir == config.ForgeCacheDir && forgeCacheEntryReferenced(path, referenced) {
+					continue
+				} else if referenced[path] {
+					continue
+				}
+			}
+			output.Freed += removeCacheEntry(path)
+			output.Removed = append(output.Removed, path)
+		}
+	}
+	if jsonOutput() {
+		printOutput(output)
+		return
+	}
+	verb := "Removed "
+	if dryRun {
+		verb = "Would remove "
+	}
+	fmt.Println(verb + strconv.Itoa(len(output.Removed)) + " cache entries with " + formatBytes(output.Freed) + " from " + config.CacheDir)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// canarySuffix is appended to the environment name of a branch deployed with -canary, e.g. production_canary
+const canarySuffix = "_canary"
+
+// canaryMarkerFile is the file inside of a canary environment that contains the name of the environment it is a canary of
+const canaryMarkerFile = ".g10k-canary"
+
+// writeCanaryMarker marks the given directory as a canary of the given Puppet environment, so that it does not get purged as an unmanaged environment by later g10k runs
+func writeCanaryMarker(dir string, canaryOf string) {
+	if dryRun {
+		return
+	}
+	file := filepath.Join(dir, canaryMarkerFile)
+	if err := writeFileAtomic(file, []byte(canaryOf+"\n"), 0644); err != nil {
+		Fatalf("writeCanaryMarker(): Could not write " + file + " Error: " + err.Error())
+	}
+	applyOwnership(file)
+}
+
+// withCanaryEnvironments returns the given managed environments plus all canary environments among the given environment directories whose environment is still managed
+func withCanaryEnvironments(environmentDirs []string, allEnvironments map[string]bool) map[string]bool {
+	managedEnvironments := make(map[string]bool)
+	for env, managed := range allEnvironments {
+		managedEnvironments[env] = managed
+	}
+	for _, dir := range environmentDirs {
+		content, err := ioutil.ReadFile(filepath.Join(dir, canaryMarkerFile))
+		if err != nil {
+			continue
+		}
+		if canaryOf := strings.TrimSpace(string(content)); allEnvironments[canaryOf] {
+			Debugf("Not purging canary environment " + filepath.Base(dir) + " of environment " + canaryOf)
+			managedEnvironments[filepath.Base(dir)] = true
+		}
+	}
+	return managedEnvironments
+}
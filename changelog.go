@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reSCPRemote matches the scp-like syntax of a git remote, e.g. git@github.com:puppetlabs/puppetlabs-apt.git
+var reSCPRemote = regexp.MustCompile(`^(?:[^@/]+@)?([^:/]+):(.+)$`)
+
+// compareURL returns the URL of the web page that compares the two commits of the given git remote on GitHub or GitLab, or an empty string for other git servers
+func compareURL(remote string, from string, to string) string {
+	var scheme, host, path string
+	if u, err := url.Parse(remote); err == nil && len(u.Host) > 0 {
+		scheme, host, path = u.Scheme, u.Host, u.Path
+		if scheme != "http" && scheme != "https" {
+			// the web interface does not use the port of the SSH server
+			scheme, host = "https", u.Hostname()
+		}
+	} else if m := reSCPRemote.FindStringSubmatch(remote); m != nil {
+		scheme, host, path = "https", m[1], "/"+m[2]
+	} else {
+		return ""
+	}
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+	if len(path) == 0 {
+		return ""
+	}
+	hostname := strings.ToLower(host)
+	switch {
+	case strings.Contains(hostname, "github"):
+		return scheme + "://" + host + path + "/compare/" + from + "..." + to
+	case strings.Contains(hostname, "gitlab"):
+		return scheme + "://" + host + path + "/-/compare/" + from + "..." + to
+	}
+	return ""
+}
+
+// changelogVersion returns the version of a module for the changelog with git commits abbreviated
+func changelogVersion(version string) string {
+	if reCommitHash.MatchString(version) {
+		return shortCommit(version)
+	}
+	return version
+}
+
+// printChangelog prints the added, removed and updated modules of every Puppet environment of this g10k run
+func printChangelog() {
+	var envs []string
+	for env := range moduleChanges {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		fmt.Println("Changelog of environment " + env + ":")
+		for _, mc := range moduleChanges[env] {
+			switch {
+			case len(mc.From) == 0:
+				fmt.Println("  added " + mc.Module + " " + changelogVersion(mc.To))
+			case len(mc.To) == 0:
+				fmt.Println("  removed " + mc.Module + " " + changelogVersion(mc.From))
+			case len(mc.CompareURL) > 0:
+				fmt.Println("  updated " + mc.Module + " " + changelogVersion(mc.From) + " → " + changelogVersion(mc.To) + " " + mc.CompareURL)
+			default:
+				fmt.Println("  updated " + mc.Module + " " + changelogVersion(mc.From) + " → " + changelogVersion(mc.To))
+			}
+		}
+	}
+}
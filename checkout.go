@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// checkoutControlRepo makes the given Puppet environment directory a git working copy of the control repository at the given commit instead of extracting an archive of it.
+// The commit gets fetched from the cached mirror and origin points to the remote of the control repository, so that operators can run git status or git log in place and hotfix in emergencies.
+// The moduledir and the g10k deploy metadata are excluded from git, with the environment purge level git clean removes all other untracked content.
+func checkoutControlRepo(srcDir string, targetDir string, tree string, commit string, moduleDir string, allowList []string) error {
+	checkDirAndCreate(targetDir, "git checkout of environment")
+	git := "git -C " + shellquote.Join(targetDir) + " "
+	if !isDir(filepath.Join(targetDir, ".git")) {
+		Debugf("Initializing git working copy in " + targetDir)
+		if er := executeCommand(git+"init -q", config.Timeout, true); er.returnCode != 0 {
+			return er.err
+		}
+		if er := executeCommand("git --git-dir "+shellquote.Join(srcDir)+" remote get-url origin", config.Timeout, true); er.returnCode == 0 {
+			executeCommand(git+"remote add origin "+shellquote.Join(strings.TrimSpace(er.stdout)), config.Timeout, true)
+		}
+	}
+
+	exclude := []string{"/" + strings.Trim(moduleDir, "/") + "/", "/.g10k-*", "/.resource_types/"}
+	for _, pattern := range allowList {
+		exclude = append(exclude, "/"+strings.TrimPrefix(pattern, "/"))
+	}
+	checkDirAndCreate(filepath.Join(targetDir, ".git", "info"), "git info directory")
+	if err := writeFileAtomic(filepath.Join(targetDir, ".git", "info", "exclude"), []byte(strings.Join(exclude, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	commands := []string{
+		git + "fetch -q --no-tags " + shellquote.Join(srcDir, "+"+tree+":refs/remotes/origin/"+tree),
+		git + "checkout -q -f -B " + shellquote.Join(tree, commit),
+	}
+	if purgeEnvironmentContent() {
+		commands = append(commands, git+"clean -q -f -d")
+	}
+	for _, command := range commands {
+		if er := executeCommand(command, config.Timeout, true); er.returnCode != 0 {
+			return er.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// checkpointFile returns the path of the checkpoint file of the config file inside of the cachedir, g10k processes with different config files can share one cachedir
+func checkpointFile() string {
+	hash := sha256.Sum256([]byte(configFile))
+	return filepath.Join(config.CacheDir, "checkpoint-"+hex.EncodeToString(hash[:])[:12]+".json")
+}
+
+// checkpointEnabled returns true if the progress of this g10k run gets recorded, which is only the case for a full deploy of the Puppet environments of a config file
+func checkpointEnabled() bool {
+	return len(configFile) > 0 && !dryRun && len(moduleParam) == 0
+}
+
+// startCheckpoint creates the checkpoint of this g10k run or continues the checkpoint of the previous interrupted run with -resume
+func startCheckpoint() {
+	if !checkpointEnabled() {
+		return
+	}
+	file := checkpointFile()
+	if fileExists(file) {
+		previous := readCheckpointFile(file)
+		if !resume {
+			Warnf("WARNING: The previous g10k run started at " + previous.StartedAt.Format(time.RFC3339) + " did not complete, use -resume to only deploy the environments it did not complete")
+		} else if previous.ConfigFile != configFile || previous.Branch != branchParam || previous.Environment != environmentParam {
+			Warnf("WARNING: Not resuming the previous g10k run started at " + previous.StartedAt.Format(time.RFC3339) + ", because it used a different config file, -branch or -environment parameter")
+		} else {
+			if previous.Completed == nil {
+				previous.Completed = make(map[string]string)
+			}
+			checkpoint = previous
+			Infof("Resuming the g10k run started at " + checkpoint.StartedAt.Format(time.RFC3339) + " with " + strconv.Itoa(len(checkpoint.Completed)) + " already deployed environment(s)")
+			return
+		}
+	} else if resume {
+		Infof("Nothing to resume, because there is no checkpoint of an interrupted g10k run in " + file)
+	}
+	checkpoint = DeployCheckpoint{ConfigFile: configFile, Branch: branchParam, Environment: environmentParam, StartedAt: time.Now(), Completed: make(map[string]string)}
+	writeStructJSONFile(file, checkpoint)
+}
+
+// readCheckpointFile reads the checkpoint of a previous g10k run
+func readCheckpointFile(file string) DeployCheckpoint {
+	var cp DeployCheckpoint
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		Warnf("Could not read JSON file " + file + " " + err.Error())
+		return cp
+	}
+	if err := json.Unmarshal(content, &cp); err != nil {
+		Warnf("Could not parse JSON file " + file + " " + err.Error())
+	}
+	return cp
+}
+
+// checkpointEnvironment records the given Puppet environment with the commit of its deploy file as completed
+func checkpointEnvironment(env string, deployFile string) {
+	if !checkpointEnabled() || checkpoint.Completed == nil || !fileExists(deployFile) {
+		return
+	}
+	dr := readDeployResultFile(deployFile)
+	if !dr.DeploySuccess {
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	checkpoint.Completed[env] = dr.Signature
+	writeStructJSONFile(checkpointFile(), checkpoint)
+}
+
+// resumedEnvironment returns true if the given Puppet environment was already deployed by the interrupted g10k run with the current commit of its branch
+func resumedEnvironment(pe PuppetEnvironment) bool {
+	if !resume || checkpoint.Completed == nil {
+		return false
+	}
+	mutex.Lock()
+	signature, ok := checkpoint.Completed[pe.env]
+	mutex.Unlock()
+	return ok && isDir(pe.targetDir) && signature == branchCommit(pe)
+}
+
+// finishCheckpoint removes the checkpoint once all Puppet environments were deployed successfully
+func finishCheckpoint() {
+	if !checkpointEnabled() || checkpoint.Completed == nil || deployFailed() {
+		return
+	}
+	if err := os.Remove(checkpointFile()); err != nil && !os.IsNotExist(err) {
+		Warnf("WARNING: Could not remove checkpoint file " + checkpointFile() + " Error: " + err.Error())
+	}
+}
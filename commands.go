@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+	"gopkg.in/yaml.v2"
+)
+
+// Subcommand is a g10k subcommand with its arguments and the one-line summary that g10k help lists
+type Subcommand struct {
+	Name    string
+	Args    string
+	Summary string
+	Run     func(args []string)
+}
+
+// subcommands returns all g10k subcommands in the order of g10k help, deploy and validate have no Run function as they are a regular g10k run with the equivalent legacy flags
+func subcommands() []Subcommand {
+	return []Subcommand{
+		{"deploy", "[environment <name> | module <name>] [flags]", "deploy all Puppet environments, a single environment or a single module in every environment", nil},
+		{"validate", "[flags]", "validate the g10k config file or with -puppetfile the Puppetfile", nil},
+		{"status", "[flags]", "print the deployed Puppet environments of the basedirs or of a running g10k serve", statusCommand},
+		{"history", "[flags] [environment]", "print the last g10k runs or the deploys of an environment from the history_db", historyCommand},
+		{"explain", "[flags] <environment> <module>", "print why a module of a deployed environment is at its deployed version", explainCommand},
+		{"list", "environments | modules [environment] [flags]", "list the deployed environments or the deployed modules with their versions from the deploy manifests", listSubcommand},
+		{"drift", "[flags]", "list the files of the deployed environments that were changed outside of g10k", driftCommand},
+		{"licenses", "[flags]", "list the licenses of the deployed modules and flag the ones the license_policy denies", licensesCommand},
+		{"rollback", "[flags] <environment>", "point an environment back to a previous successfully deployed version", rollbackCommand},
+		{"verify-manifest", "[flags] <environment>", "verify the signed deploy manifests of an environment and its files on disk", verifyManifestCommand},
+		{"cache", "info | clean | prune [flags]", "print the size of the cachedir, remove all cached repositories and modules or only the unused ones", cacheCommand},
+		{"serve", "[flags]", "run the webhook server that deploys the pushed branches", serveCommand},
+		{"agent", "[flags]", "converge the basedir to the desired state that a primary g10k published", agentCommand},
+		{"watch", "[flags]", "deploy a local control repository checkout again every time a file in it changes", watchCommand},
+		{"healthcheck", "[flags]", "verify that g10k can deploy with the config file", healthcheckCommand},
+		{"init", "[flags]", "generate a starter g10k config file", initCommand},
+		{"migrate", "[flags]", "convert an r10k config file to a g10k config file", migrateCommand},
+		{"config", "print [flags]", "print the effective g10k config", configCommand},
+		{"completion", "bash|zsh|fish", "print the shell completion script for bash, zsh or fish", completionCommand},
+		{"help", "[subcommand]", "print the subcommands or the flags of a subcommand", helpCommand},
+	}
+}
+
+// findSubcommand returns the g10k subcommand with the given name
+func findSubcommand(name string) (Subcommand, bool) {
+	for _, sc := range subcommands() {
+		if sc.Name == name {
+			return sc, true
+		}
+	}
+	return Subcommand{}, false
+}
+
+// runSubcommand executes the given g10k subcommand, e.g. g10k init
+func runSubcommand(name string, args []string) {
+	sc, ok := findSubcommand(name)
+	if !ok || sc.Run == nil {
+		Fatalf("Error: unknown subcommand " + name + "\nRun " + os.Args[0] + " help for the list of subcommands")
+	}
+	sc.Run(args)
+}
+
+// subcommandFlagSet returns the flag set of the given g10k subcommand, whose -h prints the arguments and the summary of the subcommand before its flags
+func subcommandFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() { printSubcommandUsage(fs, strings.Fields(name)[0]) }
+	return fs
+}
+
+// printSubcommandUsage prints the arguments, the summary and the flags of the given g10k subcommand
+func printSubcommandUsage(fs *flag.FlagSet, name string) {
+	sc, _ := findSubcommand(name)
+	fmt.Fprintln(fs.Output(), "Usage: "+os.Args[0]+" "+sc.Name+" "+sc.Args+"\n\n"+sc.Summary+"\n\nFlags:")
+	fs.PrintDefaults()
+}
+
+// printUsage prints the subcommands of g10k and the legacy flags of a regular g10k run, it is the -h of g10k
+func printUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: "+os.Args[0]+" <subcommand> [arguments] [flags]\n\nSubcommands:")
+	for _, sc := range subcommands() {
+		fmt.Fprintf(out, "  %-16s %s\n", sc.Name, sc.Summary)
+	}
+	fmt.Fprintln(out, "\nRun "+os.Args[0]+" help <subcommand> for the arguments and flags of a subcommand.")
+	fmt.Fprintln(out, "\nWithout subcommand g10k deploys with the following flags, e.g. "+os.Args[0]+" -config test.yaml:")
+	flag.PrintDefaults()
+}
+
+// helpCommand prints the subcommands of g10k or the arguments and flags of the given subcommand, e.g. g10k help deploy
+func helpCommand(args []string) {
+	if len(args) == 0 {
+		os.Args = []string{os.Args[0], "-h"}
+		main()
+		return
+	}
+	sc, ok := findSubcommand(args[0])
+	if !ok {
+		Fatalf("Error: unknown subcommand " + args[0] + "\nRun " + os.Args[0] + " help for the list of subcommands")
+	}
+	if sc.Run == nil {
+		// deploy and validate share the flags of the regular g10k run
+		os.Args = []string{os.Args[0], sc.Name, "-h"}
+		main()
+		return
+	}
+	sc.Run([]string{"-h"})
+}
+
+// legacyArgs translates the arguments of g10k deploy and g10k validate into the equivalent flags of a regular g10k run,
+// e.g. g10k deploy module stdlib -config test.yaml into -module stdlib -config test.yaml, which only updates stdlib in every Puppet environment whose Puppetfile contains it
+func legacyArgs(name string, args []string) []string {
+	if name == "validate" {
+		return append([]string{"-validate"}, args...)
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return args
+	}
+	if args[0] != "environment" && args[0] != "module" {
+		Fatalf("Error: unknown deploy target " + args[0] + ", you can deploy an environment or a module\nExample call: " + os.Args[0] + " deploy environment example_production -config test.yaml")
+	}
+	if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+		Fatalf("Error: you need to specify which " + args[0] + " to deploy\nExample call: " + os.Args[0] + " deploy environment example_production -config test.yaml or " + os.Args[0] + " deploy module stdlib -config test.yaml")
+	}
+	return append([]string{"-" + args[0], args[1]}, args[2:]...)
+}
+
+// InitConfig is the starter g10k config file that g10k init generates
+type InitConfig struct {
+	CacheDir string `yaml:"cachedir"`
+	Deploy   struct {
+		PurgeLevels []string `yaml:"purge_levels"`
+	} `yaml:"deploy"`
+	Sources map[string]InitSource `yaml:"sources"`
+}
+
+// InitSource is the source of the control repository in the starter g10k config file of g10k init
+type InitSource struct {
+	Remote                      string `yaml:"remote"`
+	Basedir                     string `yaml:"basedir"`
+	PrivateKey                  string `yaml:"private_key,omitempty"`
+	AutoCorrectEnvironmentNames string `yaml:"invalid_branches"`
+}
+
+// initCommand generates a starter g10k config file, checks if the control repository is reachable and optionally does a first dry run
+func initCommand(args []string) {
+	fs := subcommandFlagSet("init")
+	output := fs.String("output", "g10k.yaml", "where to write the generated g10k config file")
+	source := fs.String("source", "puppet", "name of the source in the generated g10k config file")
+	remote := fs.String("remote", "", "git URL of your Puppet control repository")
+	basedir := fs.String("basedir", "/etc/puppetlabs/code/environments", "directory in which the Puppet environments should be deployed")
+	cachedir := fs.String("cachedir", "/var/cache/g10k", "directory in which g10k caches git repositories and Forge modules")
+	privateKey := fs.String("privatekey", "", "SSH private key to use for the control repository")
+	overwrite := fs.Bool("force", false, "overwrite an existing g10k config file")
+	firstDryRun := fs.Bool("dryrun", false, "do a first dry run with the generated g10k config file")
+	fs.Parse(args)
+
+	if len(*remote) == 0 {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			Fatalf("Error: -remote parameter is required if g10k init is not run interactively")
+		}
+		reader := bufio.NewReader(os.Stdin)
+		*remote = promptValue(reader, "git URL of your Puppet control repository", "")
+		*source = promptValue(reader, "source name", *source)
+		*basedir = promptValue(reader, "basedir for your Puppet environments", *basedir)
+		*cachedir = promptValue(reader, "cachedir", *cachedir)
+		*privateKey = promptValue(reader, "SSH private key (leave empty for none)", *privateKey)
+	}
+	if len(*remote) == 0 {
+		Fatalf("Error: git URL of the control repository is missing!")
+	}
+	if fileExists(*output) && !*overwrite {
+		Fatalf("Error: " + *output + " already exists! Use -force to overwrite it.")
+	}
+
+	if er := gitLsRemote(*remote, *privateKey); er.returnCode != 0 {
+		Fatalf("Error: could not reach control repository " + *remote + " Error: " + er.errorOutput())
+	}
+	fmt.Println("Successfully connected to control repository " + *remote)
+
+	ic := InitConfig{CacheDir: *cachedir, Sources: map[string]InitSource{*source: {Remote: *remote, Basedir: *basedir, PrivateKey: *privateKey, AutoCorrectEnvironmentNames: "correct_and_warn"}}}
+	ic.Deploy.PurgeLevels = []string{"deployment", "puppetfile"}
+	content, err := yaml.Marshal(ic)
+	if err != nil {
+		Fatalf("initCommand(): YAML marshal error: " + err.Error())
+	}
+	if err := ioutil.WriteFile(*output, append([]byte("---\n"), content...), 0644); err != nil {
+		Fatalf("Error: could not write g10k config file " + *output + " Error: " + err.Error())
+	}
+	fmt.Println("Wrote g10k config file " + *output)
+
+	if *firstDryRun {
+		dryRun = true
+		configFile = *output
+		config = readConfigfile(configFile)
+		resolvePuppetEnvironment(false, "")
+		fmt.Println("Dry run with " + *output + " finished")
+	}
+}
+
+// promptValue asks the user for a value on the terminal and returns the default value if nothing was entered
+func promptValue(reader *bufio.Reader, question string, defaultValue string) string {
+	if len(defaultValue) > 0 {
+		fmt.Print(question + " [" + defaultValue + "]: ")
+	} else {
+		fmt.Print(question + ": ")
+	}
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if len(answer) == 0 {
+		return defaultValue
+	}
+	return answer
+}
+
+// configCommand executes the g10k config subcommands, e.g. g10k config print
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "print" {
+		Fatalf("Error: unknown or missing config subcommand\nExample call: " + os.Args[0] + " config print -config test.yaml")
+	}
+	fs := subcommandFlagSet("config print")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	format := fs.String("format", "yaml", "output format of the effective configuration, yaml or json")
+	fs.StringVar(&configRepoParam, "configrepo", "", "git repository URL from which g10k should fetch its config file")
+	fs.StringVar(&configRepoBranchParam, "configrepobranch", "", "which branch of the -configrepo git repository to use, defaults to the default branch of the repository")
+	fs.StringVar(&configRepoPathParam, "configrepopath", "g10k.yaml", "path of the g10k config file inside the -configrepo git repository")
+	fs.StringVar(&configRepoKeyParam, "configrepokey", "", "SSH private key to use for the -configrepo git repository")
+	fs.IntVar(&maxworker, "maxworker", 50, "how many Goroutines are allowed to run in parallel for Git and Forge module resolving")
+	fs.IntVar(&maxExtractworker, "maxextractworker", 20, "how many Goroutines are allowed to run in parallel for local Git and Forge module extracting processes (git clone, untar and gunzip)")
+	fs.BoolVar(&usecacheFallback, "usecachefallback", false, "if g10k should try to use its cache for sources and modules instead of failing")
+	fs.BoolVar(&retryGitCommands, "retrygitcommands", false, "if g10k should purge the local repository and retry a failed git command (clone or remote update) instead of failing")
+	fs.BoolVar(&gitObjectSyntaxNotSupported, "gitobjectsyntaxnotsupported", false, "if your git version is too old to support reference syntax like master^{object} use this setting to revert to the older syntax")
+	fs.Parse(args[1:])
+
+	if *format != "yaml" && *format != "json" {
+		Fatalf("Error: Unsupported value " + *format + " of parameter -format Supported values are yaml and json")
+	}
+	configFile = *configFileFlag
+	if len(configRepoParam) > 0 {
+		if len(configFile) > 0 {
+			Fatalf("Error: -configrepo parameter is not allowed with -config parameter!")
+		}
+		configFile = fetchConfigRepository(configRepoParam, configRepoBranchParam, configRepoPathParam, configRepoKeyParam)
+	}
+	if len(configFile) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " config print -config test.yaml")
+	}
+
+	config = loadConfig(configFile)
+	fmt.Print(effectiveConfig(config, *format))
+}
+
+// effectiveConfig returns the given configuration with all secrets redacted in the given format.
+// Internal settings that are derived from other settings are left out.
+func effectiveConfig(cs ConfigSettings, format string) string {
+	data, err := yaml.Marshal(cs)
+	if err != nil {
+		Fatalf("effectiveConfig(): YAML marshal error: " + err.Error())
+	}
+	var settings yaml.MapSlice
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		Fatalf("effectiveConfig(): YAML unmarshal error: " + err.Error())
+	}
+	internalSettings := []string{"forgecachedir", "modulescachedir", "envcachedir", "git", "deploy", "forgecachettl"}
+	effective := yaml.MapSlice{}
+	for _, item := range settings {
+		if stringSliceContains(internalSettings, fmt.Sprint(item.Key)) {
+			continue
+		}
+		effective = append(effective, yaml.MapItem{Key: item.Key, Value: redactSecrets(fmt.Sprint(item.Key), item.Value)})
+	}
+
+	if format == "json" {
+		jsonData, err := json.MarshalIndent(mapSliceToMap(effective), "", "  ")
+		if err != nil {
+			Fatalf("effectiveConfig(): JSON marshal error: " + err.Error())
+		}
+		return string(jsonData) + "\n"
+	}
+	yamlData, err := yaml.Marshal(effective)
+	if err != nil {
+		Fatalf("effectiveConfig(): YAML marshal error: " + err.Error())
+	}
+	return "---\n" + string(yamlData)
+}
+
+// redactSecrets replaces the values of settings that look like secrets and passwords inside of URLs with REDACTED
+func redactSecrets(key string, value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		redacted := yaml.MapSlice{}
+		for _, item := range v {
+			redacted = append(redacted, yaml.MapItem{Key: item.Key, Value: redactSecrets(fmt.Sprint(item.Key), item.Value)})
+		}
+		return redacted
+	case []interface{}:
+		redacted := []interface{}{}
+		for _, item := range v {
+			redacted = append(redacted, redactSecrets(key, item))
+		}
+		return redacted
+	case string:
+		lowerKey := strings.ToLower(key)
+		// the path of a chat webhook URL is its secret
+		if len(v) > 0 && (strings.Contains(lowerKey, "secret") || strings.Contains(lowerKey, "password") || strings.Contains(lowerKey, "token") || lowerKey == "authorization" || lowerKey == "webhook_url") {
+			return "REDACTED"
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, hasPassword := u.User.Password(); hasPassword {
+				u.User = url.UserPassword(u.User.Username(), "REDACTED")
+				return u.String()
+			}
+		}
+	}
+	return value
+}
+
+// mapSliceToMap converts an ordered YAML map to a map that can be marshalled to JSON
+func mapSliceToMap(value interface{}) interface{} {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{})
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = mapSliceToMap(item.Value)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = mapSliceToMap(item)
+		}
+		return s
+	}
+	return value
+}
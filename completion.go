@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// reHelpFlag matches a flag in the output of g10k help <subcommand>, the type is missing for boolean flags
+	reHelpFlag = regexp.MustCompile(`(?m)^  (-[\w-]+)(?: (\w+))?$`)
+	// rePuppetfileModule matches the name of a module in a Puppetfile, e.g. mod 'puppetlabs/stdlib', '9.4.1'
+	rePuppetfileModule = regexp.MustCompile(`^\s*mod\s+['"]([^'"]+)['"]`)
+)
+
+// completionScripts are the shell completion scripts of g10k completion, they ask g10k completion __complete for the candidates of the current word
+var completionScripts = map[string]string{
+	"bash": `# bash completion for g10k, e.g. source <(g10k completion bash)
+_g10k() {
+	local IFS=$'\n'
+	COMPREPLY=($("${COMP_WORDS[0]}" completion __complete "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+}
+complete -o default -F _g10k g10k
+`,
+	"zsh": `#compdef g10k
+# zsh completion for g10k, e.g. source <(g10k completion zsh) after compinit
+_g10k() {
+	local -a candidates
+	candidates=("${(@f)$("${words[1]}" completion __complete "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+	if [[ -n "${candidates[1]}" ]]; then
+		compadd -a candidates
+	else
+		_files
+	fi
+}
+compdef _g10k g10k
+`,
+	"fish": `# fish completion for g10k, e.g. g10k completion fish > ~/.config/fish/completions/g10k.fish
+function __g10k_complete
+	set -l words (commandline -opc)
+	$words[1] completion __complete $words[2..-1] (commandline -ct) 2>/dev/null
+end
+complete -c g10k -a '(__g10k_complete)'
+`,
+}
+
+// completionCommand prints the completion script for the given shell, e.g. g10k completion bash,
+// the scripts call g10k completion __complete with the words of the command line to get the candidates of the last word
+func completionCommand(args []string) {
+	if len(args) > 0 && args[0] == "__complete" {
+		// warnings about the config file would end up as candidates
+		logLevelParam = "error"
+		for _, candidate := range completionCandidates(args[1:]) {
+			fmt.Println(candidate)
+		}
+		return
+	}
+	fs := subcommandFlagSet("completion")
+	fs.Parse(args)
+	script, ok := completionScripts[fs.Arg(0)]
+	if !ok {
+		Fatalf("Error: you need to specify the shell for the completion script: bash, zsh or fish\nExample call: " + os.Args[0] + " completion bash")
+	}
+	fmt.Print(script)
+}
+
+// completionCandidates returns the candidates for the last of the given words of a g10k command line without the g10k executable,
+// e.g. the environments for g10k deploy environment <TAB> or the flags of the subcommand for a word starting with -
+func completionCandidates(words []string) []string {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current := words[len(words)-1]
+	if len(words) == 1 && !strings.HasPrefix(current, "-") {
+		var names []string
+		for _, sc := range subcommands() {
+			names = append(names, sc.Name)
+		}
+		return filterCandidates(names, current)
+	}
+	subcommand, first := words[0], 1
+	if strings.HasPrefix(subcommand, "-") {
+		// the legacy flags of a regular g10k run
+		subcommand, first = "deploy", 0
+	}
+	flags := subcommandFlags(subcommand)
+
+	// find the values of the flags like -config and the positional arguments before the current word,
+	// the environments and modules of a command line without -config or -remote are completed from $G10K_CONFIG or $G10K_REMOTE
+	values := map[string]string{"-config": os.Getenv("G10K_CONFIG"), "-remote": os.Getenv("G10K_REMOTE")}
+	var positional []string
+	for i := first; i < len(words)-1; i++ {
+		word := words[i]
+		if !strings.HasPrefix(word, "-") {
+			positional = append(positional, word)
+			continue
+		}
+		name := "-" + strings.TrimLeft(word, "-")
+		if strings.Contains(name, "=") {
+			parts := strings.SplitN(name, "=", 2)
+			values[parts[0]] = parts[1]
+			continue
+		}
+		if flags[name] && i+1 < len(words)-1 {
+			values[name] = words[i+1]
+			i++
+		}
+	}
+	if previous := words[len(words)-2]; strings.HasPrefix(previous, "-") && flags["-"+strings.TrimLeft(previous, "-")] {
+		switch strings.TrimLeft(previous, "-") {
+		case "environment":
+			return filterCandidates(completionEnvironments(values, true), current)
+		case "module":
+			return filterCandidates(completionModules(values), current)
+		case "output":
+			return filterCandidates([]string{"text", "json", "github"}, current)
+		case "log-level":
+			return filterCandidates([]string{"error", "warn", "info", "debug", "trace"}, current)
+		case "log-format":
+			return filterCandidates([]string{"text", "json"}, current)
+		case "color":
+			return filterCandidates([]string{"auto", "always", "never"}, current)
+		}
+		// e.g. a file for -config, which the shells complete themselves
+		return nil
+	}
+	if strings.HasPrefix(current, "-") {
+		var names []string
+		for name := range flags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return filterCandidates(names, current)
+	}
+
+	var candidates []string
+	switch {
+	case subcommand == "deploy" && len(positional) == 0 && first == 1:
+		candidates = []string{"environment", "module"}
+	case subcommand == "deploy" && len(positional) == 1 && positional[0] == "environment":
+		candidates = completionEnvironments(values, true)
+	case subcommand == "deploy" && len(positional) == 1 && positional[0] == "module":
+		candidates = completionModules(values)
+	case subcommand == "help" && len(positional) == 0:
+		return completionCandidates([]string{current})
+	case subcommand == "completion" && len(positional) == 0:
+		candidates = []string{"bash", "zsh", "fish"}
+	case subcommand == "list" && len(positional) == 0:
+		candidates = []string{"environments", "modules"}
+	case subcommand == "list" && len(positional) == 1 && positional[0] == "modules":
+		candidates = completionEnvironments(values, false)
+	case subcommand == "cache" && len(positional) == 0:
+		candidates = []string{"info", "clean", "prune"}
+	case subcommand == "config" && len(positional) == 0:
+		candidates = []string{"print"}
+	case (subcommand == "rollback" || subcommand == "verify-manifest" || subcommand == "history" || subcommand == "explain") && len(positional) == 0:
+		candidates = completionEnvironments(values, false)
+	case subcommand == "explain" && len(positional) == 1:
+		candidates = completionModules(values)
+	}
+	return filterCandidates(candidates, current)
+}
+
+// filterCandidates returns the candidates that start with the given prefix
+func filterCandidates(candidates []string, prefix string) []string {
+	var filtered []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, prefix) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered
+}
+
+// subcommandFlags returns the flags of the given g10k subcommand from its help output, a flag maps to true if it takes a value
+func subcommandFlags(subcommand string) map[string]bool {
+	flags := make(map[string]bool)
+	executable, err := os.Executable()
+	if err != nil {
+		return flags
+	}
+	out, _ := exec.Command(executable, "help", subcommand).CombinedOutput()
+	for _, m := range reHelpFlag.FindAllStringSubmatch(string(out), -1) {
+		flags[m[1]] = len(m[2]) > 0
+	}
+	return flags
+}
+
+// completionEnvironments returns the deployed Puppet environments of the -config file or of the -remote g10k serve,
+// with deployTargets the source_branch names that g10k deploy environment expects instead of the directory names
+func completionEnvironments(values map[string]string, deployTargets bool) []string {
+	var statuses []EnvironmentStatus
+	if configPath := values["-config"]; len(configPath) > 0 && fileExists(configPath) {
+		config = loadConfig(configPath)
+		statuses = environmentStatuses()
+	} else if remote := values["-remote"]; len(remote) > 0 {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(strings.TrimSuffix(remote, "/") + "/status")
+		if err != nil {
+			return nil
+		}
+		defer resp.Body.Close()
+		var status ServeStatus
+		if json.NewDecoder(resp.Body).Decode(&status) != nil {
+			return nil
+		}
+		statuses = status.Environments
+	}
+	var envs []string
+	for _, status := range statuses {
+		if deployTargets {
+			envs = append(envs, status.Source+"_"+status.Branch)
+		} else {
+			envs = append(envs, status.Environment)
+		}
+	}
+	sort.Strings(envs)
+	return envs
+}
+
+// completionModules returns the short names of the modules in the Puppetfiles of the environments deployed with the -config file,
+// or of the -puppetfilelocation (default ./Puppetfile) without a config file
+func completionModules(values map[string]string) []string {
+	var puppetfiles []string
+	if configPath := values["-config"]; len(configPath) > 0 && fileExists(configPath) {
+		config = loadConfig(configPath)
+		for _, source := range sortedSourceNames() {
+			matches, _ := filepath.Glob(filepath.Join(config.Sources[source].Basedir, "*", "Puppetfile"))
+			puppetfiles = append(puppetfiles, matches...)
+		}
+	} else if location := values["-puppetfilelocation"]; len(location) > 0 {
+		puppetfiles = []string{location}
+	} else {
+		puppetfiles = []string{"./Puppetfile"}
+	}
+	unique := make(map[string]bool)
+	for _, puppetfile := range puppetfiles {
+		f, err := os.Open(puppetfile)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if m := rePuppetfileModule.FindStringSubmatch(scanner.Text()); m != nil {
+				// -module matches the module name without its author
+				name := m[1][strings.LastIndexAny(m[1], "/-")+1:]
+				unique[name] = true
+			}
+		}
+		f.Close()
+	}
+	var modules []string
+	for name := range unique {
+		modules = append(modules, name)
+	}
+	sort.Strings(modules)
+	return modules
+}
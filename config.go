@@ -3,12 +3,16 @@ package main
 import (
 	"bufio"
 	"io/ioutil"
+	"net"
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -18,12 +22,28 @@ var (
 	reModuledir = regexp.MustCompile(`^\s*(?:moduledir)\s+['\"]?([^'\"]+)['\"]?`)
 )
 
-// readConfigfile creates the ConfigSettings struct from the g10k config file
+// readConfigfile creates the ConfigSettings struct from the g10k config file and creates the cachedir
 func readConfigfile(configFile string) ConfigSettings {
+	return parseConfigfile(configFile, true)
+}
+
+// loadConfig creates the ConfigSettings struct from the g10k config file without creating any of the configured directories, e.g. for the subcommands that only read the deployed environments
+func loadConfig(configFile string) ConfigSettings {
+	return parseConfigfile(configFile, false)
+}
+
+// parseConfigfile creates the ConfigSettings struct from the g10k config file, with createDirs the cachedir and its subdirectories get created
+func parseConfigfile(configFile string, createDirs bool) ConfigSettings {
+	cacheDir := checkDirAndCreate
+	if !createDirs {
+		cacheDir = func(dir string, name string) string {
+			return normalizeDir(dir)
+		}
+	}
 	Debugf("Trying to read g10k config file: " + configFile)
 	data, err := ioutil.ReadFile(configFile)
 	if err != nil {
-		Fatalf("readConfigfile(): There was an error parsing the config file " + configFile + ": " + err.Error())
+		FatalExitf(exitConfigError, "readConfigfile(): There was an error parsing the config file "+configFile+": "+err.Error())
 	}
 
 	rubySymbolsRemoved := ""
@@ -39,21 +59,21 @@ func readConfigfile(configFile string) ConfigSettings {
 	var config ConfigSettings
 	err = yaml.Unmarshal([]byte(rubySymbolsRemoved), &config)
 	if err != nil {
-		Fatalf("YAML unmarshal error: " + err.Error())
+		FatalExitf(exitConfigError, "YAML unmarshal error: "+err.Error())
 	}
 
 	if len(os.Getenv("g10k_cachedir")) > 0 {
 		cachedir := os.Getenv("g10k_cachedir")
 		Debugf("Found environment variable g10k_cachedir set to: " + cachedir)
-		config.CacheDir = checkDirAndCreate(cachedir, "cachedir environment variable g10k_cachedir")
+		config.CacheDir = cacheDir(cachedir, "cachedir environment variable g10k_cachedir")
 	} else {
-		config.CacheDir = checkDirAndCreate(config.CacheDir, "cachedir from g10k config "+configFile)
+		config.CacheDir = cacheDir(config.CacheDir, "cachedir from g10k config "+configFile)
 	}
 
-	config.CacheDir = checkDirAndCreate(config.CacheDir, "cachedir")
-	config.ForgeCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "forge"), "cachedir/forge")
-	config.ModulesCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "modules"), "cachedir/modules")
-	config.EnvCacheDir = checkDirAndCreate(filepath.Join(config.CacheDir, "environments"), "cachedir/environments")
+	config.CacheDir = cacheDir(config.CacheDir, "cachedir")
+	config.ForgeCacheDir = cacheDir(filepath.Join(config.CacheDir, "forge"), "cachedir/forge")
+	config.ModulesCacheDir = cacheDir(filepath.Join(config.CacheDir, "modules"), "cachedir/modules")
+	config.EnvCacheDir = cacheDir(filepath.Join(config.CacheDir, "environments"), "cachedir/environments")
 
 	if len(config.ForgeBaseURL) == 0 {
 		config.ForgeBaseURL = "https://forgeapi.puppet.com"
@@ -105,11 +125,32 @@ func readConfigfile(configFile string) ConfigSettings {
 	if len(config.ForgeCacheTTLString) != 0 {
 		ttl, err := time.ParseDuration(config.ForgeCacheTTLString)
 		if err != nil {
-			Fatalf("Error: Can not convert value " + config.ForgeCacheTTLString + " of config setting forge_cache_ttl to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + configFile)
+			FatalExitf(exitConfigError, "Error: Can not convert value "+config.ForgeCacheTTLString+" of config setting forge_cache_ttl to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
 		}
 		config.ForgeCacheTTL = ttl
 	}
 
+	if config.CommandOutputLimit < 0 {
+		FatalExitf(exitConfigError, "Error: command_output_limit must be a positive number of bytes in "+configFile)
+	}
+
+	if len(config.Owner) > 0 {
+		u, err := user.Lookup(config.Owner)
+		if err != nil {
+			FatalExitf(exitConfigError, "Error: Can not find user "+config.Owner+" of config setting owner in "+configFile+" Error: "+err.Error())
+		} else {
+			config.ownerUID, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if len(config.Group) > 0 {
+		g, err := user.LookupGroup(config.Group)
+		if err != nil {
+			FatalExitf(exitConfigError, "Error: Can not find group "+config.Group+" of config setting group in "+configFile+" Error: "+err.Error())
+		} else {
+			config.ownerGID, _ = strconv.Atoi(g.Gid)
+		}
+	}
+
 	// check for non-empty config.Deploy which takes precedence over the non-deploy scoped settings
 	// See https://github.com/puppetlabs/r10k/blob/master/doc/dynamic-environments/configuration.mkd#deploy
 	emptyDeploy := DeploySettings{}
@@ -125,11 +166,273 @@ func readConfigfile(configFile string) ConfigSettings {
 		config.Deploy = emptyDeploy
 	}
 
+	if environmentMaxworker > 0 {
+		config.EnvironmentMaxworker = environmentMaxworker
+	}
+	if config.EnvironmentMaxworker < 0 {
+		FatalExitf(exitConfigError, "Error: Setting environment_maxworker in "+configFile+" must not be negative")
+	}
+
+	if config.MaxModuleFailures < 0 || config.MaxEnvironmentFailures < 0 {
+		FatalExitf(exitConfigError, "Error: Settings max_module_failures and max_environment_failures in "+configFile+" must not be negative")
+	}
+	if (config.MaxModuleFailures > 0 || config.MaxEnvironmentFailures > 0) && !failFast {
+		Debugf("Continuing with the other Puppet environments if one of them fails, because of max_module_failures/max_environment_failures setting")
+		keepGoing = true
+	}
+
+	if len(exportDirParam) > 0 {
+		config.ExportDir = exportDirParam
+	}
+	if len(config.ExportFormat) > 0 && config.ExportFormat != "tar.gz" && config.ExportFormat != "zip" {
+		FatalExitf(exitConfigError, "Error: Unsupported value "+config.ExportFormat+" of setting export_format in "+configFile+" Supported values are tar.gz and zip")
+	}
+	if config.ExportOnly && len(config.ExportDir) == 0 {
+		FatalExitf(exitConfigError, "Error: Setting export_only in "+configFile+" requires the export_dir setting or -exportdir parameter")
+	}
+
+	if len(config.Push.Hosts) > 0 {
+		if len(config.Push.SSHCommand) == 0 {
+			config.Push.SSHCommand = "ssh -o BatchMode=yes"
+		}
+		if config.Push.Versions < 1 {
+			config.Push.Versions = 2
+		}
+		if config.ExportOnly && len(config.Push.Basedir) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting export_only in "+configFile+" requires the basedir setting of push, as the environments are not built in their basedir")
+		}
+	}
+
+	if len(config.Publish.URL) > 0 {
+		if !strings.HasPrefix(config.Publish.URL, "s3://") && !strings.HasPrefix(config.Publish.URL, "gs://") && !strings.HasPrefix(config.Publish.URL, "az://") {
+			FatalExitf(exitConfigError, "Error: Unsupported url "+config.Publish.URL+" of setting publish in "+configFile+" Supported are s3://, gs:// and az:// urls")
+		}
+		if account, container, _ := azureBlob(config.Publish.URL); strings.HasPrefix(config.Publish.URL, "az://") && (len(account) == 0 || len(container) == 0) {
+			FatalExitf(exitConfigError, "Error: The url "+config.Publish.URL+" of setting publish in "+configFile+" must be of the form az://<storage account>/<container>/<prefix>")
+		}
+		if len(config.ExportDir) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting publish in "+configFile+" requires the export_dir setting or -exportdir parameter")
+		}
+		if config.Publish.Versions < 0 {
+			FatalExitf(exitConfigError, "Error: Setting versions of publish in "+configFile+" must not be negative")
+		}
+	}
+
+	if len(config.ManifestSigning.Method) > 0 {
+		if config.ManifestSigning.Method != "gpg" && config.ManifestSigning.Method != "minisign" {
+			FatalExitf(exitConfigError, "Error: Unsupported method "+config.ManifestSigning.Method+" of setting manifest_signing in "+configFile+" Supported methods are gpg and minisign")
+		}
+		// g10k agent only verifies signatures
+		if len(config.ManifestSigning.Key) == 0 && len(config.Agent.URL) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting manifest_signing in "+configFile+" requires the key with which the deploy manifests get signed")
+		}
+		if config.ManifestSigning.Method == "minisign" && len(config.ManifestSigning.PublicKey) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting manifest_signing in "+configFile+" requires the public_key of the minisign key to verify the signatures")
+		}
+	}
+
+	if len(config.KVPublish) > 0 {
+		if _, err := newKVStore(config.KVPublish); err != nil {
+			FatalExitf(exitConfigError, "Error: Invalid kv_publish "+config.KVPublish+" in "+configFile+": "+err.Error())
+		}
+	}
+
+	if len(config.Agent.URL) > 0 {
+		if !strings.HasPrefix(config.Agent.URL, "s3://") && !strings.HasPrefix(config.Agent.URL, "gs://") && !strings.HasPrefix(config.Agent.URL, "az://") {
+			FatalExitf(exitConfigError, "Error: Unsupported url "+config.Agent.URL+" of setting agent in "+configFile+" Supported are s3://, gs:// and az:// urls")
+		}
+		if len(config.Agent.Basedir) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting agent in "+configFile+" requires the basedir to which the Puppet environments get deployed")
+		}
+		if len(config.ManifestSigning.Method) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting agent in "+configFile+" requires the manifest_signing setting to verify the signature of the desired state")
+		}
+		if len(config.Agent.Interval) > 0 {
+			if interval, err := time.ParseDuration(config.Agent.Interval); err != nil || interval <= 0 {
+				FatalExitf(exitConfigError, "Error: Can not convert value "+config.Agent.Interval+" of setting interval of agent to a positive golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
+			}
+		}
+	}
+
+	if (len(config.Puppetserver.Cert) > 0) != (len(config.Puppetserver.Key) > 0) {
+		FatalExitf(exitConfigError, "Error: Settings cert and key of puppetserver in "+configFile+" have to be set together")
+	}
+	for _, u := range config.Puppetserver.URLs {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			FatalExitf(exitConfigError, "Error: Unsupported url "+u+" of setting puppetserver in "+configFile+" Expected e.g. https://puppet:8140")
+		}
+	}
+	for _, file := range []string{config.Puppetserver.Cert, config.Puppetserver.Key, config.Puppetserver.CA} {
+		if len(file) > 0 && !fileExists(file) {
+			FatalExitf(exitConfigError, "Error: could not find file "+file+" of setting puppetserver in "+configFile)
+		}
+	}
+
+	for setting, value := range map[string]string{"rotate_interval": config.LogFile.RotateInterval, "max_age": config.LogFile.MaxAge} {
+		if len(value) > 0 {
+			if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+				FatalExitf(exitConfigError, "Error: Can not convert value "+value+" of setting "+setting+" of log_file to a positive golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
+			}
+		}
+	}
+	if config.LogFile.MaxSize < 0 || config.LogFile.MaxBackups < 0 {
+		FatalExitf(exitConfigError, "Error: Settings max_size and max_backups of log_file in "+configFile+" can not be negative")
+	}
+
+	if len(config.Syslog.Address) > 0 {
+		if _, err := newSyslogWriter(config.Syslog); err != nil {
+			FatalExitf(exitConfigError, "Error: Invalid setting syslog in "+configFile+": "+err.Error())
+		}
+	} else if len(config.Syslog.Facility)+len(config.Syslog.AppName) > 0 {
+		FatalExitf(exitConfigError, "Error: Setting syslog in "+configFile+" requires the address of the syslog server, e.g. unix:///dev/log")
+	}
+
+	for _, n := range config.Notifications {
+		if !strings.HasPrefix(n.URL, "https://") && !strings.HasPrefix(n.URL, "http://") {
+			FatalExitf(exitConfigError, "Error: Unsupported webhook_url "+webhookHost(n.URL)+" of setting notifications in "+configFile+" Expected e.g. https://hooks.slack.com/services/...")
+		}
+		if len(n.Type) > 0 && n.Type != "slack" && n.Type != "teams" && n.Type != "generic" {
+			FatalExitf(exitConfigError, "Error: Unsupported type "+n.Type+" of setting notifications in "+configFile+" Supported are slack, teams and generic")
+		}
+		for _, event := range n.Events {
+			if event != "success" && event != "failure" {
+				FatalExitf(exitConfigError, "Error: Unsupported event "+event+" of setting notifications in "+configFile+" Supported are success and failure")
+			}
+		}
+		if _, err := template.New("notification").Funcs(notificationFuncs).Parse(n.Template); err != nil {
+			FatalExitf(exitConfigError, "Error: Invalid template of setting notifications in "+configFile+": "+err.Error())
+		}
+		if len(n.CA) > 0 && !fileExists(n.CA) {
+			FatalExitf(exitConfigError, "Error: could not find file "+n.CA+" of setting notifications in "+configFile)
+		}
+	}
+
+	if len(config.Mail.SMTPServer) > 0 {
+		if _, _, err := net.SplitHostPort(config.Mail.SMTPServer); err != nil {
+			FatalExitf(exitConfigError, "Error: Unsupported smtp_server "+config.Mail.SMTPServer+" of setting mail in "+configFile+" Expected e.g. mail.example.com:25")
+		}
+		if len(config.Mail.From) == 0 || len(config.Mail.To) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting mail in "+configFile+" requires the from address and at least one to address")
+		}
+	} else if len(config.Mail.To) > 0 {
+		FatalExitf(exitConfigError, "Error: Setting mail in "+configFile+" requires the smtp_server, e.g. mail.example.com:25")
+	}
+
+	for setting, address := range map[string]string{"statsd": config.Metrics.StatsD, "graphite": config.Metrics.Graphite} {
+		if len(address) > 0 {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				FatalExitf(exitConfigError, "Error: Unsupported "+setting+" server "+address+" of setting metrics in "+configFile+" Expected e.g. localhost:8125")
+			}
+		}
+	}
+	if len(config.Metrics.Prefix) > 0 && len(config.Metrics.StatsD) == 0 && len(config.Metrics.Graphite) == 0 {
+		FatalExitf(exitConfigError, "Error: Setting metrics in "+configFile+" requires a statsd or graphite server, e.g. localhost:8125")
+	}
+
+	if len(config.ProgressInterval) > 0 {
+		if d, err := time.ParseDuration(config.ProgressInterval); err != nil || d < 0 {
+			FatalExitf(exitConfigError, "Error: Can not convert value "+config.ProgressInterval+" of setting progress_interval to a golang Duration. Valid time units are 30s, 1m or 0 to disable the progress lines. In "+configFile)
+		}
+	}
+
+	if len(config.PuppetDB.URL) > 0 {
+		if !strings.HasPrefix(config.PuppetDB.URL, "https://") && !strings.HasPrefix(config.PuppetDB.URL, "http://") {
+			FatalExitf(exitConfigError, "Error: Unsupported url "+config.PuppetDB.URL+" of setting puppetdb in "+configFile+" Expected e.g. https://puppetdb:8081")
+		}
+		if (len(config.PuppetDB.Cert) > 0) != (len(config.PuppetDB.Key) > 0) {
+			FatalExitf(exitConfigError, "Error: Settings cert and key of puppetdb in "+configFile+" have to be set together")
+		}
+	}
+	if len(config.PuppetDB.Mode) > 0 && config.PuppetDB.Mode != "prioritize" && config.PuppetDB.Mode != "restrict" {
+		FatalExitf(exitConfigError, "Error: Unsupported value "+config.PuppetDB.Mode+" of setting mode of puppetdb in "+configFile+" Supported values are prioritize and restrict")
+	}
+
+	if len(config.TriggerRuns.OrchestratorURL) > 0 {
+		if !strings.HasPrefix(config.TriggerRuns.OrchestratorURL, "https://") {
+			FatalExitf(exitConfigError, "Error: Unsupported orchestrator_url "+config.TriggerRuns.OrchestratorURL+" of setting trigger_runs in "+configFile+" Expected e.g. https://puppet:8143")
+		}
+		if len(config.TriggerRuns.TokenFile) == 0 {
+			FatalExitf(exitConfigError, "Error: Setting orchestrator_url of trigger_runs in "+configFile+" requires the token_file with an RBAC token")
+		}
+	}
+
+	if (len(config.Serve.TLSCert) > 0) != (len(config.Serve.TLSKey) > 0) {
+		FatalExitf(exitConfigError, "Error: Settings tls_cert and tls_key of serve in "+configFile+" have to be set together")
+	}
+	if len(config.Serve.TLSClientCA) > 0 && len(config.Serve.TLSCert) == 0 {
+		FatalExitf(exitConfigError, "Error: Setting tls_client_ca of serve in "+configFile+" requires tls_cert and tls_key")
+	}
+	for _, file := range []string{config.Serve.TLSCert, config.Serve.TLSKey, config.Serve.TLSClientCA} {
+		if len(file) > 0 && !fileExists(file) {
+			FatalExitf(exitConfigError, "Error: could not find file "+file+" of setting serve in "+configFile)
+		}
+	}
+	if (len(config.Serve.APIUser) > 0) != (len(config.Serve.APIPassword) > 0) {
+		FatalExitf(exitConfigError, "Error: Settings api_user and api_password of serve in "+configFile+" have to be set together")
+	}
+	if len(config.Serve.Schedule) > 0 {
+		if _, err := parseSchedule(config.Serve.Schedule); err != nil {
+			FatalExitf(exitConfigError, "Error: Invalid schedule "+config.Serve.Schedule+" of setting serve in "+configFile+": "+err.Error())
+		}
+	}
+	if len(config.Serve.SSHControlPersist) > 0 {
+		if persist, err := time.ParseDuration(config.Serve.SSHControlPersist); err != nil || persist < time.Second {
+			FatalExitf(exitConfigError, "Error: Can not convert value "+config.Serve.SSHControlPersist+" of setting ssh_control_persist of serve to a golang Duration of at least 1s. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
+		}
+	}
+	if len(config.Serve.HALockTTL) > 0 {
+		if ttl, err := time.ParseDuration(config.Serve.HALockTTL); err != nil || ttl < time.Second {
+			FatalExitf(exitConfigError, "Error: Can not convert value "+config.Serve.HALockTTL+" of setting ha_lock_ttl of serve to a golang Duration of at least 1s. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
+		}
+	}
+	if len(config.Serve.HALock) > 0 {
+		if _, err := newHALock(config.Serve.HALock, defaultHALockTTL); err != nil {
+			FatalExitf(exitConfigError, "Error: Invalid ha_lock "+config.Serve.HALock+" of setting serve in "+configFile+": "+err.Error())
+		}
+	}
+	if len(config.Serve.ScheduleJitter) > 0 {
+		if _, err := time.ParseDuration(config.Serve.ScheduleJitter); err != nil {
+			FatalExitf(exitConfigError, "Error: Can not convert value "+config.Serve.ScheduleJitter+" of setting schedule_jitter of serve to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In "+configFile)
+		}
+	}
+	if len(config.Serve.ScheduleConcurrency) > 0 && config.Serve.ScheduleConcurrency != "queue" && config.Serve.ScheduleConcurrency != "skip" {
+		FatalExitf(exitConfigError, "Error: Unsupported value "+config.Serve.ScheduleConcurrency+" of setting schedule_concurrency of serve in "+configFile+" Supported values are queue and skip")
+	}
+
+	if len(config.DeployStrategy) > 0 && config.DeployStrategy != "in_place" && config.DeployStrategy != "atomic" && config.DeployStrategy != "symlink" && config.DeployStrategy != "nfs" {
+		FatalExitf(exitConfigError, "Error: Unsupported value "+config.DeployStrategy+" of setting deploy_strategy in "+configFile+" Supported values are in_place, atomic, symlink and nfs")
+	}
+	if config.GenerateTypesMaxworker < 0 {
+		FatalExitf(exitConfigError, "Error: Setting generate_types_maxworker in "+configFile+" must not be negative")
+	} else if config.GenerateTypesMaxworker == 0 && config.GenerateTypes {
+		config.GenerateTypesMaxworker = 1
+	}
+	if config.EnvironmentConf.ConfigVersion && len(config.ConfigVersion) == 0 {
+		FatalExitf(exitConfigError, "Error: Setting config_version of environment_conf in "+configFile+" requires a config_version command")
+	}
+	if config.SymlinkVersions < 0 {
+		FatalExitf(exitConfigError, "Error: symlink_versions in "+configFile+" must be at least 1")
+	} else if config.SymlinkVersions == 0 && (config.DeployStrategy == "symlink" || config.DeployStrategy == "nfs") {
+		config.SymlinkVersions = defaultSymlinkVersions
+	}
+
+	for _, setting := range config.EnvironmentOverrides {
+		if !stringSliceContains(overridableSettings, setting) {
+			FatalExitf(exitConfigError, "Error: Unsupported value "+setting+" of setting environment_overrides in "+configFile+" Supported values are "+strings.Join(overridableSettings, ", "))
+		}
+	}
+
+	config.purgeLevelsConfigured = len(config.PurgeLevels) > 0
 	if len(config.PurgeLevels) == 0 {
 		config.PurgeLevels = []string{"deployment", "puppetfile"}
 	}
 
 	for source, sa := range config.Sources {
+		sa = expandSourceVariables(source, sa)
+		if config.ExportOnly {
+			// the environments are only built to be exported, the real basedir stays untouched
+			sa.Basedir = filepath.Join(config.CacheDir, "export", source)
+		}
 		sa.Basedir = normalizeDir(sa.Basedir)
 
 		// set default to "correct_and_warn" like r10k
@@ -137,6 +440,9 @@ func readConfigfile(configFile string) ConfigSettings {
 		if len(sa.AutoCorrectEnvironmentNames) == 0 {
 			sa.AutoCorrectEnvironmentNames = "correct_and_warn"
 		}
+		if !stringSliceContains([]string{"correct_and_warn", "correct", "error"}, sa.AutoCorrectEnvironmentNames) {
+			FatalExitf(exitConfigError, "Error: Unsupported value "+sa.AutoCorrectEnvironmentNames+" of setting invalid_branches for source "+source+" in "+configFile+" Supported values are correct_and_warn, correct and error")
+		}
 		config.Sources[source] = sa
 	}
 
@@ -148,11 +454,55 @@ func readConfigfile(configFile string) ConfigSettings {
 	return config
 }
 
+// fetchConfigRepository mirrors the given git repository, extracts the given branch into the cachedir and returns the path of the g10k config file inside of it
+func fetchConfigRepository(remote string, branch string, path string, privateKey string) string {
+	cachedir := "/tmp/g10k"
+	if len(os.Getenv("g10k_cachedir")) > 0 {
+		cachedir = os.Getenv("g10k_cachedir")
+	} else if len(cacheDirParam) > 0 {
+		cachedir = cacheDirParam
+	}
+	cachedir = checkDirAndCreate(cachedir, "cachedir for -configrepo")
+	repoDir := strings.Replace(strings.Replace(remote, "/", "_", -1), ":", "-", -1)
+	workDir := filepath.Join(checkDirAndCreate(filepath.Join(cachedir, "config"), "cachedir/config"), repoDir+".git")
+	targetDir := filepath.Join(cachedir, "config", repoDir)
+
+	// the config repository gets fetched before the run_lock is taken
+	defer lockCacheEntry(cachedir, workDir)()
+	configRepoGit := GitModule{git: remote, privateKey: privateKey}
+	if !doMirrorOrUpdate(configRepoGit, workDir, 0) {
+		FatalExitf(exitConfigError, "fetchConfigRepository(): Failed to clone or update config repository "+remote+" to "+workDir)
+	}
+	if len(branch) == 0 {
+		branch = detectDefaultBranch(workDir)
+	}
+
+	Debugf("Extracting branch " + branch + " of config repository " + remote + " to " + targetDir)
+	purgeDir(targetDir, "fetchConfigRepository()")
+	checkDirAndCreate(targetDir, "config repository dir")
+	cmd := exec.Command("git", "--git-dir", workDir, "archive", branch)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		FatalExitf(exitConfigError, "fetchConfigRepository(): Failed to execute command: git --git-dir "+workDir+" archive "+branch+" Error: "+err.Error())
+	}
+	cmd.Start()
+	unTar(cmdOut, targetDir)
+	if err := cmd.Wait(); err != nil {
+		FatalExitf(exitConfigError, "fetchConfigRepository(): Failed to execute command: git --git-dir "+workDir+" archive "+branch+" Error: "+err.Error())
+	}
+
+	configFile := filepath.Join(targetDir, path)
+	if !fileExists(configFile) {
+		FatalExitf(exitConfigError, "fetchConfigRepository(): Could not find g10k config file "+path+" in branch "+branch+" of config repository "+remote)
+	}
+	return configFile
+}
+
 // preparePuppetfile remove whitespace and comment lines from the given Puppetfile and merges Puppetfile resources that are identified with having a , at the end
 func preparePuppetfile(pf string) string {
 	file, err := os.Open(pf)
 	if err != nil {
-		Fatalf("preparePuppetfile(): Error while opening Puppetfile " + pf + " Error: " + err.Error())
+		FatalExitf(exitPuppetfileError, "preparePuppetfile(): Error while opening Puppetfile "+pf+" Error: "+err.Error())
 	}
 	defer file.Close()
 
@@ -179,7 +529,7 @@ func preparePuppetfile(pf string) string {
 		}
 	}
 	if err := scanner.Err(); err != nil {
-		Fatalf("preparePuppetfile(): Error while scanning Puppetfile " + pf + " Error: " + err.Error())
+		FatalExitf(exitPuppetfileError, "preparePuppetfile(): Error while scanning Puppetfile "+pf+" Error: "+err.Error())
 	}
 
 	return pfString
@@ -199,6 +549,10 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 	} else {
 		Debugf("Trying to parse: " + pf)
 		n = preparePuppetfile(pf)
+		if isBoltProject(filepath.Dir(pf)) {
+			Debugf("Installing the modules of " + pf + " into " + boltModuleDir + " by default, because it belongs to a Bolt project")
+			n = boltPuppetfile(n)
+		}
 	}
 
 	reEmptyLine := regexp.MustCompile(`^\s*$`)
@@ -207,7 +561,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 	reForgeModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"]+[-/][^'\"]+)['\"](?:\s*)[,]?(.*)`)
 	reForgeAttribute := regexp.MustCompile(`\s*['\"]?([^\s'\"]+)\s*['\"]?(?:=>)?\s*['\"]?([^'\"]+)?`)
 	reGitModule := regexp.MustCompile(`^\s*(?:mod)\s+['\"]?([^'\"/]+)['\"]\s*,(.*)`)
-	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
+	reGitAttribute := regexp.MustCompile(`\s*:(git|commit|tag|branch|ref|link|ignore[-_]unreachable|fallback|install_path|default_branch|local|use_ssh_agent|proxy)\s*=>\s*['\"]?([^'\"]+)['\"]?`)
 	reUniqueGitAttribute := regexp.MustCompile(`\s*:(?:commit|tag|branch|ref|link)\s*=>`)
 	reDanglingAttribute := regexp.MustCompile(`^\s*:[^ ]+\s*=>`)
 	moduleDir := "modules"
@@ -221,14 +575,14 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 			continue
 		}
 		if strings.Count(line, ":git") > 1 || strings.Count(line, ":tag") > 1 || strings.Count(line, ":branch") > 1 || strings.Count(line, ":ref") > 1 || strings.Count(line, ":link") > 1 {
-			Fatalf("Error: trailing comma found in " + pf + " somewhere here: " + line)
+			FatalExitf(exitPuppetfileError, "Error: trailing comma found in "+pf+" somewhere here: "+line)
 		}
 		if m := reDanglingAttribute.FindStringSubmatch(line); len(m) >= 1 {
 			previousLine := ""
 			if i-1 >= 0 {
 				previousLine = lines[i-1]
 			}
-			Fatalf("Error: found dangling module attribute in " + pf + " somewhere here: " + previousLine + line + " Check for missing , at the end of the line.")
+			FatalExitf(exitPuppetfileError, "Error: found dangling module attribute in "+pf+" somewhere here: "+previousLine+line+" Check for missing , at the end of the line.")
 		}
 		if m := reModuledir.FindStringSubmatch(line); len(m) > 1 {
 			// moduledir CLI parameter override
@@ -244,7 +598,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 		} else if m := reForgeCacheTTL.FindStringSubmatch(line); len(m) > 1 {
 			ttl, err := time.ParseDuration(m[1])
 			if err != nil {
-				Fatalf("Error: Can not convert value " + m[1] + " of parameter " + m[0] + " to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In " + pf + " line: " + line)
+				FatalExitf(exitPuppetfileError, "Error: Can not convert value "+m[1]+" of parameter "+m[0]+" to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In "+pf+" line: "+line)
 			}
 			puppetFile.forgeCacheTTL = ttl
 		} else if m := reForgeModule.FindStringSubmatch(line); len(m) > 1 {
@@ -256,12 +610,12 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 				comp = strings.Split(forgeModuleName, "-")
 				forgeModuleNameSeparator = "-"
 				if len(comp) != 2 {
-					Fatalf("Error: Forge module name is invalid! Should be like puppetlabs/apt or puppetlabs-apt, but is: " + m[2] + " in " + pf + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Forge module name is invalid! Should be like puppetlabs/apt or puppetlabs-apt, but is: "+m[2]+" in "+pf+" line: "+line)
 				}
 			}
 			forgeModuleName = comp[0] + "/" + comp[1]
 			if _, ok := puppetFile.forgeModules[comp[1]]; ok {
-				Fatalf("Error: Duplicate forge module found in " + pf + " for module " + forgeModuleName + " line: " + line)
+				FatalExitf(exitPuppetfileError, "Error: Duplicate forge module found in "+pf+" for module "+forgeModuleName+" line: "+line)
 			}
 			//Debugf("Found Forge module name " + forgeModuleName + " with " + forgeModuleNameSeparator + " as a separator")
 			forgeModuleVersion := "present"
@@ -293,7 +647,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 							//fmt.Println("line:", line)
 							removeForgeNotationAuthor := strings.Split(line, forgeModuleNameSeparator)
 							if len(removeForgeNotationAuthor) < 2 {
-								Fatalf("Error: Found git module in Forge notation: " + forgeModuleName + " with git url: " + forgeAttributeValue + ", but something went wrong while trying to remove the author part to make g10k detect it as an Git module module:" + comp[1] + " line: " + line)
+								FatalExitf(exitPuppetfileError, "Error: Found git module in Forge notation: "+forgeModuleName+" with git url: "+forgeAttributeValue+", but something went wrong while trying to remove the author part to make g10k detect it as an Git module module:"+comp[1]+" line: "+line)
 							} else {
 								//fmt.Println("removeForgeNotationAuthor:", removeForgeNotationAuthor[0])
 								replacedLine := strings.Replace(line, removeForgeNotationAuthor[0]+forgeModuleNameSeparator, "mod '", 1)
@@ -308,10 +662,10 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 				}
 			}
 			if forceForgeVersions && (forgeModuleVersion == "present" || forgeModuleVersion == "latest") {
-				Fatalf("Error: Found " + forgeModuleVersion + " setting for forge module in " + pf + " for module " + forgeModuleName + " line: " + line + " and force_forge_versions is set to true! Please specify a version (e.g. '2.3.0')")
+				FatalExitf(exitPuppetfileError, "Error: Found "+forgeModuleVersion+" setting for forge module in "+pf+" for module "+forgeModuleName+" line: "+line+" and force_forge_versions is set to true! Please specify a version (e.g. '2.3.0')")
 			}
 			if _, ok := puppetFile.gitModules[comp[1]]; ok {
-				Fatalf("Error: Forge Puppet module with same name found in " + pf + " for module " + comp[1] + " line: " + line)
+				FatalExitf(exitPuppetfileError, "Error: Forge Puppet module with same name found in "+pf+" for module "+comp[1]+" line: "+line)
 			}
 			// the base url in the Puppetfile takes precedence over an base url specified in the g10k config yaml
 			if len(puppetFile.forgeBaseURL) == 0 {
@@ -329,13 +683,13 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 				gitModuleAttributes := m[2]
 				//fmt.Println("found git mod attribute ---> ", gitModuleAttributes)
 				if strings.Count(gitModuleAttributes, ":git") < 1 && strings.Count(gitModuleAttributes, ":local") < 1 {
-					Fatalf("Error: Missing :git url in " + pf + " for module " + gitModuleName + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Missing :git url in "+pf+" for module "+gitModuleName+" line: "+line)
 				}
 				if strings.Count(gitModuleAttributes, ",") > 3 {
-					Fatalf("Error: Too many attributes in " + pf + " for module " + gitModuleName + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Too many attributes in "+pf+" for module "+gitModuleName+" line: "+line)
 				}
 				if _, ok := puppetFile.gitModules[gitModuleName]; ok {
-					Fatalf("Error: Duplicate module found in " + pf + " for module " + gitModuleName + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Duplicate module found in "+pf+" for module "+gitModuleName+" line: "+line)
 				}
 				gas := reUniqueGitAttribute.FindAllStringSubmatch(gitModuleAttributes, -1)
 				cga := ""
@@ -343,7 +697,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 					for _, ga := range gas {
 						cga += strings.TrimSpace(strings.Replace(ga[0], "=>", "", -1)) + ", "
 					}
-					Fatalf("Error: Found conflicting git attributes " + cga + "in " + pf + " for module " + gitModuleName + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Found conflicting git attributes "+cga+"in "+pf+" for module "+gitModuleName+" line: "+line)
 				}
 				puppetFile.gitModules[gitModuleName] = GitModule{}
 				gm := GitModule{moduleDir: moduleDir}
@@ -353,17 +707,17 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 				for i := 0; i <= strings.Count(gitModuleAttributes, ","); i++ {
 					//fmt.Println("i -->", i)
 					if i >= len(gitModuleAttributesArray) {
-						Fatalf("Error: Trailing comma or invalid setting for module found in " + pf + " for module " + gitModuleName + " line: " + line)
+						FatalExitf(exitPuppetfileError, "Error: Trailing comma or invalid setting for module found in "+pf+" for module "+gitModuleName+" line: "+line)
 					}
 					a := reGitAttribute.FindStringSubmatch(gitModuleAttributesArray[i])
 					//fmt.Println("a -->", a)
 					if len(a) == 0 {
-						Fatalf("Error: Trailing comma or invalid setting for module found in " + pf + " for module " + gitModuleName + " line: " + line)
+						FatalExitf(exitPuppetfileError, "Error: Trailing comma or invalid setting for module found in "+pf+" for module "+gitModuleName+" line: "+line)
 					}
 					gitModuleAttribute := a[1]
 					if gitModuleAttribute == "git" {
 						if strings.Contains(a[2], "ProxyCommand") {
-							Fatalf("Error: Found ProxyCommand option in git url in " + pf + " for module " + gitModuleName + " line: " + line)
+							FatalExitf(exitPuppetfileError, "Error: Found ProxyCommand option in git url in "+pf+" for module "+gitModuleName+" line: "+line)
 						}
 						gm.git = a[2]
 					} else if gitModuleAttribute == "branch" {
@@ -383,13 +737,13 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 					} else if gitModuleAttribute == "link" {
 						link, err := strconv.ParseBool(a[2])
 						if err != nil {
-							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+							FatalExitf(exitPuppetfileError, "Error: Can not convert value "+a[2]+" of parameter "+gitModuleAttribute+" to boolean. In "+pf+" for module "+gitModuleName+" line: "+line)
 						}
 						gm.link = link
 					} else if gitModuleAttribute == "ignore-unreachable" || gitModuleAttribute == "ignore_unreachable" {
 						ignoreUnreachable, err := strconv.ParseBool(a[2])
 						if err != nil {
-							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+							FatalExitf(exitPuppetfileError, "Error: Can not convert value "+a[2]+" of parameter "+gitModuleAttribute+" to boolean. In "+pf+" for module "+gitModuleName+" line: "+line)
 						}
 						gm.ignoreUnreachable = ignoreUnreachable
 					} else if gitModuleAttribute == "fallback" || gitModuleAttribute == "default_branch" {
@@ -402,7 +756,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 					} else if gitModuleAttribute == "local" {
 						local, err := strconv.ParseBool(a[2])
 						if err != nil {
-							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+							FatalExitf(exitPuppetfileError, "Error: Can not convert value "+a[2]+" of parameter "+gitModuleAttribute+" to boolean. In "+pf+" for module "+gitModuleName+" line: "+line)
 						}
 						if local {
 							gm.local = true
@@ -410,14 +764,16 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 					} else if gitModuleAttribute == "use_ssh_agent" {
 						useSSHAgent, err := strconv.ParseBool(a[2])
 						if err != nil {
-							Fatalf("Error: Can not convert value " + a[2] + " of parameter " + gitModuleAttribute + " to boolean. In " + pf + " for module " + gitModuleName + " line: " + line)
+							FatalExitf(exitPuppetfileError, "Error: Can not convert value "+a[2]+" of parameter "+gitModuleAttribute+" to boolean. In "+pf+" for module "+gitModuleName+" line: "+line)
 						}
 						gm.useSSHAgent = useSSHAgent
+					} else if gitModuleAttribute == "proxy" {
+						gm.proxy = a[2]
 					}
 
 				}
 				if _, ok := puppetFile.forgeModules[gitModuleName]; ok {
-					Fatalf("Error: Git Puppet module with same name found in " + pf + " for module " + gitModuleName + " line: " + line)
+					FatalExitf(exitPuppetfileError, "Error: Git Puppet module with same name found in "+pf+" for module "+gitModuleName+" line: "+line)
 				}
 				if config.IgnoreUnreachableModules {
 					Debugf("Setting :ignore_unreachable for Git module " + gitModuleName)
@@ -428,7 +784,7 @@ func readPuppetfile(pf string, sshKey string, source string, branch string, forc
 		} else {
 			// for now only in dry run mode
 			if dryRun {
-				Fatalf("Error: Could not interpret line: " + line + " In " + pf)
+				FatalExitf(exitPuppetfileError, "Error: Could not interpret line: "+line+" In "+pf)
 			}
 
 		}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configVersionFile is the name of the script inside of each Puppet environment that prints the output of the config_version command, so that it can be used as config_version in the environment.conf
+const configVersionFile = ".g10k-config-version"
+
+// writeConfigVersions executes the config_version command for every Puppet environment that was changed by this g10k run and writes its output to the environment
+func writeConfigVersions() {
+	if len(config.ConfigVersion) == 0 || dryRun {
+		return
+	}
+	var envs []string
+	for env := range needSyncEnvs {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		pe, ok := puppetEnvironments[env]
+		if !ok || !isDir(pe.targetDir) {
+			continue
+		}
+		writeConfigVersion(pe)
+	}
+}
+
+// writeConfigVersion executes the config_version command for the given Puppet environment and writes a script printing its output to the .g10k-config-version file of the environment.
+// If the command fails the previous config version of the environment is kept.
+func writeConfigVersion(pe PuppetEnvironment) {
+	commit := ""
+	if deployFile := filepath.Join(pe.targetDir, ".g10k-deploy.json"); fileExists(deployFile) {
+		commit = readDeployResultFile(deployFile).Signature
+	}
+	configVersionCmd := expandDeployVariables(config.ConfigVersion, pe.source, pe.branch, pe.env)
+	configVersionCmd = strings.ReplaceAll(configVersionCmd, "{{commit}}", commit)
+	configVersionCmd = strings.ReplaceAll(configVersionCmd, "{{environmentdir}}", pe.targetDir)
+	er := executeCommand(configVersionCmd, config.Timeout, true)
+	if er.returnCode != 0 {
+		Warnf("WARNING: config_version command " + configVersionCmd + " failed for environment " + pe.env + ": " + er.errorOutput())
+		return
+	}
+	version := strings.TrimSpace(er.stdout)
+	Debugf("config_version of environment " + pe.env + " is " + version)
+
+	file := filepath.Join(pe.targetDir, configVersionFile)
+	content := "#!/bin/sh\necho '" + strings.ReplaceAll(version, "'", `'\''`) + "'\n"
+	if existing, err := ioutil.ReadFile(file); err == nil && string(existing) == content {
+		return
+	}
+	if err := writeFileAtomic(file, []byte(content), 0755); err != nil {
+		Warnf("WARNING: Could not write config version file " + file + " Error: " + err.Error())
+		return
+	}
+	applyOwnership(file)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// runMutex serializes deploy runs and configuration reloads when g10k is running as a long-running process
+	runMutex sync.Mutex
+	// configMutex protects the config of g10k serve against a reload by SIGHUP. A reload holds runMutex and configMutex while it replaces the config,
+	// so the deploy runs holding runMutex can read it directly, everything else like the HTTP handlers has to hold a read lock of configMutex
+	configMutex sync.RWMutex
+)
+
+// currentConfig returns the current config of g10k serve for code that holds neither runMutex nor configMutex, e.g. the scheduled syncs
+func currentConfig() ConfigSettings {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return config
+}
+
+// lockConfig holds a read lock of the config of g10k serve while the given HTTP handler runs, so that a reload can not replace it in the meantime
+func lockConfig(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		configMutex.RLock()
+		defer configMutex.RUnlock()
+		handler(w, r)
+	}
+}
+
+// reloadConfigOnSIGHUP re-reads the g10k config file every time g10k receives a SIGHUP signal
+func reloadConfigOnSIGHUP() {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			sdNotify("RELOADING=1")
+			reloadConfig()
+			sdNotify("READY=1")
+		}
+	}()
+}
+
+// validateConfigfile validates the given g10k config file in a separate g10k process, because g10k exits on an invalid config file
+var validateConfigfile = func(path string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return errors.New("the g10k executable could not be found: " + err.Error())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(currentConfig().Timeout)*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, executable, "-validate", "-config", path).CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(out)) + " (" + err.Error() + ")")
+	}
+	return nil
+}
+
+// reloadConfig validates the g10k config file in a separate g10k process and only replaces the current configuration if the validation was successful.
+// The new configuration gets applied after the currently running deploy has finished, so queued deploys are not dropped. The parameters of g10k serve still override it.
+func reloadConfig() bool {
+	Infof("Reloading config file " + configFile)
+	if err := validateConfigfile(configFile); err != nil {
+		Warnf("WARNING: Not reloading config file " + configFile + ", because it is invalid: " + err.Error())
+		return false
+	}
+	newConfig := loadConfig(configFile)
+	applyServeOverrides(&newConfig)
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	configMutex.Lock()
+	config = newConfig
+	configMutex.Unlock()
+	openLogOutputs()
+	Infof("Successfully reloaded config file " + configFile)
+	return true
+}
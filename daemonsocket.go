@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// daemonDeniedFlags are the parameters that g10k -via-daemon can not pass to the serve socket, because the daemon deploys with its own config
+var daemonDeniedFlags = map[string]struct{}{
+	"config":             empty,
+	"configrepo":         empty,
+	"configrepobranch":   empty,
+	"configrepopath":     empty,
+	"configrepokey":      empty,
+	"puppetfile":         empty,
+	"puppetfilelocation": empty,
+	"moduledir":          empty,
+	"cachedir":           empty,
+	"exportdir":          empty,
+	"version":            empty,
+	"via-daemon":         empty,
+	// the daemon would write these files with its own permissions
+	"report":       empty,
+	"timings-file": empty,
+	"cpuprofile":   empty,
+	"memprofile":   empty,
+}
+
+// runViaDaemon passes the parameters of this g10k run to the g10k serve listening on the given unix socket,
+// prints the output of the g10k run of the daemon and returns its exit code
+func runViaDaemon(socket string) int {
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "via-daemon" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	if err := validateDaemonArgs(args); err != nil {
+		Fatalf("Error: " + err.Error())
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		Fatalf("Error: could not connect to the g10k daemon on " + socket + ": " + err.Error())
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(DaemonRequest{Args: args}); err != nil {
+		Fatalf("Error: could not send the g10k run to the g10k daemon on " + socket + ": " + err.Error())
+	}
+	decoder := json.NewDecoder(conn)
+	for {
+		var message DaemonMessage
+		if err := decoder.Decode(&message); err != nil {
+			Fatalf("Error: lost the connection to the g10k daemon on " + socket + ": " + err.Error())
+		}
+		if message.ExitCode != nil {
+			return *message.ExitCode
+		}
+		if message.Stream == "stderr" {
+			os.Stderr.WriteString(message.Data)
+		} else {
+			os.Stdout.WriteString(message.Data)
+		}
+	}
+}
+
+// validateDaemonArgs returns an error if the given parameters are not allowed to be run by the g10k daemon
+func validateDaemonArgs(args []string) error {
+	for _, arg := range args {
+		name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+		if !strings.HasPrefix(arg, "-") || len(name) == 0 {
+			return errors.New("unexpected argument " + arg + " for the g10k daemon")
+		}
+		if _, denied := daemonDeniedFlags[name]; denied {
+			return errors.New("parameter -" + name + " is not allowed with -via-daemon, the g10k daemon deploys with its own config")
+		}
+	}
+	return nil
+}
+
+// listenDaemonSocket accepts g10k runs from g10k -via-daemon on the serve socket, which only its owner and group are allowed to use
+func listenDaemonSocket(socket string) net.Listener {
+	// a socket left behind by a killed g10k serve
+	if conn, err := net.Dial("unix", socket); err == nil {
+		conn.Close()
+		Fatalf("Error: another g10k serve is already listening on " + socket)
+	}
+	os.Remove(socket)
+	checkDirAndCreate(filepath.Dir(socket), "serve socket")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		Fatalf("Error: could not listen on " + socket + ": " + err.Error())
+	}
+	if err := os.Chmod(socket, 0660); err != nil {
+		Fatalf("Error: could not change the permissions of " + socket + ": " + err.Error())
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleDaemonConn(conn)
+		}
+	}()
+	return listener
+}
+
+// daemonMessageWriter streams everything written to it as DaemonMessage lines of the given stream
+type daemonMessageWriter struct {
+	stream  string
+	encoder *json.Encoder
+	mutex   *sync.Mutex
+}
+
+func (dmw daemonMessageWriter) Write(p []byte) (int, error) {
+	dmw.mutex.Lock()
+	defer dmw.mutex.Unlock()
+	if err := dmw.encoder.Encode(DaemonMessage{Stream: dmw.stream, Data: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// handleDaemonConn runs the g10k run requested on the serve socket as a separate g10k process with the config of g10k serve and streams its output back
+func handleDaemonConn(conn net.Conn) {
+	defer conn.Close()
+	var request DaemonRequest
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&request); err != nil {
+		Warnf("WARNING: Ignoring invalid request on the serve socket: " + err.Error())
+		return
+	}
+	var encoderMutex sync.Mutex
+	encoder := json.NewEncoder(conn)
+	stderr := daemonMessageWriter{stream: "stderr", encoder: encoder, mutex: &encoderMutex}
+	exitCode := runDaemonRequest(request.Args, daemonMessageWriter{stream: "stdout", encoder: encoder, mutex: &encoderMutex}, stderr)
+	encoderMutex.Lock()
+	encoder.Encode(DaemonMessage{ExitCode: &exitCode})
+	encoderMutex.Unlock()
+}
+
+// runDaemonRequest runs g10k with the config of g10k serve and the given parameters, serialized with the webhook deploys, and returns its exit code
+func runDaemonRequest(args []string, stdout io.Writer, stderr io.Writer) int {
+	if err := validateDaemonArgs(args); err != nil {
+		io.WriteString(stderr, "Error: "+err.Error()+"\n")
+		return 1
+	}
+	if deployCancelled() {
+		io.WriteString(stderr, "Error: the g10k daemon is shutting down\n")
+		return 1
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		io.WriteString(stderr, "Error: the g10k daemon could not find the g10k executable: "+err.Error()+"\n")
+		return 1
+	}
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	args = append([]string{"-config", configFile}, args...)
+	Infof("Running g10k " + strings.Join(args, " ") + " requested on the serve socket")
+	cmd := exec.Command(executable, args...)
+	cmd.Env = daemonCommandEnv()
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := startCommand(cmd); err != nil {
+		io.WriteString(stderr, "Error: the g10k daemon could not start g10k: "+err.Error()+"\n")
+		return 1
+	}
+	if err := waitCommand(cmd); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+			return exitErr.ExitCode()
+		}
+		return 1
+	}
+	return 0
+}
+
+// daemonCommandEnv returns the environment of the g10k runs of g10k serve, which share their SSH connections for the serve ssh_control_persist duration unless GIT_SSH_COMMAND is set
+func daemonCommandEnv() []string {
+	env := os.Environ()
+	cfg := currentConfig()
+	if len(cfg.Serve.SSHControlPersist) == 0 || len(os.Getenv("GIT_SSH_COMMAND")) > 0 {
+		return env
+	}
+	persist, _ := time.ParseDuration(cfg.Serve.SSHControlPersist)
+	controlDir := checkDirAndCreate(filepath.Join(cfg.CacheDir, "ssh"), "cachedir/ssh")
+	os.Chmod(controlDir, 0700)
+	return append(env, "GIT_SSH_COMMAND=ssh -o ControlMaster=auto -o ControlPersist="+strconv.Itoa(int(persist.Seconds()))+" -o ControlPath="+filepath.Join(controlDir, "%C"))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// extractedModulesDir returns the directory inside the cachedir in which every git module commit is extracted once for hardlink_git_modules
+func extractedModulesDir() string {
+	return filepath.Join(config.CacheDir, "extracted")
+}
+
+// extractGitModuleOnce extracts the given commit of the git module into the cachedir unless it was already extracted before and returns this directory.
+// All Puppet environments that use this commit of the module get hardlinks to these files instead of their own copy.
+func extractGitModuleOnce(srcDir string, tree string, commitHash string) string {
+	extractedDir := filepath.Join(extractedModulesDir(), commitHash)
+	if isDir(extractedDir) && fileExists(filepath.Join(extractedDir, ".latest_commit")) {
+		Debugf("Using already extracted commit " + commitHash + " of " + srcDir + " in " + extractedDir)
+		return extractedDir
+	}
+	checkDirAndCreate(extractedModulesDir(), "cachedir/extracted")
+	tmpDir, err := ioutil.TempDir(extractedModulesDir(), "."+commitHash+".")
+	if err != nil {
+		Fatalf("extractGitModuleOnce(): Could not create temporary directory in " + extractedModulesDir() + " Error: " + err.Error())
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		Fatalf("extractGitModuleOnce(): Could not chmod " + tmpDir + " Error: " + err.Error())
+	}
+	applyOwnership(tmpDir)
+	cmd := exec.Command("git", "--git-dir", srcDir, "archive", tree)
+	Debugf("Executing git --git-dir " + srcDir + " archive " + tree)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		Fatalf("extractGitModuleOnce(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	startCommand(cmd)
+	unTar(cmdOut, tmpDir)
+	if err := waitCommand(cmd); err != nil {
+		Fatalf("extractGitModuleOnce(): Failed to execute command: git --git-dir " + srcDir + " archive " + tree + " Error: " + err.Error())
+	}
+	if config.PreserveCommitTimestamps {
+		applyCommitTimestamps(srcDir, commitHash, tmpDir)
+	}
+	// with module_store the environments read the commit of the module through their symlink
+	if err := writeFileAtomic(filepath.Join(tmpDir, ".latest_commit"), []byte(commitHash), 0644); err != nil {
+		Fatalf("extractGitModuleOnce(): Could not write hash file in " + tmpDir + " Error: " + err.Error())
+	}
+	// another environment might have extracted the same commit in the meantime
+	if isDir(extractedDir) && !fileExists(filepath.Join(extractedDir, ".latest_commit")) {
+		// extracted by an older g10k version without the hash file
+		exchangeDirs(tmpDir, extractedDir)
+		purgeDir(tmpDir, "extractGitModuleOnce()")
+	} else if err := os.Rename(tmpDir, extractedDir); err != nil {
+		Debugf("Discarding " + tmpDir + ", because " + extractedDir + " already exists")
+		purgeDir(tmpDir, "extractGitModuleOnce()")
+	}
+	return extractedDir
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// checksumsFile is the file inside of each Puppet environment that contains the checksums of all deployed files
+const checksumsFile = ".g10k-checksums.json"
+
+// controlRepoContent is the key of the control repository content inside of the DeployChecksums
+const controlRepoContent = "."
+
+// DriftedFile is a file of a Puppet environment that was modified, added or deleted outside of g10k
+type DriftedFile struct {
+	Content string `json:"content"`
+	Change  string `json:"change"`
+	Path    string `json:"path"`
+}
+
+// isDeployMetadata returns true if the given path relative to a Puppet environment is written by g10k or Puppet itself and therefore not part of the deployed content
+func isDeployMetadata(relPath string) bool {
+	first := strings.Split(relPath, "/")[0]
+	return strings.HasPrefix(first, ".g10k-") || first == ".resource_types" || first == ".git"
+}
+
+// fileChecksums returns the hex encoded SHA256 checksums of all files inside of the given directory relative to it, symlinks are recorded with their target.
+// Paths for which skip returns true are left out.
+func fileChecksums(dir string, skip func(relPath string) bool) map[string]string {
+	checksums := make(map[string]string)
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return checksums
+	}
+	filepath.Walk(resolvedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == resolvedDir {
+			return nil
+		}
+		relPath, _ := filepath.Rel(resolvedDir, path)
+		if skip(relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(path)
+			checksums[relPath] = "symlink:" + link
+		} else if hash, err := fileSha256(path); err == nil {
+			checksums[relPath] = hex.EncodeToString(hash)
+		}
+		return nil
+	})
+	return checksums
+}
+
+// contentChecksums returns the checksums of the files of the given content of the Puppet environment, i.e. of a module or of the control repository without its modules
+func contentChecksums(envDir string, content string, modulePaths map[string]bool) map[string]string {
+	if content == controlRepoContent {
+		return fileChecksums(envDir, func(relPath string) bool {
+			return modulePaths[relPath] || isDeployMetadata(relPath)
+		})
+	}
+	return fileChecksums(filepath.Join(envDir, content), func(relPath string) bool {
+		return relPath == ".latest_commit"
+	})
+}
+
+// readDeployChecksums reads the recorded checksums of the given Puppet environment directory
+func readDeployChecksums(envDir string) (DeployChecksums, error) {
+	var dc DeployChecksums
+	content, err := ioutil.ReadFile(filepath.Join(envDir, checksumsFile))
+	if err != nil {
+		return dc, err
+	}
+	err = json.Unmarshal(content, &dc)
+	return dc, err
+}
+
+// writeDeployChecksums records the checksums of all deployed files of the given Puppet environment in its .g10k-checksums.json file.
+// Only modules with a new resolved version and the control repository with a new commit are checksummed again, so that files modified outside of g10k do not become part of the recorded state.
+func writeDeployChecksums(env string, pf Puppetfile, manifest DeployManifest) {
+	file := filepath.Join(pf.workDir, checksumsFile)
+	previous, err := readDeployChecksums(pf.workDir)
+	mutex.Lock()
+	_, changed := needSyncEnvs[env]
+	mutex.Unlock()
+	if !changed && err == nil {
+		return
+	}
+
+	modulePaths := make(map[string]bool)
+	for _, m := range manifest.Modules {
+		modulePaths[m.Path] = true
+	}
+	dc := DeployChecksums{Environment: env, Content: make(map[string]ContentChecksums)}
+	if recorded, ok := previous.Content[controlRepoContent]; ok && recorded.Resolved == manifest.Commit && len(manifest.Commit) > 0 {
+		dc.Content[controlRepoContent] = recorded
+		if config.EnvironmentConf.Modulepath || config.EnvironmentConf.ConfigVersion {
+			// g10k itself may have changed the environment.conf
+			if hash, err := fileSha256(filepath.Join(pf.workDir, "environment.conf")); err == nil {
+				recorded.Files["environment.conf"] = hex.EncodeToString(hash)
+			}
+		}
+	} else {
+		dc.Content[controlRepoContent] = ContentChecksums{Type: "control", Resolved: manifest.Commit, Files: contentChecksums(pf.workDir, controlRepoContent, modulePaths)}
+	}
+	for _, m := range manifest.Modules {
+		if recorded, ok := previous.Content[m.Path]; ok && recorded.Type == m.Type && recorded.Resolved == m.Resolved && len(m.Resolved) > 0 {
+			dc.Content[m.Path] = recorded
+			continue
+		}
+		dc.Content[m.Path] = ContentChecksums{Type: m.Type, Resolved: m.Resolved, Files: contentChecksums(pf.workDir, m.Path, modulePaths)}
+	}
+
+	content, err := json.MarshalIndent(dc, "", "  ")
+	if err != nil {
+		Warnf("Could not encode JSON file " + file + " " + err.Error())
+		return
+	}
+	if existing, err := ioutil.ReadFile(file); err == nil && bytes.Equal(existing, content) {
+		return
+	}
+	Debugf("Writing deploy checksums " + file)
+	if err := writeFileAtomic(file, content, 0644); err != nil {
+		Warnf("Could not write JSON file " + file + " " + err.Error())
+	}
+	applyOwnership(file)
+}
+
+// detectDrift compares the files of the given Puppet environment directory with its recorded checksums and returns all files that were modified, added or deleted outside of g10k.
+// Added files matching the given purge_allowlist are ignored.
+func detectDrift(envDir string, dc DeployChecksums, allowList []string) []DriftedFile {
+	modulePaths := make(map[string]bool)
+	for content := range dc.Content {
+		if content != controlRepoContent {
+			modulePaths[content] = true
+		}
+	}
+	var drifted []DriftedFile
+	for content, recorded := range dc.Content {
+		actual := contentChecksums(envDir, content, modulePaths)
+		for relPath, checksum := range recorded.Files {
+			if actualChecksum, ok := actual[relPath]; !ok {
+				drifted = append(drifted, DriftedFile{Content: content, Change: "deleted", Path: relPath})
+			} else if actualChecksum != checksum {
+				drifted = append(drifted, DriftedFile{Content: content, Change: "modified", Path: relPath})
+			}
+		}
+		for relPath := range actual {
+			if _, ok := recorded.Files[relPath]; ok {
+				continue
+			}
+			if matchesPurgeAllowList(allowList, envDir, filepath.Join(envDir, content, relPath)) {
+				continue
+			}
+			drifted = append(drifted, DriftedFile{Content: content, Change: "added", Path: relPath})
+		}
+	}
+	sort.Slice(drifted, func(i, j int) bool {
+		return filepath.Join(drifted[i].Content, drifted[i].Path) < filepath.Join(drifted[j].Content, drifted[j].Path)
+	})
+	return drifted
+}
+
+// driftCommand reports all files of the deployed Puppet environments that were modified, added or deleted outside of g10k, e.g. g10k drift -config test.yaml
+// With -repair the drifted files get restored from the g10k cache.
+func driftCommand(args []string) {
+	fs := subcommandFlagSet("drift")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	environment := fs.String("environment", "", "only check this Puppet environment")
+	repair := fs.Bool("repair", false, "restore the drifted files from the g10k cache and remove added files")
+	fs.StringVar(&outputFormat, "output", "text", "format of the drifted files: text or json")
+	fs.Parse(args)
+	outputCommand = "drift"
+	setupOutput()
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " drift -config test.yaml")
+	}
+
+	config = loadConfig(*configFileFlag)
+
+	driftedEnvironments := 0
+	driftedFiles := 0
+	repairedFiles := 0
+	output := DriftOutput{Command: "drift", Environments: make(map[string][]DriftedFile)}
+	for _, source := range sortedSourceNames() {
+		sa := config.Sources[source]
+		entries, _ := ioutil.ReadDir(sa.Basedir)
+		for _, entry := range entries {
+			env := entry.Name()
+			envDir := filepath.Join(sa.Basedir, env)
+			if strings.HasPrefix(env, ".") || reEnvironmentVersion.MatchString(env) || isStagingDir(envDir) || !isDir(envDir) {
+				continue
+			}
+			if len(*environment) > 0 && env != *environment {
+				continue
+			}
+			dc, err := readDeployChecksums(envDir)
+			if err != nil {
+				Warnf("WARNING: No recorded checksums found for environment " + env + ", deploy it with g10k first")
+				continue
+			}
+			drifted := detectDrift(envDir, dc, resolvePurgeAllowList(sa))
+			if len(drifted) == 0 {
+				continue
+			}
+			driftedEnvironments++
+			driftedFiles += len(drifted)
+			output.Environments[env] = drifted
+			fmt.Println("Environment " + env + " has " + strconv.Itoa(len(drifted)) + " drifted file(s):")
+			for _, df := range drifted {
+				label := "control repository"
+				if df.Content != controlRepoContent {
+					label = "module " + df.Content
+				}
+				fmt.Println("  " + df.Change + " " + filepath.Join(df.Content, df.Path) + " (" + label + ")")
+			}
+			if *repair {
+				if environmentFrozen(env, envDir) {
+					Warnf("WARNING: Not repairing frozen environment " + env)
+					continue
+				}
+				repairedFiles += repairDrift(envDir, dc, drifted)
+			}
+		}
+	}
+	if jsonOutput() {
+		output.Repaired = repairedFiles
+		printOutput(output)
+	}
+	if driftedFiles == 0 {
+		fmt.Println("No drift detected")
+		return
+	}
+	fmt.Println("Found " + strconv.Itoa(driftedFiles) + " drifted file(s) in " + strconv.Itoa(driftedEnvironments) + " environment(s)")
+	if *repair {
+		fmt.Println("Repaired " + strconv.Itoa(repairedFiles) + " of " + strconv.Itoa(driftedFiles) + " drifted file(s)")
+		if repairedFiles == driftedFiles {
+			return
+		}
+	}
+	os.Exit(1)
+}
+
+// sortedSourceNames returns the names of all configured sources in alphabetical order
+func sortedSourceNames() []string {
+	var sources []string
+	for source := range config.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	return sources
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// recordDryRunChange remembers a change that g10k would make to the given Puppet environment without -dryrun, changes without an environment apply to the basedirs
+func recordDryRunChange(env string, change string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	dryRunChanges[env] = append(dryRunChanges[env], change)
+}
+
+// printDryRunPlan prints all changes that g10k would have made without -dryrun, grouped by Puppet environment
+func printDryRunPlan() {
+	if len(dryRunChanges) == 0 {
+		fmt.Println("Dry run: nothing would be changed")
+		return
+	}
+	fmt.Println("Dry run: the following changes would be made")
+	var envs []string
+	for env := range dryRunChanges {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		changes := dryRunChanges[env]
+		sort.Strings(changes)
+		indent := "  "
+		if len(env) > 0 {
+			fmt.Println("Environment " + env + ":")
+			indent = "    "
+		}
+		for _, change := range changes {
+			fmt.Println(indent + change)
+		}
+	}
+}
+
+// shortCommit abbreviates the given commit hash like git does
+func shortCommit(commit string) string {
+	if len(commit) > 7 {
+		return commit[:7]
+	}
+	return commit
+}
+
+// environmentOfPath returns the Puppet environment and the path relative to it for the given path inside of one of the deployed environments
+func environmentOfPath(path string) (string, string) {
+	for env, pe := range puppetEnvironments {
+		if strings.HasPrefix(path, pe.targetDir+"/") {
+			return env, strings.TrimPrefix(path, pe.targetDir+"/")
+		}
+	}
+	return "", path
+}
+
+// recordDryRunGitSync records the change of a git module or control repository that syncToModuleDir would make without -dryrun
+func recordDryRunGitSync(srcDir string, targetDir string, commit string, env string, isControlRepo bool, moduleDir string, allowList []string) {
+	if isControlRepo {
+		deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+		if !isDir(targetDir) {
+			recordDryRunChange(env, "create environment from commit "+shortCommit(commit))
+			return
+		}
+		previousCommit := ""
+		if fileExists(deployFile) {
+			previousCommit = readDeployResultFile(deployFile).Signature
+		}
+		recordDryRunChange(env, "update control repository "+shortCommit(previousCommit)+" → "+shortCommit(commit))
+		for _, path := range plannedControlRepoPurge(srcDir, commit, previousCommit, targetDir, moduleDir, allowList) {
+			recordDryRunChange(env, "purge file "+path)
+		}
+		return
+	}
+	_, module := environmentOfPath(targetDir)
+	previousCommit, err := ioutil.ReadFile(filepath.Join(targetDir, ".latest_commit"))
+	if err != nil || !isDir(targetDir) {
+		recordDryRunChange(env, "add module "+module+" (git "+shortCommit(commit)+")")
+		return
+	}
+	recordDryRunChange(env, "update module "+module+" (git "+shortCommit(strings.TrimSpace(string(previousCommit)))+" → "+shortCommit(commit)+")")
+}
+
+// plannedControlRepoPurge returns the files of the Puppet environment that g10k would remove when deploying the given commit of the control repository.
+// With the environment purge level or without the purge_levels setting these are all files outside of the moduledir that are not part of the new commit or the purge_allowlist, otherwise only the files of the previous commit that are not part of the new commit.
+func plannedControlRepoPurge(srcDir string, commit string, previousCommit string, targetDir string, moduleDir string, allowList []string) []string {
+	newFiles := gitTreeFiles(srcDir, commit)
+	var purged []string
+	if purgeEnvironmentContent() {
+		moduleDirPath := filepath.Join(targetDir, moduleDir)
+		filepath.Walk(targetDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == targetDir {
+				return nil
+			}
+			relPath, _ := filepath.Rel(targetDir, path)
+			if path == moduleDirPath || isDeployMetadata(relPath) || matchesPurgeAllowList(allowList, targetDir, path) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !info.IsDir() && !newFiles[relPath] {
+				purged = append(purged, relPath)
+			}
+			return nil
+		})
+	} else if len(previousCommit) > 0 {
+		for relPath := range gitTreeFiles(srcDir, previousCommit) {
+			if !newFiles[relPath] && fileExists(filepath.Join(targetDir, relPath)) {
+				purged = append(purged, relPath)
+			}
+		}
+	}
+	sort.Strings(purged)
+	return purged
+}
+
+// gitTreeFiles returns all file paths of the given commit of the git repository
+func gitTreeFiles(gitDir string, commit string) map[string]bool {
+	files := make(map[string]bool)
+	er := executeCommand("git --git-dir "+gitDir+" ls-tree -r --name-only "+commit, config.Timeout, true)
+	if er.returnCode != 0 {
+		return files
+	}
+	for _, file := range strings.Split(strings.TrimSpace(er.stdout), "\n") {
+		if len(file) > 0 {
+			files[file] = true
+		}
+	}
+	return files
+}
+
+// dryRunControlRepo extracts the branch of the given Puppet environment into a temporary directory, so that its Puppetfile can be read without touching the basedir during a -dryrun.
+// The caller has to remove the returned directory.
+func dryRunControlRepo(pe PuppetEnvironment) string {
+	tmpDir, err := ioutil.TempDir("", "g10k-dryrun-")
+	if err != nil {
+		Fatalf("dryRunControlRepo(): Could not create temporary directory Error: " + err.Error())
+	}
+	cmd := exec.Command("git", "--git-dir", pe.gitDir, "archive", pe.branch)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		Fatalf("dryRunControlRepo(): Failed to execute command: git --git-dir " + pe.gitDir + " archive " + pe.branch + " Error: " + err.Error())
+	}
+	if err := cmd.Start(); err != nil {
+		Fatalf("dryRunControlRepo(): Failed to execute command: git --git-dir " + pe.gitDir + " archive " + pe.branch + " Error: " + err.Error())
+	}
+	unTar(cmdOut, tmpDir)
+	if err := cmd.Wait(); err != nil {
+		Fatalf("dryRunControlRepo(): Failed to execute command: git --git-dir " + pe.gitDir + " archive " + pe.branch + " Error: " + err.Error())
+	}
+	return tmpDir
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// reEnvironmentConfSetting matches a setting line of an environment.conf file
+var reEnvironmentConfSetting = regexp.MustCompile(`^\s*([a-z_]+)\s*=\s*(.*?)\s*$`)
+
+// environmentConfModulepath returns the modulepath entries which are needed to find all modules of the given Puppetfile, i.e. its moduledirs and the install_path of its Git modules
+func environmentConfModulepath(pf Puppetfile) []string {
+	var entries []string
+	addEntry := func(dir string) {
+		if filepath.IsAbs(dir) {
+			if rel, err := filepath.Rel(pf.workDir, dir); err == nil && !strings.HasPrefix(rel, "..") {
+				dir = rel
+			}
+		}
+		dir = strings.TrimSuffix(dir, "/")
+		if len(dir) > 0 && !stringSliceContains(entries, dir) {
+			entries = append(entries, dir)
+		}
+	}
+	for _, moduleDir := range pf.moduleDirs {
+		addEntry(moduleDir)
+	}
+	var installPaths []string
+	for _, gm := range pf.gitModules {
+		if len(gm.installPath) > 0 {
+			installPaths = append(installPaths, gm.installPath)
+		}
+	}
+	sort.Strings(installPaths)
+	for _, installPath := range installPaths {
+		addEntry(installPath)
+	}
+	return entries
+}
+
+// patchEnvironmentConf returns the given environment.conf content with the managed modulepath entries and config_version setting.
+// Missing modulepath entries are added in front of $basemodulepath, a different existing config_version is only overwritten if clobber is set.
+func patchEnvironmentConf(content string, modulepath []string, configVersion string, clobber bool) string {
+	var lines []string
+	if len(content) > 0 {
+		lines = strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	}
+	foundModulepath := false
+	foundConfigVersion := false
+	for i, line := range lines {
+		m := reEnvironmentConfSetting.FindStringSubmatch(line)
+		if len(m) < 3 {
+			continue
+		}
+		switch m[1] {
+		case "modulepath":
+			if len(modulepath) == 0 || foundModulepath {
+				continue
+			}
+			foundModulepath = true
+			existing := strings.Split(strings.Trim(m[2], `"'`), ":")
+			var missing []string
+			for _, entry := range modulepath {
+				if !stringSliceContains(existing, entry) {
+					missing = append(missing, entry)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			var patched []string
+			for _, entry := range existing {
+				if entry == "$basemodulepath" {
+					patched = append(patched, missing...)
+					missing = nil
+				}
+				patched = append(patched, entry)
+			}
+			patched = append(patched, missing...)
+			lines[i] = "modulepath = " + strings.Join(patched, ":")
+		case "config_version":
+			if len(configVersion) == 0 || foundConfigVersion {
+				continue
+			}
+			foundConfigVersion = true
+			if existing := strings.Trim(m[2], `"'`); existing != configVersion {
+				if !clobber {
+					Warnf("WARNING: Not overwriting existing config_version = " + existing + " in environment.conf, set clobber in environment_conf to overwrite it")
+					continue
+				}
+				Warnf("WARNING: Overwriting existing config_version = " + existing + " in environment.conf")
+				lines[i] = "config_version = " + configVersion
+			}
+		}
+	}
+	if len(modulepath) > 0 && !foundModulepath {
+		lines = append(lines, "modulepath = "+strings.Join(append(modulepath, "$basemodulepath"), ":"))
+	}
+	if len(configVersion) > 0 && !foundConfigVersion {
+		lines = append(lines, "config_version = "+configVersion)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// manageEnvironmentConf generates or patches the environment.conf file of the Puppet environment of the given Puppetfile according to the environment_conf settings
+func manageEnvironmentConf(pf Puppetfile) {
+	if !config.EnvironmentConf.Modulepath && !config.EnvironmentConf.ConfigVersion {
+		return
+	}
+	var modulepath []string
+	if config.EnvironmentConf.Modulepath {
+		modulepath = environmentConfModulepath(pf)
+	}
+	configVersion := ""
+	if config.EnvironmentConf.ConfigVersion {
+		configVersion = configVersionFile
+	}
+
+	file := filepath.Join(pf.workDir, "environment.conf")
+	existing, _ := ioutil.ReadFile(file)
+	content := patchEnvironmentConf(string(existing), modulepath, configVersion, config.EnvironmentConf.Clobber)
+	if content == string(existing) {
+		return
+	}
+	Debugf("Writing " + file)
+	if err := writeFileAtomic(file, []byte(content), 0644); err != nil {
+		Warnf("WARNING: Could not write " + file + " Error: " + err.Error())
+		return
+	}
+	applyOwnership(file)
+}
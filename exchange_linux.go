@@ -0,0 +1,18 @@
+//go:build linux
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// exchangeDirs atomically exchanges the two given directories with renameat2(2) and RENAME_EXCHANGE.
+// If the filesystem does not support this, it falls back to two renames.
+func exchangeDirs(a string, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		Debugf("renameat2 with RENAME_EXCHANGE is not supported for " + b + ", falling back to rename")
+		return renameDirs(a, b)
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// exchangeDirs exchanges the two given directories with two renames, because renameat2(2) is only available on Linux
+func exchangeDirs(a string, b string) error {
+	return renameDirs(a, b)
+}
@@ -0,0 +1,20 @@
+package main
+
+// The exit codes of g10k, so that wrapper scripts can tell the cause of a failed g10k run without parsing its output.
+// A SIGINT or SIGTERM exits with 130 or 143, the g10k health subcommand has its own exit codes.
+const (
+	// exitFailure is every failure without its own exit code and a -dryrun that found changes
+	exitFailure = 1
+	// exitConfigError is an invalid or unreadable g10k config file, also with -validate
+	exitConfigError = 2
+	// exitPuppetfileError is a Puppetfile that can not be read or parsed
+	exitPuppetfileError = 3
+	// exitGitError is a git repository that can not be cloned or updated or a git reference that can not be resolved
+	exitGitError = 4
+	// exitForgeError is a Forge module that can not be queried, downloaded or verified
+	exitForgeError = 5
+	// exitPartialDeploy is a -keepgoing run in which some environments, modules or sources failed beyond the failure thresholds
+	exitPartialDeploy = 6
+	// exitPurgeRefused is a run that did not purge the environments of a source whose control repository could not be resolved
+	exitPurgeRefused = 7
+)
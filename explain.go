@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// explainCommand prints why a module of a deployed Puppet environment is at its deployed version,
+// e.g. g10k explain -config test.yaml production stdlib
+func explainCommand(args []string) {
+	fs := subcommandFlagSet("explain")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	fs.Parse(args)
+	if len(*configFileFlag) == 0 || fs.NArg() != 2 {
+		Fatalf("Error: you need to specify a config file, an environment and a module\nExample call: " + os.Args[0] + " explain -config test.yaml production stdlib")
+	}
+	config = loadConfig(*configFileFlag)
+
+	env, module := fs.Arg(0), fs.Arg(1)
+	envDir, sa := deployedEnvironmentDir(env)
+	if len(envDir) == 0 {
+		Fatalf("Error: Could not find the deployed environment " + env + " in the basedir of any source of " + *configFileFlag)
+	}
+	lines, err := explainModule(env, envDir, sa, module)
+	if err != nil {
+		Fatalf("Error: " + err.Error())
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+}
+
+// deployedEnvironmentDir returns the directory and the source of the given deployed Puppet environment
+func deployedEnvironmentDir(env string) (string, Source) {
+	for _, source := range sortedSourceNames() {
+		sa := config.Sources[source]
+		envDir := filepath.Join(sa.Basedir, env)
+		if fileExists(filepath.Join(envDir, ".g10k-manifest.json")) {
+			return envDir, sa
+		}
+	}
+	return "", Source{}
+}
+
+// explainModule returns the explanation of the deployed version of the given module: its Puppetfile line, how its version got resolved, the settings that changed it and the cache entry it was deployed from
+func explainModule(env string, envDir string, sa Source, module string) ([]string, error) {
+	manifest, err := readDeployManifest(filepath.Join(envDir, ".g10k-manifest.json"))
+	if err != nil {
+		return nil, errors.New("Could not read the deploy manifest of environment " + env + ": " + err.Error())
+	}
+	var mm ManifestModule
+	found := false
+	for _, m := range manifest.Modules {
+		if explainModuleMatches(m.Name, module) {
+			mm = m
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, errors.New("Module " + module + " is not part of the deploy manifest of environment " + env)
+	}
+
+	lines := []string{"Module " + mm.Name + " (" + mm.Type + ") of environment " + env + " from source " + manifest.Source + ", branch " + manifest.Branch + " at commit " + shortCommit(manifest.Commit)}
+	if len(mm.Path) > 0 {
+		lines = append(lines, "Deployed to "+filepath.Join(envDir, mm.Path)+" at "+mm.DeployedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+
+	pf := filepath.Join(envDir, "Puppetfile")
+	lineNumber, statement := puppetfileStatement(pf, mm.Name)
+	if lineNumber == 0 {
+		lines = append(lines, "", "Puppetfile: the module could not be found in "+pf)
+		return lines, nil
+	}
+	lines = append(lines, "", "Puppetfile "+pf+":"+strconv.Itoa(lineNumber)+":")
+	for _, l := range statement {
+		lines = append(lines, "  "+l)
+	}
+	puppetfile := readPuppetfile(pf, sa.PrivateKey, manifest.Source, manifest.Branch, sa.ForceForgeVersions, false)
+
+	lines = append(lines, "", "Resolution:")
+	var overrides []string
+	var cacheEntry string
+	switch mm.Type {
+	case "forge":
+		name := mm.Name[strings.Index(mm.Name, "/")+1:]
+		fm := puppetfile.forgeModules[name]
+		switch fm.version {
+		case "latest":
+			ttl := config.ForgeCacheTTL
+			if puppetfile.forgeCacheTTL > 0 {
+				ttl = puppetfile.forgeCacheTTL
+			}
+			checked := "on every run"
+			if ttl > 0 {
+				checked = "at most every " + ttl.String()
+			}
+			lines = append(lines, "  latest -> the newest release on "+mm.Source+", checked "+checked+" -> "+mm.Resolved)
+		case "present":
+			lines = append(lines, "  present -> any version, the one in the cache or else the newest release on "+mm.Source+" -> "+mm.Resolved)
+		default:
+			lines = append(lines, "  "+fm.version+" -> pinned release "+mm.Resolved)
+		}
+		if len(fm.sha256sum) > 0 {
+			lines = append(lines, "  verified with the sha256sum of the Puppetfile")
+		}
+		if len(puppetfile.forgeBaseURL) > 0 && puppetfile.forgeBaseURL != config.ForgeBaseURL {
+			overrides = append(overrides, "forge.baseUrl "+puppetfile.forgeBaseURL+" of the Puppetfile instead of the forge_base_url setting")
+		}
+		if sa.ForceForgeVersions {
+			overrides = append(overrides, "force_forge_versions of source "+manifest.Source+" requires a pinned version")
+		}
+		cacheEntry = filepath.Join(config.ForgeCacheDir, strings.Replace(mm.Name, "/", "-", 1)+"-"+mm.Resolved)
+	case "local":
+		lines = append(lines, "  :local => true -> the module is part of the control repository and not resolved")
+	default:
+		gm := puppetfile.gitModules[mm.Name]
+		cacheEntry = filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(gm.git, "/", "_", -1), ":", "-", -1))
+		tree, kind := "", ""
+		for _, attr := range []struct{ kind, value string }{{"branch", gm.branch}, {"commit", gm.commit}, {"tag", gm.tag}, {"ref", gm.ref}} {
+			if len(attr.value) > 0 {
+				tree, kind = attr.value, attr.kind
+				break
+			}
+		}
+		if len(tree) == 0 && gm.link {
+			tree, kind = manifest.Branch, "branch"
+			lines = append(lines, "  :link => true -> the branch "+manifest.Branch+" of the control repository")
+		} else if len(tree) == 0 {
+			tree, kind = detectDefaultBranch(cacheEntry), "branch"
+			lines = append(lines, "  no reference -> the default branch "+tree+" of "+gm.git)
+		}
+		lines = append(lines, "  "+kind+" "+tree+" -> commit "+mm.Resolved)
+		if len(gm.fallback) > 0 {
+			lines = append(lines, "  :fallback => "+strings.Join(gm.fallback, "|")+" -> tried in this order if "+tree+" does not exist")
+		}
+		if isDir(cacheEntry) && kind != "commit" {
+			revParseCmd := "git --git-dir " + cacheEntry + " rev-parse --verify '" + tree
+			if !config.GitObjectSyntaxNotSupported {
+				revParseCmd = revParseCmd + "^{commit}'"
+			} else {
+				revParseCmd = revParseCmd + "'"
+			}
+			er := executeCommand(revParseCmd, config.Timeout, true)
+			current := strings.TrimSpace(er.stdout)
+			if er.returnCode == 0 && current != mm.Resolved {
+				lines = append(lines, "  "+kind+" "+tree+" now points to "+current+" in the cache, the next deploy will update the module")
+			}
+		}
+		if len(gm.installPath) > 0 {
+			overrides = append(overrides, ":install_path => "+gm.installPath+" of the Puppetfile")
+		}
+		if gm.ignoreUnreachable {
+			overrides = append(overrides, ":ignore_unreachable => true of the Puppetfile")
+		}
+	}
+
+	if len(moduleDirParam) > 0 {
+		overrides = append(overrides, "-moduledir "+moduleDirParam)
+	}
+	if eo := readEnvironmentOverrides(envDir, env); len(eo.ModuleDir) > 0 {
+		overrides = append(overrides, "moduledir "+eo.ModuleDir+" of "+filepath.Join(envDir, ".g10k.yaml"))
+	}
+	if len(overrides) > 0 {
+		lines = append(lines, "", "Overrides:")
+		for _, o := range overrides {
+			lines = append(lines, "  "+o)
+		}
+	}
+
+	if len(cacheEntry) > 0 {
+		state := "missing, it got purged since the deploy"
+		if isDir(cacheEntry) {
+			state = "present"
+		}
+		lines = append(lines, "", "Cache entry: "+cacheEntry+" ("+state+")")
+	}
+	return lines, nil
+}
+
+// explainModuleMatches returns true if the given module of a deploy manifest is the requested module, which can be given with or without its author
+func explainModuleMatches(manifestName string, module string) bool {
+	if manifestName == module || strings.HasSuffix(manifestName, "/"+module) {
+		return true
+	}
+	// Forge modules can also be given as author-name
+	return manifestName == strings.Replace(module, "-", "/", 1)
+}
+
+// puppetfileStatement returns the line number and the lines of the mod statement of the given module inside of the Puppetfile
+func puppetfileStatement(pf string, module string) (int, []string) {
+	content, err := ioutil.ReadFile(pf)
+	if err != nil {
+		return 0, nil
+	}
+	name := regexp.QuoteMeta(module)
+	if i := strings.Index(module, "/"); i > 0 {
+		name = regexp.QuoteMeta(module[:i]) + "[/-]" + regexp.QuoteMeta(module[i+1:])
+	}
+	reMod := regexp.MustCompile(`^\s*mod\s+['"]` + name + `['"]`)
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		if !reMod.MatchString(line) {
+			continue
+		}
+		statement := []string{strings.TrimSpace(line)}
+		for _, next := range lines[i+1:] {
+			// the attributes of a module can be continued on the next lines
+			if !strings.HasPrefix(strings.TrimSpace(next), ":") {
+				break
+			}
+			statement = append(statement, "  "+strings.TrimSpace(next))
+		}
+		return i + 1, statement
+	}
+	return 0, nil
+}
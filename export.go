@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// artifactWriter adds the content of a Puppet environment to a tar.gz or zip artifact
+type artifactWriter interface {
+	addDir(name string, info os.FileInfo) error
+	addFile(name string, info os.FileInfo, path string) error
+	addSymlink(name string, info os.FileInfo, target string) error
+	Close() error
+}
+
+// finishEnvironment is called once the given Puppet environment was completely deployed to envDir
+func finishEnvironment(env string, envDir string) {
+	defer recordEnvironmentDuration(env)
+	validateEnvironmentHiera(env, envDir)
+	artifact := exportEnvironment(env, envDir)
+	if !publishEnvironment(env, envDir, artifact) || !pushEnvironment(env, envDir) {
+		// the environment has to be pushed again by a resumed run
+		return
+	}
+	checkpointEnvironment(env, filepath.Join(envDir, ".g10k-deploy.json"))
+}
+
+// exportEnvironment writes the deployed content of the given Puppet environment including its deploy manifest to an artifact in the export_dir.
+// The artifact is named after the environment and the commit of its control repository branch and gets replaced atomically, its path is returned.
+func exportEnvironment(env string, envDir string) string {
+	if len(config.ExportDir) == 0 || dryRun {
+		return ""
+	}
+	exportDir := checkDirAndCreate(config.ExportDir, "export_dir")
+	name := env
+	if dr := readDeployResultFile(filepath.Join(envDir, ".g10k-deploy.json")); len(dr.Signature) > 0 {
+		name += "-" + shortCommit(dr.Signature)
+	}
+	extension := ".tar.gz"
+	if config.ExportFormat == "zip" {
+		extension = ".zip"
+	}
+	artifact := filepath.Join(exportDir, name+extension)
+	tmpFile, err := ioutil.TempFile(exportDir, "."+name+extension+".")
+	if err != nil {
+		Fatalf("exportEnvironment(): Could not create temporary file in " + exportDir + " Error: " + err.Error())
+	}
+	defer os.Remove(tmpFile.Name())
+	var aw artifactWriter
+	if config.ExportFormat == "zip" {
+		aw = &zipArtifact{zip.NewWriter(tmpFile)}
+	} else {
+		gzipWriter := gzip.NewWriter(tmpFile)
+		aw = &tarArtifact{tar.NewWriter(gzipWriter), gzipWriter}
+	}
+	if err := addArtifactDir(aw, envDir, envDir, env); err != nil {
+		Fatalf("exportEnvironment(): Could not export environment " + env + " to " + artifact + " Error: " + err.Error())
+	}
+	if err := aw.Close(); err != nil {
+		Fatalf("exportEnvironment(): Could not write " + artifact + " Error: " + err.Error())
+	}
+	if err := tmpFile.Close(); err != nil {
+		Fatalf("exportEnvironment(): Could not write " + artifact + " Error: " + err.Error())
+	}
+	os.Chmod(tmpFile.Name(), 0644)
+	if err := os.Rename(tmpFile.Name(), artifact); err != nil {
+		Fatalf("exportEnvironment(): Could not move " + tmpFile.Name() + " to " + artifact + " Error: " + err.Error())
+	}
+	applyOwnership(artifact)
+	Infof("Exported environment " + env + " to " + artifact)
+	return artifact
+}
+
+// addArtifactDir adds the content of dir below the given name to the artifact.
+// Symlinks inside of the environment are kept, symlinks that point outside of it, e.g. into the module_store, are replaced with the content they point to.
+func addArtifactDir(aw artifactWriter, envDir string, dir string, name string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		entryName := name + "/" + entry.Name()
+		info := entry
+		if entry.Mode()&os.ModeSymlink != 0 {
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				Warnf("WARNING: Not exporting broken symlink " + path)
+				continue
+			}
+			if resolved == envDir || strings.HasPrefix(resolved, envDir+"/") {
+				target, _ := os.Readlink(path)
+				if err := aw.addSymlink(entryName, entry, target); err != nil {
+					return err
+				}
+				continue
+			}
+			if info, err = os.Stat(resolved); err != nil {
+				return err
+			}
+			path = resolved
+		}
+		if info.IsDir() {
+			if err := aw.addDir(entryName, info); err != nil {
+				return err
+			}
+			if err := addArtifactDir(aw, envDir, path, entryName); err != nil {
+				return err
+			}
+		} else if info.Mode().IsRegular() {
+			if err := aw.addFile(entryName, info, path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tarArtifact writes a tar.gz artifact
+type tarArtifact struct {
+	tw *tar.Writer
+	gw *gzip.Writer
+}
+
+func (a *tarArtifact) addDir(name string, info os.FileInfo) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: int64(info.Mode().Perm()), ModTime: info.ModTime()})
+}
+
+func (a *tarArtifact) addFile(name string, info os.FileInfo, path string) error {
+	if err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: int64(info.Mode().Perm()), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+		return err
+	}
+	return copyFileTo(a.tw, path)
+}
+
+func (a *tarArtifact) addSymlink(name string, info os.FileInfo, target string) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777, ModTime: info.ModTime()})
+}
+
+func (a *tarArtifact) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
+
+// zipArtifact writes a zip artifact
+type zipArtifact struct {
+	zw *zip.Writer
+}
+
+func (a *zipArtifact) addDir(name string, info os.FileInfo) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name + "/"
+	_, err = a.zw.CreateHeader(header)
+	return err
+}
+
+func (a *zipArtifact) addFile(name string, info os.FileInfo, path string) error {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	return copyFileTo(w, path)
+}
+
+func (a *zipArtifact) addSymlink(name string, info os.FileInfo, target string) error {
+	header := &zip.FileHeader{Name: name, Modified: info.ModTime()}
+	header.SetMode(os.ModeSymlink | 0777)
+	w, err := a.zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(target))
+	return err
+}
+
+func (a *zipArtifact) Close() error {
+	return a.zw.Close()
+}
+
+// copyFileTo copies the content of the given file to the writer
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
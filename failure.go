@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// deployFailure is the panic value of Fatalf with -keepgoing, so that the failure of a single Puppet environment or module does not abort the whole g10k run
+type deployFailure struct {
+	message  string
+	exitCode int
+}
+
+// recoverEnvironmentFailure records the failure of the given Puppet environment with -keepgoing instead of aborting the g10k run.
+// It has to be deferred by every goroutine that deploys (a part of) a Puppet environment.
+func recoverEnvironmentFailure(env string) {
+	if r := recover(); r != nil {
+		failure, ok := r.(deployFailure)
+		if !ok {
+			panic(r)
+		}
+		recordEnvironmentFailure(env, failure.message)
+	}
+}
+
+// recoverSourceFailure records the failure of the given source with -keepgoing instead of aborting the g10k run
+func recoverSourceFailure(source string) {
+	if r := recover(); r != nil {
+		failure, ok := r.(deployFailure)
+		if !ok {
+			panic(r)
+		}
+		mutex.Lock()
+		sourceFailures[source] = failure.message
+		mutex.Unlock()
+	}
+}
+
+// recoverModuleFailure records the failure of the given git repository or Forge module with -keepgoing instead of aborting the g10k run.
+// All Puppet environments that contain this module are not deployed.
+func recoverModuleFailure(module string) {
+	if r := recover(); r != nil {
+		failure, ok := r.(deployFailure)
+		if !ok {
+			panic(r)
+		}
+		mutex.Lock()
+		moduleFailures[module] = failure.message
+		mutex.Unlock()
+	}
+}
+
+// exitOnFailure aborts the g10k run if Fatalf was called with -keepgoing outside of the deploy of a Puppet environment or module.
+// It is also used by the goroutines that stream a Forge module archive through pipes, as recovering one of them would leave the others blocked.
+func exitOnFailure() {
+	if r := recover(); r != nil {
+		failure, ok := r.(deployFailure)
+		if !ok {
+			panic(r)
+		}
+		stopProfiling()
+		os.Exit(failure.exitCode)
+	}
+}
+
+// recordEnvironmentFailure remembers the first failure of the given Puppet environment
+func recordEnvironmentFailure(env string, message string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := environmentFailures[env]; !ok {
+		environmentFailures[env] = message
+	}
+}
+
+// environmentFailed returns true if the deploy of the given Puppet environment failed with -keepgoing
+func environmentFailed(env string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := environmentFailures[env]
+	return ok
+}
+
+// failedModuleOf returns the first module of the Puppetfile whose git repository or Forge module could not be resolved and its error message
+func failedModuleOf(pf Puppetfile) (string, string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for name, gm := range pf.gitModules {
+		if message, ok := moduleFailures[gm.git]; ok {
+			return name, message
+		}
+	}
+	for name, fm := range pf.forgeModules {
+		if message, ok := moduleFailures[fm.author+"/"+strings.Replace(name, "/", "-", -1)+"-"+fm.version]; ok {
+			return name, message
+		}
+	}
+	return "", ""
+}
+
+// failSource reports a source that could not be resolved, which aborts the g10k run with -failfast and fails it with -keepgoing
+func failSource(source string, message string) {
+	if failFast {
+		Fatalf(message)
+	}
+	Warnf(message)
+	mutex.Lock()
+	unresolvedSources[source] = true
+	mutex.Unlock()
+	if !keepGoing {
+		return
+	}
+	mutex.Lock()
+	sourceFailures[source] = message
+	mutex.Unlock()
+}
+
+// deployFailed returns true if any Puppet environment or source failed with -keepgoing
+func deployFailed() bool {
+	return len(environmentFailures) > 0 || len(sourceFailures) > 0
+}
+
+// withinFailureThresholds returns true if the failures of this g10k run do not exceed the max_module_failures and max_environment_failures settings, so that g10k still exits successfully.
+// Environments that were skipped because of a failed module only count as module failures, a failed source always fails the g10k run.
+func withinFailureThresholds() bool {
+	if len(sourceFailures) > 0 {
+		return false
+	}
+	failedEnvironments := 0
+	for env := range environmentFailures {
+		if _, ok := moduleFailedEnvironments[env]; !ok {
+			failedEnvironments++
+		}
+	}
+	if len(moduleFailures) > config.MaxModuleFailures || failedEnvironments > config.MaxEnvironmentFailures {
+		return false
+	}
+	Warnf("WARNING: Tolerating " + strconv.Itoa(len(moduleFailures)) + " module failure(s) and " + strconv.Itoa(failedEnvironments) + " environment failure(s), because they do not exceed max_module_failures " + strconv.Itoa(config.MaxModuleFailures) + " and max_environment_failures " + strconv.Itoa(config.MaxEnvironmentFailures))
+	return true
+}
+
+// printFailureSummary prints the status of every Puppet environment and all failed sources after a -keepgoing run
+func printFailureSummary() {
+	var envs []string
+	for env := range puppetEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	held := make(map[string]bool)
+	for _, env := range heldEnvironments {
+		held[env] = true
+	}
+	fmt.Println("Deploy summary:")
+	failed := 0
+	for _, env := range envs {
+		if message, ok := environmentFailures[env]; ok {
+			failed++
+			fmt.Println("  " + env + ": failed (" + message + ")")
+		} else if held[env] {
+			fmt.Println("  " + env + ": held")
+		} else {
+			fmt.Println("  " + env + ": ok")
+		}
+	}
+	var sources []string
+	for source := range sourceFailures {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		fmt.Println("  source " + source + ": failed (" + sourceFailures[source] + ")")
+	}
+	fmt.Println(strconv.Itoa(len(envs)-failed) + " of " + strconv.Itoa(len(envs)) + " environment(s) deployed, " + strconv.Itoa(failed) + " environment(s) and " + strconv.Itoa(len(sources)) + " source(s) failed")
+}
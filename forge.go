@@ -13,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -34,7 +35,7 @@ func checkDeprecation(fm ForgeModule, lastCheckedFile string) bool {
 		} else {
 			json, err := ioutil.ReadFile(lastCheckedFile)
 			if err != nil {
-				Fatalf("doModuleInstallOrNothing(): Error while reading Forge API result from file " + lastCheckedFile + err.Error())
+				FatalExitf(exitForgeError, "doModuleInstallOrNothing(): Error while reading Forge API result from file "+lastCheckedFile+err.Error())
 			}
 			_ = parseForgeAPIResult(string(json), fm)
 			return true
@@ -43,6 +44,14 @@ func checkDeprecation(fm ForgeModule, lastCheckedFile string) bool {
 	return false
 }
 
+// isUniqueForgeModule returns true if the given Forge module version gets resolved during this g10k run
+func isUniqueForgeModule(name string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := uniqueForgeModules[name]
+	return ok
+}
+
 func doModuleInstallOrNothing(fm ForgeModule) {
 	moduleName := fm.author + "-" + fm.name
 	moduleVersion := fm.version
@@ -58,17 +67,17 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 			// check forge API what the latest version is
 			fr = queryForgeAPI(fm)
 			if fr.needToGet {
-				if _, ok := uniqueForgeModules[moduleName+"-"+fr.versionNumber]; ok {
+				if isUniqueForgeModule(moduleName + "-" + fr.versionNumber) {
 					Debugf("no need to fetch Forge module " + moduleName + " in latest, because latest is " + fr.versionNumber + " and that will already be fetched")
 					fr.needToGet = false
 					versionDir := filepath.Join(config.ForgeCacheDir, moduleName+"-"+fr.versionNumber)
 					absolutePath, err := filepath.Abs(versionDir)
 					Debugf("trying to create symlink " + workDir + " pointing to " + absolutePath)
 					if err != nil {
-						Fatalf("doModuleInstallOrNothing(): Error while resolving absolute file path for " + versionDir + " Error: " + err.Error())
+						FatalExitf(exitForgeError, "doModuleInstallOrNothing(): Error while resolving absolute file path for "+versionDir+" Error: "+err.Error())
 					}
 					if err := os.Symlink(absolutePath, workDir); err != nil {
-						Fatalf("doModuleInstallOrNothing(): 1 Error while creating symlink " + workDir + " pointing to " + absolutePath + " Error: " + err.Error())
+						FatalExitf(exitForgeError, "doModuleInstallOrNothing(): 1 Error while creating symlink "+workDir+" pointing to "+absolutePath+" Error: "+err.Error())
 					}
 					//} else {
 					//Debugf("need to fetch Forge module " + moduleName + " in latest, because version " + fr.versionNumber + " will not be fetched already")
@@ -109,7 +118,7 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 		// ensure that a latest version this module exists
 		latestDir := filepath.Join(config.ForgeCacheDir, moduleName+"-latest")
 		if !isDir(latestDir) {
-			if _, ok := uniqueForgeModules[moduleName+"-latest"]; ok {
+			if isUniqueForgeModule(moduleName + "-latest") {
 				Debugf("we got " + fm.author + "-" + fm.name + "-" + fm.version + ", but no " + latestDir + " to use, but -latest is already being fetched.")
 				return
 			}
@@ -151,20 +160,23 @@ func doModuleInstallOrNothing(fm ForgeModule) {
 				versionDir = filepath.Join(config.ForgeCacheDir, moduleName+"-"+fr.versionNumber)
 				absolutePath, err := filepath.Abs(versionDir)
 				if err != nil {
-					Fatalf("doModuleInstallOrNothing(): Error while resolving absolute file path for " + versionDir + " Error: " + err.Error())
+					FatalExitf(exitForgeError, "doModuleInstallOrNothing(): Error while resolving absolute file path for "+versionDir+" Error: "+err.Error())
 				}
 				Debugf("trying to create symlink " + workDir + " pointing to " + absolutePath)
 				if err := os.Symlink(absolutePath, workDir); err != nil {
-					Fatalf("doModuleInstallOrNothing(): 2 Error while creating symlink " + workDir + " pointing to " + absolutePath + err.Error())
+					FatalExitf(exitForgeError, "doModuleInstallOrNothing(): 2 Error while creating symlink "+workDir+" pointing to "+absolutePath+err.Error())
 				}
 			}
 		}
+		before := time.Now()
 		downloadForgeModule(moduleName, fr.versionNumber, fm, 1)
+		trackModuleTime("forge", moduleName, "download", before)
 	}
 
 }
 
 func queryForgeAPI(fm ForgeModule) ForgeResult {
+	defer trackModuleTime("forge", fm.author+"-"+fm.name, "query", time.Now())
 	baseURL := config.ForgeBaseURL
 	if len(fm.baseURL) > 0 {
 		baseURL = fm.baseURL
@@ -172,16 +184,12 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 	url := baseURL + "/v3/modules/" + fm.author + "-" + fm.name + "?exclude_fields=changelog+readme+license+releases"
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		Fatalf("queryForgeAPI(): Error creating GET request for Puppetlabs forge API" + err.Error())
+		FatalExitf(exitForgeError, "queryForgeAPI(): Error creating GET request for Puppetlabs forge API"+err.Error())
 	}
 	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 	req.Header.Set("Connection", "keep-alive")
 
-	proxyURL, err := http.ProxyFromEnvironment(req)
-	if err != nil {
-		Fatalf("queryForgeAPI(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
-	}
-	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	client := forgeHTTPClient(url)
 	before := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
@@ -190,7 +198,7 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 			_ = getLatestCachedModule(fm)
 			return ForgeResult{false, "", "", 0}
 		}
-		Fatalf("queryForgeAPI(): Error while issuing the HTTP request to " + url + " Error: " + err.Error())
+		FatalExitf(exitForgeError, "queryForgeAPI(): Error while issuing the HTTP request to "+url+" Error: "+err.Error())
 	}
 	duration := time.Since(before).Seconds()
 	Verbosef("Querying Forge API " + url + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
@@ -204,7 +212,7 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		// need to get latest version
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			Fatalf("queryForgeAPI(): Error while reading response body for Forge module " + fm.name + " from " + url + ": " + err.Error())
+			FatalExitf(exitForgeError, "queryForgeAPI(): Error while reading response body for Forge module "+fm.name+" from "+url+": "+err.Error())
 		}
 
 		json := string(body)
@@ -222,10 +230,10 @@ func queryForgeAPI(fm ForgeModule) ForgeResult {
 		Debugf("Got 304 nothing to do for module " + fm.author + "-" + fm.name)
 		return ForgeResult{false, "", "", 0}
 	} else if strings.TrimSpace(resp.Status) == "404 Not Found" {
-		Fatalf("Received 404 from Forge for module " + fm.author + "-" + fm.name + " using URL " + url + " Does the module really exist and is it correctly named?")
+		FatalExitf(exitForgeError, "Received 404 from Forge for module "+fm.author+"-"+fm.name+" using URL "+url+" Does the module really exist and is it correctly named?")
 		return ForgeResult{false, "", "", 0}
 	}
-	Fatalf("Unexpected response code " + resp.Status)
+	FatalExitf(exitForgeError, "Unexpected response code "+resp.Status)
 	return ForgeResult{false, "", "", 0}
 }
 
@@ -253,7 +261,7 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 		}
 		// check the verbosity level
 		// otherwise these warnings mess up the progress bars
-		if info || debug {
+		if logLevelEnabled(logLevelInfo) {
 			Warnf("WARN: Forge module " + fm.author + "-" + fm.name + " has been deprecated by its author since " + deprecatedTimestamp.String() + supersededText)
 		} else {
 			mutex.Lock()
@@ -263,7 +271,7 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 	}
 
 	if len(version) < 1 {
-		Fatalf("ERROR: could not determine version of module " + fm.author + "/" + fm.name)
+		FatalExitf(exitForgeError, "ERROR: could not determine version of module "+fm.author+"/"+fm.name)
 	}
 
 	Debugf("found version " + version + " for " + fm.name + "-latest")
@@ -276,6 +284,7 @@ func parseForgeAPIResult(json string, fm ForgeModule) ForgeResult {
 
 // getMetadataForgeModule queries the configured Puppet Forge and return
 func getMetadataForgeModule(fm ForgeModule) ForgeModule {
+	defer trackModuleTime("forge", fm.author+"-"+fm.name, "query", time.Now())
 	baseURL := config.ForgeBaseURL
 	if len(fm.baseURL) > 0 {
 		baseURL = fm.baseURL
@@ -283,15 +292,11 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 	url := baseURL + "/v3/releases/" + fm.author + "-" + fm.name + "-" + fm.version
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
+		FatalExitf(exitForgeError, "getMetadataForgeModule(): Error while creating GET http request with url "+url+" Error: "+err.Error())
 	}
 	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 	req.Header.Set("Connection", "keep-alive")
-	proxyURL, err := http.ProxyFromEnvironment(req)
-	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
-	}
-	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	client := forgeHTTPClient(url)
 	before := time.Now()
 	Debugf("GETing " + url)
 	resp, err := client.Do(req)
@@ -301,7 +306,7 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 	syncForgeTime += duration
 	mutex.Unlock()
 	if err != nil {
-		Fatalf("getMetadataForgeModule(): Error while querying metadata for Forge module " + fm.name + " from " + url + ": " + err.Error())
+		FatalExitf(exitForgeError, "getMetadataForgeModule(): Error while querying metadata for Forge module "+fm.name+" from "+url+": "+err.Error())
 	}
 	defer resp.Body.Close()
 
@@ -309,7 +314,7 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 		body, err := ioutil.ReadAll(resp.Body)
 
 		if err != nil {
-			Fatalf("getMetadataForgeModule(): Error while reading response body for Forge module " + fm.name + " from " + url + ": " + err.Error())
+			FatalExitf(exitForgeError, "getMetadataForgeModule(): Error while reading response body for Forge module "+fm.name+" from "+url+": "+err.Error())
 		}
 
 		before := time.Now()
@@ -325,12 +330,13 @@ func getMetadataForgeModule(fm ForgeModule) ForgeModule {
 
 		return ForgeModule{md5sum: modulemd5sum, fileSize: moduleFilesize}
 	}
-	Fatalf("getMetadataForgeModule(): Unexpected response code while GETing " + url + " " + resp.Status)
+	FatalExitf(exitForgeError, "getMetadataForgeModule(): Unexpected response code while GETing "+url+" "+resp.Status)
 	return ForgeModule{}
 }
 
 func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, fileName string) {
 	defer wgForgeModule.Done()
+	defer exitOnFailure()
 	funcName := funcName()
 
 	before := time.Now()
@@ -339,7 +345,7 @@ func extractForgeModule(wgForgeModule *sync.WaitGroup, file *io.PipeReader, file
 	unTar(fileReader, config.ForgeCacheDir)
 
 	if err != nil {
-		Fatalf(funcName + "(): pgzip reader error for module " + fileName + " error:" + err.Error())
+		FatalExitf(exitForgeError, funcName+"(): pgzip reader error for module "+fileName+" error:"+err.Error())
 	}
 	defer fileReader.Close()
 
@@ -361,6 +367,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 	fileName := name + "-" + version + ".tar.gz"
 
 	if !isDir(filepath.Join(config.ForgeCacheDir, name+"-"+version)) {
+		atomic.AddInt64(&cacheStats.forgeMisses, 1)
 		baseURL := config.ForgeBaseURL
 		if len(fm.baseURL) > 0 {
 			baseURL = fm.baseURL
@@ -368,15 +375,11 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 		url := baseURL + "/v3/files/" + fileName
 		req, err := http.NewRequest("GET", url, nil)
 		if err != nil {
-			Fatalf("getMetadataForgeModule(): Error while creating GET http request with url " + url + " Error: " + err.Error())
+			FatalExitf(exitForgeError, "getMetadataForgeModule(): Error while creating GET http request with url "+url+" Error: "+err.Error())
 		}
 		req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
 		req.Header.Set("Connection", "close")
-		proxyURL, err := http.ProxyFromEnvironment(req)
-		if err != nil {
-			Fatalf(funcName + "(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
-		}
-		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		client := forgeHTTPClient(url)
 		before := time.Now()
 		Debugf("GETing " + url)
 		resp, err := client.Do(req)
@@ -386,7 +389,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 		syncForgeTime += duration
 		mutex.Unlock()
 		if err != nil {
-			Fatalf(funcName + "(): Error while GETing Forge module " + name + " from " + url + ": " + err.Error())
+			FatalExitf(exitForgeError, funcName+"(): Error while GETing Forge module "+name+" from "+url+": "+err.Error())
 		}
 		defer resp.Body.Close()
 
@@ -394,11 +397,12 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			wgForgeModule.Add(1)
 			go func() {
 				defer wgForgeModule.Done()
+				defer exitOnFailure()
 				targetFileName := filepath.Join(config.ForgeCacheDir, fileName)
 				Debugf(funcName + "(): Trying to create " + targetFileName)
 				out, err := os.Create(targetFileName)
 				if err != nil {
-					Fatalf(funcName + "(): Error while creating file for Forge module " + targetFileName + " Error: " + err.Error())
+					FatalExitf(exitForgeError, funcName+"(): Error while creating file for Forge module "+targetFileName+" Error: "+err.Error())
 				}
 				defer out.Close()
 				io.Copy(out, saveFileR)
@@ -409,6 +413,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 			wgForgeModule.Add(1)
 			go func() {
 				defer wgForgeModule.Done()
+				defer exitOnFailure()
 
 				// after completing the copy, we need to close
 				// the PipeWriters to propagate the EOF to all
@@ -420,18 +425,19 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 				mw := io.MultiWriter(extractW, saveFileW)
 
 				// copy the data into the multiwriter
-				if _, err := io.Copy(mw, resp.Body); err != nil {
-					Fatalf("Error while writing to MultiWriter " + err.Error())
+				if _, err := io.Copy(mw, progressReader{resp.Body, &deployProgress.forgeBytes}); err != nil {
+					FatalExitf(exitForgeError, "Error while writing to MultiWriter "+err.Error())
 				}
 			}()
 		} else if strings.TrimSpace(resp.Status) == "404 Not Found" {
-			Fatalf("Received 404 from Forge using URL " + url +
-				"\nCheck if the module name '" + fm.author + "-" + fm.name + "' and version '" + version + "' really exist" +
-				"\nUsed in Puppet environment '" + fm.sourceBranch + "'")
+			FatalExitf(exitForgeError, "Received 404 from Forge using URL "+url+
+				"\nCheck if the module name '"+fm.author+"-"+fm.name+"' and version '"+version+"' really exist"+
+				"\nUsed in Puppet environment '"+fm.sourceBranch+"'")
 		} else {
-			Fatalf("Unexpected response code while GETing " + url + " " + resp.Status)
+			FatalExitf(exitForgeError, "Unexpected response code while GETing "+url+" "+resp.Status)
 		}
 	} else {
+		atomic.AddInt64(&cacheStats.forgeHits, 1)
 		Debugf("Using cache for Forge module " + name + " version: " + version)
 	}
 	wgForgeModule.Wait()
@@ -440,7 +446,7 @@ func downloadForgeModule(name string, version string, fm ForgeModule, retryCount
 		fm.version = version
 		if doForgeModuleIntegrityCheck(fm) {
 			if retryCount == 0 {
-				Fatalf("downloadForgeModule(): giving up for Puppet module " + name + " version: " + version)
+				FatalExitf(exitForgeError, "downloadForgeModule(): giving up for Puppet module "+name+" version: "+version)
 			}
 			Warnf("Retrying...")
 			purgeDir(filepath.Join(config.ForgeCacheDir, fileName), "downloadForgeModule()")
@@ -483,9 +489,10 @@ func resolveForgeModules(modules map[string]ForgeModule) {
 		Debugf("empty ForgeModule[] found, skipping...")
 		return
 	}
+	atomic.AddInt64(&deployProgress.forgeTotal, int64(len(modules)))
 	bar := uiprogress.AddBar(len(modules)).AppendCompleted().PrependElapsed()
 	bar.PrependFunc(func(b *uiprogress.Bar) string {
-		return fmt.Sprintf("Resolving Forge modules (%d/%d)", b.Current(), len(modules))
+		return fmt.Sprintf("Resolving Forge modules (%d/%d, %s downloaded)", b.Current(), len(modules), formatBytes(atomic.LoadInt64(&deployProgress.forgeBytes)))
 	})
 	// Dummy channel to coordinate the number of concurrent goroutines.
 	// This channel should be buffered otherwise we will be immediately blocked
@@ -525,10 +532,19 @@ func resolveForgeModules(modules map[string]ForgeModule) {
 			// Otherwise, it will block the execution until an execution
 			// spot is available.
 			<-concurrentGoroutines
+			defer atomic.AddInt64(&deployProgress.forgeDone, 1)
 			defer bar.Incr()
 			defer wg.Done()
 			Debugf("resolveForgeModules(): Trying to get forge module " + m + " with Forge base url " + fm.baseURL + " and CacheTtl set to " + fm.cacheTTL.String())
-			doModuleInstallOrNothing(fm)
+			resolveOnce("forge:"+m, func() {
+				defer recoverModuleFailure(m)
+				if moduleCancelled(m) {
+					return
+				}
+				// all versions of a Forge module share the -latest link and last checked file
+				defer lockCacheEntry(config.CacheDir, filepath.Join(config.ForgeCacheDir, fm.author+"-"+fm.name))()
+				doModuleInstallOrNothing(fm)
+			})
 			done <- true
 		}(m, fm, bar)
 	}
@@ -541,7 +557,10 @@ func check4ForgeUpdate(moduleName string, currentVersion string, latestVersion s
 	Verbosef("found currently deployed Forge module " + moduleName + " in version: " + currentVersion)
 	Verbosef("found latest Forge module of " + moduleName + " in version: " + latestVersion)
 	if currentVersion != latestVersion {
-		color.Yellow("ATTENTION: Forge module: " + moduleName + " latest: " + latestVersion + " currently deployed: " + currentVersion)
+		printColored(os.Stdout, color.FgYellow, "ATTENTION: Forge module: "+moduleName+" latest: "+latestVersion+" currently deployed: "+currentVersion)
+		mutex.Lock()
+		outdatedModules = append(outdatedModules, OutdatedModule{Module: moduleName, Deployed: currentVersion, Latest: latestVersion})
+		mutex.Unlock()
 		needSyncForgeCount++
 	}
 }
@@ -552,8 +571,11 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 
 	wgCheckSum.Add(1)
 	fmm := ForgeModule{}
+	// the failure of the metadata request with -keepgoing gets passed on to the caller, which records the failure of the module
+	var metadataFailure interface{}
 	go func(m ForgeModule) {
 		defer wgCheckSum.Done()
+		defer func() { metadataFailure = recover() }()
 		fmm = getMetadataForgeModule(m)
 		Debugf(funcName + "(): target md5 hash sum: " + fmm.md5sum)
 		if m.sha256sum != "" {
@@ -574,10 +596,11 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 	wgCheckSum.Add(1)
 	go func(md5R *io.PipeReader) {
 		defer wgCheckSum.Done()
+		defer exitOnFailure()
 		before := time.Now()
 		hashmd5 := md5.New()
 		if _, err := io.Copy(hashmd5, md5R); err != nil {
-			Fatalf(funcName + "(): Error while reading Forge module archive " + fileName + " ! Error: " + err.Error())
+			FatalExitf(exitForgeError, funcName+"(): Error while reading Forge module archive "+fileName+" ! Error: "+err.Error())
 		}
 		duration := time.Since(before).Seconds()
 		Verbosef("Calculating md5 sum for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
@@ -590,10 +613,11 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 		wgCheckSum.Add(1)
 		go func(sha256R *io.PipeReader) {
 			defer wgCheckSum.Done()
+			defer exitOnFailure()
 			before := time.Now()
 			hashSha256 := sha256.New()
 			if _, err := io.Copy(hashSha256, sha256R); err != nil {
-				Fatalf(funcName + "(): Error while reading Forge module archive " + fileName + " ! Error: " + err.Error())
+				FatalExitf(exitForgeError, funcName+"(): Error while reading Forge module archive "+fileName+" ! Error: "+err.Error())
 			}
 			duration := time.Since(before).Seconds()
 			Verbosef("Calculating sha256 sum for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
@@ -605,6 +629,7 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 	wgCheckSum.Add(1)
 	go func() {
 		defer wgCheckSum.Done()
+		defer exitOnFailure()
 
 		// after completing the copy, we need to close
 		// the PipeWriters to propagate the EOF to all
@@ -627,17 +652,17 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 			calculatedArchiveSize = fi.Size()
 			file, err := os.Open(fileName)
 			if err != nil {
-				Fatalf("Can't access Forge module archive " + fileName + " ! Error: " + err.Error())
+				FatalExitf(exitForgeError, "Can't access Forge module archive "+fileName+" ! Error: "+err.Error())
 			}
 			defer file.Close()
 
 			// copy the data into the multiwriter
 			if _, err := io.Copy(mw, file); err != nil {
-				Fatalf("Error while writing to MultiWriter " + err.Error())
+				FatalExitf(exitForgeError, "Error while writing to MultiWriter "+err.Error())
 			}
 
 		} else {
-			Fatalf("Can't access Forge module archive " + fileName + " ! Error: " + err.Error())
+			FatalExitf(exitForgeError, "Can't access Forge module archive "+fileName+" ! Error: "+err.Error())
 		}
 		duration := time.Since(before).Seconds()
 		Verbosef("Calculating hash sum(s) for " + fileName + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
@@ -645,6 +670,9 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 	}()
 
 	wgCheckSum.Wait()
+	if metadataFailure != nil {
+		panic(metadataFailure)
+	}
 
 	if fmm.md5sum != calculatedMd5Sum {
 		Warnf("WARNING: calculated md5sum " + calculatedMd5Sum + " for " + fileName + " does not match expected md5sum " + fmm.md5sum)
@@ -669,6 +697,7 @@ func doForgeModuleIntegrityCheck(m ForgeModule) bool {
 
 func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspondingPuppetEnvironment string) {
 	funcName := funcName()
+	defer trackModuleTime("forge", m.author+"-"+m.name, "extract", time.Now())
 	mutex.Lock()
 	syncForgeCount++
 	mutex.Unlock()
@@ -691,9 +720,12 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		m.version = "latest"
 
 	}
+	incremental := false
+	previousVersion := ""
 	if isDir(targetDir) {
 		if fileExists(metadataFile) {
 			me := readModuleMetadata(metadataFile)
+			previousVersion = me.version
 			if m.version == "latest" {
 				//fmt.Println(latestForgeModules)
 				//fmt.Println("checking latestForgeModules for key", moduleName)
@@ -709,37 +741,61 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 				check4ForgeUpdate(m.name, me.version, latestForgeModules.m[moduleName])
 				latestForgeModules.RUnlock()
 			}
-			if me.version == m.version {
+			if me.version == m.version && config.ModuleStore && !usemove && !isSymlink(targetDir) {
+				Debugf("Need to sync, because existing Forge module: " + targetDir + " is not linked to the module store yet")
+			} else if me.version == m.version {
 				Debugf("Nothing to do, existing Forge module: " + targetDir + " has the same version " + me.version + " as the to be synced version: " + m.version)
 				return
 			}
 			Infof("Need to sync, because existing Forge module: " + targetDir + " has version " + me.version + " and the to be synced version is: " + m.version)
-			createOrPurgeDir(targetDir, "targetDir for module "+me.name)
+			// only replace the files that changed between both versions instead of purging the module
+			incremental = true
 		} else {
 			Debugf("Need to purge " + targetDir + ", because it exists without a metadata.json. This shouldn't happen!")
 			createOrPurgeDir(targetDir, "targetDir for module "+m.name+" with missing metadata.json")
 		}
 	}
+	if dryRun {
+		mutex.Lock()
+		needSyncForgeCount++
+		mutex.Unlock()
+		_, module := environmentOfPath(targetDir)
+		if len(previousVersion) > 0 {
+			recordDryRunChange(correspondingPuppetEnvironment, "update module "+module+" (forge "+previousVersion+" → "+m.version+")")
+		} else {
+			recordDryRunChange(correspondingPuppetEnvironment, "add module "+module+" (forge "+m.version+")")
+		}
+		return
+	}
 	workDir := normalizeDir(filepath.Join(config.ForgeCacheDir, moduleName+"-"+m.version))
 	resolvedWorkDir, err := filepath.EvalSymlinks(workDir)
 	if err != nil {
-		Fatalf(funcName + "(): Failed to resolve possible symlink " + workDir + " Error: " + err.Error())
+		FatalExitf(exitForgeError, funcName+"(): Failed to resolve possible symlink "+workDir+" Error: "+err.Error())
 	}
 	if !isDir(resolvedWorkDir) {
 		if config.UseCacheFallback {
 			Warnf("Failed to use " + resolvedWorkDir + " Trying to use latest cached version of module " + moduleName)
 			resolvedWorkDir = getLatestCachedModule(m)
 		} else {
-			Fatalf(funcName + "(): Forge module not found in dir: " + resolvedWorkDir)
+			FatalExitf(exitForgeError, funcName+"(): Forge module not found in dir: "+resolvedWorkDir)
 		}
 	}
 
 	if !isDir(resolvedWorkDir) {
-		Fatalf(funcName + "(): Forge module not found in dir: " + resolvedWorkDir)
+		FatalExitf(exitForgeError, funcName+"(): Forge module not found in dir: "+resolvedWorkDir)
 	}
 
 	Infof("Need to sync " + targetDir)
-	if !dryRun {
+	if !dryRun && config.ModuleStore && !usemove {
+		mutex.Lock()
+		needSyncDirs = append(needSyncDirs, targetDir)
+		if _, ok := needSyncEnvs[correspondingPuppetEnvironment]; !ok {
+			needSyncEnvs[correspondingPuppetEnvironment] = struct{}{}
+		}
+		needSyncForgeCount++
+		mutex.Unlock()
+		linkModuleToStore(storeForgeModule(resolvedWorkDir), targetDir)
+	} else if !dryRun {
 		targetDir = checkDirAndCreate(targetDir, "as targetDir for module "+name)
 		var targetDirDevice, workDirDevice uint64
 		if fileInfo, err := os.Stat(targetDir); err == nil {
@@ -747,18 +803,18 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 				targetDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
 			}
 		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + targetDir)
+			FatalExitf(exitForgeError, funcName+"(): Error while os.Stat file "+targetDir)
 		}
 		if fileInfo, err := os.Stat(resolvedWorkDir); err == nil {
 			if fileInfo.Sys() != nil {
 				workDirDevice = uint64(fileInfo.Sys().(*syscall.Stat_t).Dev)
 			}
 		} else {
-			Fatalf(funcName + "(): Error while os.Stat file " + resolvedWorkDir)
+			FatalExitf(exitForgeError, funcName+"(): Error while os.Stat file "+resolvedWorkDir)
 		}
 
-		if targetDirDevice != workDirDevice && !usemove {
-			Fatalf("Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting. ForgeCachedir: " + config.ForgeCacheDir + " target dir: " + targetDir)
+		if targetDirDevice != workDirDevice && !usemove && !config.Reflink {
+			FatalExitf(exitForgeError, "Error: Can't hardlink Forge module files over different devices. Please consider changing the cachedir setting. ForgeCachedir: "+config.ForgeCacheDir+" target dir: "+targetDir)
 		}
 
 		mutex.Lock()
@@ -768,22 +824,38 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 		}
 		needSyncForgeCount++
 		mutex.Unlock()
+		synced := make(map[string]struct{})
 		destination := func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				Fatalf(funcName + "(): Error while calling generic func() Error " + err.Error())
+				FatalExitf(exitForgeError, funcName+"(): Error while calling generic func() Error "+err.Error())
 			}
 			target, err := filepath.Rel(resolvedWorkDir, path)
 			if err != nil {
-				Fatalf(funcName + "(): Can't make " + path + " relative to " + resolvedWorkDir + " Error: " + err.Error())
+				FatalExitf(exitForgeError, funcName+"(): Can't make "+path+" relative to "+resolvedWorkDir+" Error: "+err.Error())
 			}
 
-			if info.IsDir() {
+			synced[target] = struct{}{}
+			if incremental && info.IsDir() {
+				if err = ensureDir(filepath.Join(targetDir, target)); err != nil {
+					FatalExitf(exitForgeError, funcName+"(): error while creating directory "+targetDir+"/"+target+" Error: "+err.Error())
+				}
+				applyOwnership(filepath.Join(targetDir, target))
+			} else if incremental && !usemove {
+				changed, err := linkFileIfChanged(path, filepath.Join(targetDir, target))
+				if err != nil {
+					FatalExitf(exitForgeError, funcName+"(): Failed to hardlink "+path+" to "+targetDir+"/"+target+" Error: "+err.Error())
+				}
+				if changed {
+					applyOwnership(filepath.Join(targetDir, target))
+				}
+			} else if info.IsDir() {
 				if target != "." { // skip the root dir
 					//Debugf(funcName + "() Trying to mkdir " + filepath.Join(targetDir, target))
 					err = os.Mkdir(filepath.Join(targetDir, target), os.FileMode(0755))
 					if err != nil {
-						Fatalf(funcName + "(): error while Mkdir() " + targetDir + "/" + target + " Error: " + err.Error())
+						FatalExitf(exitForgeError, funcName+"(): error while Mkdir() "+targetDir+"/"+target+" Error: "+err.Error())
 					}
+					applyOwnership(filepath.Join(targetDir, target))
 				}
 			} else {
 				if usemove {
@@ -791,24 +863,32 @@ func syncForgeToModuleDir(name string, m ForgeModule, moduleDir string, correspo
 					// deleteSourceFileToggle is set to false as we delete the source file later in the main() anyway after the sync completes
 					err = moveFile(path, filepath.Join(targetDir, target), false)
 					if err != nil {
-						Fatalf(funcName + "(): Failed to helper.moveFile " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
+						FatalExitf(exitForgeError, funcName+"(): Failed to helper.moveFile "+path+" to "+targetDir+"/"+target+" Error: "+err.Error())
+					}
+				} else if config.Reflink {
+					err = copyFile(path, filepath.Join(targetDir, target), info.Mode())
+					if err != nil {
+						FatalExitf(exitForgeError, funcName+"(): Failed to copy "+path+" to "+targetDir+"/"+target+" Error: "+err.Error())
 					}
 				} else {
 					//Debugf(funcName + "() Trying to hardlink " + path + " to " + filepath.Join(targetDir, target))
 					err = os.Link(path, filepath.Join(targetDir, target))
 					if err != nil {
-						Fatalf(funcName + "(): Failed to hardlink " + path + " to " + targetDir + "/" + target + " Error: " + err.Error())
+						FatalExitf(exitForgeError, funcName+"(): Failed to hardlink "+path+" to "+targetDir+"/"+target+" Error: "+err.Error())
 					}
 				}
+				applyOwnership(filepath.Join(targetDir, target))
 			}
 			return nil
 		}
 
-		c := make(chan error)
 		Debugf(funcName + "() filepath.Walk'ing directory " + resolvedWorkDir)
 		before := time.Now()
-		go func() { c <- filepath.Walk(resolvedWorkDir, destination) }()
-		<-c // Walk done
+		// walk in the goroutine of the caller, which records the failure of the Puppet environment with -keepgoing
+		filepath.Walk(resolvedWorkDir, destination)
+		if incremental {
+			removeStaleContent(targetDir, synced, nil)
+		}
 		duration := time.Since(before).Seconds()
 		mutex.Lock()
 		ioForgeTime += duration
@@ -828,11 +908,11 @@ func getLatestCachedModule(m ForgeModule) string {
 		Debugf("Glob'ing with path " + globPath)
 		matches, err := filepath.Glob(globPath)
 		if len(matches) == 0 {
-			Fatalf("Could not find any cached version for Forge module " + m.author + "-" + m.name)
+			FatalExitf(exitForgeError, "Could not find any cached version for Forge module "+m.author+"-"+m.name)
 		}
 		Debugf("found potential module versions:" + strings.Join(matches, " "))
 		if err != nil {
-			Fatalf("Failed to glob the latest cached module with glob path " + globPath + " Error: " + err.Error())
+			FatalExitf(exitForgeError, "Failed to glob the latest cached module with glob path "+globPath+" Error: "+err.Error())
 		}
 		//fmt.Println(matches)
 		for _, m := range matches {
@@ -847,17 +927,17 @@ func getLatestCachedModule(m ForgeModule) string {
 
 		absolutePath, err := filepath.Abs(latest)
 		if err != nil {
-			Fatalf("Error while resolving absolute file path for " + latest + " Error: " + err.Error())
+			FatalExitf(exitForgeError, "Error while resolving absolute file path for "+latest+" Error: "+err.Error())
 		}
 		Debugf("trying to create symlink " + latestDir + " pointing to " + latest)
 		if err := os.Symlink(absolutePath, latestDir); err != nil {
-			Fatalf("Error while creating symlink " + latestDir + " pointing to " + absolutePath + err.Error())
+			FatalExitf(exitForgeError, "Error while creating symlink "+latestDir+" pointing to "+absolutePath+err.Error())
 		}
 		version = strings.Split(latest, m.author+"-"+m.name+"-")[1]
 	} else {
 		versionDir, err := os.Readlink(latestDir)
 		if err != nil {
-			Fatalf("Error while reading symlink " + latestDir + " " + err.Error())
+			FatalExitf(exitForgeError, "Error while reading symlink "+latestDir+" "+err.Error())
 		}
 
 		version = strings.Split(versionDir, m.author+"-"+m.name+"-")[1]
@@ -865,7 +945,7 @@ func getLatestCachedModule(m ForgeModule) string {
 	}
 
 	if latest == "//" {
-		Fatalf("Found no usable cache for module " + m.author + "-" + m.name)
+		FatalExitf(exitForgeError, "Found no usable cache for module "+m.author+"-"+m.name)
 	}
 
 	//fmt.Println("version: ", version)
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// frozenMarkerFile is the file that freezes the Puppet environment it is placed in, its content is shown as the reason
+const frozenMarkerFile = ".g10k-frozen"
+
+// environmentFrozen returns true if the given Puppet environment matches one of the frozen_environments regexes or contains a .g10k-frozen file.
+// Frozen environments are neither updated nor purged by g10k.
+func environmentFrozen(env string, targetDir string) bool {
+	for _, frozenRegex := range config.FrozenEnvironments {
+		reFrozen, err := regexp.Compile(frozenRegex)
+		if err != nil {
+			Fatalf("Setting frozen_environments regex '" + frozenRegex + "' could not be compiled to a valid Go regex please fix!")
+		}
+		if reFrozen.MatchString(env) {
+			return true
+		}
+	}
+	return fileExists(filepath.Join(targetDir, frozenMarkerFile))
+}
+
+// holdEnvironment records that the given frozen Puppet environment was not touched, so that it is reported in the deploy summary
+func holdEnvironment(env string, targetDir string) {
+	reason := "frozen_environments setting"
+	if content, err := ioutil.ReadFile(filepath.Join(targetDir, frozenMarkerFile)); err == nil {
+		reason = frozenMarkerFile + " file"
+		if len(strings.TrimSpace(string(content))) > 0 {
+			reason += ": " + strings.TrimSpace(string(content))
+		}
+	}
+	Infof("Holding frozen environment " + env + " (" + reason + ")")
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !stringSliceContains(heldEnvironments, env) {
+		heldEnvironments = append(heldEnvironments, env)
+		sort.Strings(heldEnvironments)
+	}
+}
+
+// withFrozenEnvironments adds all frozen environments among the given environment directories to the given managed environments, so that they are not purged
+func withFrozenEnvironments(environmentDirs []string, managedEnvironments map[string]bool) {
+	for _, dir := range environmentDirs {
+		env := filepath.Base(dir)
+		// versions of frozen environments are kept by their environment
+		if reEnvironmentVersion.MatchString(env) || managedEnvironments[env] {
+			continue
+		}
+		if environmentFrozen(env, dir) {
+			holdEnvironment(env, dir)
+			managedEnvironments[env] = true
+		}
+	}
+}
+
+// purgeBasedir removes all content of the given basedir for a -force run except frozen environments
+func purgeBasedir(basedir string) {
+	entries, err := ioutil.ReadDir(basedir)
+	if err != nil {
+		createOrPurgeDir(basedir, "purgeBasedir()")
+		return
+	}
+	frozenEnvironments := make(map[string]bool)
+	for _, entry := range entries {
+		dir := filepath.Join(basedir, entry.Name())
+		if !reEnvironmentVersion.MatchString(entry.Name()) && environmentFrozen(entry.Name(), dir) {
+			frozenEnvironments[entry.Name()] = true
+		}
+	}
+	if len(frozenEnvironments) == 0 {
+		createOrPurgeDir(basedir, "purgeBasedir()")
+		return
+	}
+	for _, entry := range entries {
+		if frozenEnvironments[entry.Name()] || isEnvironmentVersion(entry.Name(), frozenEnvironments) {
+			Debugf("Not purging frozen environment " + entry.Name() + " despite -force")
+			continue
+		}
+		if !dryRun {
+			purgeDir(filepath.Join(basedir, entry.Name()), "purgeBasedir()")
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,6 +25,10 @@ var (
 	pfMode                       bool
 	pfLocation                   string
 	dryRun                       bool
+	purgeReport                  bool
+	keepGoing                    bool
+	resume                       bool
+	failFast                     bool
 	validate                     bool
 	check4update                 bool
 	checkSum                     bool
@@ -34,8 +39,16 @@ var (
 	environmentParam             string
 	tags                         bool
 	outputNameParam              string
+	canary                       bool
 	moduleParam                  string
 	configFile                   string
+	configRepoParam              string
+	configRepoBranchParam        string
+	configRepoPathParam          string
+	configRepoKeyParam           string
+	runLockParam                 string
+	viaDaemonParam               string
+	exportDirParam               string
 	config                       ConfigSettings
 	mutex                        sync.Mutex
 	empty                        struct{}
@@ -45,6 +58,23 @@ var (
 	needSyncForgeCount           int
 	needSyncDirs                 []string
 	needSyncEnvs                 map[string]struct{}
+	environmentPostrunCommands   map[string][]string
+	puppetEnvironments           map[string]PuppetEnvironment
+	reflinkUnsupported           bool
+	purgedPaths                  []string
+	heldEnvironments             []string
+	moduleEnvironments           []string
+	invalidHieraEnvironments     []string
+	dryRunChanges                map[string][]string
+	orphanedContent              map[string][]string
+	configuredPurgeLevels        []string
+	environmentFailures          map[string]string
+	sourceFailures               map[string]string
+	unresolvedSources            map[string]bool
+	purgeRefusedSources          []string
+	moduleFailures               map[string]string
+	moduleFailedEnvironments     map[string]string
+	checkpoint                   DeployCheckpoint
 	syncGitTime                  float64
 	syncForgeTime                float64
 	ioGitTime                    float64
@@ -57,6 +87,7 @@ var (
 	latestForgeModules           LatestForgeModules
 	maxworker                    int
 	maxExtractworker             int
+	environmentMaxworker         int
 	forgeModuleDeprecationNotice string
 )
 
@@ -75,26 +106,79 @@ type ConfigSettings struct {
 	EnvCacheDir                 string
 	Git                         Git
 	Sources                     map[string]Source
-	Timeout                     int            `yaml:"timeout"`
-	IgnoreUnreachableModules    bool           `yaml:"ignore_unreachable_modules"`
-	Maxworker                   int            `yaml:"maxworker"`
-	MaxExtractworker            int            `yaml:"maxextractworker"`
-	UseCacheFallback            bool           `yaml:"use_cache_fallback"`
-	RetryGitCommands            bool           `yaml:"retry_git_commands"`
-	GitObjectSyntaxNotSupported bool           `yaml:"git_object_syntax_not_supported"`
-	PostRunCommand              []string       `yaml:"postrun"`
-	Deploy                      DeploySettings `yaml:"deploy"`
-	PurgeLevels                 []string       `yaml:"purge_levels"`
-	PurgeAllowList              []string       `yaml:"purge_allowlist"`
-	DeploymentPurgeAllowList    []string       `yaml:"deployment_purge_allowlist"`
-	WriteLock                   string         `yaml:"write_lock"`
-	GenerateTypes               bool           `yaml:"generate_types"`
-	PuppetPath                  string         `yaml:"puppet_path"`
-	PurgeSkiplist               []string       `yaml:"purge_skiplist"`
-	CloneGitModules             bool           `yaml:"clone_git_modules"`
-	ForgeBaseURL                string         `yaml:"forge_base_url"`
-	ForgeCacheTTLString         string         `yaml:"forge_cache_ttl"`
+	Timeout                     int                     `yaml:"timeout"`
+	IgnoreUnreachableModules    bool                    `yaml:"ignore_unreachable_modules"`
+	Maxworker                   int                     `yaml:"maxworker"`
+	MaxExtractworker            int                     `yaml:"maxextractworker"`
+	EnvironmentMaxworker        int                     `yaml:"environment_maxworker"`
+	MaxModuleFailures           int                     `yaml:"max_module_failures"`
+	MaxEnvironmentFailures      int                     `yaml:"max_environment_failures"`
+	ShutdownTimeout             int                     `yaml:"shutdown_timeout"`
+	UseCacheFallback            bool                    `yaml:"use_cache_fallback"`
+	RetryGitCommands            bool                    `yaml:"retry_git_commands"`
+	GitObjectSyntaxNotSupported bool                    `yaml:"git_object_syntax_not_supported"`
+	PostRunCommand              []string                `yaml:"postrun"`
+	Deploy                      DeploySettings          `yaml:"deploy"`
+	PurgeLevels                 []string                `yaml:"purge_levels"`
+	PurgeAllowList              []string                `yaml:"purge_allowlist"`
+	DeploymentPurgeAllowList    []string                `yaml:"deployment_purge_allowlist"`
+	WriteLock                   string                  `yaml:"write_lock"`
+	GenerateTypes               bool                    `yaml:"generate_types"`
+	PuppetPath                  string                  `yaml:"puppet_path"`
+	GenerateTypesMaxworker      int                     `yaml:"generate_types_maxworker"`
+	Restorecon                  bool                    `yaml:"restorecon"`
+	Puppetserver                PuppetserverSettings    `yaml:"puppetserver"`
+	Notifications               []NotificationSettings  `yaml:"notifications"`
+	Mail                        MailSettings            `yaml:"mail"`
+	Metrics                     MetricsSettings         `yaml:"metrics"`
+	HistoryDB                   string                  `yaml:"history_db"`
+	TriggerRuns                 TriggerRunsSettings     `yaml:"trigger_runs"`
+	PuppetDB                    PuppetDBSettings        `yaml:"puppetdb"`
+	ValidateHiera               bool                    `yaml:"validate_hiera"`
+	ConfigVersion               string                  `yaml:"config_version"`
+	EnvironmentConf             EnvironmentConfSettings `yaml:"environment_conf"`
+	Push                        PushSettings            `yaml:"push"`
+	Publish                     PublishSettings         `yaml:"publish"`
+	KVPublish                   string                  `yaml:"kv_publish"`
+	ManifestSigning             ManifestSigningSettings `yaml:"manifest_signing"`
+	LicensePolicy               LicensePolicySettings   `yaml:"license_policy"`
+	Agent                       AgentSettings           `yaml:"agent"`
+	Serve                       ServeSettings           `yaml:"serve,omitempty"`
+	LogFile                     LogFileSettings         `yaml:"log_file"`
+	Syslog                      SyslogSettings          `yaml:"syslog"`
+	Journald                    bool                    `yaml:"journald"`
+	ProgressInterval            string                  `yaml:"progress_interval"`
+	PurgeSkiplist               []string                `yaml:"purge_skiplist"`
+	CloneGitModules             bool                    `yaml:"clone_git_modules"`
+	GitCheckoutEnvironments     bool                    `yaml:"git_checkout_environments"`
+	HardlinkGitModules          bool                    `yaml:"hardlink_git_modules"`
+	Reflink                     bool                    `yaml:"reflink"`
+	ModuleStore                 bool                    `yaml:"module_store"`
+	PreserveCommitTimestamps    bool                    `yaml:"preserve_commit_timestamps"`
+	DeployAffectedOnly          bool                    `yaml:"deploy_affected_only"`
+	ForgeBaseURL                string                  `yaml:"forge_base_url"`
+	ForgeCacheTTLString         string                  `yaml:"forge_cache_ttl"`
+	CommandOutputLimit          int                     `yaml:"command_output_limit"`
 	ForgeCacheTTL               time.Duration
+	Owner                       string `yaml:"owner"`
+	Group                       string `yaml:"group"`
+	ownerUID                    int
+	ownerGID                    int
+	purgeLevelsConfigured       bool
+	EnvironmentAllowList        []string `yaml:"environment_allowlist"`
+	EnvironmentDenyList         []string `yaml:"environment_denylist"`
+	EnvironmentPriority         []string `yaml:"environment_priority"`
+	FrozenEnvironments          []string `yaml:"frozen_environments"`
+	EnvironmentOverrides        []string `yaml:"environment_overrides"`
+	Proxy                       string   `yaml:"proxy"`
+	NoProxy                     []string `yaml:"no_proxy"`
+	StagingDir                  string   `yaml:"staging_dir"`
+	DeployStrategy              string   `yaml:"deploy_strategy"`
+	SymlinkVersions             int      `yaml:"symlink_versions"`
+	RunLock                     string   `yaml:"run_lock"`
+	ExportDir                   string   `yaml:"export_dir"`
+	ExportFormat                string   `yaml:"export_format"`
+	ExportOnly                  bool     `yaml:"export_only"`
 }
 
 // DeploySettings is a struct for settings for controlling how g10k deploys behave.
@@ -109,6 +193,313 @@ type DeploySettings struct {
 	PurgeSkiplist            []string `yaml:"purge_skiplist"`
 }
 
+// EnvironmentConfSettings controls which settings g10k manages in the environment.conf file of each Puppet environment
+type EnvironmentConfSettings struct {
+	Modulepath    bool `yaml:"modulepath"`
+	ConfigVersion bool `yaml:"config_version"`
+	Clobber       bool `yaml:"clobber"`
+}
+
+// PushSettings contains the remote hosts to which g10k syncs the deployed Puppet environments
+type PushSettings struct {
+	Hosts      []string `yaml:"hosts"`
+	Basedir    string   `yaml:"basedir"`
+	SSHCommand string   `yaml:"ssh_command"`
+	Versions   int      `yaml:"versions"`
+}
+
+// PublishSettings contains the object storage to which g10k uploads the exported artifacts of the Puppet environments
+type PublishSettings struct {
+	URL      string `yaml:"url"`
+	Versions int    `yaml:"versions"`
+}
+
+// DesiredState is the desired-state.json that g10k publishes next to the artifacts of the Puppet environments and that g10k agent converges to
+type DesiredState struct {
+	GeneratedAt  time.Time              `json:"generated_at"`
+	Environments []PublishedEnvironment `json:"environments"`
+}
+
+// PublishedEnvironment is the newest published artifact of a Puppet environment
+type PublishedEnvironment struct {
+	Environment string `json:"environment"`
+	Version     string `json:"version"`
+	URL         string `json:"url"`
+	SHA256      string `json:"sha256"`
+}
+
+// NotificationSettings contains a Slack or Microsoft Teams webhook or a generic URL that g10k POSTs the result of every g10k run to
+type NotificationSettings struct {
+	URL      string            `yaml:"webhook_url"`
+	Type     string            `yaml:"type"`
+	Events   []string          `yaml:"events"`
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+	CA       string            `yaml:"ca"`
+}
+
+// MailSettings contains the SMTP server and recipients of the mail that g10k sends about a failed g10k run
+type MailSettings struct {
+	SMTPServer    string   `yaml:"smtp_server"`
+	From          string   `yaml:"from"`
+	To            []string `yaml:"to"`
+	Username      string   `yaml:"username"`
+	Password      string   `yaml:"password"`
+	SubjectPrefix string   `yaml:"subject_prefix"`
+	Always        bool     `yaml:"always"`
+}
+
+// MetricsSettings contains the StatsD and Graphite servers that g10k sends the metrics of every g10k run to
+type MetricsSettings struct {
+	StatsD   string `yaml:"statsd"`
+	Graphite string `yaml:"graphite"`
+	Prefix   string `yaml:"prefix"`
+}
+
+// PuppetserverSettings contains the puppetserver admin APIs whose environment cache g10k flushes for every changed Puppet environment
+type PuppetserverSettings struct {
+	URLs []string `yaml:"urls"`
+	Cert string   `yaml:"cert"`
+	Key  string   `yaml:"key"`
+	CA   string   `yaml:"ca"`
+}
+
+// TriggerRunsSettings contains how g10k triggers Puppet runs of the successfully deployed Puppet environments, with the Puppet Enterprise orchestrator or a command
+type TriggerRunsSettings struct {
+	OrchestratorURL string `yaml:"orchestrator_url"`
+	TokenFile       string `yaml:"token_file"`
+	CA              string `yaml:"ca"`
+	Command         string `yaml:"command"`
+}
+
+// PuppetDBSettings contains the PuppetDB from which g10k learns which Puppet environments have active nodes, to deploy them first or only them
+type PuppetDBSettings struct {
+	URL  string `yaml:"url"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	CA   string `yaml:"ca"`
+	Mode string `yaml:"mode"`
+}
+
+// LogFileSettings contains the file that g10k writes its log messages to in addition to stdout and stderr and when it gets rotated
+type LogFileSettings struct {
+	Path           string `yaml:"path"`
+	MaxSize        int    `yaml:"max_size"`
+	RotateInterval string `yaml:"rotate_interval"`
+	MaxBackups     int    `yaml:"max_backups"`
+	MaxAge         string `yaml:"max_age"`
+}
+
+// SyslogSettings contains the syslog server to which g10k sends its log messages as RFC 5424 messages
+type SyslogSettings struct {
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"`
+	AppName  string `yaml:"app_name"`
+}
+
+// AgentSettings contains the published desired state that g10k agent converges the basedir to
+type AgentSettings struct {
+	URL      string `yaml:"url"`
+	Basedir  string `yaml:"basedir"`
+	Interval string `yaml:"interval"`
+}
+
+// ManifestSigningSettings contains the GPG or minisign key with which g10k signs the deploy manifest of every Puppet environment
+type ManifestSigningSettings struct {
+	Method    string `yaml:"method"`
+	Key       string `yaml:"key"`
+	PublicKey string `yaml:"public_key"`
+}
+
+// LicensePolicySettings contains the licenses that g10k licenses accepts and flags in the metadata.json of the deployed modules
+type LicensePolicySettings struct {
+	Allowed     []string `yaml:"allowed"`
+	Denied      []string `yaml:"denied"`
+	DenyUnknown bool     `yaml:"deny_unknown"`
+}
+
+// ServeSettings contains the address, TLS and authentication settings, the webhook secrets and the schedule of g10k serve
+type ServeSettings struct {
+	Listen              string `yaml:"listen"`
+	GitHubSecret        string `yaml:"github_secret"`
+	GitLabSecret        string `yaml:"gitlab_secret"`
+	GiteaSecret         string `yaml:"gitea_secret"`
+	BitbucketSecret     string `yaml:"bitbucket_secret"`
+	DeployToken         string `yaml:"deploy_token"`
+	Schedule            string `yaml:"schedule"`
+	ScheduleJitter      string `yaml:"schedule_jitter"`
+	ScheduleConcurrency string `yaml:"schedule_concurrency"`
+	TLSCert             string `yaml:"tls_cert"`
+	TLSKey              string `yaml:"tls_key"`
+	TLSClientCA         string `yaml:"tls_client_ca"`
+	APIUser             string `yaml:"api_user"`
+	APIPassword         string `yaml:"api_password"`
+	APIToken            string `yaml:"api_token"`
+	HALock              string `yaml:"ha_lock"`
+	HALockTTL           string `yaml:"ha_lock_ttl"`
+	Socket              string `yaml:"socket"`
+	SSHControlPersist   string `yaml:"ssh_control_persist"`
+	Tags                bool   `yaml:"tags"`
+	Pprof               bool   `yaml:"pprof"`
+	ProfileDir          string `yaml:"profile_dir"`
+}
+
+// DaemonRequest is the JSON line that g10k -via-daemon sends to the serve socket
+type DaemonRequest struct {
+	Args []string `json:"args"`
+}
+
+// DaemonMessage is a JSON line that the serve socket streams back to g10k -via-daemon, the last one contains the exit code of the g10k run
+type DaemonMessage struct {
+	Stream   string `json:"stream,omitempty"`
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// DeployRequest is the JSON body of a request to the /deploy endpoint of g10k serve
+type DeployRequest struct {
+	Environment string `json:"environment"`
+	Module      string `json:"module"`
+}
+
+// ServeStatus is the response of the /status endpoint of g10k serve
+type ServeStatus struct {
+	Running      string              `json:"running"`
+	QueueDepth   int                 `json:"queue_depth"`
+	Queued       []string            `json:"queued"`
+	Role         string              `json:"role,omitempty"`
+	Environments []EnvironmentStatus `json:"environments"`
+}
+
+// EnvironmentStatus is the status of a deployed Puppet environment in the output of g10k status and the /status endpoint of g10k serve
+type EnvironmentStatus struct {
+	Environment string    `json:"environment"`
+	Source      string    `json:"source"`
+	Branch      string    `json:"branch"`
+	Commit      string    `json:"commit"`
+	DeployedAt  time.Time `json:"deployed_at"`
+	Modules     int       `json:"modules"`
+	Success     bool      `json:"success"`
+	LastFailure string    `json:"last_failure,omitempty"`
+}
+
+// DeployJob is a deploy of g10k serve that callers can poll with /jobs/<id>
+type DeployJob struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	QueuedAt    time.Time  `json:"queued_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Log         string     `json:"log,omitempty"`
+	log         *jobLog
+}
+
+// DeployJobs is the response of g10k serve with the queued deploy jobs of a webhook and of /jobs
+type DeployJobs struct {
+	Jobs []DeployJob `json:"jobs"`
+}
+
+// GitHubPushEvent contains the fields of a GitHub or Gitea push webhook that g10k serve needs to decide which Puppet environments to deploy
+type GitHubPushEvent struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		GitURL   string `json:"git_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+}
+
+// GitLabEvent contains the fields of GitLab push, tag push and merge request webhooks that g10k serve needs to decide which Puppet environments to deploy
+type GitLabEvent struct {
+	Ref              string          `json:"ref"`
+	After            string          `json:"after"`
+	Project          GitLabProject   `json:"project"`
+	ObjectAttributes GitLabMergeInfo `json:"object_attributes"`
+}
+
+// GitLabProject contains the urls of a GitLab project
+type GitLabProject struct {
+	GitSSHURL  string `json:"git_ssh_url"`
+	GitHTTPURL string `json:"git_http_url"`
+	WebURL     string `json:"web_url"`
+}
+
+// GitLabMergeInfo contains the fields of a GitLab merge request event
+type GitLabMergeInfo struct {
+	IID          int           `json:"iid"`
+	Action       string        `json:"action"`
+	SourceBranch string        `json:"source_branch"`
+	Source       GitLabProject `json:"source"`
+}
+
+// BitbucketCloudPushEvent contains the fields of a Bitbucket Cloud repo:push webhook that g10k serve needs to decide which Puppet environments to deploy
+type BitbucketCloudPushEvent struct {
+	Push struct {
+		Changes []struct {
+			New    *BitbucketCloudRef `json:"new"`
+			Old    *BitbucketCloudRef `json:"old"`
+			Closed bool               `json:"closed"`
+		} `json:"changes"`
+	} `json:"push"`
+	Repository struct {
+		Links struct {
+			HTML struct {
+				Href string `json:"href"`
+			} `json:"html"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+// BitbucketCloudRef is a branch or tag of a Bitbucket Cloud push
+type BitbucketCloudRef struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// BitbucketServerPushEvent contains the fields of a Bitbucket Server repo:refs_changed webhook that g10k serve needs to decide which Puppet environments to deploy
+type BitbucketServerPushEvent struct {
+	Changes []struct {
+		RefID string `json:"refId"`
+		Type  string `json:"type"`
+	} `json:"changes"`
+	Repository struct {
+		Links struct {
+			Clone []struct {
+				Href string `json:"href"`
+			} `json:"clone"`
+		} `json:"links"`
+	} `json:"repository"`
+}
+
+// HieraConfig contains the settings of a version 5 hiera.yaml of a Puppet environment that g10k validates with validate_hiera
+type HieraConfig struct {
+	Version   int          `yaml:"version"`
+	Defaults  HieraLevel   `yaml:"defaults"`
+	Hierarchy []HieraLevel `yaml:"hierarchy"`
+}
+
+// HieraLevel is a level of the hierarchy or the defaults inside of a HieraConfig
+type HieraLevel struct {
+	Name        string   `yaml:"name"`
+	Datadir     string   `yaml:"datadir"`
+	DataHash    string   `yaml:"data_hash"`
+	LookupKey   string   `yaml:"lookup_key"`
+	DataDig     string   `yaml:"data_dig"`
+	Hiera3      string   `yaml:"hiera3_backend"`
+	Path        string   `yaml:"path"`
+	Paths       []string `yaml:"paths"`
+	Glob        string   `yaml:"glob"`
+	Globs       []string `yaml:"globs"`
+	URI         string   `yaml:"uri"`
+	URIs        []string `yaml:"uris"`
+	MappedPaths []string `yaml:"mapped_paths"`
+}
+
 // Forge is a simple struct that contains the base URL of
 // the Forge that g10k should use. Defaults to: https://forgeapi.puppet.com
 type Forge struct {
@@ -126,15 +517,49 @@ type Source struct {
 	Remote                      string
 	Basedir                     string
 	Prefix                      string
-	PrivateKey                  string `yaml:"private_key"`
-	ForceForgeVersions          bool   `yaml:"force_forge_versions"`
-	WarnMissingBranch           bool   `yaml:"warn_if_branch_is_missing"`
-	ErrorMissingBranch          bool   `yaml:"error_if_branch_is_missing"`
-	ExitIfUnreachable           bool   `yaml:"exit_if_unreachable"`
-	AutoCorrectEnvironmentNames string `yaml:"invalid_branches"`
-	FilterCommand               string `yaml:"filter_command"`
-	FilterRegex                 string `yaml:"filter_regex"`
-	StripComponent              string `yaml:"strip_component"`
+	PrivateKey                  string          `yaml:"private_key"`
+	ForceForgeVersions          bool            `yaml:"force_forge_versions"`
+	WarnMissingBranch           bool            `yaml:"warn_if_branch_is_missing"`
+	ErrorMissingBranch          bool            `yaml:"error_if_branch_is_missing"`
+	ExitIfUnreachable           bool            `yaml:"exit_if_unreachable"`
+	AutoCorrectEnvironmentNames string          `yaml:"invalid_branches"`
+	FilterCommand               string          `yaml:"filter_command"`
+	FilterRegex                 string          `yaml:"filter_regex"`
+	IgnoreBranches              []string        `yaml:"ignore_branches"`
+	OnlyBranches                []string        `yaml:"only_branches"`
+	StripComponent              string          `yaml:"strip_component"`
+	BranchRewrites              []BranchRewrite `yaml:"branch_rewrites"`
+	EnvironmentName             string          `yaml:"environment_name"`
+	Priority                    int             `yaml:"priority"`
+	Proxy                       string          `yaml:"proxy"`
+	StagingDir                  string          `yaml:"staging_dir"`
+	PurgeAllowList              []string        `yaml:"purge_allowlist"`
+}
+
+// PuppetEnvironment contains a branch of a source that is going to be deployed as a Puppet environment
+type PuppetEnvironment struct {
+	source    string
+	sa        Source
+	branch    string
+	name      string
+	env       string
+	targetDir string
+	gitDir    string
+	stagedDir string
+	canaryOf  string
+}
+
+// EnvironmentOverrides contains the settings of a .g10k.yaml file inside a control repository branch that override the g10k config for this Puppet environment
+type EnvironmentOverrides struct {
+	ModuleDir      string   `yaml:"moduledir"`
+	PurgeAllowList []string `yaml:"purge_allowlist"`
+	PostRunCommand []string `yaml:"postrun"`
+}
+
+// BranchRewrite is a regex replacement rule that is applied to a branch name to form the Puppet environment name
+type BranchRewrite struct {
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
 }
 
 // Puppetfile contains the key value pairs from the Puppetfile
@@ -151,6 +576,8 @@ type Puppetfile struct {
 	gitURL            string
 	moduleDirs        []string
 	controlRepoBranch string
+	purgeAllowList    []string
+	sourceProxy       string
 }
 
 // ForgeModule contains information (Version, Name, Author, md5 checksum, file size of the tar.gz archive, Forge BaseURL if custom) about a Puppetlabs Forge module
@@ -183,6 +610,9 @@ type GitModule struct {
 	local             bool
 	moduleDir         string
 	useSSHAgent       bool
+	proxy             string
+	sourceProxy       string
+	purgeAllowList    []string
 }
 
 // ForgeResult is returned by queryForgeAPI and contains if and which version of the Puppetlabs Forge module needs to be downloaded
@@ -193,10 +623,49 @@ type ForgeResult struct {
 	fileSize      int64
 }
 
-// ExecResult contains the exit code and output of an external command (e.g. git)
+// ExecResult contains the exit code and output of an external command (e.g. git), err is an *ExecError if the command failed
 type ExecResult struct {
 	returnCode int
-	output     string
+	stdout     string
+	stderr     string
+	argv       []string
+	duration   time.Duration
+	truncated  bool
+	err        error
+}
+
+// DeployManifest lists the resolved content of a deployed Puppet environment and is written to .g10k-manifest.json
+type DeployManifest struct {
+	Environment string           `json:"environment"`
+	Source      string           `json:"source"`
+	Branch      string           `json:"branch"`
+	Commit      string           `json:"commit"`
+	Modules     []ManifestModule `json:"modules"`
+}
+
+// ManifestModule contains the resolved version of a module inside of the DeployManifest
+type ManifestModule struct {
+	Name       string    `json:"name"`
+	Type       string    `json:"type"`
+	Source     string    `json:"source"`
+	Requested  string    `json:"requested"`
+	Resolved   string    `json:"resolved"`
+	Checksum   string    `json:"checksum"`
+	Path       string    `json:"path"`
+	DeployedAt time.Time `json:"deployed_at"`
+}
+
+// DeployChecksums contains the checksums of all deployed files of a Puppet environment grouped by module and is written to .g10k-checksums.json
+type DeployChecksums struct {
+	Environment string                      `json:"environment"`
+	Content     map[string]ContentChecksums `json:"content"`
+}
+
+// ContentChecksums contains the SHA256 checksums of the files of a module (or of the control repository) inside of the DeployChecksums, relative to the module directory
+type ContentChecksums struct {
+	Type     string            `json:"type"`
+	Resolved string            `json:"resolved"`
+	Files    map[string]string `json:"files"`
 }
 
 // DeployResult contains information about the Puppet environment which was deployed by g10k and tries to emulate the .r10k-deploy.json
@@ -211,14 +680,44 @@ type DeployResult struct {
 	GitURL             string    `json:"git_url"`
 }
 
+// DeployCheckpoint records the progress of a g10k run in the cachedir, so that an interrupted run can be continued with -resume
+type DeployCheckpoint struct {
+	ConfigFile  string            `json:"config_file"`
+	Branch      string            `json:"branch"`
+	Environment string            `json:"environment"`
+	StartedAt   time.Time         `json:"started_at"`
+	Completed   map[string]string `json:"completed"`
+}
+
 func init() {
 	// initialize global maps
 	needSyncEnvs = make(map[string]struct{})
+	environmentPostrunCommands = make(map[string][]string)
+	puppetEnvironments = make(map[string]PuppetEnvironment)
+	puppetdbSkippedEnvironments = make(map[string]string)
+	dryRunChanges = make(map[string][]string)
+	orphanedContent = make(map[string][]string)
 	uniqueForgeModules = make(map[string]ForgeModule)
+	resolvedOnce = make(map[string]*sync.Once)
+	environmentFailures = make(map[string]string)
+	sourceFailures = make(map[string]string)
+	unresolvedSources = make(map[string]bool)
+	moduleFailures = make(map[string]string)
+	moduleFailedEnvironments = make(map[string]string)
 }
 
 func main() {
 
+	flag.Usage = printUsage
+	if len(os.Args) > 1 && (os.Args[1] == "deploy" || os.Args[1] == "validate") {
+		name := os.Args[1]
+		flag.Usage = func() { printSubcommandUsage(flag.CommandLine, name) }
+		os.Args = append([]string{os.Args[0]}, legacyArgs(name, os.Args[2:])...)
+	} else if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
 	var (
 		configFileFlag = flag.String("config", "", "which config file to use")
 		versionFlag    = flag.Bool("version", false, "show build time and version number")
@@ -227,15 +726,21 @@ func main() {
 	flag.StringVar(&environmentParam, "environment", "", "which Puppet environment to update. Source name inside the config + '_' + branch name, e.g. foo_master, foo_qa, foo_dev")
 	flag.BoolVar(&tags, "tags", false, "to pull tags as well as branches")
 	flag.StringVar(&outputNameParam, "outputname", "", "overwrite the environment name if -branch is specified")
+	flag.BoolVar(&canary, "canary", false, "deploy the -branch as a canary environment next to the real environment, e.g. production_canary, without touching the real environment")
 	flag.StringVar(&moduleParam, "module", "", "which module of the Puppet environment to update, e.g. stdlib")
 	flag.StringVar(&moduleDirParam, "moduledir", "", "allows overriding of Puppetfile specific moduledir setting, the folder in which Puppet modules will be extracted")
 	flag.StringVar(&cacheDirParam, "cachedir", "", "allows overriding of the g10k config file cachedir setting, the folder in which g10k will download git repositories and Forge modules")
 	flag.IntVar(&maxworker, "maxworker", 50, "how many Goroutines are allowed to run in parallel for Git and Forge module resolving")
 	flag.IntVar(&maxExtractworker, "maxextractworker", 20, "how many Goroutines are allowed to run in parallel for local Git and Forge module extracting processes (git clone, untar and gunzip)")
+	flag.IntVar(&environmentMaxworker, "environmentmaxworker", 0, "how many Puppet environments are allowed to be deployed in parallel, each in its own pipeline of resolving, fetching and extracting its modules")
 	flag.BoolVar(&pfMode, "puppetfile", false, "install all modules from Puppetfile in cwd")
 	flag.StringVar(&pfLocation, "puppetfilelocation", "./Puppetfile", "which Puppetfile to use in -puppetfile mode")
 	flag.BoolVar(&force, "force", false, "purge the Puppet environment directory and do a full sync")
 	flag.BoolVar(&dryRun, "dryrun", false, "do not modify anything, just print what would be changed")
+	flag.BoolVar(&purgeReport, "purgereport", false, "do not modify anything, just list the unmanaged content of all Puppet environments that g10k would remove with all purge levels enabled")
+	flag.BoolVar(&keepGoing, "keepgoing", false, "continue deploying the other Puppet environments if one of them fails, print a summary of all failures and exit with a nonzero exit code at the end")
+	flag.BoolVar(&failFast, "failfast", false, "abort the g10k run at the first Puppet environment or source that fails, even if it is only unreachable")
+	flag.BoolVar(&resume, "resume", false, "continue the previous interrupted g10k run and only deploy the Puppet environments it did not complete")
 	flag.BoolVar(&validate, "validate", false, "only validate given configuration and exit")
 	flag.BoolVar(&usemove, "usemove", false, "do not use hardlinks to populate your Puppet environments with Puppetlabs Forge modules. Instead uses simple move commands and purges the Forge cache directory after each run! (Useful for g10k runs inside a Docker container)")
 	flag.BoolVar(&check4update, "check4update", false, "only check if the is newer version of the Puppet module avaialable. Does implicitly set dryrun to true")
@@ -243,29 +748,73 @@ func main() {
 	flag.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
 	flag.BoolVar(&verbose, "verbose", false, "log verbose output, defaults to false")
 	flag.BoolVar(&info, "info", false, "log info output, defaults to false")
-	flag.BoolVar(&quiet, "quiet", false, "no output, defaults to false")
+	flag.BoolVar(&quiet, "quiet", false, "only print warnings, errors and a single summary line of the g10k run, e.g. for cron jobs, defaults to false")
 	flag.BoolVar(&usecacheFallback, "usecachefallback", false, "if g10k should try to use its cache for sources and modules instead of failing")
 	flag.BoolVar(&retryGitCommands, "retrygitcommands", false, "if g10k should purge the local repository and retry a failed git command (clone or remote update) instead of failing")
 	flag.BoolVar(&gitObjectSyntaxNotSupported, "gitobjectsyntaxnotsupported", false, "if your git version is too old to support reference syntax like master^{object} use this setting to revert to the older syntax")
+	flag.StringVar(&configRepoParam, "configrepo", "", "git repository URL from which g10k should fetch its config file before deploying")
+	flag.StringVar(&configRepoBranchParam, "configrepobranch", "", "which branch of the -configrepo git repository to use, defaults to the default branch of the repository")
+	flag.StringVar(&configRepoPathParam, "configrepopath", "g10k.yaml", "path of the g10k config file inside the -configrepo git repository")
+	flag.StringVar(&configRepoKeyParam, "configrepokey", "", "SSH private key to use for the -configrepo git repository")
+	flag.StringVar(&exportDirParam, "exportdir", "", "write a tar.gz or zip artifact of every deployed Puppet environment to this directory, overrides the export_dir setting")
+	flag.StringVar(&runLockParam, "runlock", "", "what to do if another g10k run holds the lock in the cachedir: wait for it, fail, queue behind it unless another run is already waiting or none to not lock at all, overrides the run_lock setting (default \"wait\")")
+	flag.StringVar(&logLevelParam, "log-level", "", "which messages to log: error, warn, info, debug or trace, replaces -info (info), -verbose (debug) and -debug (trace) (default \"warn\")")
+	flag.StringVar(&colorParam, "color", "auto", "when to color the output: auto, which disables the colors and progress bars if the output is not a terminal, NO_COLOR is set or TERM is dumb, always or never, which also disables the progress bars")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the log lines: text or json, which writes every log line as a JSON record with level, time, phase, environment, module, duration and message")
+	flag.StringVar(&outputFormat, "output", "text", "format of the result of the g10k run on stdout: text, json, which prints a JSON document with the result of every environment and sends the log messages to stderr, or github, which also prints GitHub Actions ::error annotations for every failure")
+	flag.StringVar(&cpuProfileParam, "cpuprofile", "", "write a CPU profile of the g10k run to this file for go tool pprof")
+	flag.StringVar(&memProfileParam, "memprofile", "", "write a memory profile at the end of the g10k run to this file for go tool pprof")
+	flag.StringVar(&reportParam, "report", "", "write a report of the g10k run with one test case per environment and module to a file, e.g. junit=g10k.xml for the JUnit XML of GitLab CI or Jenkins, markdown=summary.md for a Markdown summary of the changed environments and modules for a pull request comment or $GITHUB_STEP_SUMMARY, or both separated by a comma")
+	flag.IntVar(&timingsParam, "timings", 0, "print the given number of the slowest git repositories and Forge modules with the durations of their fetch, query, download and extract phases at the end of the g10k run")
+	flag.StringVar(&timingsFileParam, "timings-file", "", "write the durations of all git repositories and Forge modules of the g10k run as JSON to this file, the slowest first")
+	flag.StringVar(&viaDaemonParam, "via-daemon", "", "run the g10k run in the g10k serve listening on this unix socket, which shares its cachedir and SSH connections, e.g. /run/g10k/g10k.sock")
 	flag.Parse()
 
 	configFile = *configFileFlag
 	version := *versionFlag
+	validateLogFormat()
+	validateLogLevel()
+	validateColor()
+	validateReport()
+	setupOutput()
+
+	if len(viaDaemonParam) > 0 {
+		os.Exit(runViaDaemon(viaDaemonParam))
+	}
 
 	if version {
 		fmt.Println("g10k ", buildversion, " Build time:", buildtime, "UTC")
 		os.Exit(0)
 	}
 
-	if check4update {
+	if check4update || purgeReport {
 		dryRun = true
 	}
 
+	if keepGoing && failFast {
+		Fatalf("Error: -keepgoing parameter is not allowed with -failfast parameter!")
+	}
+	// a failure outside of a Puppet environment still aborts the g10k run with -keepgoing
+	defer exitOnFailure()
+	handleTerminationSignals()
+	startProfiling()
+
 	// check for git executable dependency
 	if _, err := exec.LookPath("git"); err != nil {
 		Fatalf("Error: could not find 'git' executable in PATH")
 	}
 
+	if len(configRepoParam) > 0 {
+		if len(configFile) > 0 {
+			Fatalf("Error: -configrepo parameter is not allowed with -config parameter!")
+		}
+		configFile = fetchConfigRepository(configRepoParam, configRepoBranchParam, configRepoPathParam, configRepoKeyParam)
+	}
+
+	if purgeReport && len(configFile) == 0 {
+		Fatalf("Error: -purgereport parameter requires -config parameter!")
+	}
+
 	target := ""
 	before := time.Now()
 	if len(configFile) > 0 {
@@ -278,12 +827,27 @@ func main() {
 		if (len(outputNameParam) > 0) && (len(branchParam) == 0) {
 			Fatalf("Error: -outputname specified without -branch!")
 		}
+		if resume && force {
+			Fatalf("Error: -resume parameter is not allowed with -force parameter!")
+		}
+		if canary && (len(branchParam) == 0 || len(outputNameParam) > 0) {
+			Fatalf("Error: -canary parameter requires -branch and is not allowed with -outputname!")
+		}
 		if usecacheFallback {
 			config.UseCacheFallback = true
 		}
 		Debugf("Using as config file: " + configFile)
 		config = readConfigfile(configFile)
+		openLogOutputs()
+		if purgeReport {
+			configuredPurgeLevels = config.PurgeLevels
+			config.PurgeLevels = allPurgeLevels
+		}
 		checkDirAndCreate(config.CacheDir, "cachedir configured value")
+		if !acquireRunLock() {
+			return
+		}
+		useStagingDirAsTempDir()
 		target = configFile
 		if len(branchParam) > 0 {
 			resolvePuppetEnvironment(tags, outputNameParam)
@@ -313,12 +877,17 @@ func main() {
 			envsCacheDir := filepath.Join(cachedir, "environments")
 			config = ConfigSettings{CacheDir: cachedir, ForgeCacheDir: cachedir, ModulesCacheDir: modulesCacheDir, EnvCacheDir: envsCacheDir, Sources: sm, ForgeBaseURL: "https://forgeapi.puppet.com", Maxworker: maxworker, UseCacheFallback: usecacheFallback, MaxExtractworker: maxExtractworker, RetryGitCommands: retryGitCommands, GitObjectSyntaxNotSupported: gitObjectSyntaxNotSupported}
 			config.PurgeLevels = []string{"puppetfile"}
+			if !acquireRunLock() {
+				return
+			}
 			target = pfLocation
 			puppetfile := readPuppetfile(target, "", "cmdlineparam", "cmdlineparam", false, false)
 			puppetfile.workDir = ""
 			pfm := make(map[string]Puppetfile)
 			pfm["cmdlineparam"] = puppetfile
+			startProgressReporter(0)
 			resolvePuppetfile(pfm)
+			stopProgressReporter()
 		} else {
 			Fatalf("Error: you need to specify at least a config file or use the Puppetfile mode\nExample call: " + os.Args[0] + " -config test.yaml or " + os.Args[0] + " -puppetfile\n")
 		}
@@ -338,9 +907,71 @@ func main() {
 		}
 		fmt.Println("Synced", target, "with", syncGitCount, "git repositories and", syncForgeCount, "Forge modules in "+strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64)+"s with git ("+strconv.FormatFloat(syncGitTime, 'f', 1, 64)+"s sync, I/O", strconv.FormatFloat(ioGitTime, 'f', 1, 64)+"s) and Forge ("+strconv.FormatFloat(syncForgeTime, 'f', 1, 64)+"s query+download, I/O", strconv.FormatFloat(ioForgeTime, 'f', 1, 64)+"s) using", strconv.Itoa(config.Maxworker), "resolve and", strconv.Itoa(config.MaxExtractworker), "extract workers")
 	}
+	if !check4update && !quiet {
+		printChangelog()
+	}
+	if len(heldEnvironments) > 0 && !check4update && !quiet {
+		fmt.Println("Held frozen environment(s) " + strings.Join(heldEnvironments, ", "))
+	}
+	if unusedEnvs := environmentsWithoutActiveNodes(); len(unusedEnvs) > 0 && !check4update && !quiet {
+		fmt.Println("Environment(s) without active nodes in PuppetDB, candidates for cleanup: " + strings.Join(unusedEnvs, ", "))
+	}
+	reportDeployFinished = true
+	if !check4update {
+		printTimingReport()
+	}
+	if (keepGoing || deployCancelled()) && !quiet {
+		printFailureSummary()
+	}
+	if len(moduleParam) > 0 && len(configFile) > 0 && !check4update && !quiet {
+		if len(moduleEnvironments) == 0 {
+			Warnf("WARNING: Module " + moduleParam + " is not part of the Puppetfile of any deployed environment")
+		} else {
+			sort.Strings(moduleEnvironments)
+			fmt.Println("Deployed module " + moduleParam + " to environment(s) " + strings.Join(moduleEnvironments, ", "))
+		}
+	}
+	if purgeReport {
+		printPurgeReport()
+		writeRunResults("")
+		return
+	}
+	if dryRun && !quiet && len(configFile) > 0 {
+		printDryRunPlan()
+	}
 	if dryRun && (needSyncForgeCount > 0 || needSyncGitCount > 0) {
+		writeRunResults("")
 		os.Exit(1)
 	}
 
+	writeConfigVersions()
+	publishDesiredState()
+	publishKVState()
+	failedGenerateTypesEnvs := generateTypes()
+	failedRestoreconEnvs := restoreSELinuxContexts()
+	failedFlushEnvs := flushPuppetserverEnvironmentCaches()
 	checkForAndExecutePostrunCommand()
+	triggerPuppetRuns()
+	if len(failedGenerateTypesEnvs) > 0 {
+		Fatalf("Error: puppet generate types failed for environment(s) " + strings.Join(failedGenerateTypesEnvs, ", "))
+	}
+	if len(failedRestoreconEnvs) > 0 {
+		Fatalf("Error: restorecon failed for environment(s) " + strings.Join(failedRestoreconEnvs, ", "))
+	}
+	if len(failedFlushEnvs) > 0 {
+		Fatalf("Error: puppetserver environment cache flush failed for environment(s) " + strings.Join(failedFlushEnvs, ", "))
+	}
+	if len(invalidHieraEnvironments) > 0 {
+		sort.Strings(invalidHieraEnvironments)
+		Fatalf("Error: hiera.yaml validation failed for environment(s) " + strings.Join(invalidHieraEnvironments, ", "))
+	}
+	writeRunResults("")
+	finishCheckpoint()
+	exitIfCancelled()
+	if deployFailed() && !withinFailureThresholds() {
+		os.Exit(exitPartialDeploy)
+	}
+	if len(purgeRefusedSources) > 0 {
+		os.Exit(exitPurgeRefused)
+	}
 }
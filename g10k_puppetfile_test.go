@@ -250,7 +250,7 @@ func TestForgeCacheTTLPuppetfile(t *testing.T) {
 }
 
 func TestForceForgeVersionsPuppetfile(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, true, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, true, exitPuppetfileError, "")
 }
 
 func TestForceForgeVersionsPuppetfileCorrect(t *testing.T) {
@@ -258,59 +258,59 @@ func TestForceForgeVersionsPuppetfileCorrect(t *testing.T) {
 }
 
 func TestReadPuppetfileDuplicateGitAttribute(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileTrailingComma(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileInvalidForgeModuleName(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileDuplicateForgeModule(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileMissingGitAttribute(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileTooManyGitAttributes(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileConflictingGitAttributesTag(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileConflictingGitAttributesBranch(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileConflictingGitAttributesCommit(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileConflictingGitAttributesRef(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileIgnoreUnreachable(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileForgeCacheTTL(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Can not convert value 300x of parameter forge.cacheTtl 300x to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In tests/TestReadPuppetfileForgeCacheTTL line: forge.cacheTtl 300x")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "Error: Can not convert value 300x of parameter forge.cacheTtl 300x to a golang Duration. Valid time units are 300ms, 1.5h or 2h45m. In tests/TestReadPuppetfileForgeCacheTTL line: forge.cacheTtl 300x")
 }
 
 func TestReadPuppetfileLink(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Found conflicting git attributes :branch, :link, in tests/TestReadPuppetfileLink for module example_module line: mod 'example_module',:git => 'git@somehost.com/foo/example-module.git',:branch => 'foo',:link => true")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "Error: Found conflicting git attributes :branch, :link, in tests/TestReadPuppetfileLink for module example_module line: mod 'example_module',:git => 'git@somehost.com/foo/example-module.git',:branch => 'foo',:link => true")
 }
 
 func TestReadPuppetfileDuplicateForgeGitModule(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "Error: Git Puppet module with same name found in tests/TestReadPuppetfileDuplicateForgeGitModule for module bar line: mod 'bar',:git => 'https://github.com/foo/bar.git'")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "Error: Git Puppet module with same name found in tests/TestReadPuppetfileDuplicateForgeGitModule for module bar line: mod 'bar',:git => 'https://github.com/foo/bar.git'")
 }
 
 func TestReadPuppetfileChecksumAttribute(t *testing.T) {
@@ -403,11 +403,11 @@ func TestReadPuppetfileLocalModule(t *testing.T) {
 }
 
 func TestReadPuppetfileMissingTrailingComma(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileMissingTrailingComma2(t *testing.T) {
-	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, 1, "")
+	checkExitCodeAndOutputOfReadPuppetfileSubprocess(t, false, exitPuppetfileError, "")
 }
 
 func TestReadPuppetfileForgeNotationGitModule(t *testing.T) {
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kballard/go-shellquote"
+	"github.com/remeh/sizedwaitgroup"
+)
+
+// defaultPuppetPath is the Puppet binary that gets used for generate_types if no puppet_path is configured, like r10k does
+const defaultPuppetPath = "/opt/puppetlabs/bin/puppet"
+
+// generateTypes runs puppet generate types for every Puppet environment that was changed by this g10k run, so that the environment isolation metadata in .resource_types matches the deployed modules.
+// It returns the environments for which the type generation failed.
+func generateTypes() []string {
+	if !config.GenerateTypes || len(needSyncEnvs) == 0 {
+		return nil
+	}
+	puppetPath := config.PuppetPath
+	if len(puppetPath) == 0 {
+		puppetPath = defaultPuppetPath
+	}
+
+	var failedEnvs []string
+	var failedMutex sync.Mutex
+	wg := sizedwaitgroup.New(config.GenerateTypesMaxworker)
+	var envs []string
+	for env := range needSyncEnvs {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		pe, ok := puppetEnvironments[env]
+		if !ok || !isDir(pe.targetDir) {
+			continue
+		}
+		generateCmd := puppetPath + " " + shellquote.Join("generate", "types", "--environment", env, "--environmentpath", strings.TrimSuffix(pe.sa.Basedir, "/"))
+		if dryRun {
+			Infof("Would run " + generateCmd)
+			continue
+		}
+		wg.Add()
+		go func(env string, pe PuppetEnvironment) {
+			defer wg.Done()
+			Infof("Generating types for environment " + env)
+			er := executeCommand(generateCmd, config.Timeout, true)
+			if er.returnCode != 0 {
+				Warnf("WARNING: " + generateCmd + " failed for environment " + env + ": " + er.errorOutput())
+				failedMutex.Lock()
+				failedEnvs = append(failedEnvs, env)
+				failedMutex.Unlock()
+				return
+			}
+			applyOwnershipRecursive(filepath.Join(pe.targetDir, ".resource_types"))
+		}(env, pe)
+	}
+	wg.Wait()
+	sort.Strings(failedEnvs)
+	return failedEnvs
+}
+
+// applyOwnershipRecursive applies the configured owner and group to the given path and everything inside of it
+func applyOwnershipRecursive(path string) {
+	if dryRun || (len(config.Owner) == 0 && len(config.Group) == 0) {
+		return
+	}
+	filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err == nil {
+			applyOwnership(p)
+		}
+		return nil
+	})
+}
@@ -3,13 +3,13 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
-	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xorpaul/uiprogress"
@@ -21,9 +21,10 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 		Debugf("uniqueGitModules[] is empty, skipping...")
 		return
 	}
+	atomic.AddInt64(&deployProgress.gitTotal, int64(len(uniqueGitModules)))
 	bar := uiprogress.AddBar(len(uniqueGitModules)).AppendCompleted().PrependElapsed()
 	bar.PrependFunc(func(b *uiprogress.Bar) string {
-		return fmt.Sprintf("Resolving Git modules (%d/%d)", b.Current(), len(uniqueGitModules))
+		return fmt.Sprintf("Resolving Git modules (%d/%d, %s fetched)", b.Current(), len(uniqueGitModules), formatBytes(atomic.LoadInt64(&deployProgress.gitBytes)))
 	})
 	// Dummy channel to coordinate the number of concurrent goroutines.
 	// This channel should be buffered otherwise we will be immediately blocked
@@ -65,6 +66,7 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 			// Otherwise, it will block the execution until an execution
 			// spot is available.
 			<-concurrentGoroutines
+			defer atomic.AddInt64(&deployProgress.gitDone, 1)
 			defer bar.Incr()
 			defer wg.Done()
 
@@ -81,10 +83,17 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 			repoDir := strings.Replace(strings.Replace(url, "/", "_", -1), ":", "-", -1)
 			workDir := filepath.Join(config.ModulesCacheDir, repoDir)
 
-			success := doMirrorOrUpdate(gm, workDir, 0)
-			if !success && !config.UseCacheFallback {
-				Fatalf("Fatal: Failed to clone or pull " + url + " to " + workDir)
-			}
+			resolveOnce("git:"+url, func() {
+				defer recoverModuleFailure(url)
+				if moduleCancelled(url) {
+					return
+				}
+				defer lockCacheEntry(config.CacheDir, workDir)()
+				success := doMirrorOrUpdate(gm, workDir, 0)
+				if !success && !config.UseCacheFallback {
+					FatalExitf(exitGitError, "Fatal: Failed to clone or pull "+url+" to "+workDir)
+				}
+			})
 			done <- true
 		}(url, gm, bar)
 	}
@@ -95,6 +104,10 @@ func resolveGitRepositories(uniqueGitModules map[string]GitModule) {
 }
 
 func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool {
+	if retryCount == 0 {
+		// the retries are part of the fetch
+		defer trackModuleTime("git", gitModule.git, "fetch", time.Now())
+	}
 	//fmt.Printf("%+v\n", gitModule)
 	isControlRepo := strings.HasPrefix(workDir, config.EnvCacheDir)
 	isInModulesCacheDir := strings.HasPrefix(workDir, config.ModulesCacheDir)
@@ -110,18 +123,29 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 		}
 	}
 	er := ExecResult{}
-	gitCmd := "git clone --mirror " + gitModule.git + " " + workDir
+	proxyParameter := gitProxyParameter(gitModule)
+	gitCmd := "git " + proxyParameter + "clone --mirror " + gitModule.git + " " + workDir
 	if config.CloneGitModules && !isControlRepo && !isInModulesCacheDir {
-		gitCmd = "git clone --single-branch --branch " + gitModule.tree + " " + gitModule.git + " " + workDir
+		gitCmd = "git " + proxyParameter + "clone --single-branch --branch " + gitModule.tree + " " + gitModule.git + " " + workDir
 	}
 	if isDir(workDir) {
 		if detectGitRemoteURLChange(workDir, gitModule.git) && isControlRepo {
 			purgeDir(workDir, "git remote url changed")
 		} else {
-			gitCmd = "git --git-dir " + workDir + " remote update --prune"
+			gitCmd = "git " + proxyParameter + "--git-dir " + workDir + " remote update --prune"
 		}
 	}
 
+	if strings.Contains(gitCmd, " remote update ") {
+		atomic.AddInt64(&cacheStats.gitHits, 1)
+	} else {
+		atomic.AddInt64(&cacheStats.gitMisses, 1)
+	}
+
+	var sizeBefore int64
+	if progressTracking() {
+		sizeBefore = gitObjectsSize(workDir)
+	}
 	if explicitlyLoadSSHKey {
 		sshAddCmd := "ssh-add "
 		if runtime.GOOS == "darwin" {
@@ -131,18 +155,23 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 	} else {
 		er = executeCommand(gitCmd, config.Timeout, gitModule.ignoreUnreachable)
 	}
+	if progressTracking() {
+		if received := gitObjectsSize(workDir) - sizeBefore; received > 0 {
+			atomic.AddInt64(&deployProgress.gitBytes, received)
+		}
+	}
 
 	if er.returnCode != 0 {
 		if config.UseCacheFallback {
-			Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment!")
+			Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.err.Error())
 			Warnf("WARN: Trying to use cache for " + gitModule.git + " git repository")
 			return false
 		} else if config.RetryGitCommands && retryCount > -1 {
-			Warnf("WARN: git command failed: " + gitCmd + " deleting local cached repository and retrying...")
+			Warnf("WARN: git command failed: " + gitCmd + " deleting local cached repository and retrying... Error: " + er.errorOutput())
 			purgeDir(workDir, "doMirrorOrUpdate, because git command failed, retrying")
 			return doMirrorOrUpdate(gitModule, workDir, retryCount-1)
 		}
-		Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.output)
+		Warnf("WARN: git repository " + gitModule.git + " does not exist or is unreachable at this moment! Error: " + er.err.Error())
 		return false
 	}
 	return true
@@ -150,12 +179,13 @@ func doMirrorOrUpdate(gitModule GitModule, workDir string, retryCount int) bool
 
 func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, correspondingPuppetEnvironment string) bool {
 	startedAt := time.Now()
+	defer trackModuleTime("git", gitModule.git, "extract", startedAt)
 	mutex.Lock()
 	syncGitCount++
 	mutex.Unlock()
 	if !isDir(srcDir) {
 		if config.UseCacheFallback {
-			Fatalf("Could not find cached git module " + srcDir)
+			FatalExitf(exitGitError, "Could not find cached git module "+srcDir)
 		}
 	}
 	revParseCmd := "git --git-dir " + srcDir + " rev-parse --verify '" + gitModule.tree
@@ -179,12 +209,12 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 		return false
 	}
 
-	if len(er.output) > 0 {
-		commitHash := strings.TrimSuffix(er.output, "\n")
+	if len(er.stdout) > 0 {
+		commitHash := strings.TrimSuffix(er.stdout, "\n")
 		if strings.HasPrefix(srcDir, config.EnvCacheDir) {
 			if fileExists(deployFile) {
 				dr := readDeployResultFile(deployFile)
-				if dr.Signature == strings.TrimSuffix(er.output, "\n") && dr.DeploySuccess {
+				if dr.Signature == strings.TrimSuffix(er.stdout, "\n") && dr.DeploySuccess {
 					needToSync = false
 				}
 			}
@@ -192,7 +222,9 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 			targetHashByte, _ := ioutil.ReadFile(hashFile)
 			targetHash := string(targetHashByte)
 			Debugf("string content of " + hashFile + " is: " + targetHash)
-			if targetHash == commitHash {
+			if targetHash == commitHash && config.ModuleStore && !isControlRepo && !isSymlink(targetDir) {
+				Debugf("Need to sync, because existing Git module: " + targetDir + " is not linked to the module store yet")
+			} else if targetHash == commitHash {
 				needToSync = false
 				Debugf("Skipping, because no diff found between " + srcDir + "(" + commitHash + ") and " + targetDir + "(" + targetHash + ")")
 			} else {
@@ -222,7 +254,10 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 				purgeWholeEnvDir = true
 			} else {
 				purgeWholeEnvDir = false
-				lines := strings.Split(executeResult.output, "\n")
+				if executeCommand("git --git-dir "+srcDir+" cat-file -e "+gitModule.tree+":bolt-project.yaml", config.Timeout, true).returnCode == 0 {
+					moduleDir = boltModuleDir
+				}
+				lines := strings.Split(executeResult.stdout, "\n")
 				for _, line := range lines {
 					if m := reModuledir.FindStringSubmatch(line); len(m) > 1 {
 						// moduledir CLI parameter override
@@ -233,18 +268,66 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 						}
 					}
 				}
+				if len(moduleDirParam) == 0 {
+					if moduleDirOverride := controlRepoModuleDirOverride(srcDir, gitModule.tree); len(moduleDirOverride) > 0 {
+						moduleDir = moduleDirOverride
+					}
+				}
 			}
 		}
+		if dryRun {
+			recordDryRunGitSync(srcDir, targetDir, strings.TrimSuffix(er.stdout, "\n"), correspondingPuppetEnvironment, isControlRepo, moduleDir, controlRepoPurgeAllowList(srcDir, gitModule.tree, gitModule.purgeAllowList))
+			return true
+		}
 		// if so delete everything except the moduledir where the Puppet modules reside
 		// else simply delete the whole dir and check it out again
-		if purgeWholeEnvDir {
+		// with purge_levels set but without the environment purge level only the content of the previously deployed commit gets removed
+		// existing git modules and control repo branches without the environment purge level are updated incrementally
+		incremental := false
+		if isControlRepo && config.GitCheckoutEnvironments {
+			// git itself removes the content of the previous commit
+		} else if isControlRepo && !purgeEnvironmentContent() {
+			incremental = isDir(targetDir)
+		} else if !isControlRepo && !config.CloneGitModules && !pfMode && isDir(targetDir) {
+			Debugf("Updating existing git module " + targetDir + " incrementally")
+			incremental = true
+		} else if purgeWholeEnvDir {
 			purgeDir(targetDir, "need to sync")
 		} else {
 			Infof("Detected control repo change, but trying to preserve module dir " + filepath.Join(targetDir, moduleDir))
-			purgeControlRepoExceptModuledir(targetDir, moduleDir)
+			purgeControlRepoExceptModuledir(targetDir, moduleDir, controlRepoPurgeAllowList(srcDir, gitModule.tree, gitModule.purgeAllowList))
 		}
 
-		if !dryRun && !config.CloneGitModules || isControlRepo {
+		if config.ModuleStore && !dryRun && !config.CloneGitModules && !isControlRepo && !pfMode {
+			linkModuleToStore(extractGitModuleOnce(srcDir, gitModule.tree, strings.TrimSuffix(er.stdout, "\n")), targetDir)
+		} else if config.HardlinkGitModules && !dryRun && !config.CloneGitModules && !isControlRepo && !pfMode {
+			commitHash := strings.TrimSuffix(er.stdout, "\n")
+			before := time.Now()
+			linkTree(extractGitModuleOnce(srcDir, gitModule.tree, commitHash), targetDir, []string{".latest_commit"})
+			duration := time.Since(before).Seconds()
+			mutex.Lock()
+			ioGitTime += duration
+			mutex.Unlock()
+			Debugf("Writing hash " + commitHash + " from command " + revParseCmd + " to " + hashFile)
+			if err := writeFileAtomic(hashFile, []byte(commitHash), 0644); err != nil {
+				Warnf("Could not write hash file " + hashFile + " " + err.Error())
+			}
+			applyOwnership(hashFile)
+		} else if isControlRepo && config.GitCheckoutEnvironments {
+			commitHash := strings.TrimSuffix(er.stdout, "\n")
+			before := time.Now()
+			if err := checkoutControlRepo(srcDir, targetDir, gitModule.tree, commitHash, moduleDir, controlRepoPurgeAllowList(srcDir, gitModule.tree, gitModule.purgeAllowList)); err != nil {
+				FatalExitf(exitGitError, "syncToModuleDir(): Could not check out "+gitModule.tree+" of "+srcDir+" in "+targetDir+" Error: "+err.Error())
+			}
+			mutex.Lock()
+			ioGitTime += time.Since(before).Seconds()
+			mutex.Unlock()
+			if config.PreserveCommitTimestamps {
+				applyCommitTimestamps(srcDir, commitHash, targetDir)
+			}
+			Debugf("Writing to deploy file " + deployFile)
+			writeStructJSONFile(deployFile, DeployResult{Name: gitModule.tree, Signature: commitHash, StartedAt: startedAt})
+		} else if !dryRun && !config.CloneGitModules || isControlRepo {
 			if pfMode {
 				purgeDir(targetDir, "git dir with changes in -puppetfile mode")
 			}
@@ -259,27 +342,42 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 				} else {
 					return false
 				}
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
+				FatalExitf(exitGitError, "syncToModuleDir(): Failed to execute command: git --git-dir "+srcDir+" archive "+gitModule.tree+" Error: "+err.Error())
 			}
-			cmd.Start()
+			startCommand(cmd)
 
 			before := time.Now()
-			unTar(cmdOut, targetDir)
+			var extracted map[string]struct{}
+			if incremental {
+				extracted = unTarIncremental(cmdOut, targetDir)
+			} else {
+				unTar(cmdOut, targetDir)
+			}
 			duration := time.Since(before).Seconds()
 			mutex.Lock()
 			ioGitTime += duration
 			mutex.Unlock()
 
-			err = cmd.Wait()
+			err = waitCommand(cmd)
 			if err != nil {
-				Fatalf("syncToModuleDir(): Failed to execute command: git --git-dir " + srcDir + " archive " + gitModule.tree + " Error: " + err.Error())
+				FatalExitf(exitGitError, "syncToModuleDir(): Failed to execute command: git --git-dir "+srcDir+" archive "+gitModule.tree+" Error: "+err.Error())
 				//"\nIf you are using GitLab please ensure that you've added your deploy key to your repository." +
 				//"\nThe Puppet environment which is using this unresolveable repository is " + correspondingPuppetEnvironment)
 			}
 
 			Verbosef("syncToModuleDir(): Executing git --git-dir " + srcDir + " archive " + gitModule.tree + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 
-			commitHash := strings.TrimSuffix(er.output, "\n")
+			if incremental && isControlRepo {
+				Infof("Detected control repo change, removing only the content of the previous commit from " + targetDir)
+				purgePreviousControlRepoContent(srcDir, targetDir, deployFile, extracted)
+			} else if incremental {
+				removeStaleContent(targetDir, extracted, []string{".latest_commit"})
+			}
+
+			commitHash := strings.TrimSuffix(er.stdout, "\n")
+			if config.PreserveCommitTimestamps {
+				applyCommitTimestamps(srcDir, commitHash, targetDir)
+			}
 			if isControlRepo {
 				Debugf("Writing to deploy file " + deployFile)
 				dr := DeployResult{
@@ -290,10 +388,10 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 				writeStructJSONFile(deployFile, dr)
 			} else {
 				Debugf("Writing hash " + commitHash + " from command " + revParseCmd + " to " + hashFile)
-				f, _ := os.Create(hashFile)
-				defer f.Close()
-				f.WriteString(commitHash)
-				f.Sync()
+				if err := writeFileAtomic(hashFile, []byte(commitHash), 0644); err != nil {
+					Warnf("Could not write hash file " + hashFile + " " + err.Error())
+				}
+				applyOwnership(hashFile)
 			}
 
 		} else if config.CloneGitModules {
@@ -306,9 +404,9 @@ func syncToModuleDir(gitModule GitModule, srcDir string, targetDir string, corre
 func detectDefaultBranch(gitDir string) string {
 	remoteShowOriginCmd := "git ls-remote --symref " + gitDir
 	er := executeCommand(remoteShowOriginCmd, config.Timeout, false)
-	foundRefs := strings.Split(er.output, "\n")
+	foundRefs := strings.Split(er.stdout, "\n")
 	if len(foundRefs) < 1 {
-		Fatalf("Unable to detect default branch for git repository with command git ls-remote --symref " + gitDir)
+		FatalExitf(exitGitError, "Unable to detect default branch for git repository with command git ls-remote --symref "+gitDir)
 	}
 	// should look like this:
 	// ref: refs/heads/main\tHEAD
@@ -327,7 +425,7 @@ func detectGitRemoteURLChange(d string, url string) bool {
 		return true
 	}
 
-	f := strings.Fields(er.output)
+	f := strings.Fields(er.stdout)
 	if len(f) < 3 {
 		Warnf("WARN: Could not detect remote URL for git repository " + d + " trying to purge it and mirror it again")
 		return true
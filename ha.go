@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultHALockTTL is how long the leader lock of g10k serve stays valid without being renewed if serve ha_lock_ttl is not set
+const defaultHALockTTL = 15 * time.Second
+
+// haLockSpec is the serve ha_lock that g10k serve started with, a reload of the config file does not change it
+var haLockSpec string
+
+// haFollower is set while another g10k serve holds the ha_lock, a follower queues deploys but does not run them. It is protected by the queueMutex
+var haFollower bool
+
+// haLock is the leader lock that several g10k serve daemons deploying the same basedir share, it expires if the leader does not renew it within its TTL
+type haLock interface {
+	// acquire takes the lock or renews it if this g10k serve already holds it, it returns true if this g10k serve is the leader
+	acquire() (bool, error)
+	// release gives up the lock, so that a follower can take over immediately
+	release()
+}
+
+// newHALock returns the lock for the given serve ha_lock setting, e.g. file:///mnt/puppet/g10k.lock or consul://localhost:8500/g10k/leader
+func newHALock(spec string, ttl time.Duration) (haLock, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	hostname, _ := os.Hostname()
+	owner := hostname + ":" + strconv.Itoa(os.Getpid())
+	key := strings.Trim(u.Path, "/")
+	switch u.Scheme {
+	case "file":
+		if len(u.Path) == 0 {
+			return nil, errors.New("missing path of the lock file")
+		}
+		return &fileLock{path: u.Path, ttl: ttl, owner: owner}, nil
+	case "consul", "consul+https":
+		if len(u.Host) == 0 || len(key) == 0 {
+			return nil, errors.New("expected consul://<host>:<port>/<key>")
+		}
+		scheme := "http"
+		if u.Scheme == "consul+https" {
+			scheme = "https"
+		}
+		return &consulLock{address: scheme + "://" + u.Host, key: key, ttl: ttl, owner: owner, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, errors.New("unsupported lock type " + u.Scheme + ", supported are file:// and consul://")
+}
+
+// haLockTTL returns the configured serve ha_lock_ttl, which was validated by readConfigfile
+func haLockTTL() time.Duration {
+	if ttl, err := time.ParseDuration(config.Serve.HALockTTL); err == nil {
+		return ttl
+	}
+	return defaultHALockTTL
+}
+
+// runHALock renews the leader lock three times per TTL, takes over once the lock of the leader expired and steps down if the lock can not be renewed
+func runHALock(lock haLock, ttl time.Duration) {
+	for !deployCancelled() {
+		leader, err := lock.acquire()
+		if err != nil {
+			Warnf("WARNING: Could not acquire the ha_lock " + haLockSpec + ": " + err.Error())
+		}
+		queueMutex.Lock()
+		if leader && haFollower {
+			Infof("Became the leader, deploying with the ha_lock " + haLockSpec)
+			haFollower = false
+			queueCond.Broadcast()
+		} else if !leader && !haFollower {
+			Warnf("WARNING: Another g10k serve holds the ha_lock " + haLockSpec + ", not deploying as follower")
+			haFollower = true
+		}
+		queueMutex.Unlock()
+		time.Sleep(ttl / 3)
+	}
+}
+
+// haRole returns leader or follower if g10k serve uses an ha_lock
+func haRole() string {
+	if len(haLockSpec) == 0 {
+		return ""
+	}
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if haFollower {
+		return "follower"
+	}
+	return "leader"
+}
+
+// fileLock is a leader lock in a file on a shared filesystem like NFS, which contains its owner and expiry.
+// It does not use flock, as that is not reliable on NFS, so the clocks of the g10k hosts have to be in sync.
+type fileLock struct {
+	path  string
+	ttl   time.Duration
+	owner string
+}
+
+// read returns the owner and expiry of the lock file
+func (fl *fileLock) read() (string, time.Time) {
+	content, err := ioutil.ReadFile(fl.path)
+	if err != nil {
+		return "", time.Time{}
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 {
+		return "", time.Time{}
+	}
+	expiry, _ := time.Parse(time.RFC3339Nano, lines[1])
+	return lines[0], expiry
+}
+
+func (fl *fileLock) acquire() (bool, error) {
+	if owner, expiry := fl.read(); owner != fl.owner && time.Now().Before(expiry) {
+		return false, nil
+	}
+	tmpFile := fl.path + "." + strings.Replace(fl.owner, "/", "_", -1)
+	content := fl.owner + "\n" + time.Now().Add(fl.ttl).Format(time.RFC3339Nano) + "\n"
+	if err := ioutil.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmpFile, fl.path); err != nil {
+		os.Remove(tmpFile)
+		return false, err
+	}
+	// another g10k serve could have replaced the expired lock at the same time
+	owner, _ := fl.read()
+	return owner == fl.owner, nil
+}
+
+func (fl *fileLock) release() {
+	if owner, _ := fl.read(); owner == fl.owner {
+		os.Remove(fl.path)
+	}
+}
+
+// consulLock is a leader lock on a Consul key, which is held by a Consul session with the TTL. The token is taken from CONSUL_HTTP_TOKEN
+type consulLock struct {
+	address string
+	key     string
+	ttl     time.Duration
+	owner   string
+	session string
+	client  *http.Client
+}
+
+// put sends a PUT request to the Consul HTTP API and decodes the JSON response into result
+func (cl *consulLock) put(path string, body interface{}, result interface{}) (int, error) {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	return consulRequest(cl.client, "PUT", cl.address+path, payload, result)
+}
+
+// consulRequest sends a request with the token from CONSUL_HTTP_TOKEN to the Consul HTTP API and decodes the JSON response into result if it is not nil
+func consulRequest(client *http.Client, method string, url string, payload []byte, result interface{}) (int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); len(token) > 0 {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, errors.New(method + " " + url + " returned " + resp.Status)
+	}
+	if result != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+	}
+	return resp.StatusCode, nil
+}
+
+func (cl *consulLock) acquire() (bool, error) {
+	if len(cl.session) > 0 {
+		// the session expired if the leader could not renew it in time
+		if code, err := cl.put("/v1/session/renew/"+cl.session, nil, nil); code == http.StatusNotFound {
+			cl.session = ""
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if len(cl.session) == 0 {
+		var session struct{ ID string }
+		body := map[string]string{"Name": "g10k " + cl.owner, "TTL": strconv.Itoa(int(cl.ttl.Seconds())) + "s", "Behavior": "release"}
+		if _, err := cl.put("/v1/session/create", body, &session); err != nil {
+			return false, err
+		}
+		cl.session = session.ID
+	}
+	var acquired bool
+	if _, err := cl.put("/v1/kv/"+cl.key+"?acquire="+cl.session, cl.owner, &acquired); err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
+func (cl *consulLock) release() {
+	if len(cl.session) == 0 {
+		return
+	}
+	cl.put("/v1/kv/"+cl.key+"?release="+cl.session, nil, nil)
+	cl.put("/v1/session/destroy/"+cl.session, nil, nil)
+	cl.session = ""
+}
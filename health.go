@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+// Exit codes of g10k healthcheck, the first failed check determines the exit code
+const (
+	healthExitCacheNotWritable  = 2
+	healthExitGitMissing        = 3
+	healthExitSourceUnreachable = 4
+)
+
+// healthCheck is a single check of g10k healthcheck or of the /readyz endpoint of g10k serve
+type healthCheck struct {
+	name     string
+	exitCode int
+	check    func() error
+}
+
+// healthChecks returns the checks of the cachedir and the git binary and, if checkSources is set, of the reachability of the control repository of every source
+func healthChecks(checkSources bool) []healthCheck {
+	checks := []healthCheck{
+		{"cachedir " + config.CacheDir + " is writable", healthExitCacheNotWritable, checkCacheWritable},
+		{"git binary is available", healthExitGitMissing, checkGitBinary},
+	}
+	if checkSources {
+		for _, source := range sortedSourceNames() {
+			sa := config.Sources[source]
+			checks = append(checks, healthCheck{"control repository " + sa.Remote + " of source " + source + " is reachable", healthExitSourceUnreachable, func() error {
+				if er := gitLsRemote(sa.Remote, sa.PrivateKey); er.returnCode != 0 {
+					return errors.New(er.errorOutput())
+				}
+				return nil
+			}})
+		}
+	}
+	return checks
+}
+
+// checkCacheWritable creates and removes a file in the cachedir
+func checkCacheWritable() error {
+	if err := os.MkdirAll(config.CacheDir, 0777); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(config.CacheDir, ".g10k-healthcheck")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// checkGitBinary checks if git can be executed
+func checkGitBinary() error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return err
+	}
+	if er := executeCommand("git --version", 10, true); er.returnCode != 0 {
+		return errors.New(er.errorOutput())
+	}
+	return nil
+}
+
+// gitLsRemote lists the branches of the given git repository, with the given SSH private key if it is set
+func gitLsRemote(remote string, privateKey string) ExecResult {
+	lsRemoteCmd := "git ls-remote --heads " + remote
+	if len(privateKey) > 0 {
+		sshAddCmd := "ssh-add "
+		if runtime.GOOS == "darwin" {
+			sshAddCmd = "ssh-add -K "
+		}
+		return executeCommand("ssh-agent bash -c '"+sshAddCmd+privateKey+"; "+lsRemoteCmd+"'", 30, true)
+	}
+	return executeCommand(lsRemoteCmd, 30, true)
+}
+
+// healthcheckCommand verifies that g10k can deploy with the given config file and exits with the code of the first failed check,
+// e.g. g10k healthcheck -config test.yaml
+func healthcheckCommand(args []string) {
+	fs := subcommandFlagSet("healthcheck")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	skipSources := fs.Bool("skip-sources", false, "do not check if the control repositories are reachable")
+	fs.Parse(args)
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " healthcheck -config test.yaml")
+	}
+	// the cachedir is only created by its check
+	configFile = *configFileFlag
+	config = loadConfig(configFile)
+
+	exitCode := 0
+	for _, hc := range healthChecks(!*skipSources) {
+		if err := hc.check(); err != nil {
+			fmt.Println("FAILED: " + hc.name + ": " + err.Error())
+			if exitCode == 0 {
+				exitCode = hc.exitCode
+			}
+			continue
+		}
+		fmt.Println("OK: " + hc.name)
+	}
+	os.Exit(exitCode)
+}
+
+// healthzHandler reports that g10k serve is alive
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports if g10k serve accepts deploys and is not a follower, it does not check the control repositories, because orchestrators poll it frequently
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if deployCancelled() {
+		http.Error(w, "g10k is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if haRole() == "follower" {
+		http.Error(w, "follower, another g10k serve holds the ha_lock", http.StatusServiceUnavailable)
+		return
+	}
+	for _, hc := range healthChecks(false) {
+		if err := hc.check(); err != nil {
+			http.Error(w, "not ready: "+hc.name+": "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
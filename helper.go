@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -10,6 +11,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -24,9 +26,15 @@ import (
 
 var validationMessages []string
 
-// Debugf is a helper function for debug logging if global variable debug is set to true
+// Debugf is a helper function for debug logging with -debug or -log-level trace
 func Debugf(s string) {
-	if debug {
+	if !logLevelEnabled(logLevelTrace) {
+		return
+	}
+	logToOutputs("trace", s)
+	if jsonLogging() {
+		writeLogRecord(os.Stderr, "trace", s)
+	} else {
 		pc, _, _, _ := runtime.Caller(1)
 		callingFunctionName := strings.Split(runtime.FuncForPC(pc).Name(), ".")[len(strings.Split(runtime.FuncForPC(pc).Name(), "."))-1]
 		if strings.HasPrefix(callingFunctionName, "func") {
@@ -38,47 +46,97 @@ func Debugf(s string) {
 	}
 }
 
-// Verbosef is a helper function for verbose logging if global variable verbose is set to true
+// Verbosef is a helper function for verbose logging with -verbose or -log-level debug
 func Verbosef(s string) {
-	if debug || verbose {
+	if !logLevelEnabled(logLevelDebug) {
+		return
+	}
+	logToOutputs("debug", s)
+	if jsonLogging() {
+		writeLogRecord(os.Stderr, "debug", s)
+	} else {
 		log.Print(fmt.Sprint(s))
 	}
 }
 
-// Infof is a helper function for info logging if global variable info is set to true
+// Infof is a helper function for info logging with -info or -log-level info
 func Infof(s string) {
-	if debug || verbose || info {
-		color.Green(s)
+	if !logLevelEnabled(logLevelInfo) {
+		return
+	}
+	logToOutputs("info", s)
+	if jsonLogging() {
+		writeLogRecord(os.Stdout, "info", s)
+	} else {
+		printColored(os.Stdout, color.FgGreen, s)
 	}
 }
 
 // Validatef is a helper function for validation logging if global variable validate is set to true
 func Validatef() {
+	writeReport("")
+	if jsonOutput() {
+		printValidateOutput()
+	}
+	printValidationAnnotations()
+	stopProfiling()
 	if len(validationMessages) > 0 {
 		for _, message := range validationMessages {
-			color.New(color.FgRed).Fprintln(os.Stdout, message)
+			printColored(os.Stdout, color.FgRed, message)
 		}
-		os.Exit(1)
+		os.Exit(exitConfigError)
 	} else {
-		color.New(color.FgGreen).Fprintln(os.Stdout, "Configuration successfully parsed.")
+		printColored(os.Stdout, color.FgGreen, "Configuration successfully parsed.")
 		os.Exit(0)
 	}
 }
 
-// Warnf is a helper function for warning logging
+// Warnf is a helper function for warning logging, which is only silenced by -log-level error
 func Warnf(s string) {
-	color.Set(color.FgYellow)
-	fmt.Println(s)
-	color.Unset()
+	if !logLevelEnabled(logLevelWarn) {
+		return
+	}
+	logToOutputs("warn", s)
+	recordWarning(s)
+	if jsonLogging() {
+		writeLogRecord(os.Stdout, "warn", s)
+		return
+	}
+	printColored(os.Stdout, color.FgYellow, s)
+}
+
+// Errorf is a helper function for error logging that does not exit, for errors after which g10k can continue
+func Errorf(s string) {
+	logToOutputs("error", s)
+	if jsonLogging() {
+		writeLogRecord(os.Stderr, "error", s)
+		return
+	}
+	printColored(os.Stderr, color.FgRed, s)
 }
 
 // Fatalf is a helper function for fatal logging
 func Fatalf(s string) {
+	FatalExitf(exitFailure, s)
+}
+
+// FatalExitf is Fatalf with the given exit code for the class of the failure
+func FatalExitf(exitCode int, s string) {
 	if validate {
 		validationMessages = append(validationMessages, s)
 	} else {
-		color.New(color.FgRed).Fprintln(os.Stderr, s)
-		os.Exit(1)
+		logToOutputs("error", s)
+		if jsonLogging() {
+			writeLogRecord(os.Stderr, "error", s)
+		} else {
+			printColored(os.Stderr, color.FgRed, s)
+		}
+		if keepGoing {
+			// the deploy of the affected Puppet environment gets aborted by recoverEnvironmentFailure()
+			panic(deployFailure{s, exitCode})
+		}
+		writeRunResults(s)
+		os.Exit(exitCode)
 	}
 }
 
@@ -91,6 +149,12 @@ func fileExists(file string) bool {
 	return true
 }
 
+// isSymlink checks if the given path is a symlink and returns a bool
+func isSymlink(path string) bool {
+	fi, err := os.Lstat(path)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
 // isDir checks if the given dir exists and returns a bool
 func isDir(dir string) bool {
 	fi, err := os.Stat(dir)
@@ -121,6 +185,7 @@ func checkDirAndCreate(dir string, name string) string {
 				if err := os.MkdirAll(dir, 0777); err != nil {
 					Fatalf("checkDirAndCreate(): Error: failed to create directory: " + dir)
 				}
+				applyOwnership(dir)
 			} else {
 				if !isDir(dir) {
 					Fatalf("checkDirAndCreate(): Error: " + dir + " exists, but is not a directory! Exiting!")
@@ -140,6 +205,24 @@ func checkDirAndCreate(dir string, name string) string {
 	return dir
 }
 
+// applyOwnership changes the owner and/or group of the given path to the configured owner and group settings
+func applyOwnership(path string) {
+	if dryRun || (len(config.Owner) == 0 && len(config.Group) == 0) {
+		return
+	}
+	uid := -1
+	gid := -1
+	if len(config.Owner) > 0 {
+		uid = config.ownerUID
+	}
+	if len(config.Group) > 0 {
+		gid = config.ownerGID
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		Fatalf("applyOwnership(): Error while changing ownership of " + path + " to " + config.Owner + ":" + config.Group + " Error: " + err.Error())
+	}
+}
+
 func createOrPurgeDir(dir string, callingFunction string) {
 	if !dryRun {
 		if !fileExists(dir) {
@@ -147,8 +230,8 @@ func createOrPurgeDir(dir string, callingFunction string) {
 			os.MkdirAll(dir, 0777)
 		} else {
 			Debugf("Trying to remove: " + dir + " called from " + callingFunction)
-			if err := os.RemoveAll(dir); err != nil {
-				log.Print("createOrPurgeDir(): error: removing dir failed", err)
+			if err := retryOnESTALE("removal of "+dir, func() error { return os.RemoveAll(dir) }); err != nil {
+				Errorf("createOrPurgeDir(): error: removing dir failed " + err.Error())
 			}
 			Debugf("Trying to create dir: " + dir + " called from " + callingFunction)
 			os.MkdirAll(dir, 0777)
@@ -161,17 +244,102 @@ func purgeDir(dir string, callingFunction string) {
 		Debugf("Unnecessary to remove dir: " + dir + " it does not exist. Called from " + callingFunction)
 	} else {
 		Debugf("Trying to remove: " + dir + " called from " + callingFunction)
-		if err := os.RemoveAll(dir); err != nil {
-			log.Print("purgeDir(): os.RemoveAll() error: removing dir failed: ", err.Error())
+		if err := retryOnESTALE("removal of "+dir, func() error { return os.RemoveAll(dir) }); err != nil {
+			Errorf("purgeDir(): os.RemoveAll() error: removing dir failed: " + err.Error())
 			if err = syscall.Unlink(dir); err != nil {
-				log.Print("purgeDir(): syscall.Unlink() error: removing link failed: ", err.Error())
+				Errorf("purgeDir(): syscall.Unlink() error: removing link failed: " + err.Error())
 			}
 		}
 	}
 }
 
+// defaultCommandOutputLimit is the number of bytes of the stderr of a command that g10k keeps without command_output_limit
+const defaultCommandOutputLimit = 64 * 1024
+
+// ExecError is the error of a failed command with its stderr, which usually explains why git failed
+type ExecError struct {
+	argv       []string
+	returnCode int
+	duration   time.Duration
+	stderr     string
+	err        error
+}
+
+func (e *ExecError) Error() string {
+	message := redactCredentials(shellquote.Join(e.argv...))
+	if _, ok := e.err.(*exec.ExitError); ok {
+		message += " exited with code " + strconv.Itoa(e.returnCode)
+	} else {
+		message += " failed: " + e.err.Error()
+	}
+	message += " after " + strconv.FormatFloat(e.duration.Seconds(), 'f', 3, 64) + "s"
+	if stderr := strings.TrimSpace(e.stderr); len(stderr) > 0 {
+		message += ": " + stderr
+	}
+	return message
+}
+
+// errorOutput returns why the command failed: its stderr, or its stdout if it printed its error there, or the error of starting it
+func (er ExecResult) errorOutput() string {
+	if stderr := strings.TrimSpace(er.stderr); len(stderr) > 0 {
+		return stderr
+	}
+	if stdout := strings.TrimSpace(er.stdout); len(stdout) > 0 {
+		return truncateOutput(stdout, commandOutputLimit())
+	}
+	if er.err != nil {
+		return er.err.Error()
+	}
+	return ""
+}
+
+// commandOutputLimit returns the number of bytes of command output that g10k keeps for its log messages and errors
+func commandOutputLimit() int {
+	if config.CommandOutputLimit > 0 {
+		return config.CommandOutputLimit
+	}
+	return defaultCommandOutputLimit
+}
+
+// tailBuffer keeps the last limit bytes written to it, as the end of git's stderr contains the error
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	// only cut the buffer once it is twice the limit to avoid copying it on every write
+	if len(b.buf) > 2*b.limit {
+		b.buf = append([]byte{}, b.buf[len(b.buf)-b.limit:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	if len(b.buf) > b.limit {
+		b.truncated = true
+		return "[...] " + string(b.buf[len(b.buf)-b.limit:])
+	}
+	if b.truncated {
+		return "[...] " + string(b.buf)
+	}
+	return string(b.buf)
+}
+
+// truncateOutput returns the first limit bytes of the given command output for a log message
+func truncateOutput(output string, limit int) string {
+	if len(output) <= limit {
+		return output
+	}
+	return output[:limit] + " [... " + strconv.Itoa(len(output)-limit) + " more bytes]"
+}
+
+// executeCommand executes the given command without a shell and returns its complete stdout, the end of its stderr and an *ExecError if it failed
 func executeCommand(command string, timeout int, allowFail bool) ExecResult {
-	Debugf("Executing " + command)
+	Debugf("Executing " + redactCredentials(command))
 	parts := strings.SplitN(command, " ", 2)
 	cmd := parts[0]
 	cmdArgs := []string{}
@@ -185,20 +353,38 @@ func executeCommand(command string, timeout int, allowFail bool) ExecResult {
 	}
 
 	before := time.Now()
-	out, err := exec.Command(cmd, cmdArgs...).CombinedOutput()
-	duration := time.Since(before).Seconds()
-	er := ExecResult{0, string(out)}
-	if msg, ok := err.(*exec.ExitError); ok { // there is error code
-		er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+	var stdout bytes.Buffer
+	stderr := tailBuffer{limit: commandOutputLimit()}
+	c := exec.Command(cmd, cmdArgs...)
+	c.Stdout = &stdout
+	c.Stderr = &stderr
+	traceFile := ""
+	if strings.Contains(command, "git ") {
+		// log the HTTP requests of git over HTTPS with -log-level trace
+		if traceFile = gitHTTPTraceFile(); len(traceFile) > 0 {
+			c.Env = append(os.Environ(), "GIT_TRACE_CURL="+traceFile, "GIT_TRACE_CURL_NO_DATA=1")
+		}
 	}
+	err := startCommand(c)
+	if err == nil {
+		err = waitCommand(c)
+	}
+	logGitHTTPTrace(traceFile)
+	er := ExecResult{stdout: stdout.String(), stderr: stderr.String(), argv: append([]string{cmd}, cmdArgs...), duration: time.Since(before)}
+	er.truncated = stderr.truncated
+	duration := er.duration.Seconds()
 	if (allowFail || config.UseCacheFallback) && err != nil {
-		Debugf("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Debugf("Executing " + redactCredentials(command) + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	} else {
-		Verbosef("Executing " + command + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
+		Verbosef("Executing " + redactCredentials(command) + " took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 	}
 	if err != nil {
 		er.returnCode = 1
-		er.output = fmt.Sprint(err) + " " + fmt.Sprint(string(out))
+		if msg, ok := err.(*exec.ExitError); ok { // there is error code
+			er.returnCode = msg.Sys().(syscall.WaitStatus).ExitStatus()
+		}
+		er.err = &ExecError{argv: er.argv, returnCode: er.returnCode, duration: er.duration, stderr: er.stderr, err: err}
+		Debugf(er.err.Error())
 	}
 	return er
 }
@@ -212,30 +398,80 @@ func funcName() string {
 
 func timeTrack(start time.Time, name string) {
 	duration := time.Since(start).Seconds()
+	mutex.Lock()
 	if name == "resolveForgeModules" {
-		syncForgeTime = duration
+		syncForgeTime += duration
 	} else if name == "resolveGitRepositories" {
-		syncGitTime = duration
+		syncGitTime += duration
 	}
+	mutex.Unlock()
 	Debugf(name + "() took " + strconv.FormatFloat(duration, 'f', 5, 64) + "s")
 }
 
 // checkForAndExecutePostrunCommand check if a `postrun` command was specified in the g10k config and executes it
+// Puppet environments with their own postrun command in a .g10k.yaml file get their own postrun command executed instead
 func checkForAndExecutePostrunCommand() {
-	if len(config.PostRunCommand) > 0 {
-		postrunCommandString := strings.Join(config.PostRunCommand, " ")
-		postrunCommandString = strings.Replace(postrunCommandString, "$modifieddirs", strings.Join(needSyncDirs, " "), -1)
+	ownPostrunEnvs := make(map[string]struct{})
+	for workDir, postrunCommand := range environmentPostrunCommands {
+		env := filepath.Base(workDir)
+		if _, ok := needSyncEnvs[env]; !ok || environmentFailed(env) {
+			continue
+		}
+		ownPostrunEnvs[env] = empty
+		executePostrunCommand(postrunCommand, needSyncDirsOfEnvironment(workDir), []string{env})
+	}
 
-		needSyncEnvText := ""
+	if len(config.PostRunCommand) > 0 {
+		globalNeedSyncEnvs := []string{}
 		for needSyncEnv := range needSyncEnvs {
-			needSyncEnvText += needSyncEnv + " "
+			if _, ok := ownPostrunEnvs[needSyncEnv]; !ok && !environmentFailed(needSyncEnv) {
+				globalNeedSyncEnvs = append(globalNeedSyncEnvs, needSyncEnv)
+			}
 		}
-		postrunCommandString = strings.Replace(postrunCommandString, "$modifiedenvs", needSyncEnvText, -1)
-		postrunCommandString = strings.Replace(postrunCommandString, "$branchparam", branchParam, -1)
+		if hasEnvironmentVariables(config.PostRunCommand) {
+			// the postrun command contains per environment variables, so it gets executed once for every modified environment
+			for _, env := range globalNeedSyncEnvs {
+				executePostrunCommand(config.PostRunCommand, needSyncDirsOfEnvironment(puppetEnvironments[env].targetDir), []string{env})
+			}
+		} else {
+			executePostrunCommand(config.PostRunCommand, needSyncDirs, globalNeedSyncEnvs)
+		}
+	}
+}
 
-		er := executeCommand(postrunCommandString, config.Timeout, false)
-		Debugf("postrun command '" + postrunCommandString + "' terminated with exit code " + strconv.Itoa(er.returnCode))
+// needSyncDirsOfEnvironment returns the modified directories inside the given Puppet environment directory
+func needSyncDirsOfEnvironment(workDir string) []string {
+	envNeedSyncDirs := []string{}
+	if len(workDir) == 0 {
+		return envNeedSyncDirs
+	}
+	for _, needSyncDir := range needSyncDirs {
+		if needSyncDir == workDir || strings.HasPrefix(needSyncDir, workDir+"/") {
+			envNeedSyncDirs = append(envNeedSyncDirs, needSyncDir)
+		}
 	}
+	return envNeedSyncDirs
+}
+
+// executePostrunCommand replaces the $modifieddirs, $modifiedenvs and $branchparam variables and the deploy variables in the given postrun command and executes it
+func executePostrunCommand(postrunCommand []string, modifiedDirs []string, modifiedEnvs []string) {
+	postrunCommandString := strings.Join(postrunCommand, " ")
+	if pe, ok := puppetEnvironments[strings.Join(modifiedEnvs, "")]; ok && len(modifiedEnvs) == 1 {
+		postrunCommandString = expandDeployVariables(postrunCommandString, pe.source, pe.branch, pe.env)
+	} else {
+		postrunCommandString = expandDeployVariables(postrunCommandString, "", "", "")
+	}
+	postrunCommandString = strings.Replace(postrunCommandString, "$modifieddirs", strings.Join(modifiedDirs, " "), -1)
+
+	needSyncEnvText := ""
+	for _, needSyncEnv := range modifiedEnvs {
+		needSyncEnvText += needSyncEnv + " "
+	}
+	postrunCommandString = strings.Replace(postrunCommandString, "$modifiedenvs", needSyncEnvText, -1)
+	postrunCommandString = strings.Replace(postrunCommandString, "$branchparam", branchParam, -1)
+
+	er := executeCommand(postrunCommandString, config.Timeout, false)
+	Debugf("postrun command '" + postrunCommandString + "' terminated with exit code " + strconv.Itoa(er.returnCode))
 }
 
 // getSha256sumFile return the SHA256 hash sum of the given file
@@ -297,11 +533,44 @@ func writeStructJSONFile(file string, v interface{}) {
 		Warnf("Could not encode JSON file " + file + " " + err.Error())
 	}
 
-	err = ioutil.WriteFile(file, content, 0644)
+	err = writeFileAtomic(file, content, 0644)
 	if err != nil {
 		Warnf("Could not write JSON file " + file + " " + err.Error())
 	}
+	applyOwnership(file)
+
+}
 
+// writeFileAtomic writes the content to a temporary file next to the given file and renames it into place.
+// This never modifies the existing file, which might be hardlinked into a live Puppet environment.
+func writeFileAtomic(file string, content []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".")
+	if err != nil {
+		return err
+	}
+	tmpFile := f.Name()
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if nfsDeploy() {
+		// write-then-fsync, so that other NFS clients never see the renamed file without its content
+		if err := f.Sync(); err != nil {
+			f.Close()
+			os.Remove(tmpFile)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := os.Chmod(tmpFile, perm); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+	return os.Rename(tmpFile, file)
 }
 
 func readDeployResultFile(file string) DeployResult {
@@ -332,3 +601,18 @@ func stripComponent(component string, env string) string {
 		return strings.TrimPrefix(env, component)
 	}
 }
+
+// mapEnvironmentName applies the branch_rewrites rules and the environment_name template of the given source to the branch name
+func mapEnvironmentName(source string, sa Source, branch string) string {
+	for _, rewrite := range sa.BranchRewrites {
+		reRewrite, err := regexp.Compile(rewrite.Regex)
+		if err != nil {
+			Fatalf("Setting branch_rewrites regex '" + rewrite.Regex + "' of source " + source + " could not be compiled to a valid Go regex please fix!")
+		}
+		branch = reRewrite.ReplaceAllString(branch, rewrite.Replacement)
+	}
+	if len(sa.EnvironmentName) > 0 {
+		branch = expandDeployVariables(sa.EnvironmentName, source, branch, "")
+	}
+	return branch
+}
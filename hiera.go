@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// builtinHieraBackends are the Hiera backend functions that ship with Puppet
+var builtinHieraBackends = []string{"yaml_data", "json_data", "hocon_data", "eyaml_lookup_key"}
+
+// validateEnvironmentHiera checks the hiera.yaml of the given deployed Puppet environment with validate_hiera and prints every problem as a warning
+func validateEnvironmentHiera(env string, envDir string) {
+	if !config.ValidateHiera || dryRun {
+		return
+	}
+	problems := hieraProblems(envDir)
+	if len(problems) == 0 {
+		return
+	}
+	for _, problem := range problems {
+		Warnf("WARNING: hiera.yaml of environment " + env + ": " + problem)
+	}
+	mutex.Lock()
+	invalidHieraEnvironments = append(invalidHieraEnvironments, env)
+	mutex.Unlock()
+}
+
+// hieraProblems parses the hiera.yaml of the given Puppet environment directory and returns all problems that would break Hiera lookups,
+// i.e. a datadir or backend function that does not exist inside of the deployed environment
+func hieraProblems(envDir string) []string {
+	content, err := ioutil.ReadFile(filepath.Join(envDir, "hiera.yaml"))
+	if err != nil {
+		// Puppet uses its defaults without a hiera.yaml
+		return nil
+	}
+	var hc HieraConfig
+	if err := yaml.Unmarshal(content, &hc); err != nil {
+		return []string{"could not parse YAML: " + err.Error()}
+	}
+	if hc.Version != 5 {
+		return []string{"unsupported version " + strconv.Itoa(hc.Version) + ", the hiera.yaml of an environment has to be version 5"}
+	}
+
+	var problems []string
+	for i, level := range hc.Hierarchy {
+		name := level.Name
+		if len(name) == 0 {
+			name = "#" + strconv.Itoa(i+1)
+			problems = append(problems, "hierarchy level "+name+" has no name")
+		}
+		backends := 0
+		for _, backend := range []string{level.DataHash, level.LookupKey, level.DataDig, level.Hiera3} {
+			if len(backend) > 0 {
+				backends++
+			}
+		}
+		if len(level.Hiera3) > 0 && backends == 1 {
+			// Hiera 3 backends are Ruby classes of the Puppet installation
+			continue
+		}
+		if backends == 0 {
+			level.DataHash, level.LookupKey, level.DataDig = hc.Defaults.DataHash, hc.Defaults.LookupKey, hc.Defaults.DataDig
+		}
+		backend := level.DataHash + level.LookupKey + level.DataDig
+		if backends > 1 {
+			problems = append(problems, "hierarchy level "+name+" has more than one of data_hash, lookup_key, data_dig and hiera3_backend")
+		} else if len(backend) == 0 {
+			problems = append(problems, "hierarchy level "+name+" has no data_hash, lookup_key, data_dig or hiera3_backend and there is none in defaults")
+		} else if !hieraBackendExists(envDir, backend) {
+			problems = append(problems, "backend function "+backend+" of hierarchy level "+name+" does not exist in any module of the environment")
+		}
+
+		if len(level.URI) > 0 || len(level.URIs) > 0 {
+			// uris are passed to the backend as they are
+			continue
+		}
+		datadir := level.Datadir
+		if len(datadir) == 0 {
+			datadir = hc.Defaults.Datadir
+		}
+		if len(datadir) == 0 {
+			datadir = "data"
+		}
+		if strings.Contains(datadir, "%{") || filepath.IsAbs(datadir) {
+			continue
+		}
+		if !isDir(filepath.Join(envDir, datadir)) {
+			problems = append(problems, "datadir "+datadir+" of hierarchy level "+name+" does not exist")
+		}
+	}
+	return problems
+}
+
+// hieraBackendExists returns true if the given Hiera backend function ships with Puppet or is a Ruby or Puppet language function of a module inside of the Puppet environment
+func hieraBackendExists(envDir string, function string) bool {
+	if stringSliceContains(builtinHieraBackends, function) {
+		return true
+	}
+	parts := strings.Split(function, "::")
+	if len(parts) < 2 {
+		// non-namespaced functions can only come from the environment itself
+		matches, _ := filepath.Glob(filepath.Join(envDir, "lib", "puppet", "functions", function+".rb"))
+		return len(matches) > 0
+	}
+	module := parts[0]
+	patterns := []string{
+		filepath.Join(envDir, "*", module, "lib", "puppet", "functions", filepath.Join(parts...)+".rb"),
+		filepath.Join(envDir, "*", module, "functions", filepath.Join(parts[1:]...)+".pp"),
+	}
+	for _, pattern := range patterns {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return true
+		}
+	}
+	return false
+}
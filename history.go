@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// historyRecorded is set once the g10k run is recorded in the history database, so that a failure afterwards does not record it again
+var historyRecorded bool
+
+// historySchema creates the tables of the history database, the modules of an environment are only recorded for the runs that deployed it
+const historySchema = `.timeout 10000
+CREATE TABLE IF NOT EXISTS runs (id INTEGER PRIMARY KEY, started_at TEXT, duration REAL, host TEXT, config TEXT, branch TEXT, success INTEGER, error TEXT);
+CREATE TABLE IF NOT EXISTS environments (run_id INTEGER, environment TEXT, source TEXT, branch TEXT, commit_id TEXT, result TEXT, duration REAL, error TEXT);
+CREATE TABLE IF NOT EXISTS modules (run_id INTEGER, environment TEXT, module TEXT, type TEXT, version TEXT, previous TEXT, changed INTEGER);
+CREATE INDEX IF NOT EXISTS environments_environment ON environments (environment, run_id);
+CREATE INDEX IF NOT EXISTS modules_environment ON modules (environment, run_id);
+`
+
+// HistoryRun is a g10k run in the history database
+type HistoryRun struct {
+	ID           int     `json:"id"`
+	StartedAt    string  `json:"started_at"`
+	Duration     float64 `json:"duration"`
+	Host         string  `json:"host"`
+	Success      bool    `json:"success"`
+	Error        string  `json:"error,omitempty"`
+	Deployed     int     `json:"deployed"`
+	Failed       int     `json:"failed"`
+	Environments int     `json:"environments"`
+}
+
+// HistoryDeploy is a run that deployed, held or failed a Puppet environment in the history database
+type HistoryDeploy struct {
+	RunID     int            `json:"run_id"`
+	StartedAt string         `json:"started_at"`
+	Commit    string         `json:"commit"`
+	Result    string         `json:"result"`
+	Duration  float64        `json:"duration"`
+	Error     string         `json:"error,omitempty"`
+	Changes   []ModuleChange `json:"changes"`
+}
+
+// HistoryOutput is the JSON document of g10k history
+type HistoryOutput struct {
+	Command string       `json:"command"`
+	Runs    []HistoryRun `json:"runs"`
+}
+
+// EnvironmentHistoryOutput is the JSON document of g10k history with an environment
+type EnvironmentHistoryOutput struct {
+	Command     string          `json:"command"`
+	Environment string          `json:"environment"`
+	Deploys     []HistoryDeploy `json:"deploys"`
+}
+
+// recordHistory records the g10k run with the result of every Puppet environment and the resolved versions of the modules of the deployed environments in the history_db, fatal is the error that aborted it.
+// A history database that can not be written only gets a warning.
+func recordHistory(fatal string) {
+	if len(config.HistoryDB) == 0 || historyRecorded || validate || dryRun || check4update || outputCommand != "deploy" {
+		return
+	}
+	historyRecorded = true
+	checkDirAndCreate(filepath.Dir(config.HistoryDB), "history_db")
+	if err := sqliteExec(config.HistoryDB, historySQL(fatal)); err != nil {
+		Warnf("WARNING: Could not record the g10k run in the history database " + config.HistoryDB + ": " + err.Error())
+	}
+}
+
+// historySQL returns the SQL statements that record the g10k run in the history database
+func historySQL(fatal string) string {
+	output := deployOutput(fatal)
+	host, _ := os.Hostname()
+	var sql strings.Builder
+	sql.WriteString(historySchema)
+	sql.WriteString("BEGIN;\n")
+	sql.WriteString("INSERT INTO runs (started_at, duration, host, config, branch, success, error) VALUES (" + strings.Join([]string{
+		sqlQuote(outputStart.UTC().Format(time.RFC3339)), sqlFloat(output.Duration), sqlQuote(host), sqlQuote(configFile), sqlQuote(branchParam), sqlBool(output.Success), sqlQuote(fatal)}, ", ") + ");\n")
+	runID := "(SELECT max(id) FROM runs)"
+	for _, eo := range output.Environments {
+		envDir := puppetEnvironments[eo.Environment].targetDir
+		manifest, _ := readDeployManifest(filepath.Join(envDir, ".g10k-manifest.json"))
+		sql.WriteString("INSERT INTO environments (run_id, environment, source, branch, commit_id, result, duration, error) VALUES (" + strings.Join([]string{
+			runID, sqlQuote(eo.Environment), sqlQuote(eo.Source), sqlQuote(eo.Branch), sqlQuote(manifest.Commit), sqlQuote(eo.Result), sqlFloat(environmentDurations[eo.Environment].Seconds()), sqlQuote(eo.Error)}, ", ") + ");\n")
+		if eo.Result != "deployed" {
+			continue
+		}
+		previous := make(map[string]ModuleChange)
+		for _, mc := range moduleChanges[eo.Environment] {
+			previous[mc.Module] = mc
+		}
+		for _, m := range manifest.Modules {
+			mc, changed := previous[m.Name]
+			sql.WriteString("INSERT INTO modules (run_id, environment, module, type, version, previous, changed) VALUES (" + strings.Join([]string{
+				runID, sqlQuote(eo.Environment), sqlQuote(m.Name), sqlQuote(m.Type), sqlQuote(m.Resolved), sqlQuote(mc.From), sqlBool(changed)}, ", ") + ");\n")
+			delete(previous, m.Name)
+		}
+		for _, mc := range previous {
+			// a removed module is only part of the previous manifest
+			sql.WriteString("INSERT INTO modules (run_id, environment, module, type, version, previous, changed) VALUES (" + strings.Join([]string{
+				runID, sqlQuote(eo.Environment), sqlQuote(mc.Module), "''", "''", sqlQuote(mc.From), "1"}, ", ") + ");\n")
+		}
+	}
+	sql.WriteString("COMMIT;\n")
+	return sql.String()
+}
+
+// readDeployManifest reads the given .g10k-manifest.json, an environment without it returns an empty manifest
+func readDeployManifest(file string) (DeployManifest, error) {
+	var manifest DeployManifest
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, json.Unmarshal(content, &manifest)
+}
+
+// sqliteExec executes the given SQL statements with the sqlite3 command line tool
+func sqliteExec(db string, sql string) error {
+	_, err := sqliteRun(db, sql)
+	return err
+}
+
+// sqliteQuery returns the rows of the given SQL query, every row as a slice of its columns
+func sqliteQuery(db string, query string) ([][]string, error) {
+	out, err := sqliteRun(db, historySchema+query)
+	if err != nil {
+		return nil, err
+	}
+	var rows [][]string
+	for _, line := range strings.Split(out, "\x1e") {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		rows = append(rows, strings.Split(strings.TrimLeft(line, "\n"), "\x1f"))
+	}
+	return rows, nil
+}
+
+// sqliteRun pipes the given SQL into sqlite3 and returns its output with the unit separator between the columns and the record separator between the rows
+func sqliteRun(db string, sql string) (string, error) {
+	cmd := exec.Command("sqlite3", "-batch", "-bail", "-noheader", "-separator", "\x1f", "-newline", "\x1e", db)
+	cmd.Stdin = strings.NewReader(sql)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	Debugf("Executing sqlite3 " + db)
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(strings.TrimSpace(err.Error() + " " + stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// sqlQuote returns the given string as SQL string literal
+func sqlQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+func sqlFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+func sqlBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+// historyRuns returns the last g10k runs of the history database, the latest first
+func historyRuns(db string, limit int) ([]HistoryRun, error) {
+	rows, err := sqliteQuery(db, "SELECT r.id, r.started_at, r.duration, r.host, r.success, r.error,"+
+		" (SELECT count(*) FROM environments e WHERE e.run_id = r.id AND e.result = 'deployed'),"+
+		" (SELECT count(*) FROM environments e WHERE e.run_id = r.id AND e.result = 'failed'),"+
+		" (SELECT count(*) FROM environments e WHERE e.run_id = r.id)"+
+		" FROM runs r ORDER BY r.id DESC LIMIT "+strconv.Itoa(limit)+";\n")
+	if err != nil {
+		return nil, err
+	}
+	runs := []HistoryRun{}
+	for _, row := range rows {
+		if len(row) != 9 {
+			return nil, errors.New("unexpected row " + strings.Join(row, " "))
+		}
+		hr := HistoryRun{StartedAt: row[1], Host: row[3], Success: row[4] == "1", Error: row[5]}
+		hr.ID, _ = strconv.Atoi(row[0])
+		hr.Duration, _ = strconv.ParseFloat(row[2], 64)
+		hr.Deployed, _ = strconv.Atoi(row[6])
+		hr.Failed, _ = strconv.Atoi(row[7])
+		hr.Environments, _ = strconv.Atoi(row[8])
+		runs = append(runs, hr)
+	}
+	return runs, nil
+}
+
+// historyDeploys returns the last runs that deployed, held or failed the given Puppet environment with their module changes, the latest first
+func historyDeploys(db string, env string, limit int) ([]HistoryDeploy, error) {
+	rows, err := sqliteQuery(db, "SELECT r.id, r.started_at, e.commit_id, e.result, e.duration, e.error FROM environments e JOIN runs r ON r.id = e.run_id"+
+		" WHERE e.environment = "+sqlQuote(env)+" AND e.result <> 'unchanged' ORDER BY r.id DESC LIMIT "+strconv.Itoa(limit)+";\n")
+	if err != nil {
+		return nil, err
+	}
+	deploys := []HistoryDeploy{}
+	index := make(map[int]int)
+	var runIDs []string
+	for _, row := range rows {
+		if len(row) != 6 {
+			return nil, errors.New("unexpected row " + strings.Join(row, " "))
+		}
+		hd := HistoryDeploy{StartedAt: row[1], Commit: row[2], Result: row[3], Error: row[5], Changes: []ModuleChange{}}
+		hd.RunID, _ = strconv.Atoi(row[0])
+		hd.Duration, _ = strconv.ParseFloat(row[4], 64)
+		index[hd.RunID] = len(deploys)
+		runIDs = append(runIDs, row[0])
+		deploys = append(deploys, hd)
+	}
+	if len(runIDs) == 0 {
+		return deploys, nil
+	}
+	rows, err = sqliteQuery(db, "SELECT run_id, module, previous, version FROM modules WHERE environment = "+sqlQuote(env)+" AND changed = 1 AND run_id IN ("+strings.Join(runIDs, ", ")+") ORDER BY run_id, module;\n")
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if len(row) != 4 {
+			return nil, errors.New("unexpected row " + strings.Join(row, " "))
+		}
+		runID, _ := strconv.Atoi(row[0])
+		i := index[runID]
+		deploys[i].Changes = append(deploys[i].Changes, ModuleChange{Module: row[1], From: row[2], To: row[3]})
+	}
+	return deploys, nil
+}
+
+// historyCommand prints the last g10k runs or the deploys of the given Puppet environment from the history_db,
+// e.g. g10k history -config test.yaml or g10k history -config test.yaml production
+func historyCommand(args []string) {
+	fs := subcommandFlagSet("history")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	limit := fs.Int("limit", 20, "number of runs or deploys to print")
+	fs.StringVar(&outputFormat, "output", "text", "format of the history: text or json")
+	fs.Parse(args)
+	outputCommand = "history"
+	setupOutput()
+	if len(*configFileFlag) == 0 || fs.NArg() > 1 {
+		Fatalf("Error: you need to specify a config file and optionally one environment\nExample call: " + os.Args[0] + " history -config test.yaml production")
+	}
+	config = loadConfig(*configFileFlag)
+	if len(config.HistoryDB) == 0 {
+		Fatalf("Error: Setting history_db is not set in " + *configFileFlag)
+	}
+	if !fileExists(config.HistoryDB) {
+		Fatalf("Error: The history database " + config.HistoryDB + " does not exist yet, it is created by the next g10k run")
+	}
+
+	if fs.NArg() == 0 {
+		runs, err := historyRuns(config.HistoryDB, *limit)
+		if err != nil {
+			Fatalf("Error: Could not query the history database " + config.HistoryDB + ": " + err.Error())
+		}
+		if jsonOutput() {
+			printOutput(HistoryOutput{Command: "history", Runs: runs})
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RUN\tSTARTED\tDURATION\tHOST\tDEPLOYED\tFAILED\tRESULT")
+		for _, hr := range runs {
+			result := "ok"
+			if !hr.Success {
+				result = "failed"
+				if len(hr.Error) > 0 {
+					result += ": " + hr.Error
+				}
+			}
+			fmt.Fprintln(tw, strconv.Itoa(hr.ID)+"\t"+historyTime(hr.StartedAt)+"\t"+strconv.FormatFloat(hr.Duration, 'f', 1, 64)+"s\t"+hr.Host+"\t"+strconv.Itoa(hr.Deployed)+"/"+strconv.Itoa(hr.Environments)+"\t"+strconv.Itoa(hr.Failed)+"\t"+result)
+		}
+		tw.Flush()
+		return
+	}
+
+	env := fs.Arg(0)
+	deploys, err := historyDeploys(config.HistoryDB, env, *limit)
+	if err != nil {
+		Fatalf("Error: Could not query the history database " + config.HistoryDB + ": " + err.Error())
+	}
+	if jsonOutput() {
+		printOutput(EnvironmentHistoryOutput{Command: "history", Environment: env, Deploys: deploys})
+		return
+	}
+	if len(deploys) == 0 {
+		fmt.Println("No deploys of environment " + env + " in the history database " + config.HistoryDB)
+		return
+	}
+	for _, hd := range deploys {
+		line := historyTime(hd.StartedAt) + "  run " + strconv.Itoa(hd.RunID) + "  " + hd.Result
+		if len(hd.Commit) > 0 {
+			line += " " + shortCommit(hd.Commit)
+		}
+		if len(hd.Error) > 0 {
+			line += ": " + hd.Error
+		}
+		fmt.Println(line)
+		for _, mc := range hd.Changes {
+			from, to := "(new)", "(removed)"
+			if len(mc.From) > 0 {
+				from = mc.From
+			}
+			if len(mc.To) > 0 {
+				to = mc.To
+			}
+			fmt.Println("    " + mc.Module + " " + from + " -> " + to)
+		}
+	}
+}
+
+// historyTime returns the given RFC3339 time of the history database in the local time zone
+func historyTime(t string) string {
+	parsed, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return t
+	}
+	return parsed.Local().Format("2006-01-02 15:04:05")
+}
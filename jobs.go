@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDeployJobs is how many finished deploy jobs g10k serve remembers for /jobs
+const maxDeployJobs = 100
+
+// maxJobLogSize is how many bytes of the output of a deploy job g10k serve keeps, older output gets dropped
+const maxJobLogSize = 1 << 20
+
+var (
+	// deployJobs contains the deploy jobs of g10k serve by their ID, it is protected by the queueMutex
+	deployJobs = make(map[string]*DeployJob)
+	// deployJobIDs contains the IDs of the deploy jobs, oldest first
+	deployJobIDs []string
+)
+
+// jobLog keeps the end of the output of a deploy job
+type jobLog struct {
+	mutex sync.Mutex
+	buf   []byte
+}
+
+func (jl *jobLog) Write(p []byte) (int, error) {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	jl.buf = append(jl.buf, p...)
+	if len(jl.buf) > maxJobLogSize {
+		jl.buf = jl.buf[len(jl.buf)-maxJobLogSize:]
+	}
+	return len(p), nil
+}
+
+func (jl *jobLog) String() string {
+	jl.mutex.Lock()
+	defer jl.mutex.Unlock()
+	return reANSIColor.ReplaceAllString(string(jl.buf), "")
+}
+
+// newDeployJob registers a queued deploy job with a random ID and forgets the oldest finished jobs, the caller has to hold the queueMutex
+func newDeployJob(description string) *DeployJob {
+	id := make([]byte, 8)
+	rand.Read(id)
+	job := &DeployJob{ID: hex.EncodeToString(id), Description: description, Status: "queued", QueuedAt: time.Now(), log: &jobLog{}}
+	deployJobs[job.ID] = job
+	deployJobIDs = append(deployJobIDs, job.ID)
+	for i := 0; i < len(deployJobIDs) && len(deployJobIDs) > maxDeployJobs; i++ {
+		if status := deployJobs[deployJobIDs[i]].Status; status != "queued" && status != "running" {
+			delete(deployJobs, deployJobIDs[i])
+			deployJobIDs = append(deployJobIDs[:i], deployJobIDs[i+1:]...)
+			i--
+		}
+	}
+	return job
+}
+
+// startDeployJob marks the given deploy job as running, the caller has to hold the queueMutex
+func startDeployJob(job *DeployJob) {
+	now := time.Now()
+	job.Status = "running"
+	job.StartedAt = &now
+}
+
+// finishDeployJob marks the given deploy job as succeeded or, with an error message, as failed
+func finishDeployJob(job *DeployJob, message string) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = "succeeded"
+	if len(message) > 0 {
+		job.Status = "failed"
+		job.Error = message
+	}
+}
+
+// jobsHandler lists the deploy jobs of g10k serve, newest first, or returns a single job including its output with /jobs/<id>
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jobs"), "/")
+	queueMutex.Lock()
+	if len(id) > 0 {
+		job, ok := deployJobs[id]
+		var result DeployJob
+		if ok {
+			result = *job
+		}
+		queueMutex.Unlock()
+		if !ok {
+			http.Error(w, "unknown job "+id, http.StatusNotFound)
+			return
+		}
+		result.Log = result.log.String()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+		return
+	}
+	jobs := []DeployJob{}
+	for i := len(deployJobIDs) - 1; i >= 0; i-- {
+		jobs = append(jobs, *deployJobs[deployJobIDs[i]])
+	}
+	queueMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeployJobs{Jobs: jobs})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// journaldSocket is the socket of the native protocol of the systemd journal
+var journaldSocket = "/run/systemd/journal/socket"
+
+// journaldLogging is set with the journald setting to send the log messages to the systemd journal
+var journaldLogging bool
+
+// journaldMutex protects journaldConn
+var journaldMutex sync.Mutex
+
+// journaldConn is the connection to the journald socket, which is opened with the first log message
+var journaldConn *net.UnixConn
+
+// logToJournald sends the given log record with its environment, module, result, phase and duration as G10K_* fields to the systemd journal,
+// e.g. journalctl G10K_ENVIRONMENT=production. Errors are ignored, as there is no other place to log them to.
+func logToJournald(record LogRecord) {
+	var entry bytes.Buffer
+	fields := [][]string{
+		{"MESSAGE", record.Message},
+		{"PRIORITY", strconv.Itoa(logSeverities[record.Level])},
+		{"SYSLOG_IDENTIFIER", "g10k"},
+		{"G10K_LEVEL", record.Level},
+		{"G10K_ENVIRONMENT", record.Environment},
+		{"G10K_MODULE", record.Module},
+		{"G10K_RESULT", record.Result},
+		{"G10K_PHASE", record.Phase},
+	}
+	if record.Duration > 0 {
+		fields = append(fields, []string{"G10K_DURATION", strconv.FormatFloat(record.Duration, 'f', -1, 64)})
+	}
+	for _, field := range fields {
+		if len(field[1]) == 0 {
+			continue
+		}
+		if strings.Contains(field[1], "\n") {
+			// values with newlines are sent with their length as 64 bit little endian
+			entry.WriteString(field[0] + "\n")
+			binary.Write(&entry, binary.LittleEndian, uint64(len(field[1])))
+			entry.WriteString(field[1] + "\n")
+		} else {
+			entry.WriteString(field[0] + "=" + field[1] + "\n")
+		}
+	}
+
+	journaldMutex.Lock()
+	defer journaldMutex.Unlock()
+	if journaldConn == nil {
+		conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+		if err != nil {
+			return
+		}
+		journaldConn = conn
+	}
+	if _, err := journaldConn.Write(entry.Bytes()); err != nil {
+		journaldConn.Close()
+		journaldConn = nil
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// kvStore is a Consul or etcd key value store to which g10k publishes the deploy state of every Puppet environment with kv_publish
+type kvStore interface {
+	put(key string, value []byte) error
+	delete(key string) error
+}
+
+// newKVStore returns the key value store and key prefix of the given kv_publish setting, e.g. consul://localhost:8500/g10k/environments or etcd://localhost:2379/g10k/environments
+func newKVStore(spec string) (kvStore, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if len(u.Host) == 0 || len(prefix) == 0 {
+		return nil, errors.New("expected <type>://<host>:<port>/<key prefix>")
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	scheme := "http"
+	if strings.HasSuffix(u.Scheme, "+https") {
+		scheme = "https"
+	}
+	switch strings.TrimSuffix(u.Scheme, "+https") {
+	case "consul":
+		return &consulKV{address: scheme + "://" + u.Host, prefix: prefix, client: client}, nil
+	case "etcd":
+		return &etcdKV{address: scheme + "://" + u.Host, prefix: prefix, client: client}, nil
+	}
+	return nil, errors.New("unsupported key value store " + u.Scheme + ", supported are consul:// and etcd://")
+}
+
+// consulKV writes the keys with the Consul HTTP API, the token is taken from CONSUL_HTTP_TOKEN
+type consulKV struct {
+	address string
+	prefix  string
+	client  *http.Client
+}
+
+func (ckv *consulKV) put(key string, value []byte) error {
+	_, err := consulRequest(ckv.client, "PUT", ckv.address+"/v1/kv/"+ckv.prefix+"/"+key, value, nil)
+	return err
+}
+
+func (ckv *consulKV) delete(key string) error {
+	_, err := consulRequest(ckv.client, "DELETE", ckv.address+"/v1/kv/"+ckv.prefix+"/"+key, nil, nil)
+	return err
+}
+
+// etcdKV writes the keys with the JSON gateway of the etcd v3 API
+type etcdKV struct {
+	address string
+	prefix  string
+	client  *http.Client
+}
+
+// post sends the given request with base64 encoded key and value to the etcd v3 JSON gateway
+func (ekv *etcdKV) post(path string, request map[string]string) error {
+	payload, _ := json.Marshal(request)
+	resp, err := ekv.client.Post(ekv.address+path, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("POST " + ekv.address + path + " returned " + resp.Status)
+	}
+	return nil
+}
+
+func (ekv *etcdKV) put(key string, value []byte) error {
+	return ekv.post("/v3/kv/put", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(ekv.prefix + "/" + key)), "value": base64.StdEncoding.EncodeToString(value)})
+}
+
+func (ekv *etcdKV) delete(key string) error {
+	return ekv.post("/v3/kv/deleterange", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(ekv.prefix + "/" + key))})
+}
+
+// publishKVState writes the deploy state of every deployed Puppet environment as JSON to the key <prefix>/<environment> of the kv_publish store and removes the keys of purged environments.
+// Only changed keys are written, so that watches of the key value store only fire if an environment was deployed. Errors are only logged, as the deploy itself succeeded.
+func publishKVState() {
+	if len(config.KVPublish) == 0 || dryRun {
+		return
+	}
+	store, err := newKVStore(config.KVPublish)
+	if err != nil {
+		return
+	}
+	publishedFile := filepath.Join(config.CacheDir, "kv-published.json")
+	previous := make(map[string]string)
+	if content, err := ioutil.ReadFile(publishedFile); err == nil {
+		json.Unmarshal(content, &previous)
+	}
+	published := make(map[string]string)
+	for _, es := range environmentStatuses() {
+		mutex.Lock()
+		es.LastFailure = environmentFailures[es.Environment]
+		mutex.Unlock()
+		value, _ := json.Marshal(es)
+		if previous[es.Environment] == string(value) {
+			published[es.Environment] = string(value)
+			continue
+		}
+		if err := store.put(es.Environment, value); err != nil {
+			Warnf("WARNING: Could not publish the deploy state of environment " + es.Environment + " to " + config.KVPublish + ": " + err.Error())
+			continue
+		}
+		Debugf("Published the deploy state of environment " + es.Environment + " to " + config.KVPublish)
+		published[es.Environment] = string(value)
+	}
+	for env, value := range previous {
+		if _, ok := published[env]; ok {
+			continue
+		}
+		if err := store.delete(env); err != nil {
+			Warnf("WARNING: Could not remove the deploy state of environment " + env + " from " + config.KVPublish + ": " + err.Error())
+			published[env] = value
+			continue
+		}
+		Debugf("Removed the deploy state of environment " + env + " from " + config.KVPublish)
+	}
+	writeStructJSONFile(publishedFile, published)
+}
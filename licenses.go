@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// ModuleLicense is the license of a deployed module from its metadata.json and its status in the license_policy: ok, unknown or denied
+type ModuleLicense struct {
+	Module  string `json:"module"`
+	Type    string `json:"type"`
+	License string `json:"license"`
+	Status  string `json:"status"`
+}
+
+// moduleLicense returns the license field of the metadata.json of the given module directory, or an empty string if the module has none
+func moduleLicense(moduleDir string) string {
+	content, err := ioutil.ReadFile(filepath.Join(moduleDir, "metadata.json"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(gjson.Get(string(content), "license").String())
+}
+
+// licenseStatus returns the status of the given license in the license_policy: denied if it is on the denied list, or if it is unknown and deny_unknown is set,
+// unknown if the module has no license or it is not on a non-empty allowed list, ok otherwise
+func licenseStatus(license string) string {
+	policy := config.LicensePolicy
+	for _, denied := range policy.Denied {
+		if strings.EqualFold(license, denied) {
+			return "denied"
+		}
+	}
+	unknown := len(license) == 0
+	if !unknown && len(policy.Allowed) > 0 {
+		unknown = true
+		for _, allowed := range policy.Allowed {
+			if strings.EqualFold(license, allowed) {
+				unknown = false
+				break
+			}
+		}
+	}
+	switch {
+	case unknown && policy.DenyUnknown:
+		return "denied"
+	case unknown:
+		return "unknown"
+	}
+	return "ok"
+}
+
+// environmentLicenses returns the licenses of all modules in the deploy manifest of the given Puppet environment directory
+func environmentLicenses(envDir string) ([]ModuleLicense, error) {
+	content, err := ioutil.ReadFile(filepath.Join(envDir, ".g10k-manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var manifest DeployManifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, err
+	}
+	licenses := []ModuleLicense{}
+	for _, m := range manifest.Modules {
+		license := moduleLicense(filepath.Join(envDir, m.Path))
+		licenses = append(licenses, ModuleLicense{Module: m.Name, Type: m.Type, License: license, Status: licenseStatus(license)})
+	}
+	return licenses, nil
+}
+
+// licenseSummary returns the number of modules per license of a Puppet environment, e.g. 9 Apache-2.0, 2 MIT, 1 unknown
+func licenseSummary(licenses []ModuleLicense) string {
+	counts := make(map[string]int)
+	for _, ml := range licenses {
+		license := ml.License
+		if len(license) == 0 {
+			license = "unknown"
+		}
+		counts[license]++
+	}
+	var names []string
+	for license := range counts {
+		names = append(names, license)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var summary []string
+	for _, license := range names {
+		summary = append(summary, strconv.Itoa(counts[license])+" "+license)
+	}
+	return strings.Join(summary, ", ")
+}
+
+// licensesCommand prints the licenses of the deployed modules of every Puppet environment and flags the unknown and denied licenses of the license_policy,
+// e.g. g10k licenses -config test.yaml exits with 1 if a module with a denied license is deployed
+func licensesCommand(args []string) {
+	fs := subcommandFlagSet("licenses")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	environment := fs.String("environment", "", "only list the licenses of this Puppet environment")
+	fs.StringVar(&outputFormat, "output", "text", "format of the licenses: text or json")
+	fs.Parse(args)
+	outputCommand = "licenses"
+	setupOutput()
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " licenses -config test.yaml")
+	}
+
+	config = loadConfig(*configFileFlag)
+
+	output := LicensesOutput{Command: "licenses", Environments: make(map[string][]ModuleLicense)}
+	for _, source := range sortedSourceNames() {
+		sa := config.Sources[source]
+		entries, _ := ioutil.ReadDir(sa.Basedir)
+		for _, entry := range entries {
+			env := entry.Name()
+			envDir := filepath.Join(sa.Basedir, env)
+			if strings.HasPrefix(env, ".") || reEnvironmentVersion.MatchString(env) || isStagingDir(envDir) || !isDir(envDir) {
+				continue
+			}
+			if len(*environment) > 0 && env != *environment {
+				continue
+			}
+			licenses, err := environmentLicenses(envDir)
+			if err != nil {
+				Warnf("WARNING: No deploy manifest found for environment " + env + ", deploy it with g10k first")
+				continue
+			}
+			output.Environments[env] = licenses
+			if !jsonOutput() {
+				fmt.Println("Environment " + env + ": " + licenseSummary(licenses))
+			}
+			for _, ml := range licenses {
+				switch ml.Status {
+				case "unknown":
+					output.Unknown++
+				case "denied":
+					output.Denied++
+				default:
+					continue
+				}
+				if jsonOutput() {
+					continue
+				}
+				license := ml.License
+				if len(license) == 0 {
+					license = "no license in metadata.json"
+				}
+				fmt.Println("  " + ml.Status + ": " + ml.Type + " module " + ml.Module + " (" + license + ")")
+			}
+		}
+	}
+	if jsonOutput() {
+		printOutput(output)
+	} else if output.Unknown+output.Denied > 0 {
+		fmt.Println("Found " + strconv.Itoa(output.Denied) + " module(s) with a denied and " + strconv.Itoa(output.Unknown) + " with an unknown license")
+	}
+	if output.Denied > 0 {
+		os.Exit(exitFailure)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// listTime returns the given deploy time in the local time zone for the tables of g10k status and g10k list, or - if it is unknown
+func listTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format("2006-01-02 15:04:05")
+}
+
+// deployedManifests returns the deploy manifests of the deployed Puppet environments of all sources, or only of the given environment
+func deployedManifests(env string) map[string]DeployManifest {
+	manifests := make(map[string]DeployManifest)
+	for _, es := range environmentStatuses() {
+		if len(env) > 0 && es.Environment != env {
+			continue
+		}
+		envDir := filepath.Join(config.Sources[es.Source].Basedir, es.Environment)
+		content, err := ioutil.ReadFile(filepath.Join(envDir, ".g10k-manifest.json"))
+		if err != nil {
+			Warnf("WARNING: No deploy manifest found for environment " + es.Environment + ", deploy it with g10k first")
+			continue
+		}
+		var manifest DeployManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			Warnf("WARNING: Could not parse the deploy manifest of environment " + es.Environment + ": " + err.Error())
+			continue
+		}
+		manifests[es.Environment] = manifest
+	}
+	return manifests
+}
+
+// listSubcommand prints the deployed Puppet environments or the deployed modules of all or one environment from their deploy result and manifest files without resolving anything,
+// e.g. g10k list environments -config test.yaml or g10k list modules production -config test.yaml
+func listSubcommand(args []string) {
+	fs := subcommandFlagSet("list")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	fs.StringVar(&outputFormat, "output", "text", "format of the list: text or json")
+	fs.Parse(args)
+	// allow the flags before and after the arguments
+	var positional []string
+	for fs.NArg() > 0 {
+		positional = append(positional, fs.Arg(0))
+		fs.Parse(fs.Args()[1:])
+	}
+	outputCommand = "list"
+	setupOutput()
+	if len(positional) == 0 || (positional[0] != "environments" && positional[0] != "modules") || (positional[0] == "environments" && len(positional) > 1) || len(positional) > 2 {
+		Fatalf("Error: you need to specify what to list: environments or modules [environment]\nExample call: " + os.Args[0] + " list environments -config test.yaml or " + os.Args[0] + " list modules production -config test.yaml")
+	}
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " list " + positional[0] + " -config test.yaml")
+	}
+
+	config = loadConfig(*configFileFlag)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if positional[0] == "environments" {
+		environments := environmentStatuses()
+		if jsonOutput() {
+			printOutput(ListOutput{Command: "list", Environments: environments})
+			return
+		}
+		fmt.Fprintln(tw, "ENVIRONMENT\tSOURCE\tBRANCH\tCOMMIT\tDEPLOYED")
+		for _, es := range environments {
+			fmt.Fprintln(tw, es.Environment+"\t"+es.Source+"\t"+es.Branch+"\t"+shortCommit(es.Commit)+"\t"+listTime(es.DeployedAt))
+		}
+		tw.Flush()
+		return
+	}
+
+	env := ""
+	if len(positional) > 1 {
+		env = positional[1]
+	}
+	manifests := deployedManifests(env)
+	if len(env) > 0 && len(manifests) == 0 {
+		Fatalf("Error: environment " + env + " is not deployed")
+	}
+	modules := make(map[string][]ManifestModule)
+	for name, manifest := range manifests {
+		modules[name] = manifest.Modules
+	}
+	if jsonOutput() {
+		printOutput(ListOutput{Command: "list", Modules: modules})
+		return
+	}
+	fmt.Fprintln(tw, "ENVIRONMENT\tMODULE\tTYPE\tVERSION\tSOURCE\tDEPLOYED")
+	var envs []string
+	for name := range manifests {
+		envs = append(envs, name)
+	}
+	sort.Strings(envs)
+	for _, name := range envs {
+		for _, m := range manifests[name].Modules {
+			version := m.Resolved
+			if m.Type == "git" {
+				version = shortCommit(version)
+			}
+			if len(version) == 0 {
+				version = "-"
+			}
+			fmt.Fprintln(tw, name+"\t"+m.Name+"\t"+m.Type+"\t"+version+"\t"+m.Source+"\t"+listTime(m.DeployedAt))
+		}
+	}
+	tw.Flush()
+}
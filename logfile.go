@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultLogFileMaxSize is the size in MB at which the log_file gets rotated if log_file max_size is not set
+const defaultLogFileMaxSize = 100
+
+// logFileTimeFormat is the suffix of the rotated log files
+const logFileTimeFormat = "2006-01-02T15-04-05.000"
+
+// logFile is the log_file that the log helpers write to in addition to stdout and stderr, it is nil if log_file is not configured
+var logFile *rotatingLogFile
+
+// rotatingLogFile is a log file that gets rotated once it reaches its maximum size or rotate_interval.
+// Several g10k processes can write to the same file, e.g. g10k serve and its g10k runs, every one of them notices when another one rotated it.
+type rotatingLogFile struct {
+	mutex     sync.Mutex
+	settings  LogFileSettings
+	file      *os.File
+	size      int64
+	rotatedAt time.Time
+}
+
+// openLogFile starts writing the log messages to the configured log_file, it is called again after the config got reloaded
+func openLogFile() {
+	if logFile != nil {
+		logFile.mutex.Lock()
+		unchanged := logFile.settings == config.LogFile
+		logFile.mutex.Unlock()
+		if unchanged {
+			return
+		}
+		logFile.close()
+		logFile = nil
+	}
+	if len(config.LogFile.Path) == 0 {
+		return
+	}
+	if err := ensureDir(filepath.Dir(config.LogFile.Path)); err != nil {
+		Fatalf("Error: could not create the directory of the log_file " + config.LogFile.Path + ": " + err.Error())
+	}
+	lf := &rotatingLogFile{settings: config.LogFile, rotatedAt: time.Now()}
+	if backups := lf.backups(); len(backups) > 0 {
+		if t, err := time.ParseInLocation(logFileTimeFormat, strings.TrimPrefix(backups[len(backups)-1], config.LogFile.Path+"."), time.Local); err == nil {
+			lf.rotatedAt = t
+		}
+	}
+	if err := lf.open(); err != nil {
+		Fatalf("Error: could not open the log_file " + config.LogFile.Path + ": " + err.Error())
+	}
+	logFile = lf
+}
+
+// logToFile writes the given log record to the log_file as a text line or, with -log-format json, as JSON
+func logToFile(record LogRecord) {
+	var line []byte
+	if jsonLogging() {
+		line, _ = json.Marshal(record)
+	} else {
+		line = []byte(time.Now().Format("2006/01/02 15:04:05") + " " + strings.ToUpper(record.Level) + " " + record.Message)
+	}
+	logFile.write(append(line, '\n'))
+}
+
+func (lf *rotatingLogFile) open() error {
+	f, err := os.OpenFile(lf.settings.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	lf.file = f
+	lf.size = fi.Size()
+	return nil
+}
+
+func (lf *rotatingLogFile) close() {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if lf.file != nil {
+		lf.file.Close()
+		lf.file = nil
+	}
+}
+
+// write appends the given line to the log file and rotates it before if it would exceed its max_size or its rotate_interval passed.
+// Errors are ignored, as there is no other place to log them to.
+func (lf *rotatingLogFile) write(line []byte) {
+	lf.mutex.Lock()
+	defer lf.mutex.Unlock()
+	if lf.file == nil {
+		return
+	}
+	// another g10k process rotated the log file
+	if current, err := os.Stat(lf.settings.Path); err != nil || !lf.isCurrentFile(current) {
+		lf.file.Close()
+		if lf.open() != nil {
+			lf.file = nil
+			return
+		}
+		lf.rotatedAt = time.Now()
+	}
+	maxSize := int64(lf.settings.MaxSize)
+	if maxSize <= 0 {
+		maxSize = defaultLogFileMaxSize
+	}
+	interval, _ := time.ParseDuration(lf.settings.RotateInterval)
+	if lf.size > 0 && (lf.size+int64(len(line)) > maxSize*1024*1024 || (interval > 0 && time.Since(lf.rotatedAt) >= interval)) {
+		lf.rotate()
+		if lf.file == nil {
+			return
+		}
+	}
+	n, _ := lf.file.Write(line)
+	lf.size += int64(n)
+}
+
+// isCurrentFile returns true if the open file of the log file is still the file at its path
+func (lf *rotatingLogFile) isCurrentFile(current os.FileInfo) bool {
+	fi, err := lf.file.Stat()
+	return err == nil && os.SameFile(fi, current)
+}
+
+// rotate renames the log file with the time of the rotation as suffix, opens a new one and removes the rotated files beyond max_backups or older than max_age
+func (lf *rotatingLogFile) rotate() {
+	now := time.Now()
+	lf.file.Close()
+	lf.file = nil
+	if current, err := os.Stat(lf.settings.Path); err == nil && current.Size() > 0 {
+		os.Rename(lf.settings.Path, lf.settings.Path+"."+now.Format(logFileTimeFormat))
+	}
+	lf.rotatedAt = now
+	if lf.open() != nil {
+		lf.file = nil
+	}
+	backups := lf.backups()
+	maxAge, _ := time.ParseDuration(lf.settings.MaxAge)
+	for i, backup := range backups {
+		tooMany := lf.settings.MaxBackups > 0 && i < len(backups)-lf.settings.MaxBackups
+		tooOld := false
+		if fi, err := os.Stat(backup); err == nil && maxAge > 0 {
+			tooOld = now.Sub(fi.ModTime()) > maxAge
+		}
+		if tooMany || tooOld {
+			os.Remove(backup)
+		}
+	}
+}
+
+// backups returns the rotated log files, the oldest first
+func (lf *rotatingLogFile) backups() []string {
+	backups, _ := filepath.Glob(lf.settings.Path + ".*")
+	var rotated []string
+	for _, backup := range backups {
+		if _, err := time.Parse(logFileTimeFormat, strings.TrimPrefix(backup, lf.settings.Path+".")); err == nil {
+			rotated = append(rotated, backup)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the log levels of -log-level, every level includes the messages of the levels before it
+const (
+	logLevelError = iota
+	logLevelWarn
+	logLevelInfo
+	logLevelDebug
+	logLevelTrace
+)
+
+// logLevels maps the supported values of -log-level to their log level
+var logLevels = map[string]int{"error": logLevelError, "warn": logLevelWarn, "info": logLevelInfo, "debug": logLevelDebug, "trace": logLevelTrace}
+
+// logLevelParam is the -log-level, without it the log level follows the -debug, -verbose and -info parameters
+var logLevelParam string
+
+// logFormat is text for the colored log lines or json for one LogRecord per line, set by -log-format
+var logFormat = "text"
+
+// logMutex keeps the JSON log records of concurrent goroutines from being interleaved
+var logMutex sync.Mutex
+
+var (
+	reLogEnvironment = regexp.MustCompile(`\b(?:[Ee]nvironment|environment\(s\)) ['"]?([\w.@-]+)`)
+	reLogModule      = regexp.MustCompile(`\b[Mm]odule ['"]?([\w./@-]+)`)
+	reLogFailure     = regexp.MustCompile(`(?i)\b(?:failed|could not|error)\b`)
+	reLogSuccess     = regexp.MustCompile(`^(?:Deployed|Synced|Successfully)\b`)
+	reLogDuration    = regexp.MustCompile(`\b(?:took|in|after) ([0-9]+(?:\.[0-9]+)?(?:ns|µs|us|ms|s|m|h)(?:[0-9.]+(?:ms|s|m))*)\b`)
+	// logNameStopwords are the words following environment or module in log messages that are not a name
+	logNameStopwords = map[string]struct{}{"cache": empty, "caches": empty, "directory": empty, "dir": empty, "name": empty, "of": empty, "to": empty, "and": empty, "with": empty, "is": empty, "pipelines": empty}
+)
+
+// LogRecord is a log line of g10k with -log-format json, the environment, module, duration and result are taken from the message if it names them
+type LogRecord struct {
+	Level       string  `json:"level"`
+	Time        string  `json:"time"`
+	Phase       string  `json:"phase,omitempty"`
+	Environment string  `json:"environment,omitempty"`
+	Module      string  `json:"module,omitempty"`
+	Duration    float64 `json:"duration,omitempty"`
+	Result      string  `json:"result,omitempty"`
+	Message     string  `json:"message"`
+}
+
+// jsonLogging returns true if the log lines are written as JSON records
+func jsonLogging() bool {
+	return logFormat == "json"
+}
+
+// newLogRecord returns the record of the given log message, whose phase is the name of the function that logged it.
+// skip is the number of stack frames between the logging function and newLogRecord.
+func newLogRecord(level string, message string, skip int) LogRecord {
+	record := LogRecord{Level: level, Time: time.Now().UTC().Format(time.RFC3339Nano), Message: message}
+	if pc, _, _, ok := runtime.Caller(skip + 1); ok {
+		name := runtime.FuncForPC(pc).Name()
+		name = name[strings.LastIndex(name, ".")+1:]
+		// anonymous functions are named func1, func2 and so on
+		if !strings.HasPrefix(name, "func") {
+			record.Phase = name
+		}
+	}
+	record.Environment = logName(reLogEnvironment, message)
+	record.Module = logName(reLogModule, message)
+	if m := reLogDuration.FindStringSubmatch(message); m != nil {
+		if d, err := time.ParseDuration(strings.Replace(m[1], "us", "µs", 1)); err == nil {
+			record.Duration = d.Seconds()
+		}
+	}
+	if level == "error" || reLogFailure.MatchString(message) {
+		record.Result = "failure"
+	} else if reLogSuccess.MatchString(message) {
+		record.Result = "success"
+	}
+	return record
+}
+
+// logName returns the environment or module name that the given regex finds in the log message
+func logName(re *regexp.Regexp, message string) string {
+	for _, m := range re.FindAllStringSubmatch(message, -1) {
+		name := strings.TrimRight(m[1], ".")
+		if _, stopword := logNameStopwords[name]; !stopword && len(name) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// writeLogRecord writes the given log message as a JSON record to w
+func writeLogRecord(w io.Writer, level string, message string) {
+	record := newLogRecord(level, message, 2)
+	logMutex.Lock()
+	json.NewEncoder(w).Encode(record)
+	logMutex.Unlock()
+}
+
+// currentLogLevel returns the -log-level or the log level of the -debug (trace), -verbose (debug) and -info (info) parameters, the default is warn
+func currentLogLevel() int {
+	if level, ok := logLevels[logLevelParam]; ok {
+		return level
+	}
+	switch {
+	case debug:
+		return logLevelTrace
+	case verbose:
+		return logLevelDebug
+	case info:
+		return logLevelInfo
+	}
+	return logLevelWarn
+}
+
+// logLevelEnabled returns true if messages of the given log level are logged
+func logLevelEnabled(level int) bool {
+	return currentLogLevel() >= level
+}
+
+// validateLogLevel exits if the -log-level is not supported, -log-level error also suppresses the summary of the g10k run like -quiet
+func validateLogLevel() {
+	if len(logLevelParam) == 0 {
+		return
+	}
+	if _, ok := logLevels[logLevelParam]; !ok {
+		unsupported := logLevelParam
+		logLevelParam = ""
+		Fatalf("Error: Unsupported -log-level " + unsupported + " Supported are error, warn, info, debug and trace")
+	}
+	if logLevelParam == "error" {
+		quiet = true
+	}
+}
+
+// openLogOutputs opens the log_file, syslog and journald outputs of the config, it is called again after the config got reloaded
+func openLogOutputs() {
+	openLogFile()
+	openSyslog()
+	journaldLogging = config.Journald
+}
+
+// logToOutputs writes the given log message to the log_file, syslog and journald if they are configured
+func logToOutputs(level string, message string) {
+	if logFile == nil && syslogOutput == nil && !journaldLogging {
+		return
+	}
+	record := newLogRecord(level, message, 2)
+	if logFile != nil {
+		logToFile(record)
+	}
+	if syslogOutput != nil {
+		syslogOutput.write(record)
+	}
+	if journaldLogging {
+		logToJournald(record)
+	}
+}
+
+// validateLogFormat exits if the -log-format is not supported
+func validateLogFormat() {
+	if logFormat != "text" && logFormat != "json" {
+		unsupported := logFormat
+		// the text format is used for this error
+		logFormat = "text"
+		Fatalf("Error: Unsupported -log-format " + unsupported + " Supported are text and json")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeDeployManifest writes the .g10k-manifest.json file with every module of the given Puppet environment and its resolved version.
+// The checksum and deploy timestamp of a module are only updated if its resolved version changed, so that the file stays the same if nothing changed.
+func writeDeployManifest(env string, pf Puppetfile, dr DeployResult) DeployManifest {
+	manifestFile := filepath.Join(pf.workDir, ".g10k-manifest.json")
+	previousModules := make(map[string]ManifestModule)
+	if content, err := ioutil.ReadFile(manifestFile); err == nil {
+		var previous DeployManifest
+		if err := json.Unmarshal(content, &previous); err == nil {
+			for _, m := range previous.Modules {
+				previousModules[m.Type+":"+m.Name] = m
+			}
+		}
+	}
+
+	manifest := DeployManifest{Environment: env, Source: pf.source, Branch: pf.controlRepoBranch, Commit: dr.Signature, Modules: []ManifestModule{}}
+	for name, gm := range pf.gitModules {
+		moduleDirectory := filepath.Join(pf.workDir, gm.moduleDir, name)
+		if len(gm.installPath) > 0 {
+			moduleDirectory = filepath.Join(pf.workDir, gm.installPath, name)
+		}
+		m := ManifestModule{Name: name, Type: "git", Source: gm.git}
+		if gm.local {
+			m.Type = "local"
+		} else {
+			for _, requested := range []string{gm.ref, gm.commit, gm.tag, gm.branch} {
+				if len(requested) > 0 {
+					m.Requested = requested
+					break
+				}
+			}
+			resolved, _ := ioutil.ReadFile(filepath.Join(moduleDirectory, ".latest_commit"))
+			m.Resolved = strings.TrimSpace(string(resolved))
+		}
+		manifest.Modules = append(manifest.Modules, manifestModule(m, pf.workDir, moduleDirectory, previousModules))
+	}
+	for _, fm := range pf.forgeModules {
+		moduleDirectory := filepath.Join(pf.workDir, fm.moduleDir, fm.name)
+		source := config.ForgeBaseURL
+		if len(fm.baseURL) > 0 {
+			source = fm.baseURL
+		} else if len(pf.forgeBaseURL) > 0 {
+			source = pf.forgeBaseURL
+		}
+		m := ManifestModule{Name: fm.author + "/" + fm.name, Type: "forge", Source: source, Requested: fm.version}
+		if metadataFile := filepath.Join(moduleDirectory, "metadata.json"); fileExists(metadataFile) {
+			m.Resolved = readModuleMetadata(metadataFile).version
+		}
+		manifest.Modules = append(manifest.Modules, manifestModule(m, pf.workDir, moduleDirectory, previousModules))
+	}
+	if len(moduleParam) > 0 {
+		// only the -module got deployed, all other modules are still the ones of the previous manifest
+		for _, m := range previousModules {
+			if m.Name != moduleParam && !strings.HasSuffix(m.Name, "/"+moduleParam) {
+				manifest.Modules = append(manifest.Modules, m)
+			}
+		}
+	}
+	sort.Slice(manifest.Modules, func(i, j int) bool {
+		if manifest.Modules[i].Name != manifest.Modules[j].Name {
+			return manifest.Modules[i].Name < manifest.Modules[j].Name
+		}
+		return manifest.Modules[i].Type < manifest.Modules[j].Type
+	})
+	recordModuleChanges(env, previousModules, manifest.Modules)
+
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		Warnf("Could not encode JSON file " + manifestFile + " " + err.Error())
+		return manifest
+	}
+	if existing, err := ioutil.ReadFile(manifestFile); err == nil && bytes.Equal(existing, content) {
+		return manifest
+	}
+	Debugf("Writing deploy manifest " + manifestFile)
+	if err := writeFileAtomic(manifestFile, content, 0644); err != nil {
+		Warnf("Could not write JSON file " + manifestFile + " " + err.Error())
+	}
+	applyOwnership(manifestFile)
+	return manifest
+}
+
+// manifestModule completes the given module entry with its path, checksum and deploy timestamp, which are taken from the previous manifest if the module did not change
+func manifestModule(m ManifestModule, workDir string, moduleDirectory string, previousModules map[string]ManifestModule) ManifestModule {
+	m.Path, _ = filepath.Rel(workDir, moduleDirectory)
+	if previous, ok := previousModules[m.Type+":"+m.Name]; ok && previous.Resolved == m.Resolved && previous.Requested == m.Requested && previous.Path == m.Path && m.Type != "local" {
+		m.Checksum = previous.Checksum
+		m.DeployedAt = previous.DeployedAt
+		return m
+	}
+	if isDir(moduleDirectory) {
+		m.Checksum = directoryChecksum(moduleDirectory)
+	}
+	m.DeployedAt = time.Now().UTC().Truncate(time.Second)
+	return m
+}
+
+// directoryChecksum returns a SHA256 checksum over the relative paths and contents of all files inside of the given directory
+func directoryChecksum(dir string) string {
+	hash := sha256.New()
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return ""
+	}
+	filepath.Walk(resolvedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || info.Name() == ".latest_commit" {
+			return nil
+		}
+		relPath, _ := filepath.Rel(resolvedDir, path)
+		hash.Write([]byte(relPath + "\x00"))
+		if info.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(path)
+			hash.Write([]byte("symlink:" + link + "\x00"))
+		} else if fileHash, err := fileSha256(path); err == nil {
+			hash.Write(fileHash)
+		}
+		return nil
+	})
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
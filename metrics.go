@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxStatsDPacket is the maximum size of a StatsD UDP packet that does not get fragmented on common networks
+const maxStatsDPacket = 1432
+
+// cacheStats counts the git repositories and Forge modules that were served from the g10k cache or had to be cloned or downloaded
+var cacheStats struct {
+	gitHits, gitMisses     int64
+	forgeHits, forgeMisses int64
+}
+
+// environmentDurations contains the time from the start of the g10k run until every Puppet environment was deployed completely
+var environmentDurations = make(map[string]time.Duration)
+
+// metricsSent is set once the metrics of this g10k run are sent, so that a failure afterwards does not send them again
+var metricsSent bool
+
+// metric is a StatsD counter (c), gauge (g) or timer (ms)
+type metric struct {
+	name  string
+	value float64
+	kind  string
+}
+
+// recordEnvironmentDuration remembers when the given Puppet environment was deployed completely
+func recordEnvironmentDuration(env string) {
+	mutex.Lock()
+	environmentDurations[env] = time.Since(outputStart)
+	mutex.Unlock()
+}
+
+// sendMetrics sends the metrics of the g10k run and of every Puppet environment to the configured StatsD and Graphite servers, fatal is the error that aborted it.
+// Metrics that can not be sent only get a warning.
+func sendMetrics(fatal string) {
+	if (len(config.Metrics.StatsD) == 0 && len(config.Metrics.Graphite) == 0) || metricsSent || validate || dryRun || check4update || outputCommand != "deploy" {
+		return
+	}
+	metricsSent = true
+	metrics := runMetrics(fatal)
+	prefix := config.Metrics.Prefix
+	if len(prefix) == 0 {
+		prefix = "g10k"
+	}
+	if len(config.Metrics.StatsD) > 0 {
+		if err := sendStatsD(config.Metrics.StatsD, prefix, metrics); err != nil {
+			Warnf("WARNING: Could not send the metrics to StatsD " + config.Metrics.StatsD + ": " + err.Error())
+		}
+	}
+	if len(config.Metrics.Graphite) > 0 {
+		if err := sendGraphite(config.Metrics.Graphite, prefix, metrics); err != nil {
+			Warnf("WARNING: Could not send the metrics to Graphite " + config.Metrics.Graphite + ": " + err.Error())
+		}
+	}
+}
+
+// runMetrics returns the metrics of the g10k run and of every Puppet environment
+func runMetrics(fatal string) []metric {
+	success := 1.0
+	if len(fatal) > 0 || deployFailed() {
+		success = 0
+	}
+	changed := 0
+	for env := range needSyncEnvs {
+		if _, failed := environmentFailures[env]; !failed {
+			changed++
+		}
+	}
+	metrics := []metric{
+		{"run.duration", float64(time.Since(outputStart).Milliseconds()), "ms"},
+		{"run.success", success, "g"},
+		{"run.count", 1, "c"},
+		{"run.failures", 1 - success, "c"},
+		{"environments.total", float64(len(puppetEnvironments)), "g"},
+		{"environments.changed", float64(changed), "g"},
+		{"environments.failed", float64(len(environmentFailures)), "g"},
+		{"modules.failed", float64(len(moduleFailures)), "g"},
+		{"git.synced", float64(syncGitCount), "g"},
+		{"git.sync_duration", syncGitTime * 1000, "ms"},
+		{"git.io_duration", ioGitTime * 1000, "ms"},
+		{"git.cache_hits", float64(atomic.LoadInt64(&cacheStats.gitHits)), "c"},
+		{"git.cache_misses", float64(atomic.LoadInt64(&cacheStats.gitMisses)), "c"},
+		{"forge.synced", float64(syncForgeCount), "g"},
+		{"forge.sync_duration", syncForgeTime * 1000, "ms"},
+		{"forge.io_duration", ioForgeTime * 1000, "ms"},
+		{"forge.cache_hits", float64(atomic.LoadInt64(&cacheStats.forgeHits)), "c"},
+		{"forge.cache_misses", float64(atomic.LoadInt64(&cacheStats.forgeMisses)), "c"},
+	}
+	var envs []string
+	for env := range puppetEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		name := "environment." + metricName(env) + "."
+		_, failed := environmentFailures[env]
+		_, synced := needSyncEnvs[env]
+		metrics = append(metrics, metric{name + "failed", boolMetric(failed), "g"}, metric{name + "changed", boolMetric(synced && !failed), "g"})
+		if d, ok := environmentDurations[env]; ok {
+			metrics = append(metrics, metric{name + "duration", float64(d.Milliseconds()), "ms"})
+		}
+		if modules, ok := manifestModuleCount(puppetEnvironments[env].targetDir); ok {
+			metrics = append(metrics, metric{name + "modules", float64(modules), "g"})
+		}
+	}
+	return metrics
+}
+
+// manifestModuleCount returns the number of modules in the deploy manifest of the given Puppet environment directory
+func manifestModuleCount(envDir string) (int, bool) {
+	manifest, err := readDeployManifest(filepath.Join(envDir, ".g10k-manifest.json"))
+	return len(manifest.Modules), err == nil
+}
+
+// metricName replaces the characters that separate or end a StatsD or Graphite metric name
+func metricName(name string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_", "/", "_").Replace(name)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sendStatsD sends the metrics to the StatsD server at the given host:port over UDP, several metrics per packet
+func sendStatsD(address string, prefix string, metrics []metric) error {
+	conn, err := net.DialTimeout("udp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var packet []string
+	size := 0
+	for _, m := range metrics {
+		line := prefix + "." + m.name + ":" + strconv.FormatFloat(m.value, 'f', -1, 64) + "|" + m.kind
+		if size+len(line)+1 > maxStatsDPacket && len(packet) > 0 {
+			if _, err := conn.Write([]byte(strings.Join(packet, "\n"))); err != nil {
+				return err
+			}
+			packet, size = nil, 0
+		}
+		packet = append(packet, line)
+		size += len(line) + 1
+	}
+	if len(packet) > 0 {
+		_, err = conn.Write([]byte(strings.Join(packet, "\n")))
+	}
+	return err
+}
+
+// sendGraphite sends the metrics to the Graphite server at the given host:port with the plaintext protocol over TCP
+func sendGraphite(address string, prefix string, metrics []metric) error {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	var lines strings.Builder
+	for _, m := range metrics {
+		lines.WriteString(prefix + "." + m.name + " " + strconv.FormatFloat(m.value, 'f', -1, 64) + " " + now + "\n")
+	}
+	_, err = conn.Write([]byte(lines.String()))
+	return err
+}
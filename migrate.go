@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// migrateCommand converts the given r10k config file to a g10k config file and prints a report of the r10k settings without a g10k counterpart
+func migrateCommand(args []string) {
+	fs := subcommandFlagSet("migrate")
+	output := fs.String("output", "g10k.yaml", "where to write the generated g10k config file")
+	overwrite := fs.Bool("force", false, "overwrite an existing g10k config file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		Fatalf("Error: missing r10k config file\nExample call: g10k migrate -output /etc/g10k/g10k.yaml /etc/puppetlabs/r10k/r10k.yaml")
+	}
+	r10kConfigFile := fs.Arg(0)
+	if fileExists(*output) && !*overwrite {
+		Fatalf("Error: " + *output + " already exists! Use -force to overwrite it.")
+	}
+
+	data, err := ioutil.ReadFile(r10kConfigFile)
+	if err != nil {
+		Fatalf("migrateCommand(): There was an error reading the r10k config file " + r10kConfigFile + ": " + err.Error())
+	}
+	content, unsupported := migrateR10kConfig(data)
+	if err := ioutil.WriteFile(*output, []byte(content), 0644); err != nil {
+		Fatalf("Error: could not write g10k config file " + *output + " Error: " + err.Error())
+	}
+	fmt.Println("Wrote g10k config file " + *output + " converted from r10k config file " + r10kConfigFile)
+	if len(unsupported) > 0 {
+		Warnf("The following r10k settings have no g10k counterpart and were not migrated:")
+		for _, setting := range unsupported {
+			Warnf("  " + setting)
+		}
+	}
+}
+
+// migrateR10kConfig converts the content of a r10k config file to the content of an equivalent g10k config file.
+// It also returns the r10k settings without a g10k counterpart.
+func migrateR10kConfig(data []byte) (string, []string) {
+	// r10k uses Ruby symbols as keys, see readConfigfile()
+	reWhitespaceColon := regexp.MustCompile(`(?m)^(\s*):`)
+	var r10kConfig map[string]interface{}
+	if err := yaml.Unmarshal([]byte(reWhitespaceColon.ReplaceAllString(string(data), "$1")), &r10kConfig); err != nil {
+		Fatalf("migrateR10kConfig(): YAML unmarshal error: " + err.Error())
+	}
+
+	var unsupported []string
+	g10kConfig := yaml.MapSlice{}
+	gitPrivateKey := ""
+	for _, key := range sortedKeys(r10kConfig) {
+		value := r10kConfig[key]
+		switch key {
+		case "cachedir":
+			g10kConfig = append(g10kConfig, yaml.MapItem{Key: "cachedir", Value: value})
+		case "postrun":
+			g10kConfig = append(g10kConfig, yaml.MapItem{Key: "postrun", Value: value})
+		case "pool_size":
+			g10kConfig = append(g10kConfig, yaml.MapItem{Key: "maxworker", Value: value})
+		case "proxy":
+			g10kConfig = append(g10kConfig, yaml.MapItem{Key: "proxy", Value: value})
+		case "forge":
+			for forgeKey, forgeValue := range stringMap(value) {
+				if forgeKey == "baseurl" {
+					g10kConfig = append(g10kConfig, yaml.MapItem{Key: "forge_base_url", Value: forgeValue})
+				} else {
+					unsupported = append(unsupported, "forge:"+forgeKey)
+				}
+			}
+		case "git":
+			for gitKey, gitValue := range stringMap(value) {
+				if gitKey == "private_key" {
+					gitPrivateKey = fmt.Sprint(gitValue)
+				} else {
+					unsupported = append(unsupported, "git:"+gitKey)
+				}
+			}
+		case "deploy":
+			deploy := yaml.MapSlice{}
+			deploySettings := stringMap(value)
+			for _, deployKey := range sortedKeys(deploySettings) {
+				deployValue := deploySettings[deployKey]
+				switch deployKey {
+				case "purge_levels", "purge_allowlist", "write_lock", "generate_types", "puppet_path":
+					deploy = append(deploy, yaml.MapItem{Key: deployKey, Value: deployValue})
+				case "purge_whitelist":
+					deploy = append(deploy, yaml.MapItem{Key: "purge_allowlist", Value: deployValue})
+				case "exclude_spec":
+					if excludeSpec, ok := deployValue.(bool); ok && excludeSpec {
+						deploy = append(deploy, yaml.MapItem{Key: "purge_skiplist", Value: []string{"spec"}})
+					}
+				default:
+					unsupported = append(unsupported, "deploy:"+deployKey)
+				}
+			}
+			g10kConfig = append(g10kConfig, yaml.MapItem{Key: "deploy", Value: deploy})
+		case "sources":
+			// handled below, because the git private_key needs to be added to each source
+		default:
+			unsupported = append(unsupported, key)
+		}
+	}
+
+	sources := yaml.MapSlice{}
+	r10kSources := stringMap(r10kConfig["sources"])
+	for _, sourceName := range sortedKeys(r10kSources) {
+		source := yaml.MapSlice{}
+		sourceSettings := stringMap(r10kSources[sourceName])
+		for _, sourceKey := range sortedKeys(sourceSettings) {
+			sourceValue := sourceSettings[sourceKey]
+			switch sourceKey {
+			case "remote", "basedir", "prefix", "invalid_branches", "filter_command", "strip_component", "private_key", "proxy":
+				source = append(source, yaml.MapItem{Key: sourceKey, Value: sourceValue})
+			case "ignore_branch_prefixes":
+				var ignoreBranches []string
+				if prefixes, ok := sourceValue.([]interface{}); ok {
+					for _, prefix := range prefixes {
+						ignoreBranches = append(ignoreBranches, "^"+regexp.QuoteMeta(fmt.Sprint(prefix)))
+					}
+				}
+				source = append(source, yaml.MapItem{Key: "ignore_branches", Value: ignoreBranches})
+			default:
+				unsupported = append(unsupported, "sources:"+sourceName+":"+sourceKey)
+			}
+		}
+		if _, ok := sourceSettings["private_key"]; !ok && len(gitPrivateKey) > 0 {
+			source = append(source, yaml.MapItem{Key: "private_key", Value: gitPrivateKey})
+		}
+		sources = append(sources, yaml.MapItem{Key: sourceName, Value: source})
+	}
+	g10kConfig = append(g10kConfig, yaml.MapItem{Key: "sources", Value: sources})
+
+	content, err := yaml.Marshal(g10kConfig)
+	if err != nil {
+		Fatalf("migrateR10kConfig(): YAML marshal error: " + err.Error())
+	}
+	sort.Strings(unsupported)
+	return "---\n" + string(content), unsupported
+}
+
+// stringMap converts a YAML hash to a map with string keys
+func stringMap(value interface{}) map[string]interface{} {
+	result := make(map[string]interface{})
+	switch m := value.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			result[strings.TrimPrefix(fmt.Sprint(k), ":")] = v
+		}
+	case map[string]interface{}:
+		for k, v := range m {
+			result[strings.TrimPrefix(k, ":")] = v
+		}
+	}
+	return result
+}
+
+// sortedKeys returns the keys of the given map in a stable order
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
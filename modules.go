@@ -10,7 +10,19 @@ import (
 )
 
 func unTar(r io.Reader, targetBaseDir string) {
-	funcName := funcName()
+	extractTar(r, targetBaseDir, nil)
+}
+
+// unTarIncremental extracts the tar stream into an existing directory and only replaces files whose content changed.
+// It returns the relative paths of all extracted entries, so that stale content can be removed afterwards.
+func unTarIncremental(r io.Reader, targetBaseDir string) map[string]struct{} {
+	extracted := make(map[string]struct{})
+	extractTar(r, targetBaseDir, extracted)
+	return extracted
+}
+
+func extractTar(r io.Reader, targetBaseDir string, extracted map[string]struct{}) {
+	funcName := "unTar"
 	tarBallReader := tar.NewReader(r)
 	for {
 		header, err := tarBallReader.Next()
@@ -38,9 +50,19 @@ func unTar(r io.Reader, targetBaseDir string) {
 			continue
 		}
 		targetFilename := filepath.Join(targetBaseDir, filename)
+		if extracted != nil && header.Typeflag != tar.TypeXGlobalHeader {
+			extracted[filepath.Clean(filename)] = struct{}{}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
+			if extracted != nil {
+				if err = ensureDir(targetFilename); err != nil {
+					Fatalf(funcName + "(): error while creating directory: " + filename + " Error: " + err.Error())
+				}
+				applyOwnership(targetFilename)
+				continue
+			}
 			//fmt.Println("Untarring :", targetFilename)
 			// handle directory
 			//fmt.Println("Creating directory :", filename)
@@ -58,10 +80,25 @@ func unTar(r io.Reader, targetBaseDir string) {
 				Fatalf(funcName + "(): error while Chtimes() file: " + filename + " Error: " + err.Error())
 
 			}
+			applyOwnership(targetFilename)
 
 		case tar.TypeReg:
+			if extracted != nil {
+				changed, err := writeFileIfChanged(targetFilename, tarBallReader, os.FileMode(header.Mode), header.ModTime)
+				if err != nil {
+					Fatalf(funcName + "(): error while writing file: " + filename + " Error: " + err.Error())
+				}
+				if changed {
+					applyOwnership(targetFilename)
+				}
+				continue
+			}
 			// handle normal file
 			//fmt.Println("Untarring :", targetFilename)
+			// remove an existing file first, because it might be hardlinked into a live Puppet environment
+			if err := os.Remove(targetFilename); err != nil && !os.IsNotExist(err) {
+				Fatalf(funcName + "(): error while Remove() existing file: " + filename + " Error: " + err.Error())
+			}
 			writer, err := os.Create(targetFilename)
 
 			if err != nil {
@@ -78,8 +115,15 @@ func unTar(r io.Reader, targetBaseDir string) {
 			}
 
 			writer.Close()
+			applyOwnership(targetFilename)
 
 		case tar.TypeSymlink:
+			if link, err := os.Readlink(targetFilename); err == nil && link == header.Linkname && extracted != nil {
+				continue
+			}
+			if isDir(targetFilename) && extracted != nil {
+				purgeDir(targetFilename, funcName+"()")
+			}
 			if fileExists(targetFilename) {
 				if err = os.Remove(targetFilename); err != nil {
 					Fatalf(funcName + "(): error while removing existing file " + targetFilename + " to be replaced with symlink pointing to " + header.Linkname + " Error: " + err.Error())
@@ -88,6 +132,7 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if err = os.Symlink(header.Linkname, targetFilename); err != nil {
 				Fatalf(funcName + "(): error while creating symlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 			}
+			applyOwnership(targetFilename)
 
 		case tar.TypeLink:
 			if fileExists(targetFilename) {
@@ -98,6 +143,7 @@ func unTar(r io.Reader, targetBaseDir string) {
 			if err = os.Link(header.Linkname, targetFilename); err != nil {
 				Fatalf(funcName + "(): error while creating hardlink " + targetFilename + " pointing to " + header.Linkname + " Error: " + err.Error())
 			}
+			applyOwnership(targetFilename)
 
 		// Skip pax_global_header with the commit ID this archive was created from
 		case tar.TypeXGlobalHeader:
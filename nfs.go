@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// nfsRetries is how often a filesystem operation that failed with a stale NFS file handle is retried with deploy_strategy nfs
+const nfsRetries = 5
+
+// nfsDeploy returns true if the basedirs are on NFS and g10k has to flush every new environment version to the server before switching to it
+func nfsDeploy() bool {
+	return config.DeployStrategy == "nfs"
+}
+
+// retryOnESTALE executes the given filesystem operation and retries it with deploy_strategy nfs as long as it fails with ESTALE, e.g. because another NFS client replaced the directory in the meantime
+func retryOnESTALE(description string, operation func() error) error {
+	err := operation()
+	for i := 1; i <= nfsRetries && nfsDeploy() && errors.Is(err, syscall.ESTALE); i++ {
+		Debugf("Retrying " + description + " after stale NFS file handle, attempt " + strconv.Itoa(i) + " of " + strconv.Itoa(nfsRetries))
+		time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		err = operation()
+	}
+	return err
+}
+
+// syncPath flushes the given file or directory to disk, which also commits its content to the NFS server
+func syncPath(path string) error {
+	return retryOnESTALE("fsync of "+path, func() error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return f.Sync()
+	})
+}
+
+// syncTree flushes all files and directories below dir, so that a new environment version is completely written before the environment symlink points to it
+func syncTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		return syncPath(path)
+	})
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// moduleChanges contains the modules whose resolved version changed in every Puppet environment of this g10k run
+var moduleChanges = make(map[string][]ModuleChange)
+
+// reCommitHash matches the resolved version of a git module
+var reCommitHash = regexp.MustCompile(`^[0-9a-f]{40}$`)
+
+// notificationsSent is set once the notifications of this g10k run are sent, so that a failure afterwards does not send them again
+var notificationsSent bool
+
+// ModuleChange is a module whose resolved version changed with this g10k run, From is empty for an added and To for a removed module.
+// CompareURL is the web page comparing the two commits of a git module on GitHub or GitLab.
+type ModuleChange struct {
+	Module     string `json:"module"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+	CompareURL string `json:"compare_url,omitempty"`
+}
+
+// NotificationData is the payload of a generic notification and the data of a notification template
+type NotificationData struct {
+	Status              string                    `json:"status"`
+	Config              string                    `json:"config"`
+	Host                string                    `json:"host"`
+	Duration            float64                   `json:"duration"`
+	ChangedEnvironments []string                  `json:"changed_environments"`
+	FailedEnvironments  map[string]string         `json:"failed_environments"`
+	ModuleChanges       map[string][]ModuleChange `json:"module_changes"`
+	Errors              []string                  `json:"errors"`
+	Summary             string                    `json:"summary"`
+}
+
+// notificationFuncs are the additional functions of the notification templates, json quotes a value for a JSON payload
+var notificationFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		content, err := json.Marshal(v)
+		return string(content), err
+	},
+	"join": strings.Join,
+}
+
+// recordModuleChanges remembers the modules of the given Puppet environment whose resolved version differs from its previous deploy manifest
+func recordModuleChanges(env string, previousModules map[string]ManifestModule, modules []ManifestModule) {
+	if len(previousModules) == 0 {
+		// the first deploy of this environment
+		return
+	}
+	var changes []ModuleChange
+	current := make(map[string]bool)
+	for _, m := range modules {
+		current[m.Type+":"+m.Name] = true
+		if previous, ok := previousModules[m.Type+":"+m.Name]; !ok {
+			changes = append(changes, ModuleChange{Module: m.Name, To: m.Resolved})
+		} else if previous.Resolved != m.Resolved {
+			mc := ModuleChange{Module: m.Name, From: previous.Resolved, To: m.Resolved}
+			if m.Type == "git" && previous.Source == m.Source && reCommitHash.MatchString(mc.From) && reCommitHash.MatchString(mc.To) {
+				mc.CompareURL = compareURL(m.Source, mc.From, mc.To)
+			}
+			changes = append(changes, mc)
+		}
+	}
+	for key, m := range previousModules {
+		if !current[key] {
+			changes = append(changes, ModuleChange{Module: m.Name, From: m.Resolved})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Module < changes[j].Module })
+	mutex.Lock()
+	moduleChanges[env] = changes
+	mutex.Unlock()
+}
+
+// sendNotifications sends the configured notifications and mail about the completed or failed g10k run, fatal is the error that aborted it.
+// A notification that can not be sent only gets a warning.
+func sendNotifications(fatal string) {
+	if (len(config.Notifications) == 0 && len(config.Mail.SMTPServer) == 0) || notificationsSent || validate || dryRun || check4update || outputCommand != "deploy" {
+		return
+	}
+	notificationsSent = true
+	data := notificationData(fatal)
+	sendMail(data)
+	if data.Status == "success" && len(data.ChangedEnvironments) == 0 {
+		Debugf("Not sending notifications, because no environment changed")
+		return
+	}
+	for _, n := range config.Notifications {
+		if !notifyOn(n, data.Status) {
+			continue
+		}
+		if err := sendNotification(n, data); err != nil {
+			Warnf("WARNING: Could not send the " + notificationType(n) + " notification to " + webhookHost(n.URL) + ": " + err.Error())
+		}
+	}
+}
+
+// notificationData returns the data of the notifications about this g10k run
+func notificationData(fatal string) NotificationData {
+	data := NotificationData{Status: "success", Config: configFile, Duration: time.Since(outputStart).Seconds(), ChangedEnvironments: []string{}, FailedEnvironments: make(map[string]string), ModuleChanges: moduleChanges, Errors: []string{}}
+	data.Host, _ = os.Hostname()
+	for env := range needSyncEnvs {
+		if _, failed := environmentFailures[env]; !failed {
+			data.ChangedEnvironments = append(data.ChangedEnvironments, env)
+		}
+	}
+	sort.Strings(data.ChangedEnvironments)
+	for env, message := range environmentFailures {
+		data.FailedEnvironments[env] = message
+	}
+	if len(fatal) > 0 {
+		data.Errors = append(data.Errors, fatal)
+	}
+	var sources []string
+	for source := range sourceFailures {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		data.Errors = append(data.Errors, "source "+source+": "+sourceFailures[source])
+	}
+	if len(fatal) > 0 || deployFailed() {
+		data.Status = "failure"
+	}
+	data.Summary = notificationSummary(data)
+	return data
+}
+
+// notificationSummary returns the text of the Slack and Teams notifications
+func notificationSummary(data NotificationData) string {
+	result := "succeeded"
+	if data.Status == "failure" {
+		result = "failed"
+	}
+	lines := []string{"g10k deploy of " + data.Config + " on " + data.Host + " " + result + " in " + strconv.FormatFloat(data.Duration, 'f', 1, 64) + "s"}
+	if len(data.ChangedEnvironments) > 0 {
+		lines = append(lines, "Deployed environment(s): "+strings.Join(data.ChangedEnvironments, ", "))
+	}
+	var envs []string
+	for env := range data.ModuleChanges {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		var changes []string
+		for _, mc := range data.ModuleChanges[env] {
+			from, to := "(new)", "(removed)"
+			if len(mc.From) > 0 {
+				from = shortVersion(mc.From)
+			}
+			if len(mc.To) > 0 {
+				to = shortVersion(mc.To)
+			}
+			changes = append(changes, mc.Module+" "+from+" -> "+to)
+		}
+		lines = append(lines, "Module changes in "+env+": "+strings.Join(changes, ", "))
+	}
+	envs = nil
+	for env := range data.FailedEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		lines = append(lines, "Failed environment "+env+": "+data.FailedEnvironments[env])
+	}
+	for _, message := range data.Errors {
+		lines = append(lines, "Error: "+strings.TrimPrefix(message, "Error: "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// shortVersion abbreviates the resolved version of a module if it is a commit hash
+func shortVersion(version string) string {
+	if reCommitHash.MatchString(version) {
+		return shortCommit(version)
+	}
+	return version
+}
+
+// webhookHost returns the scheme and host of the given webhook URL, as its path usually contains its secret
+func webhookHost(webhookURL string) string {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return "an invalid URL"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// notifyOn returns true if the given notification is sent for a g10k run with the given status, without its events setting it is sent for both
+func notifyOn(n NotificationSettings, status string) bool {
+	return len(n.Events) == 0 || stringSliceContains(n.Events, status)
+}
+
+// notificationType returns the type of the given notification, the default is generic
+func notificationType(n NotificationSettings) string {
+	if len(n.Type) == 0 {
+		return "generic"
+	}
+	return n.Type
+}
+
+// notificationPayload returns the body of the given notification, which is its template or the default payload of its type
+func notificationPayload(n NotificationSettings, data NotificationData) ([]byte, error) {
+	if len(n.Template) > 0 {
+		tmpl, err := template.New("notification").Funcs(notificationFuncs).Parse(n.Template)
+		if err != nil {
+			return nil, err
+		}
+		var payload bytes.Buffer
+		if err := tmpl.Execute(&payload, data); err != nil {
+			return nil, err
+		}
+		return payload.Bytes(), nil
+	}
+	var payload bytes.Buffer
+	encoder := json.NewEncoder(&payload)
+	// keep the -> of the module changes readable
+	encoder.SetEscapeHTML(false)
+	var err error
+	switch notificationType(n) {
+	case "slack", "teams":
+		err = encoder.Encode(map[string]string{"text": data.Summary})
+	default:
+		err = encoder.Encode(data)
+	}
+	return payload.Bytes(), err
+}
+
+// sendNotification POSTs the payload of the given notification
+func sendNotification(n NotificationSettings, data NotificationData) error {
+	payload, err := notificationPayload(n, data)
+	if err != nil {
+		return err
+	}
+	client, err := tlsHTTPClient("", "", n.CA)
+	if err != nil {
+		return err
+	}
+	client.Transport.(*http.Transport).Proxy = http.ProxyFromEnvironment
+	req, err := http.NewRequest("POST", n.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "https://github.com/xorpaul/g10k/")
+	for header, value := range n.Headers {
+		req.Header.Set(header, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("POST returned " + resp.Status)
+	}
+	return nil
+}
+
+// sendMail sends the summary of the g10k run by mail, only for a failed g10k run unless mail always is set
+func sendMail(data NotificationData) {
+	if len(config.Mail.SMTPServer) == 0 || (data.Status != "failure" && !config.Mail.Always) {
+		return
+	}
+	if err := smtpSendMail(config.Mail, mailMessage(config.Mail, data)); err != nil {
+		Warnf("WARNING: Could not send the mail about the g10k run with " + config.Mail.SMTPServer + ": " + err.Error())
+	}
+}
+
+// mailMessage returns the mail with the summary of the g10k run
+func mailMessage(settings MailSettings, data NotificationData) []byte {
+	result := "succeeded"
+	if data.Status == "failure" {
+		result = "failed"
+	}
+	headers := []string{
+		"From: " + settings.From,
+		"To: " + strings.Join(settings.To, ", "),
+		"Subject: " + settings.SubjectPrefix + "g10k deploy on " + data.Host + " " + result,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+		"Auto-Submitted: auto-generated",
+	}
+	body := strings.Replace(data.Summary, "\n", "\r\n", -1)
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body + "\r\n")
+}
+
+// smtpSendMail sends the given mail with the SMTP server of the mail settings, with STARTTLS if the server supports it
+func smtpSendMail(settings MailSettings, message []byte) error {
+	var auth smtp.Auth
+	if len(settings.Username) > 0 {
+		host, _, _ := net.SplitHostPort(settings.SMTPServer)
+		auth = smtp.PlainAuth("", settings.Username, settings.Password, host)
+	}
+	return smtp.SendMail(settings.SMTPServer, auth, settings.From, settings.To, message)
+}
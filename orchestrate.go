@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// OrchestratorDeployRequest is the body of the deploy command of the Puppet Enterprise orchestrator API, which runs Puppet on the nodes of the given scope
+type OrchestratorDeployRequest struct {
+	Environment string            `json:"environment"`
+	Scope       map[string]string `json:"scope"`
+	Description string            `json:"description"`
+}
+
+// triggerPuppetRuns triggers Puppet runs on the nodes of every Puppet environment that was successfully deployed by this g10k run,
+// either with the orchestrator API or with the trigger_runs command. A failed trigger is only reported, as the code itself got deployed.
+func triggerPuppetRuns() {
+	if len(config.TriggerRuns.OrchestratorURL)+len(config.TriggerRuns.Command) == 0 || len(needSyncEnvs) == 0 {
+		return
+	}
+	var envs []string
+	for env := range needSyncEnvs {
+		if !environmentFailed(env) {
+			envs = append(envs, env)
+		}
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		pe, ok := puppetEnvironments[env]
+		if !ok || !isDir(pe.targetDir) {
+			continue
+		}
+		if len(config.TriggerRuns.Command) > 0 {
+			triggerCmd := expandDeployVariables(config.TriggerRuns.Command, pe.source, pe.branch, pe.env)
+			if dryRun {
+				Infof("Would run " + triggerCmd)
+			} else if er := executeCommand(triggerCmd, config.Timeout, true); er.returnCode != 0 {
+				Warnf("WARNING: trigger_runs command " + triggerCmd + " failed for environment " + env + ": " + er.errorOutput())
+			} else {
+				Infof("Triggered Puppet runs of environment " + env + " with " + triggerCmd)
+			}
+		}
+		if len(config.TriggerRuns.OrchestratorURL) > 0 {
+			if dryRun {
+				Infof("Would trigger Puppet runs of environment " + env + " with the orchestrator " + config.TriggerRuns.OrchestratorURL)
+			} else if job, err := orchestratorDeploy(env); err != nil {
+				Warnf("WARNING: Could not trigger Puppet runs of environment " + env + " with the orchestrator " + config.TriggerRuns.OrchestratorURL + ": " + err.Error())
+			} else {
+				Infof("Triggered Puppet runs of environment " + env + " as orchestrator job " + job)
+			}
+		}
+	}
+}
+
+// orchestratorDeploy starts an orchestrator job running Puppet on every node whose last catalog was compiled in the given environment and returns the name of the job
+func orchestratorDeploy(env string) (string, error) {
+	token, err := ioutil.ReadFile(config.TriggerRuns.TokenFile)
+	if err != nil {
+		return "", err
+	}
+	client, err := tlsHTTPClient("", "", config.TriggerRuns.CA)
+	if err != nil {
+		return "", err
+	}
+	body, _ := json.Marshal(OrchestratorDeployRequest{
+		Environment: env,
+		Scope:       map[string]string{"query": "nodes[certname] { catalog_environment = \"" + env + "\" }"},
+		Description: "g10k deployed environment " + env,
+	})
+	req, err := http.NewRequest("POST", strings.TrimSuffix(config.TriggerRuns.OrchestratorURL, "/")+"/orchestrator/v1/command/deploy", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Authentication", strings.TrimSpace(string(token)))
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return "", errors.New("POST " + req.URL.String() + " returned " + resp.Status + ": " + strings.TrimSpace(string(message)))
+	}
+	var result struct {
+		Job struct {
+			Name string `json:"name"`
+		} `json:"job"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return result.Job.Name, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// outputFormat is text for the human readable output or json for a JSON document on stdout, set by -output
+var outputFormat = "text"
+
+// outputCommand is the command of the JSON document, it is set by the subcommands that support -output json
+var outputCommand = "deploy"
+
+// outputWriter is the stdout of the g10k process, which only gets the JSON document with -output json
+var outputWriter io.Writer = os.Stdout
+
+// outputStart is the start of the g10k run for the duration of the JSON document
+var outputStart = time.Now()
+
+// outdatedModules are the Forge modules that -check4update found a newer version of
+var outdatedModules []OutdatedModule
+
+// DeployOutput is the JSON document of a g10k run with -output json, its command is deploy, diff for a -dryrun or outdated for -check4update
+type DeployOutput struct {
+	Command         string              `json:"command"`
+	Success         bool                `json:"success"`
+	Error           string              `json:"error,omitempty"`
+	Config          string              `json:"config,omitempty"`
+	Puppetfile      string              `json:"puppetfile,omitempty"`
+	Branch          string              `json:"branch,omitempty"`
+	Duration        float64             `json:"duration"`
+	GitRepositories int                 `json:"git_repositories"`
+	ForgeModules    int                 `json:"forge_modules"`
+	Environments    []EnvironmentOutput `json:"environments"`
+	FailedSources   map[string]string   `json:"failed_sources,omitempty"`
+	FailedModules   map[string]string   `json:"failed_modules,omitempty"`
+	Changes         map[string][]string `json:"changes,omitempty"`
+	Outdated        []OutdatedModule    `json:"outdated,omitempty"`
+	Timings         []ModuleTiming      `json:"timings,omitempty"`
+}
+
+// ErrorOutput is the JSON document of a g10k subcommand that failed
+type ErrorOutput struct {
+	Command string `json:"command"`
+	Success bool   `json:"success"`
+	Error   string `json:"error"`
+}
+
+// EnvironmentOutput is the result of a Puppet environment in the JSON document of a g10k run: deployed, unchanged, held or failed
+type EnvironmentOutput struct {
+	Environment string         `json:"environment"`
+	Source      string         `json:"source"`
+	Branch      string         `json:"branch"`
+	Result      string         `json:"result"`
+	Error       string         `json:"error,omitempty"`
+	Changelog   []ModuleChange `json:"changelog,omitempty"`
+}
+
+// OutdatedModule is a Forge module with a newer version than the deployed one
+type OutdatedModule struct {
+	Module   string `json:"module"`
+	Deployed string `json:"deployed"`
+	Latest   string `json:"latest"`
+}
+
+// ValidateOutput is the JSON document of g10k -validate
+type ValidateOutput struct {
+	Command string   `json:"command"`
+	Config  string   `json:"config"`
+	Valid   bool     `json:"valid"`
+	Errors  []string `json:"errors"`
+}
+
+// StatusOutput is the JSON document of g10k status
+type StatusOutput struct {
+	Command string `json:"command"`
+	ServeStatus
+}
+
+// DriftOutput is the JSON document of g10k drift
+type DriftOutput struct {
+	Command      string                   `json:"command"`
+	Environments map[string][]DriftedFile `json:"environments"`
+	Repaired     int                      `json:"repaired"`
+}
+
+// ListOutput is the JSON document of g10k list environments or g10k list modules
+type ListOutput struct {
+	Command      string                      `json:"command"`
+	Environments []EnvironmentStatus         `json:"environments,omitempty"`
+	Modules      map[string][]ManifestModule `json:"modules,omitempty"`
+}
+
+// CacheOutput is the JSON document of g10k cache info, clean and prune
+type CacheOutput struct {
+	Command    string           `json:"command"`
+	CacheDir   string           `json:"cachedir"`
+	Components []CacheComponent `json:"components,omitempty"`
+	Removed    []string         `json:"removed,omitempty"`
+	Freed      int64            `json:"freed,omitempty"`
+}
+
+// LicensesOutput is the JSON document of g10k licenses
+type LicensesOutput struct {
+	Command      string                     `json:"command"`
+	Environments map[string][]ModuleLicense `json:"environments"`
+	Unknown      int                        `json:"unknown"`
+	Denied       int                        `json:"denied"`
+}
+
+// jsonOutput returns true if g10k prints a JSON document instead of the human readable output
+func jsonOutput() bool {
+	return outputFormat == "json"
+}
+
+// setupOutput validates the -output and with -output json sends everything that g10k prints for humans, including the log messages, to stderr,
+// so that stdout only gets the JSON document
+func setupOutput() {
+	if outputFormat != "text" && outputFormat != "json" && outputFormat != "github" {
+		unsupported := outputFormat
+		outputFormat = "text"
+		Fatalf("Error: Unsupported -output " + unsupported + " Supported are text, json and github")
+	}
+	if !jsonOutput() || outputWriter != os.Stdout {
+		return
+	}
+	os.Stdout = os.Stderr
+	color.Output = os.Stderr
+}
+
+// printOutput writes the given JSON document to stdout
+func printOutput(document interface{}) {
+	encoder := json.NewEncoder(outputWriter)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(document)
+}
+
+// writeRunResults writes the -report, sends the notifications and metrics, records the run in the history database and prints the JSON document of the g10k run with -output json
+// or its GitHub Actions annotations with -output github and the summary line with -quiet, fatal is the error that aborted it.
+// It is called at the end of the g10k run and by Fatalf, which exits right after it.
+func writeRunResults(fatal string) {
+	defer stopProfiling()
+	writeReport(fatal)
+	sendNotifications(fatal)
+	sendMetrics(fatal)
+	recordHistory(fatal)
+	printAnnotations(fatal)
+	printQuietSummary(fatal)
+	if !jsonOutput() || validate {
+		return
+	}
+	// the JSON document must be printed only once, even if printing it fails
+	outputFormat = "text"
+	if outputCommand != "deploy" {
+		printOutput(ErrorOutput{Command: outputCommand, Error: fatal})
+		return
+	}
+	printOutput(deployOutput(fatal))
+}
+
+// deployOutput returns the JSON document of the g10k run
+func deployOutput(fatal string) DeployOutput {
+	output := DeployOutput{Command: "deploy", Success: len(fatal) == 0 && !deployFailed(), Error: fatal, Config: configFile, Branch: branchParam, Duration: time.Since(outputStart).Seconds(),
+		GitRepositories: syncGitCount, ForgeModules: syncForgeCount, Environments: []EnvironmentOutput{}}
+	if pfMode {
+		output.Puppetfile = pfLocation
+	}
+	if check4update {
+		output.Command = "outdated"
+		output.Outdated = outdatedModules
+	} else if dryRun {
+		output.Command = "diff"
+		output.Changes = dryRunChanges
+	}
+	if len(sourceFailures) > 0 {
+		output.FailedSources = sourceFailures
+	}
+	if len(moduleFailures) > 0 {
+		output.FailedModules = moduleFailures
+	}
+	if timingsParam > 0 {
+		output.Timings = slowestModules()
+	}
+	held := make(map[string]bool)
+	for _, env := range heldEnvironments {
+		held[env] = true
+	}
+	var envs []string
+	for env := range puppetEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		pe := puppetEnvironments[env]
+		eo := EnvironmentOutput{Environment: env, Source: pe.source, Branch: pe.branch, Result: "unchanged"}
+		if message, ok := environmentFailures[env]; ok {
+			eo.Result = "failed"
+			eo.Error = message
+		} else if held[env] {
+			eo.Result = "held"
+		} else if !reportDeployFinished {
+			// the g10k run got aborted before this environment was deployed completely
+			continue
+		} else if _, ok := needSyncEnvs[env]; ok {
+			eo.Result = "deployed"
+		}
+		eo.Changelog = moduleChanges[env]
+		output.Environments = append(output.Environments, eo)
+	}
+	return output
+}
+
+// printValidateOutput prints the JSON document of g10k -validate
+func printValidateOutput() {
+	errors := validationMessages
+	if errors == nil {
+		errors = []string{}
+	}
+	for i, message := range errors {
+		errors[i] = strings.TrimSpace(message)
+	}
+	printOutput(ValidateOutput{Command: "validate", Config: configFile, Valid: len(errors) == 0, Errors: errors})
+}
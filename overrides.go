@@ -0,0 +1,191 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// overridableSettings are the settings that can be overridden per Puppet environment with a .g10k.yaml file inside the control repository branch
+var overridableSettings = []string{"moduledir", "purge_allowlist", "postrun"}
+
+// readEnvironmentOverrides reads the .g10k.yaml file of the given Puppet environment directory if it exists
+func readEnvironmentOverrides(targetDir string, env string) EnvironmentOverrides {
+	overridesFile := filepath.Join(targetDir, ".g10k.yaml")
+	if !fileExists(overridesFile) {
+		return EnvironmentOverrides{}
+	}
+	if len(config.EnvironmentOverrides) == 0 {
+		Debugf("Ignoring " + overridesFile + " of environment " + env + ", because the environment_overrides setting is not set in " + configFile)
+		return EnvironmentOverrides{}
+	}
+	data, err := ioutil.ReadFile(overridesFile)
+	if err != nil {
+		Fatalf("readEnvironmentOverrides(): There was an error reading " + overridesFile + ": " + err.Error())
+	}
+	return parseEnvironmentOverrides(data, overridesFile, true)
+}
+
+// parseEnvironmentOverrides parses the content of a .g10k.yaml file and drops every setting that is not allowed by the environment_overrides setting
+func parseEnvironmentOverrides(data []byte, overridesFile string, warn bool) EnvironmentOverrides {
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		Fatalf("parseEnvironmentOverrides(): YAML unmarshal error of " + overridesFile + ": " + err.Error())
+	}
+	var overrides EnvironmentOverrides
+	if err := yaml.Unmarshal(data, &overrides); err != nil {
+		Fatalf("parseEnvironmentOverrides(): YAML unmarshal error of " + overridesFile + ": " + err.Error())
+	}
+
+	for setting := range settings {
+		if stringSliceContains(config.EnvironmentOverrides, setting) {
+			Debugf("Using setting " + setting + " of " + overridesFile)
+			continue
+		}
+		if warn {
+			Warnf("WARNING: Ignoring setting " + setting + " in " + overridesFile + ", because it is not allowed by the environment_overrides setting in " + configFile)
+		}
+		switch setting {
+		case "moduledir":
+			overrides.ModuleDir = ""
+		case "purge_allowlist":
+			overrides.PurgeAllowList = nil
+		case "postrun":
+			overrides.PostRunCommand = nil
+		}
+	}
+
+	if len(overrides.ModuleDir) > 0 {
+		moduleDir := filepath.Clean(overrides.ModuleDir)
+		if filepath.IsAbs(moduleDir) || moduleDir == ".." || strings.HasPrefix(moduleDir, "../") {
+			if warn {
+				Warnf("WARNING: Ignoring setting moduledir " + overrides.ModuleDir + " in " + overridesFile + ", because it points outside of the Puppet environment")
+			}
+			overrides.ModuleDir = ""
+		} else {
+			overrides.ModuleDir = normalizeDir(moduleDir)
+		}
+	}
+	return overrides
+}
+
+// controlRepoOverrides returns the settings of the .g10k.yaml file inside the given tree of the control repository
+func controlRepoOverrides(srcDir string, tree string) EnvironmentOverrides {
+	if len(config.EnvironmentOverrides) == 0 {
+		return EnvironmentOverrides{}
+	}
+	er := executeCommand("git --git-dir "+srcDir+" show "+tree+":.g10k.yaml", config.Timeout, true)
+	if er.returnCode != 0 {
+		return EnvironmentOverrides{}
+	}
+	return parseEnvironmentOverrides([]byte(er.stdout), srcDir+" "+tree+":.g10k.yaml", false)
+}
+
+// controlRepoModuleDirOverride returns the moduledir setting of the .g10k.yaml file inside the given tree of the control repository
+func controlRepoModuleDirOverride(srcDir string, tree string) string {
+	return controlRepoOverrides(srcDir, tree).ModuleDir
+}
+
+// controlRepoPurgeAllowList returns the purge_allowlist of the Puppet environment of the given tree of the control repository.
+// The purge_allowlist setting of a .g10k.yaml file replaces the purge_allowlist of the source.
+func controlRepoPurgeAllowList(srcDir string, tree string, sourceAllowList []string) []string {
+	if allowList := controlRepoOverrides(srcDir, tree).PurgeAllowList; allowList != nil {
+		return allowList
+	}
+	return sourceAllowList
+}
+
+// resolvePurgeAllowList returns the purge_allowlist of the given source, which replaces the global purge_allowlist
+func resolvePurgeAllowList(sa Source) []string {
+	if sa.PurgeAllowList != nil {
+		return sa.PurgeAllowList
+	}
+	return config.PurgeAllowList
+}
+
+// applyEnvironmentOverrides applies the settings of a .g10k.yaml file to the Puppetfile of this Puppet environment.
+// A -moduledir parameter still takes precedence over the moduledir setting.
+func applyEnvironmentOverrides(pf *Puppetfile, overrides EnvironmentOverrides, env string) {
+	if len(overrides.ModuleDir) > 0 && len(moduleDirParam) == 0 {
+		Debugf("Using moduledir " + overrides.ModuleDir + " for environment " + env + " from .g10k.yaml")
+		pf.moduleDirs = []string{overrides.ModuleDir}
+		for name, gm := range pf.gitModules {
+			gm.moduleDir = overrides.ModuleDir
+			pf.gitModules[name] = gm
+		}
+		for name, fm := range pf.forgeModules {
+			fm.moduleDir = overrides.ModuleDir
+			pf.forgeModules[name] = fm
+		}
+	}
+	if overrides.PurgeAllowList != nil {
+		pf.purgeAllowList = overrides.PurgeAllowList
+	}
+	if overrides.PostRunCommand != nil {
+		mutex.Lock()
+		environmentPostrunCommands[pf.workDir] = overrides.PostRunCommand
+		mutex.Unlock()
+	}
+}
+
+// isPurgeAllowListed returns true if the given path inside the Puppet environment matches one of the purge_allowlist globs of the environment
+func isPurgeAllowListed(pf Puppetfile, path string) bool {
+	return matchesPurgeAllowList(pf.purgeAllowList, pf.workDir, path)
+}
+
+// matchesPurgeAllowList returns true if the given path inside the Puppet environment directory matches one of the given purge_allowlist globs
+func matchesPurgeAllowList(allowList []string, envDir string, path string) bool {
+	relPath, err := filepath.Rel(envDir, path)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range allowList {
+		if matchesGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesGlob matches the given path against a glob pattern like r10k does for its purge_allowlist.
+// * and ? do not match a /, ** matches any number of directories, e.g. .resource_types/** or **/*.pp
+func matchesGlob(pattern string, path string) bool {
+	expr := "^"
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr += "(.*/)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			expr += "(/.*)?"
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr += ".*"
+			i++
+		case c == '*':
+			expr += "[^/]*"
+		case c == '?':
+			expr += "[^/]"
+		case c == '[' && strings.Contains(pattern[i:], "]"):
+			// character classes like [abc] or [!abc]
+			end := i + strings.Index(pattern[i:], "]")
+			class := pattern[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i = end
+		default:
+			expr += regexp.QuoteMeta(string(c))
+		}
+	}
+	re, err := regexp.Compile(expr + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(path)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"sync"
+)
+
+// resolvedOnce contains a sync.Once for every git repository and Forge module that got resolved by one of the environment pipelines or priority tiers of this g10k run
+var resolvedOnce map[string]*sync.Once
+
+// pipelinedDeploy returns true if every Puppet environment gets deployed in its own pipeline with the environment_maxworker setting
+func pipelinedDeploy() bool {
+	return config.EnvironmentMaxworker > 0
+}
+
+// sharedModuleResolution returns true if the modules of the Puppet environments are not resolved all at once, but by every environment pipeline or environment_priority tier on its own
+func sharedModuleResolution() bool {
+	return pipelinedDeploy() || len(config.EnvironmentPriority) > 0 || len(config.PuppetDB.URL) > 0
+}
+
+// resolveOnce executes the given function only once for the given git repository or Forge module, because the environment pipelines and priority tiers all resolve their own modules.
+// Pipelines that need the same module wait until the first one resolved it. Otherwise the modules of all environments are already resolved only once.
+func resolveOnce(key string, resolve func()) {
+	if !sharedModuleResolution() {
+		resolve()
+		return
+	}
+	mutex.Lock()
+	once, ok := resolvedOnce[key]
+	if !ok {
+		once = new(sync.Once)
+		resolvedOnce[key] = once
+	}
+	mutex.Unlock()
+	once.Do(resolve)
+}
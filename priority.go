@@ -0,0 +1,37 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+)
+
+// environmentPriorityTier returns the index of the first environment_priority regex that matches the given Puppet environment.
+// Environments that do not match any of them are deployed last. With puppetdb every tier is split, so that its environments with active nodes are deployed first.
+func environmentPriorityTier(env string) int {
+	tier := len(config.EnvironmentPriority)
+	for i, priorityRegex := range config.EnvironmentPriority {
+		rePriority, err := regexp.Compile(priorityRegex)
+		if err != nil {
+			Fatalf("Setting environment_priority regex '" + priorityRegex + "' could not be compiled to a valid Go regex please fix!")
+		}
+		if rePriority.MatchString(env) {
+			tier = i
+			break
+		}
+	}
+	if len(config.PuppetDB.URL) > 0 {
+		tier *= 2
+		if !environmentHasActiveNodes(env) {
+			tier++
+		}
+	}
+	return tier
+}
+
+// prioritizeEnvironments sorts the given Puppet environments by their environment_priority tier and keeps the order of the environments inside of a tier
+func prioritizeEnvironments(environments []PuppetEnvironment) []PuppetEnvironment {
+	sort.SliceStable(environments, func(i, j int) bool {
+		return environmentPriorityTier(environments[i].env) < environmentPriorityTier(environments[j].env)
+	})
+	return environments
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+	"sync"
+)
+
+var (
+	// cpuProfileParam is the -cpuprofile file
+	cpuProfileParam string
+	// memProfileParam is the -memprofile file
+	memProfileParam string
+	// cpuProfileFile is the open -cpuprofile file while the CPU profile is recorded
+	cpuProfileFile *os.File
+	// profilingOnce makes sure that the profiles are only written once, as g10k can exit from several goroutines
+	profilingOnce sync.Once
+)
+
+// startProfiling starts recording the CPU profile of the g10k run with -cpuprofile
+func startProfiling() {
+	if len(cpuProfileParam) == 0 {
+		return
+	}
+	f, err := os.Create(cpuProfileParam)
+	if err != nil {
+		Fatalf("Error: could not create the CPU profile " + cpuProfileParam + ": " + err.Error())
+	}
+	if err := runtimepprof.StartCPUProfile(f); err != nil {
+		f.Close()
+		Fatalf("Error: could not start the CPU profile " + cpuProfileParam + ": " + err.Error())
+	}
+	cpuProfileFile = f
+}
+
+// stopProfiling writes the CPU profile of -cpuprofile and the heap profile of -memprofile, it is called on every exit of the g10k run including failures and termination signals
+func stopProfiling() {
+	profilingOnce.Do(func() {
+		if cpuProfileFile != nil {
+			runtimepprof.StopCPUProfile()
+			if err := cpuProfileFile.Close(); err != nil {
+				Warnf("WARNING: Could not write the CPU profile " + cpuProfileParam + ": " + err.Error())
+			} else {
+				Infof("Wrote CPU profile " + cpuProfileParam)
+			}
+		}
+		if len(memProfileParam) == 0 {
+			return
+		}
+		f, err := os.Create(memProfileParam)
+		if err != nil {
+			Warnf("WARNING: Could not create the memory profile " + memProfileParam + ": " + err.Error())
+			return
+		}
+		// get up-to-date statistics of the live heap
+		runtime.GC()
+		err = runtimepprof.WriteHeapProfile(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			Warnf("WARNING: Could not write the memory profile " + memProfileParam + ": " + err.Error())
+			return
+		}
+		Infof("Wrote memory profile " + memProfileParam)
+	})
+}
+
+// handlePprof serves the pprof profiles of g10k serve on /debug/pprof/ with the same authentication as its API
+func handlePprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", requireAPIAuth(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAPIAuth(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAPIAuth(pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAPIAuth(pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAPIAuth(pprof.Trace))
+	if len(config.Serve.APIUser) == 0 && len(config.Serve.APIToken) == 0 {
+		Warnf("WARNING: Serving pprof profiles on /debug/pprof/ without authentication, configure the serve api_user or api_token to protect them")
+	}
+}
+
+// deployProfileArgs returns the -cpuprofile and -memprofile parameters that let the g10k run of the given deploy job write its profiles to the serve profile_dir
+func deployProfileArgs(jobID string) []string {
+	if len(config.Serve.ProfileDir) == 0 {
+		return nil
+	}
+	return []string{"-cpuprofile", filepath.Join(config.Serve.ProfileDir, jobID+".cpu.pprof"), "-memprofile", filepath.Join(config.Serve.ProfileDir, jobID+".mem.pprof")}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/xorpaul/uiprogress"
+)
+
+// defaultProgressInterval is the interval of the plain-text progress lines if progress_interval is not set
+const defaultProgressInterval = 10 * time.Second
+
+// deployProgress counts the resolved modules, the downloaded bytes and the completed environments of the g10k run for the progress display
+var deployProgress struct {
+	gitDone, gitTotal     int64
+	forgeDone, forgeTotal int64
+	envDone, envTotal     int64
+	gitBytes, forgeBytes  int64
+}
+
+// progressEnvironmentBar shows the completed environments with the progress bars if more than one environment gets deployed
+var progressEnvironmentBar *uiprogress.Bar
+
+// progressStop stops the plain-text progress lines, it is nil if they are not printed
+var progressStop chan struct{}
+
+// progressBarsEnabled returns true if the progress bars are shown, which needs an interactive terminal without -color never and is not possible with several environment pipelines
+func progressBarsEnabled() bool {
+	return !logLevelEnabled(logLevelInfo) && !quiet && !pipelinedDeploy() && !jsonOutput() && colorParam != "never" && interactiveTerminal(os.Stdout)
+}
+
+// progressInterval returns the progress_interval of the plain-text progress lines, 0 disables them
+func progressInterval() time.Duration {
+	if len(config.ProgressInterval) == 0 {
+		return defaultProgressInterval
+	}
+	interval, _ := time.ParseDuration(config.ProgressInterval)
+	return interval
+}
+
+// progressTracking returns true if the progress is shown as progress bars or as plain-text progress lines
+func progressTracking() bool {
+	return progressBarsEnabled() || progressStop != nil
+}
+
+// startProgressReporter resets the progress counters and prints a plain-text progress line every progress_interval if the progress bars can not be shown, e.g. in CI jobs or cron mails
+func startProgressReporter(environments int) {
+	atomic.StoreInt64(&deployProgress.gitDone, 0)
+	atomic.StoreInt64(&deployProgress.gitTotal, 0)
+	atomic.StoreInt64(&deployProgress.forgeDone, 0)
+	atomic.StoreInt64(&deployProgress.forgeTotal, 0)
+	atomic.StoreInt64(&deployProgress.envDone, 0)
+	atomic.StoreInt64(&deployProgress.envTotal, int64(environments))
+	atomic.StoreInt64(&deployProgress.gitBytes, 0)
+	atomic.StoreInt64(&deployProgress.forgeBytes, 0)
+	progressEnvironmentBar = nil
+	if logLevelEnabled(logLevelInfo) || quiet || progressBarsEnabled() || progressStop != nil {
+		if progressBarsEnabled() && environments > 1 {
+			progressEnvironmentBar = uiprogress.AddBar(environments).AppendCompleted()
+			progressEnvironmentBar.PrependFunc(func(b *uiprogress.Bar) string {
+				return fmt.Sprintf("Deploying environments (%d/%d)", b.Current(), environments)
+			})
+		}
+		return
+	}
+	interval := progressInterval()
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	progressStop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				fmt.Println(progressLine())
+			}
+		}
+	}()
+}
+
+// stopProgressReporter stops the plain-text progress lines
+func stopProgressReporter() {
+	if progressStop != nil {
+		close(progressStop)
+		progressStop = nil
+	}
+}
+
+// progressLine returns the plain-text progress line of the g10k run
+func progressLine() string {
+	line := "Progress: " + strconv.FormatInt(atomic.LoadInt64(&deployProgress.gitDone), 10) + "/" + strconv.FormatInt(atomic.LoadInt64(&deployProgress.gitTotal), 10) + " git modules (" + formatBytes(atomic.LoadInt64(&deployProgress.gitBytes)) + " fetched), " +
+		strconv.FormatInt(atomic.LoadInt64(&deployProgress.forgeDone), 10) + "/" + strconv.FormatInt(atomic.LoadInt64(&deployProgress.forgeTotal), 10) + " Forge modules (" + formatBytes(atomic.LoadInt64(&deployProgress.forgeBytes)) + " downloaded)"
+	if envTotal := atomic.LoadInt64(&deployProgress.envTotal); envTotal > 0 {
+		line += ", " + strconv.FormatInt(atomic.LoadInt64(&deployProgress.envDone), 10) + "/" + strconv.FormatInt(envTotal, 10) + " environments"
+	}
+	return line
+}
+
+// completeProgressEnvironments counts the given number of environments as completed
+func completeProgressEnvironments(n int) {
+	done := atomic.AddInt64(&deployProgress.envDone, int64(n))
+	if progressEnvironmentBar != nil {
+		progressEnvironmentBar.Set(int(done))
+	}
+}
+
+// formatBytes returns the given number of bytes in a human readable unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
+
+// gitObjectsSize returns the size of the objects of the given git repository, whose growth is the number of bytes a clone or fetch received
+func gitObjectsSize(workDir string) int64 {
+	objectsDir := filepath.Join(workDir, "objects")
+	if !isDir(objectsDir) {
+		// a git clone of clone_git_modules has a working tree
+		objectsDir = filepath.Join(workDir, ".git", "objects")
+	}
+	var size int64
+	filepath.Walk(objectsDir, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// progressReader counts the bytes read from a Forge download
+type progressReader struct {
+	r       io.Reader
+	counter *int64
+}
+
+func (pr progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	atomic.AddInt64(pr.counter, int64(n))
+	return n, err
+}
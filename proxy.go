@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// resolveProxy returns the proxy that should be used for the given URL and the level of the setting it came from.
+// The proxy settings are resolved in the order module, source, global g10k config setting and finally the http_proxy, https_proxy and no_proxy environment variables.
+// The no_proxy g10k config setting only applies to the global and environment proxy settings.
+func resolveProxy(rawURL string, moduleProxy string, sourceProxy string) (string, string) {
+	if len(moduleProxy) > 0 {
+		return moduleProxy, "module"
+	}
+	if len(sourceProxy) > 0 {
+		return sourceProxy, "source"
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		Fatalf("resolveProxy(): Could not parse URL " + rawURL + " Error: " + err.Error())
+	}
+	if matchesNoProxy(u.Hostname(), config.NoProxy) {
+		return "", "no_proxy"
+	}
+	if len(config.Proxy) > 0 {
+		return config.Proxy, "global"
+	}
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		Fatalf("resolveProxy(): Error while getting http proxy with golang http.ProxyFromEnvironment()" + err.Error())
+	}
+	if proxyURL != nil {
+		return proxyURL.String(), "environment"
+	}
+	return "", ""
+}
+
+// matchesNoProxy returns true if the given host matches one of the no_proxy entries, either exactly or as a subdomain
+func matchesNoProxy(host string, noProxy []string) bool {
+	for _, entry := range noProxy {
+		entry = strings.TrimPrefix(strings.TrimSpace(entry), ".")
+		if entry == "*" || host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// logProxy logs at debug level which proxy gets used for the given URL
+func logProxy(rawURL string, proxy string, level string) {
+	if len(proxy) > 0 {
+		Debugf("Using proxy " + proxy + " for " + rawURL + " (" + level + " proxy setting)")
+	} else if level == "no_proxy" {
+		Debugf("Using no proxy for " + rawURL + ", because of no_proxy setting")
+	}
+}
+
+// forgeProxyURL returns the proxy URL that should be used for the given Forge URL or nil if no proxy should be used
+func forgeProxyURL(rawURL string) *url.URL {
+	proxy, level := resolveProxy(rawURL, "", "")
+	logProxy(rawURL, proxy, level)
+	if len(proxy) == 0 {
+		return nil
+	}
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		Fatalf("forgeProxyURL(): Could not parse proxy URL " + proxy + " from " + level + " proxy setting Error: " + err.Error())
+	}
+	return proxyURL
+}
+
+// gitProxyParameter returns the git parameter that configures the proxy for the given git module or an empty string if git should use its defaults
+func gitProxyParameter(gitModule GitModule) string {
+	if !strings.HasPrefix(gitModule.git, "http://") && !strings.HasPrefix(gitModule.git, "https://") {
+		return ""
+	}
+	proxy, level := resolveProxy(gitModule.git, gitModule.proxy, gitModule.sourceProxy)
+	logProxy(gitModule.git, proxy, level)
+	switch level {
+	case "module", "source", "global":
+		return "-c http.proxy=" + proxy + " "
+	case "no_proxy":
+		// an empty http.proxy disables the proxy from the environment variables
+		return "-c http.proxy= "
+	}
+	return ""
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// publishUploads returns the local files and their urls below the given environment url for the given version of the exported artifact of a Puppet environment.
+// The deploy manifest .g10k-manifest.json is uploaded last, so that every published manifest has its artifact, an environment without a Puppetfile has no manifest.
+func publishUploads(envDir string, artifact string, envURL string, version string) [][]string {
+	extension := ".tar.gz"
+	if strings.HasSuffix(artifact, ".zip") {
+		extension = ".zip"
+	}
+	uploads := [][]string{{artifact, envURL + "/" + version + extension}}
+	if manifestFile := filepath.Join(envDir, ".g10k-manifest.json"); fileExists(manifestFile) {
+		uploads = append(uploads, []string{manifestFile, envURL + "/" + version + ".json"})
+	}
+	return uploads
+}
+
+// publishEnvironment uploads the exported artifact and the deploy manifest of the given Puppet environment to the object storage below publish url and removes old versions.
+// It returns false if the environment could not be published.
+func publishEnvironment(env string, envDir string, artifact string) bool {
+	if len(config.Publish.URL) == 0 || len(artifact) == 0 {
+		return true
+	}
+	envURL := strings.TrimSuffix(config.Publish.URL, "/") + "/" + env
+	version := deployVersion(envDir)
+	uploads := publishUploads(envDir, artifact, envURL, version)
+	for _, upload := range uploads {
+		er := executeCommand(uploadCommand(upload[0], upload[1]), config.Timeout, true)
+		if er.returnCode != 0 {
+			Warnf("WARNING: Could not upload " + upload[0] + " to " + upload[1] + ": " + er.errorOutput())
+			recordEnvironmentFailure(env, "publish to "+config.Publish.URL+" failed")
+			return false
+		}
+	}
+	Infof("Published environment " + env + " to " + uploads[0][1])
+	if checksum, err := fileSha256(artifact); err == nil {
+		publishedDir := checkDirAndCreate(filepath.Join(config.CacheDir, "published"), "cachedir/published")
+		writeStructJSONFile(filepath.Join(publishedDir, env+".json"), PublishedEnvironment{Environment: env, Version: version, URL: uploads[0][1], SHA256: hex.EncodeToString(checksum)})
+	}
+
+	if config.Publish.Versions > 0 {
+		er := executeCommand(listCommand(envURL+"/"), config.Timeout, true)
+		if er.returnCode != 0 {
+			Warnf("WARNING: Could not list old versions of environment " + env + " in " + envURL + ": " + er.errorOutput())
+			return true
+		}
+		for _, object := range expiredObjects(er.stdout, config.Publish.Versions) {
+			if er := executeCommand(deleteCommand(envURL+"/"+object), config.Timeout, true); er.returnCode != 0 {
+				Warnf("WARNING: Could not remove old version " + envURL + "/" + object + ": " + er.errorOutput())
+			}
+		}
+	}
+	return true
+}
+
+// publishDesiredState uploads the desired-state.json with the newest published artifact of every deployed Puppet environment below publish url, which g10k agent converges to.
+// It gets signed with manifest_signing, the signature is uploaded after the desired state, so that an agent never accepts a desired state whose artifacts are missing.
+func publishDesiredState() {
+	if len(config.Publish.URL) == 0 || dryRun {
+		return
+	}
+	state := DesiredState{GeneratedAt: time.Now().UTC(), Environments: []PublishedEnvironment{}}
+	for _, es := range environmentStatuses() {
+		var pe PublishedEnvironment
+		content, err := ioutil.ReadFile(filepath.Join(config.CacheDir, "published", es.Environment+".json"))
+		if err != nil || json.Unmarshal(content, &pe) != nil {
+			continue
+		}
+		state.Environments = append(state.Environments, pe)
+	}
+	stateFile := filepath.Join(checkDirAndCreate(filepath.Join(config.CacheDir, "published"), "cachedir/published"), "desired-state.json")
+	writeStructJSONFile(stateFile, state)
+	uploads := []string{stateFile}
+	if len(config.ManifestSigning.Method) > 0 {
+		if er := executeCommand(signCommand(stateFile), config.Timeout, true); er.returnCode != 0 {
+			Warnf("WARNING: Could not sign " + stateFile + ": " + er.errorOutput())
+			return
+		}
+		uploads = append(uploads, stateFile+".sig")
+	}
+	for _, file := range uploads {
+		url := strings.TrimSuffix(config.Publish.URL, "/") + "/" + filepath.Base(file)
+		if er := executeCommand(uploadCommand(file, url), config.Timeout, true); er.returnCode != 0 {
+			Warnf("WARNING: Could not upload " + file + " to " + url + ": " + er.errorOutput())
+			return
+		}
+	}
+	Infof("Published the desired state of " + strconv.Itoa(len(state.Environments)) + " environment(s) to " + strings.TrimSuffix(config.Publish.URL, "/") + "/desired-state.json")
+}
+
+// expiredObjects returns the artifacts and manifests of the given object listing that are older than the newest versions
+func expiredObjects(listing string, versions int) []string {
+	objects := make(map[string][]string)
+	var names []string
+	for _, line := range strings.Split(listing, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		object := path.Base(fields[len(fields)-1])
+		name := object
+		for _, extension := range []string{".tar.gz", ".zip", ".json"} {
+			name = strings.TrimSuffix(name, extension)
+		}
+		if name == object {
+			continue
+		}
+		if _, ok := objects[name]; !ok {
+			names = append(names, name)
+		}
+		objects[name] = append(objects[name], object)
+	}
+	// versions start with their timestamp, so the newest versions sort last
+	sort.Strings(names)
+	var expired []string
+	for i := 0; i < len(names)-versions; i++ {
+		expired = append(expired, objects[names[i]]...)
+	}
+	return expired
+}
+
+// azureBlob splits the given az://<account>/<container>/<name> url into the storage account, container and blob name
+func azureBlob(url string) (string, string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(url, "az://"), "/", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// uploadCommand returns the command that uploads the local file to the given object storage url
+func uploadCommand(file string, url string) string {
+	switch {
+	case strings.HasPrefix(url, "gs://"):
+		return shellquote.Join("gsutil", "-q", "cp", file, url)
+	case strings.HasPrefix(url, "az://"):
+		account, container, name := azureBlob(url)
+		return shellquote.Join("az", "storage", "blob", "upload", "--only-show-errors", "--overwrite", "--account-name", account, "--container-name", container, "--name", name, "--file", file)
+	}
+	return shellquote.Join("aws", "s3", "cp", "--only-show-errors", file, url)
+}
+
+// downloadCommand returns the command that downloads the given object storage url to the local file
+func downloadCommand(url string, file string) string {
+	switch {
+	case strings.HasPrefix(url, "gs://"):
+		return shellquote.Join("gsutil", "-q", "cp", url, file)
+	case strings.HasPrefix(url, "az://"):
+		account, container, name := azureBlob(url)
+		return shellquote.Join("az", "storage", "blob", "download", "--only-show-errors", "--account-name", account, "--container-name", container, "--name", name, "--file", file)
+	}
+	return shellquote.Join("aws", "s3", "cp", "--only-show-errors", url, file)
+}
+
+// listCommand returns the command that lists all objects below the given object storage url
+func listCommand(url string) string {
+	switch {
+	case strings.HasPrefix(url, "gs://"):
+		return shellquote.Join("gsutil", "ls", url)
+	case strings.HasPrefix(url, "az://"):
+		account, container, name := azureBlob(url)
+		return shellquote.Join("az", "storage", "blob", "list", "--only-show-errors", "--account-name", account, "--container-name", container, "--prefix", name, "--query", "[].name", "--output", "tsv")
+	}
+	return shellquote.Join("aws", "s3", "ls", url)
+}
+
+// deleteCommand returns the command that removes the given object storage url
+func deleteCommand(url string) string {
+	switch {
+	case strings.HasPrefix(url, "gs://"):
+		return shellquote.Join("gsutil", "-q", "rm", url)
+	case strings.HasPrefix(url, "az://"):
+		account, container, name := azureBlob(url)
+		return shellquote.Join("az", "storage", "blob", "delete", "--only-show-errors", "--account-name", account, "--container-name", container, "--name", name)
+	}
+	return shellquote.Join("aws", "s3", "rm", "--only-show-errors", url)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// puppetdbNodeQuery counts the active nodes of every environment by the environment of their last catalog
+const puppetdbNodeQuery = `["extract",[["function","count"],"catalog_environment"],["=","node_state","active"],["group_by","catalog_environment"]]`
+
+// puppetdbActiveNodes contains the number of active nodes of every Puppet environment according to PuppetDB, it is nil if puppetdb is not configured or could not be queried
+var puppetdbActiveNodes map[string]int
+
+// puppetdbSkippedEnvironments contains the target directories of the Puppet environments that mode restrict did not deploy in this g10k run, the purge of unmanaged environments keeps them
+var puppetdbSkippedEnvironments map[string]string
+
+// loadPuppetDBActiveNodes queries PuppetDB for the active nodes of every Puppet environment once per g10k run.
+// If PuppetDB can not be queried, g10k deploys all environments without prioritizing or restricting them.
+func loadPuppetDBActiveNodes() {
+	if len(config.PuppetDB.URL) == 0 || puppetdbActiveNodes != nil {
+		return
+	}
+	nodes, err := queryPuppetDBActiveNodes()
+	if err != nil {
+		Warnf("WARNING: Could not query the active nodes of the environments from PuppetDB " + config.PuppetDB.URL + ", deploying all environments: " + err.Error())
+		return
+	}
+	Debugf("PuppetDB reported active nodes in " + strconv.Itoa(len(nodes)) + " environment(s)")
+	puppetdbActiveNodes = nodes
+}
+
+// queryPuppetDBActiveNodes returns the number of active nodes of every Puppet environment that has at least one of them
+func queryPuppetDBActiveNodes() (map[string]int, error) {
+	client, err := tlsHTTPClient(config.PuppetDB.Cert, config.PuppetDB.Key, config.PuppetDB.CA)
+	if err != nil {
+		return nil, err
+	}
+	queryURL := strings.TrimSuffix(config.PuppetDB.URL, "/") + "/pdb/query/v4/nodes?query=" + url.QueryEscape(puppetdbNodeQuery)
+	resp, err := client.Get(queryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("GET " + queryURL + " returned " + resp.Status)
+	}
+	var result []struct {
+		Environment string `json:"catalog_environment"`
+		Count       int    `json:"count"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	nodes := make(map[string]int)
+	for _, r := range result {
+		nodes[r.Environment] = r.Count
+	}
+	return nodes, nil
+}
+
+// environmentHasActiveNodes returns true if PuppetDB knows active nodes of the given Puppet environment or could not be queried
+func environmentHasActiveNodes(env string) bool {
+	if puppetdbActiveNodes == nil {
+		return true
+	}
+	return puppetdbActiveNodes[env] > 0
+}
+
+// skipBasedOnPuppetDB returns true if puppetdb mode restrict is set and the given Puppet environment has no active nodes.
+// Environments that are deployed explicitly with -branch or -environment are never skipped, so that new branches can get their first nodes.
+func skipBasedOnPuppetDB(env string) bool {
+	return config.PuppetDB.Mode == "restrict" && len(branchParam) == 0 && len(environmentParam) == 0 && !environmentHasActiveNodes(env)
+}
+
+// environmentsWithoutActiveNodes returns the deployed Puppet environments of this g10k run and the ones skipped by mode restrict without active nodes in PuppetDB, which are candidates for a cleanup
+func environmentsWithoutActiveNodes() []string {
+	if puppetdbActiveNodes == nil {
+		return nil
+	}
+	var envs []string
+	for env, pe := range puppetEnvironments {
+		if !environmentHasActiveNodes(env) && isDir(pe.targetDir) {
+			envs = append(envs, env)
+		}
+	}
+	for env, targetDir := range puppetdbSkippedEnvironments {
+		if _, deployed := puppetEnvironments[env]; !deployed && isDir(targetDir) {
+			envs = append(envs, env)
+		}
+	}
+	sort.Strings(envs)
+	return envs
+}
@@ -6,13 +6,14 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/remeh/sizedwaitgroup"
 	"github.com/xorpaul/uiprogress"
-	"golang.org/x/term"
 )
 
 // sourceSanityCheck is a validation function that checks if the given source has all necessary attributes (basedir, remote, SSH key exists if given)
@@ -35,38 +36,60 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 	allPuppetfiles := make(map[string]Puppetfile)
 	allEnvironments := make(map[string]bool)
 	allBasedirs := make(map[string]bool)
+	var foundEnvironments []PuppetEnvironment
 	foundMatch := false
+	if sharedModuleResolution() {
+		// the environment pipelines and priority tiers share the resolved modules of this run
+		latestForgeModules.m = make(map[string]string)
+		resolvedOnce = make(map[string]*sync.Once)
+	}
+	loadPuppetDBActiveNodes()
+	startCheckpoint()
 	for source, sa := range config.Sources {
 		wg.Add()
 		go func(source string, sa Source) {
 			defer wg.Done()
-			if force {
-				createOrPurgeDir(sa.Basedir, "resolvePuppetEnvironment()")
+			defer recoverSourceFailure(source)
+			if deployCancelled() {
+				return
+			}
+			// a basedir with the {{branch}} variable can only be created once the branch is known
+			perBranchBasedir := hasBranchVariable(sa)
+			// with deploy_strategy atomic or symlink the environments are rebuilt from scratch in the staging_dir instead
+			if force && !perBranchBasedir && !stagedDeploy() {
+				purgeBasedir(sa.Basedir)
 			}
 
-			sa.Basedir = checkDirAndCreate(sa.Basedir, "basedir for source "+source)
+			if !perBranchBasedir {
+				sa.Basedir = checkDirAndCreate(sa.Basedir, "basedir for source "+source)
+			}
 			Debugf("Puppet environment: " + source + " (" + fmt.Sprintf("%+v", sa) + ")")
 
 			// check for a valid source that has all necessary attributes (basedir, remote, SSH key exist if given)
 			sourceSanityCheck(source, sa)
 
 			workDir := filepath.Join(config.EnvCacheDir, source+".git")
-			// check if sa.Basedir exists
-			checkDirAndCreate(sa.Basedir, "basedir")
 
 			controlRepoGit := GitModule{}
 			controlRepoGit.git = sa.Remote
 			controlRepoGit.privateKey = sa.PrivateKey
-			if success := doMirrorOrUpdate(controlRepoGit, workDir, 0); success {
+			controlRepoGit.sourceProxy = sa.Proxy
+			unlock := lockCacheEntry(config.CacheDir, workDir)
+			success := doMirrorOrUpdate(controlRepoGit, workDir, 0)
+			unlock()
+			if success {
+				if !perBranchBasedir {
+					prepareStagingDir(source, sa)
+				}
 
 				// get all branches
 				er := executeCommand("git --git-dir "+workDir+" branch", config.Timeout, false)
-				outputBranches := er.output
+				outputBranches := er.stdout
 				outputTags := ""
 
 				if tags {
 					er := executeCommand("git --git-dir "+workDir+" tag", config.Timeout, false)
-					outputTags = er.output
+					outputTags = er.stdout
 				}
 
 				branches := strings.Split(strings.TrimSpace(outputBranches+outputTags), "\n")
@@ -76,10 +99,6 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 				for _, branch := range branches {
 					branch = strings.TrimLeft(branch, "* ")
 					reInvalidCharacters := regexp.MustCompile(`\W`)
-					if sa.AutoCorrectEnvironmentNames == "error" && reInvalidCharacters.MatchString(branch) {
-						Warnf("Ignoring branch " + branch + ", because it contains invalid characters")
-						continue
-					}
 					// XXX: maybe make this user configurable (either with dedicated file or as YAML array in g10k config)
 					if strings.Contains(branch, ";") || strings.Contains(branch, "&") || strings.Contains(branch, "|") || strings.HasPrefix(branch, "tmp/") && strings.HasSuffix(branch, "/head") {
 						Debugf("Skipping branch " + branch + " of source " + source + ", because of invalid character(s) inside the branch name")
@@ -98,6 +117,12 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 							continue
 						}
 					}
+					if len(sa.IgnoreBranches) > 0 || len(sa.OnlyBranches) > 0 {
+						if skipBasedOnBranchLists(branch, source, sa) {
+							Debugf("Skipping branch " + branch + " of source " + source + ", because of ignore_branches/only_branches setting")
+							continue
+						}
+					}
 
 					if len(branchParam) > 0 {
 						if branch == branchParam {
@@ -115,87 +140,102 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 						}
 					}
 
-					wg.Add()
+					if len(branch) == 0 {
+						continue
+					}
 
-					go func(branch string, sa Source, prefix string) {
-						defer wg.Done()
-						if len(branch) != 0 {
-							Debugf("Resolving environment " + prefix + branch + " of source " + source)
+					sa := sa
+					prefix := prefix
+					if perBranchBasedir {
+						sa = expandBranchVariables(sa, branch)
+						if force {
+							purgeBasedir(sa.Basedir)
+						}
+						sa.Basedir = checkDirAndCreate(sa.Basedir, "basedir for branch "+branch+" of source "+source)
+						prepareStagingDir(source, sa)
+						prefix = resolveSourcePrefix(source, sa)
+					}
+					Debugf("Resolving environment " + prefix + branch + " of source " + source)
 
-							renamedBranch := branch
-							if (len(outputNameTag) > 0) && (len(branchParam) > 0) {
-								renamedBranch = outputNameTag
-								Debugf("Renaming branch " + branch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
-							}
+					renamedBranch := branch
+					if (len(outputNameTag) > 0) && (len(branchParam) > 0) {
+						renamedBranch = outputNameTag
+						Debugf("Renaming branch " + branch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
+					}
 
-							// https://github.com/puppetlabs/r10k/blob/main/doc/dynamic-environments/configuration.mkd#strip_component
-							if len(sa.StripComponent) != 0 {
-								stripRenamedBranch := stripComponent(sa.StripComponent, renamedBranch)
-								if stripRenamedBranch != renamedBranch {
-									// only print this if the branch was definately renamed, because of the strip component
-									Debugf("Renaming branch " + renamedBranch + " to " + stripRenamedBranch + ", because of strip_component in source " + source + " " + sa.Remote)
-									renamedBranch = stripRenamedBranch
-								}
-							}
+					// https://github.com/puppetlabs/r10k/blob/main/doc/dynamic-environments/configuration.mkd#strip_component
+					if len(sa.StripComponent) != 0 {
+						stripRenamedBranch := stripComponent(sa.StripComponent, renamedBranch)
+						if stripRenamedBranch != renamedBranch {
+							// only print this if the branch was definately renamed, because of the strip component
+							Debugf("Renaming branch " + renamedBranch + " to " + stripRenamedBranch + ", because of strip_component in source " + source + " " + sa.Remote)
+							renamedBranch = stripRenamedBranch
+						}
+					}
 
-							if sa.AutoCorrectEnvironmentNames == "correct" || sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
-								oldBranch := renamedBranch
-								renamedBranch = reInvalidCharacters.ReplaceAllString(renamedBranch, "_")
-								if oldBranch != renamedBranch {
-									if sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
-										Warnf("Renaming branch " + oldBranch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
-									} else {
-										Debugf("Renaming branch " + oldBranch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
-									}
-								}
-							}
+					if len(sa.BranchRewrites) > 0 || len(sa.EnvironmentName) > 0 {
+						mappedRenamedBranch := mapEnvironmentName(source, sa, renamedBranch)
+						if mappedRenamedBranch != renamedBranch {
+							Debugf("Renaming branch " + renamedBranch + " to " + mappedRenamedBranch + ", because of branch_rewrites/environment_name in source " + source + " " + sa.Remote)
+							renamedBranch = mappedRenamedBranch
+						}
+					}
 
-							mutex.Lock()
-							if _, ok := allEnvironments[prefix+renamedBranch]; !ok {
-								allEnvironments[prefix+renamedBranch] = true
+					// https://github.com/puppetlabs/r10k/blob/main/doc/dynamic-environments/git-environments.mkd#invalid_branches
+					if sa.AutoCorrectEnvironmentNames == "error" && reInvalidCharacters.MatchString(renamedBranch) {
+						Warnf("ERROR: Ignoring branch " + branch + ", because it contains invalid characters (resulting environment name: " + prefix + renamedBranch + ")")
+						continue
+					}
+					if sa.AutoCorrectEnvironmentNames == "correct" || sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
+						oldBranch := renamedBranch
+						renamedBranch = reInvalidCharacters.ReplaceAllString(renamedBranch, "_")
+						if oldBranch != renamedBranch {
+							if sa.AutoCorrectEnvironmentNames == "correct_and_warn" {
+								Warnf("Renaming branch " + oldBranch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
 							} else {
-								Fatalf("Renamed environment naming conflict detected with renamed environment " + prefix + renamedBranch)
+								Debugf("Renaming branch " + oldBranch + " to " + renamedBranch + " from  source " + source + " " + sa.Remote)
 							}
-							mutex.Unlock()
-							targetDir := filepath.Join(sa.Basedir, prefix+strings.Replace(renamedBranch, "/", "_", -1))
-							targetDir = normalizeDir(targetDir)
-
-							env := strings.Replace(strings.Replace(targetDir, sa.Basedir, "", 1), "/", "", -1)
-							if len(moduleParam) == 0 {
-								gitModule := GitModule{}
-								gitModule.tree = branch
-								syncToModuleDir(gitModule, workDir, targetDir, env)
-							}
-							pf := filepath.Join(targetDir, "Puppetfile")
-							if !fileExists(pf) {
-								Debugf("resolvePuppetEnvironment(): Skipping branch " + source + "_" + branch + " because " + pf + " does not exist")
-								deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
-								if fileExists(deployFile) {
-									Debugf("Finishing writing to deploy file " + deployFile)
-									dr := readDeployResultFile(deployFile)
-									dr.DeploySuccess = true
-									dr.FinishedAt = time.Now()
-									dr.GitDir = sa.Basedir
-									dr.GitURL = sa.Remote
-									writeStructJSONFile(deployFile, dr)
-								}
-							} else {
-								puppetfile := readPuppetfile(pf, sa.PrivateKey, source, branch, sa.ForceForgeVersions, false)
-								puppetfile.workDir = normalizeDir(targetDir)
-								puppetfile.controlRepoBranch = branch
-								puppetfile.gitDir = workDir
-								puppetfile.gitURL = sa.Remote
-								mutex.Lock()
-								for _, moduleDir := range puppetfile.moduleDirs {
-									checkDirAndCreate(filepath.Join(puppetfile.workDir, moduleDir), "moduledir for env")
-								}
-								allPuppetfiles[env] = puppetfile
-								allBasedirs[sa.Basedir] = true
-								mutex.Unlock()
+						}
+					}
 
-							}
+					targetDir := filepath.Join(sa.Basedir, prefix+strings.Replace(renamedBranch, "/", "_", -1))
+					canaryOf := ""
+					if canary {
+						canaryOf = prefix + renamedBranch
+						renamedBranch += canarySuffix
+						targetDir += canarySuffix
+						Debugf("Deploying branch " + branch + " of source " + source + " as canary of environment " + canaryOf)
+					}
+					targetDir = normalizeDir(targetDir)
+
+					env := strings.Replace(strings.Replace(targetDir, sa.Basedir, "", 1), "/", "", -1)
+					if len(config.EnvironmentAllowList) > 0 || len(config.EnvironmentDenyList) > 0 {
+						if skipBasedOnEnvironmentLists(env) {
+							Debugf("Skipping environment " + env + " of source " + source + ", because of environment_allowlist/environment_denylist setting")
+							continue
 						}
-					}(branch, sa, prefix)
+					}
+					if skipBasedOnPuppetDB(env) {
+						Debugf("Skipping environment " + env + " of source " + source + ", because it has no active nodes in PuppetDB")
+						mutex.Lock()
+						puppetdbSkippedEnvironments[env] = targetDir
+						mutex.Unlock()
+						continue
+					}
+					Verbosef("Mapping branch " + branch + " of source " + source + " to Puppet environment " + env + " (invalid_branches: " + sa.AutoCorrectEnvironmentNames + ")")
+
+					mutex.Lock()
+					foundEnvironments = append(foundEnvironments, PuppetEnvironment{
+						source:    source,
+						sa:        sa,
+						branch:    branch,
+						name:      prefix + renamedBranch,
+						env:       env,
+						targetDir: targetDir,
+						gitDir:    workDir,
+						canaryOf:  canaryOf,
+					})
+					mutex.Unlock()
 				}
 
 				if sa.ErrorMissingBranch && !foundBranch {
@@ -204,9 +244,9 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 					Warnf("WARNING: Couldn't find specified branch '" + branchParam + "' anywhere in source '" + source + "' (" + sa.Remote + ")")
 				}
 			} else {
-				Warnf("WARNING: Could not resolve git repository in source '" + source + "' (" + sa.Remote + ")")
+				failSource(source, "WARNING: Could not resolve git repository in source '"+source+"' ("+sa.Remote+")")
 				if sa.ExitIfUnreachable {
-					os.Exit(1)
+					os.Exit(exitGitError)
 				}
 			}
 		}(source, sa)
@@ -218,13 +258,185 @@ func resolvePuppetEnvironment(tags bool, outputNameTag string) {
 			Warnf("WARNING: Environment '" + environmentParam + "' cannot be found in any source and will not be deployed.")
 		}
 	}
-	//fmt.Println("allPuppetfiles: ", allPuppetfiles, len(allPuppetfiles))
-	//fmt.Println("allPuppetfiles[0]: ", allPuppetfiles["postinstall"])
-	resolvePuppetfile(allPuppetfiles)
+
+	var stagedEnvironments []PuppetEnvironment
+	resolvedEnvironments := prioritizeEnvironments(resolveEnvironmentCollisions(foundEnvironments))
+	for _, pe := range resolvedEnvironments {
+		allEnvironments[pe.name] = true
+		puppetEnvironments[pe.env] = pe
+	}
+	// the environments without active nodes are only listed as candidates for a cleanup, they must not be purged
+	for env := range puppetdbSkippedEnvironments {
+		allEnvironments[env] = true
+	}
+	startProgressReporter(len(resolvedEnvironments))
+	defer stopProgressReporter()
+	if pipelinedDeploy() {
+		Debugf("Deploying " + strconv.Itoa(len(resolvedEnvironments)) + " Puppet environments with " + strconv.Itoa(config.EnvironmentMaxworker) + " environment pipelines")
+		wg = sizedwaitgroup.New(config.EnvironmentMaxworker)
+	}
+	// finishEnvironments waits for the started environments and deploys their modules, so that they are available before the next environment_priority tier gets deployed
+	tierEnvironments := 0
+	finishEnvironments := func() {
+		wg.Wait()
+		if !pipelinedDeploy() {
+			resolvePuppetfile(allPuppetfiles)
+		}
+		commitStagedEnvironments(stagedEnvironments)
+		if !pipelinedDeploy() {
+			completeProgressEnvironments(tierEnvironments)
+		}
+		tierEnvironments = 0
+		allPuppetfiles = make(map[string]Puppetfile)
+		stagedEnvironments = nil
+	}
+	for i, pe := range resolvedEnvironments {
+		if i > 0 && environmentPriorityTier(pe.env) != environmentPriorityTier(resolvedEnvironments[i-1].env) {
+			finishEnvironments()
+			Debugf("Deploying the environments of environment_priority tier " + strconv.Itoa(environmentPriorityTier(pe.env)+1))
+		}
+		tierEnvironments++
+		wg.Add()
+		go func(pe PuppetEnvironment) {
+			defer wg.Done()
+			if pipelinedDeploy() {
+				defer completeProgressEnvironments(1)
+			}
+			defer recoverEnvironmentFailure(pe.env)
+			if environmentCancelled(pe.env) {
+				return
+			}
+			source := pe.source
+			sa := pe.sa
+			branch := pe.branch
+			targetDir := pe.targetDir
+			env := pe.env
+			if environmentFrozen(env, targetDir) {
+				holdEnvironment(env, targetDir)
+				return
+			}
+			if resumedEnvironment(pe) {
+				Infof("Skipping environment " + env + ", because it was already deployed by the resumed g10k run")
+				return
+			}
+			if config.DeployAffectedOnly && !force && len(moduleParam) == 0 && environmentUnchanged(pe) {
+				Infof("Skipping environment " + env + ", because its branch " + branch + " and Puppetfile did not change since the last successful deploy")
+				return
+			}
+			if stagedDeploy() && !dryRun {
+				// build the environment next to the live one and swap it into place once it is complete
+				pe.stagedDir = stageEnvironment(pe)
+				trackStagingTempDir(stagingTempDir(pe))
+				targetDir = pe.stagedDir
+				if !pipelinedDeploy() {
+					mutex.Lock()
+					stagedEnvironments = append(stagedEnvironments, pe)
+					mutex.Unlock()
+				}
+			}
+			if len(moduleParam) == 0 {
+				gitModule := GitModule{}
+				gitModule.git = sa.Remote
+				gitModule.tree = branch
+				gitModule.purgeAllowList = resolvePurgeAllowList(sa)
+				syncToModuleDir(gitModule, pe.gitDir, targetDir, env)
+			}
+			if len(pe.canaryOf) > 0 {
+				writeCanaryMarker(targetDir, pe.canaryOf)
+			}
+			// a dry run reads the Puppetfile of the branch without extracting the control repository into the basedir
+			controlRepoDir := targetDir
+			if dryRun && len(moduleParam) == 0 {
+				controlRepoDir = dryRunControlRepo(pe)
+				defer purgeDir(controlRepoDir, "resolvePuppetEnvironment() -dryrun")
+			}
+			pf := filepath.Join(controlRepoDir, "Puppetfile")
+			if !fileExists(pf) {
+				Debugf("resolvePuppetEnvironment(): Skipping branch " + source + "_" + branch + " because " + pf + " does not exist")
+				deployFile := filepath.Join(targetDir, ".g10k-deploy.json")
+				if fileExists(deployFile) && !dryRun {
+					Debugf("Finishing writing to deploy file " + deployFile)
+					dr := readDeployResultFile(deployFile)
+					dr.DeploySuccess = true
+					dr.FinishedAt = time.Now()
+					dr.GitDir = sa.Basedir
+					dr.GitURL = sa.Remote
+					writeStructJSONFile(deployFile, dr)
+					if !stagedDeploy() {
+						finishEnvironment(env, targetDir)
+					}
+				}
+			} else {
+				puppetfile := readPuppetfile(pf, sa.PrivateKey, source, branch, sa.ForceForgeVersions, false)
+				puppetfile.workDir = normalizeDir(targetDir)
+				puppetfile.controlRepoBranch = branch
+				puppetfile.gitDir = pe.gitDir
+				puppetfile.gitURL = sa.Remote
+				puppetfile.sourceProxy = sa.Proxy
+				puppetfile.purgeAllowList = resolvePurgeAllowList(sa)
+				applyEnvironmentOverrides(&puppetfile, readEnvironmentOverrides(controlRepoDir, env), env)
+				if purgeReport && len(moduleParam) == 0 {
+					reportUnmanagedControlRepoContent(env, targetDir, pe.gitDir, branch, puppetfile.moduleDirs, controlRepoPurgeAllowList(pe.gitDir, branch, puppetfile.purgeAllowList))
+				}
+				for _, moduleDir := range puppetfile.moduleDirs {
+					checkDirAndCreate(filepath.Join(puppetfile.workDir, moduleDir), "moduledir for env")
+				}
+				mutex.Lock()
+				allPuppetfiles[env] = puppetfile
+				allBasedirs[sa.Basedir] = true
+				mutex.Unlock()
+				if pipelinedDeploy() {
+					// continue with the modules of this environment without waiting for the other environments
+					resolvePuppetfile(map[string]Puppetfile{env: puppetfile})
+				}
+			}
+			if pipelinedDeploy() && len(pe.stagedDir) > 0 {
+				commitStagedEnvironments([]PuppetEnvironment{pe})
+			}
+		}(pe)
+	}
+	finishEnvironments()
 	//fmt.Printf("%+v\n", allEnvironments)
-	if len(moduleParam) == 0 {
+	if deployCancelled() {
+		// the environments of sources that were not resolved anymore must not be purged
+		Warnf("WARNING: Not purging unmanaged content, because the g10k run got cancelled")
+	} else if len(moduleParam) == 0 {
 		purgeUnmanagedContent(allBasedirs, allEnvironments)
+		if config.ModuleStore {
+			garbageCollectModuleStore()
+		}
+	}
+}
+
+// resolveEnvironmentCollisions detects Puppet environments that got the same directory from different branches and resolves them with the priority setting of their sources.
+// The source with the higher priority wins, a conflict between branches of the same source or sources with the same priority is fatal.
+func resolveEnvironmentCollisions(environments []PuppetEnvironment) []PuppetEnvironment {
+	sort.SliceStable(environments, func(i, j int) bool {
+		if environments[i].sa.Priority != environments[j].sa.Priority {
+			return environments[i].sa.Priority > environments[j].sa.Priority
+		}
+		if environments[i].source != environments[j].source {
+			return environments[i].source < environments[j].source
+		}
+		return environments[i].branch < environments[j].branch
+	})
+	claimedEnvironments := make(map[string]PuppetEnvironment)
+	var resolvedEnvironments []PuppetEnvironment
+	for _, pe := range environments {
+		if claimed, ok := claimedEnvironments[pe.targetDir]; ok {
+			if claimed.source == pe.source {
+				Fatalf("Renamed environment naming conflict detected with renamed environment " + pe.name)
+			} else if claimed.sa.Priority == pe.sa.Priority {
+				Fatalf("Environment naming conflict detected for environment " + pe.name + " between branch " + claimed.branch + " of source " + claimed.source + " and branch " + pe.branch + " of source " + pe.source + ". Set a different priority for these sources to resolve it")
+			} else {
+				Warnf("WARNING: Skipping branch " + pe.branch + " of source " + pe.source + ", because environment " + pe.name + " is already provided by branch " + claimed.branch + " of source " + claimed.source + " with a higher priority")
+			}
+			continue
+		}
+		claimedEnvironments[pe.targetDir] = pe
+		resolvedEnvironments = append(resolvedEnvironments, pe)
 	}
+	return resolvedEnvironments
 }
 
 // resolveSourcePrefix implements the prefix read out from each source given in the config file, like r10k https://github.com/puppetlabs/r10k/blob/master/doc/dynamic-environments/configuration.mkd#prefix
@@ -242,8 +454,11 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	wg := sizedwaitgroup.New(config.MaxExtractworker)
 	exisitingModuleDirs := make(map[string]struct{})
 	uniqueGitModules := make(map[string]GitModule)
-	// if we made it this far initialize the global maps
-	latestForgeModules.m = make(map[string]string)
+	forgeModules := make(map[string]ForgeModule)
+	if !sharedModuleResolution() {
+		// if we made it this far initialize the global maps
+		latestForgeModules.m = make(map[string]string)
+	}
 	for env, pf := range allPuppetfiles {
 		Debugf("Resolving branch " + env + " of source " + pf.source)
 		//fmt.Println(pf)
@@ -260,6 +475,7 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			}
 
 			gitModule.privateKey = pf.privateKey
+			gitModule.sourceProxy = pf.sourceProxy
 			if _, ok := uniqueGitModules[gitModule.git]; !ok {
 				uniqueGitModules[gitModule.git] = gitModule
 			}
@@ -281,18 +497,21 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			// fmt.Println("Found Forge module", fm.author, "/", forgeModuleName, "with version", fm.version, "and cacheTTL", fm.cacheTTL)
 			forgeModuleName = strings.Replace(forgeModuleName, "/", "-", -1)
 			uniqueForgeModuleName := fm.author + "/" + forgeModuleName + "-" + fm.version
-			if _, ok := uniqueForgeModules[uniqueForgeModuleName]; !ok {
-				uniqueForgeModules[uniqueForgeModuleName] = fm
+			if _, ok := forgeModules[uniqueForgeModuleName]; !ok {
+				forgeModules[uniqueForgeModuleName] = fm
 			} else {
 				// Use the shortest Forge cache TTL for this module
-				if uniqueForgeModules[uniqueForgeModuleName].cacheTTL > pf.forgeCacheTTL {
-					delete(uniqueForgeModules, uniqueForgeModuleName)
-					uniqueForgeModules[uniqueForgeModuleName] = fm
+				if forgeModules[uniqueForgeModuleName].cacheTTL > pf.forgeCacheTTL {
+					delete(forgeModules, uniqueForgeModuleName)
+					forgeModules[uniqueForgeModuleName] = fm
 				}
 			}
+			mutex.Lock()
+			uniqueForgeModules[uniqueForgeModuleName] = forgeModules[uniqueForgeModuleName]
+			mutex.Unlock()
 		}
 	}
-	if !debug && !verbose && !info && !quiet && term.IsTerminal(int(os.Stdout.Fd())) {
+	if progressBarsEnabled() {
 		uiprogress.Start()
 	}
 	var wgResolve sync.WaitGroup
@@ -303,9 +522,19 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	}()
 	go func() {
 		defer wgResolve.Done()
-		resolveForgeModules(uniqueForgeModules)
+		resolveForgeModules(forgeModules)
 	}()
 	wgResolve.Wait()
+	for env, pf := range allPuppetfiles {
+		if module, message := failedModuleOf(pf); len(module) > 0 {
+			Warnf("WARNING: Not deploying environment " + env + ", because its module " + module + " failed: " + message)
+			recordEnvironmentFailure(env, "module "+module+": "+message)
+			mutex.Lock()
+			moduleFailedEnvironments[env] = module
+			mutex.Unlock()
+			delete(allPuppetfiles, env)
+		}
+	}
 	//log.Println(config.Sources["cmdlineparam"])
 	for env, pf := range allPuppetfiles {
 		Debugf("Syncing " + env + " with workDir " + pf.workDir)
@@ -321,6 +550,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			mutex.Lock()
 			for _, exisitingModuleDir := range exisitingModuleDirsFI {
 				//fmt.Println("adding dir: ", moduleDir+exisitingModuleDir.Name())
+				if isPurgeAllowListed(pf, filepath.Join(moduleDir, exisitingModuleDir.Name())) {
+					Debugf("Not purging " + filepath.Join(moduleDir, exisitingModuleDir.Name()) + " due to purge_allowlist match")
+					continue
+				}
 				exisitingModuleDirs[filepath.Join(moduleDir, exisitingModuleDir.Name())] = empty
 			}
 			mutex.Unlock()
@@ -352,6 +585,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			wg.Add()
 			go func(gitName string, gitModule GitModule, env string, pf Puppetfile) {
 				defer wg.Done()
+				defer recoverEnvironmentFailure(env)
+				if environmentCancelled(env) {
+					return
+				}
 				targetDir := normalizeDir(filepath.Join(moduleDir, gitName))
 				moduleCacheDir := filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(gitModule.git, "/", "_", -1), ":", "-", -1))
 				tree := detectDefaultBranch(moduleCacheDir)
@@ -412,7 +649,7 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 					gitModule.tree = tree
 					success = syncToModuleDir(gitModule, moduleCacheDir, targetDir, env)
 					if !success && !config.IgnoreUnreachableModules {
-						Fatalf("Failed to resolve git module '" + gitName + "' with repository " + gitModule.git + " and branch/reference '" + tree + "' used in control repository branch '" + pf.sourceBranch + "' or Puppet environment '" + env + "'")
+						FatalExitf(exitGitError, "Failed to resolve git module '"+gitName+"' with repository "+gitModule.git+" and branch/reference '"+tree+"' used in control repository branch '"+pf.sourceBranch+"' or Puppet environment '"+env+"'")
 					}
 				}
 
@@ -440,6 +677,10 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			moduleDir = normalizeDir(moduleDir)
 			go func(forgeModuleName string, fm ForgeModule, moduleDir string, env string) {
 				defer wg.Done()
+				defer recoverEnvironmentFailure(env)
+				if environmentCancelled(env) {
+					return
+				}
 				syncForgeToModuleDir(forgeModuleName, fm, moduleDir, env)
 				// remove this module from the exisitingModuleDirs map
 				mutex.Lock()
@@ -454,20 +695,44 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 	if stringSliceContains(config.PurgeLevels, "puppetfile") {
 		if len(exisitingModuleDirs) > 0 && len(moduleParam) == 0 {
 			for d := range exisitingModuleDirs {
+				if env, _ := environmentOfPath(d); environmentFailed(env) {
+					// the modules of a failed environment might not have been synced yet
+					continue
+				}
 				Infof("Removing unmanaged path " + d)
-				if !dryRun {
+				if dryRun {
+					env, path := environmentOfPath(d)
+					recordDryRunChange(env, "remove module "+path)
+					recordOrphanedContent(env, path+"/", "puppetfile")
+				} else {
 					purgeDir(d, "purge_level puppetfile")
+					mutex.Lock()
+					purgedPaths = append(purgedPaths, d)
+					mutex.Unlock()
 				}
 			}
 		}
 	}
-	if !debug && !verbose && !info && !quiet && term.IsTerminal(int(os.Stdout.Fd())) {
+	if progressBarsEnabled() {
 		uiprogress.Stop()
 	}
 
-	for _, pf := range allPuppetfiles {
+	for env, pf := range allPuppetfiles {
+		if environmentFailed(env) {
+			Debugf("Not updating the deploy file of environment " + env + ", because its deploy failed")
+			continue
+		}
+		if len(moduleParam) > 0 {
+			if len(pf.gitModules) == 0 && len(pf.forgeModules) == 0 {
+				Debugf("Not updating the deploy file of environment " + env + ", because its Puppetfile does not contain module " + moduleParam)
+				continue
+			}
+			mutex.Lock()
+			moduleEnvironments = append(moduleEnvironments, env)
+			mutex.Unlock()
+		}
 		deployFile := filepath.Join(pf.workDir, ".g10k-deploy.json")
-		if fileExists(deployFile) {
+		if fileExists(deployFile) && !dryRun {
 			Debugf("Finishing writing to deploy file " + deployFile)
 			dr := readDeployResultFile(deployFile)
 			dr.DeploySuccess = true
@@ -476,6 +741,15 @@ func resolvePuppetfile(allPuppetfiles map[string]Puppetfile) {
 			dr.GitDir = pf.gitDir
 			dr.GitURL = pf.gitURL
 			writeStructJSONFile(deployFile, dr)
+			manageEnvironmentConf(pf)
+			manifest := writeDeployManifest(env, pf, dr)
+			writeDeployChecksums(env, pf, manifest)
+			if !signDeployManifest(env, pf.workDir) {
+				continue
+			}
+			if !stagedDeploy() {
+				finishEnvironment(env, pf.workDir)
+			}
 		}
 	}
 
@@ -504,3 +778,55 @@ func skipBasedOnFilterRegex(branch string, sourceName string, sa Source, workDir
 	return len(m) <= 0
 
 }
+
+// skipBasedOnBranchLists returns true if the branch matches one of the ignore_branches regexes or none of the only_branches regexes of the source
+func skipBasedOnBranchLists(branch string, sourceName string, sa Source) bool {
+	for _, ignoreRegex := range sa.IgnoreBranches {
+		reIgnore, err := regexp.Compile(ignoreRegex)
+		if err != nil {
+			Fatalf("Setting ignore_branches regex '" + ignoreRegex + "' of source " + sourceName + " could not be compiled to a valid Go regex please fix!")
+		}
+		if reIgnore.MatchString(branch) {
+			return true
+		}
+	}
+	if len(sa.OnlyBranches) == 0 {
+		return false
+	}
+	for _, onlyRegex := range sa.OnlyBranches {
+		reOnly, err := regexp.Compile(onlyRegex)
+		if err != nil {
+			Fatalf("Setting only_branches regex '" + onlyRegex + "' of source " + sourceName + " could not be compiled to a valid Go regex please fix!")
+		}
+		if reOnly.MatchString(branch) {
+			return false
+		}
+	}
+	return true
+}
+
+// skipBasedOnEnvironmentLists returns true if the Puppet environment name matches one of the global environment_denylist regexes or none of the environment_allowlist regexes
+func skipBasedOnEnvironmentLists(env string) bool {
+	for _, denyRegex := range config.EnvironmentDenyList {
+		reDeny, err := regexp.Compile(denyRegex)
+		if err != nil {
+			Fatalf("Setting environment_denylist regex '" + denyRegex + "' could not be compiled to a valid Go regex please fix!")
+		}
+		if reDeny.MatchString(env) {
+			return true
+		}
+	}
+	if len(config.EnvironmentAllowList) == 0 {
+		return false
+	}
+	for _, allowRegex := range config.EnvironmentAllowList {
+		reAllow, err := regexp.Compile(allowRegex)
+		if err != nil {
+			Fatalf("Setting environment_allowlist regex '" + allowRegex + "' could not be compiled to a valid Go regex please fix!")
+		}
+		if reAllow.MatchString(env) {
+			return false
+		}
+	}
+	return true
+}
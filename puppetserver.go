@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// flushPuppetserverEnvironmentCaches deletes the environment cache of every Puppet environment that was changed by this g10k run on every configured puppetserver,
+// so that the new code takes effect without waiting for the environment_timeout. It returns the environments for which a flush failed.
+func flushPuppetserverEnvironmentCaches() []string {
+	if len(config.Puppetserver.URLs) == 0 || len(needSyncEnvs) == 0 {
+		return nil
+	}
+	var envs []string
+	for env := range needSyncEnvs {
+		if !environmentFailed(env) {
+			envs = append(envs, env)
+		}
+	}
+	sort.Strings(envs)
+	client, err := tlsHTTPClient(config.Puppetserver.Cert, config.Puppetserver.Key, config.Puppetserver.CA)
+	if err != nil {
+		Warnf("WARNING: Not flushing the puppetserver environment caches: " + err.Error())
+		return envs
+	}
+	var failedEnvs []string
+	for _, env := range envs {
+		failed := false
+		for _, server := range config.Puppetserver.URLs {
+			flushURL := strings.TrimSuffix(server, "/") + "/puppet-admin-api/v1/environment-cache?environment=" + url.QueryEscape(env)
+			if dryRun {
+				Infof("Would flush " + flushURL)
+				continue
+			}
+			Verbosef("Flushing the environment cache of " + env + " on " + server)
+			if err := flushPuppetserverEnvironmentCache(client, flushURL); err != nil {
+				Warnf("WARNING: Could not flush the environment cache of " + env + " on " + server + ": " + err.Error())
+				failed = true
+			}
+		}
+		if failed {
+			failedEnvs = append(failedEnvs, env)
+		}
+	}
+	return failedEnvs
+}
+
+// flushPuppetserverEnvironmentCache sends the DELETE request of the given environment-cache URL of the puppetserver admin API
+func flushPuppetserverEnvironmentCache(client *http.Client, flushURL string) error {
+	req, err := http.NewRequest("DELETE", flushURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return errors.New("DELETE " + flushURL + " returned " + resp.Status)
+	}
+	return nil
+}
+
+// tlsHTTPClient returns an HTTP client for the APIs of the Puppet infrastructure, which authenticates with the given client cert and key and trusts the given ca, e.g. the Puppet CA.
+// Without ca the system CAs are trusted.
+func tlsHTTPClient(certFile string, keyFile string, caFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caFile) > 0 {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("could not find any certificate in " + caFile)
+		}
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: time.Duration(config.Timeout) * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
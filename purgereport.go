@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// allPurgeLevels contains every purge level that g10k supports, -purgereport evaluates all of them
+var allPurgeLevels = []string{"deployment", "puppetfile", "environment"}
+
+// recordOrphanedContent remembers a path inside of the given Puppet environment that the given purge level would remove, an empty path stands for the whole environment
+func recordOrphanedContent(env string, path string, purgeLevel string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(path) == 0 {
+		path = "entire environment"
+	}
+	label := "purge_level " + purgeLevel
+	if !stringSliceContains(configuredPurgeLevels, purgeLevel) {
+		label += ", not enabled"
+	}
+	orphanedContent[env] = append(orphanedContent[env], path+" ("+label+")")
+}
+
+// purgeReportLines returns the -purgereport output for all recorded orphaned content, grouped by Puppet environment
+func purgeReportLines() []string {
+	if len(orphanedContent) == 0 {
+		return []string{"Purge report: no unmanaged content found"}
+	}
+	lines := []string{"Purge report: the following unmanaged content would be removed with purge_levels ['" + strings.Join(allPurgeLevels, "', '") + "']"}
+	var envs []string
+	count := 0
+	for env := range orphanedContent {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	for _, env := range envs {
+		paths := orphanedContent[env]
+		sort.Strings(paths)
+		lines = append(lines, "Environment "+env+":")
+		for _, path := range paths {
+			lines = append(lines, "    "+path)
+		}
+		count += len(paths)
+	}
+	return append(lines, "Found "+strconv.Itoa(count)+" unmanaged path(s) in "+strconv.Itoa(len(envs))+" environment(s)")
+}
+
+// printPurgeReport prints the -purgereport output
+func printPurgeReport() {
+	for _, line := range purgeReportLines() {
+		fmt.Println(line)
+	}
+}
+
+// reportUnmanagedControlRepoContent records the content of the deployed Puppet environment that the environment purge level would remove when deploying the given commit of the control repository
+func reportUnmanagedControlRepoContent(env string, targetDir string, gitDir string, commit string, moduleDirs []string, allowList []string) {
+	if !isDir(targetDir) {
+		return
+	}
+	treeFiles := gitTreeFiles(gitDir, commit)
+	treeDirs := make(map[string]bool)
+	for file := range treeFiles {
+		for dir := filepath.Dir(file); dir != "."; dir = filepath.Dir(dir) {
+			treeDirs[dir] = true
+		}
+	}
+	var moduleDirPaths []string
+	for _, moduleDir := range moduleDirs {
+		moduleDirPaths = append(moduleDirPaths, filepath.Join(targetDir, moduleDir))
+	}
+	paths, _ := unmanagedEnvironmentContent(targetDir, targetDir, treeFiles, treeDirs, moduleDirPaths, allowList)
+	for _, path := range paths {
+		recordOrphanedContent(env, path, "environment")
+	}
+}
+
+// unmanagedEnvironmentContent returns all paths below dir relative to the Puppet environment directory that are neither part of the control repository nor a moduledir, deploy metadata or the purge_allowlist.
+// Directories that only contain unmanaged content are returned as a whole with a trailing slash. The second return value is true if everything below dir is unmanaged.
+func unmanagedEnvironmentContent(envDir string, dir string, treeFiles map[string]bool, treeDirs map[string]bool, moduleDirs []string, allowList []string) ([]string, bool) {
+	entries, _ := ioutil.ReadDir(dir)
+	var paths []string
+	allUnmanaged := true
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		relPath, _ := filepath.Rel(envDir, path)
+		isModuleDir := false
+		containsModuleDir := false
+		for _, moduleDir := range moduleDirs {
+			if path == moduleDir {
+				isModuleDir = true
+			} else if strings.HasPrefix(moduleDir, path+"/") {
+				containsModuleDir = true
+			}
+		}
+		if isModuleDir || isDeployMetadata(relPath) || matchesPurgeAllowList(allowList, envDir, path) {
+			allUnmanaged = false
+			continue
+		}
+		if containsModuleDir {
+			// only the content next to the moduledir can be unmanaged
+			allUnmanaged = false
+			subPaths, _ := unmanagedEnvironmentContent(envDir, path, treeFiles, treeDirs, moduleDirs, allowList)
+			paths = append(paths, subPaths...)
+			continue
+		}
+		if entry.IsDir() {
+			subPaths, subUnmanaged := unmanagedEnvironmentContent(envDir, path, treeFiles, treeDirs, moduleDirs, allowList)
+			if subUnmanaged && !treeDirs[relPath] {
+				paths = append(paths, relPath+"/")
+				continue
+			}
+			allUnmanaged = false
+			paths = append(paths, subPaths...)
+		} else if treeFiles[relPath] {
+			allUnmanaged = false
+		} else {
+			paths = append(paths, relPath)
+		}
+	}
+	return paths, allUnmanaged
+}
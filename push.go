@@ -0,0 +1,83 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// pushEnvironment syncs the given deployed Puppet environment with rsync to all push hosts and switches it atomically on every host.
+// It returns false if the environment could not be pushed to one of the hosts.
+func pushEnvironment(env string, envDir string) bool {
+	if len(config.Push.Hosts) == 0 {
+		return true
+	}
+	remoteBasedir := config.Push.Basedir
+	if len(remoteBasedir) == 0 {
+		remoteBasedir = filepath.Dir(envDir)
+	}
+	version := deployVersion(envDir)
+	success := true
+	var wg sync.WaitGroup
+	for _, host := range config.Push.Hosts {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			before := time.Now()
+			for _, command := range pushCommands(host, env, envDir, remoteBasedir, version) {
+				er := executeCommand(command, config.Timeout, true)
+				if er.returnCode != 0 {
+					Warnf("WARNING: Could not push environment " + env + " to " + host + ": " + er.errorOutput())
+					recordEnvironmentFailure(env, "push to "+host+" failed")
+					mutex.Lock()
+					success = false
+					mutex.Unlock()
+					return
+				}
+			}
+			Verbosef("Pushing environment " + env + " to " + host + " took " + strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64) + "s")
+		}(host)
+	}
+	wg.Wait()
+	return success
+}
+
+// pushCommands returns the rsync command that transfers the environment into a new version directory on the host, hardlinking unchanged files from the current version,
+// and the ssh command that atomically switches the environment symlink to it and removes old versions
+func pushCommands(host string, env string, envDir string, remoteBasedir string, version string) []string {
+	versionsDir := filepath.Join(remoteBasedir, ".g10k-versions", env)
+	remoteEnvDir := filepath.Join(remoteBasedir, env)
+	rsync := []string{"rsync", "-a", "--delete", "--copy-unsafe-links",
+		"-e", config.Push.SSHCommand,
+		"--rsync-path", "mkdir -p " + shellquote.Join(versionsDir) + " && rsync",
+		"--link-dest", remoteEnvDir + "/",
+		normalizeDir(envDir) + "/", host + ":" + filepath.Join(versionsDir, version) + "/"}
+
+	versionLink := filepath.Join(".g10k-versions", env, version)
+	newLink := "." + env + ".g10k-new"
+	script := "cd " + shellquote.Join(remoteBasedir) +
+		" && ln -sfn " + shellquote.Join(versionLink, newLink) +
+		// an environment that was not pushed before is kept as an old version
+		" && if [ -d " + shellquote.Join(env) + " ] && [ ! -L " + shellquote.Join(env) + " ]; then mv " + shellquote.Join(env, filepath.Join(".g10k-versions", env, "previous")) + "; fi" +
+		" && mv -T " + shellquote.Join(newLink, env) +
+		// rsync -a keeps the modification time of the source, so the versions are sorted by their name, newest first and an environment that was not pushed before last.
+		// The current version is never removed
+		" && cd " + shellquote.Join(filepath.Join(".g10k-versions", env)) +
+		" && { ls -1 | grep -v -x -F -e previous -e " + shellquote.Join(version) + " | sort -r; [ ! -e previous ] || echo previous; }" +
+		" | tail -n +" + strconv.Itoa(config.Push.Versions) + " | xargs -r rm -rf"
+	ssh, _ := shellquote.Split(config.Push.SSHCommand)
+	ssh = append(ssh, host, script)
+	return []string{shellquote.Join(rsync...), shellquote.Join(ssh...)}
+}
+
+// deployVersion returns the name of a new version of the deployed Puppet environment in envDir, made of the current time and the commit of its control repository branch
+func deployVersion(envDir string) string {
+	version := time.Now().Format("20060102150405")
+	if dr := readDeployResultFile(filepath.Join(envDir, ".g10k-deploy.json")); len(dr.Signature) > 0 {
+		version += "-" + shortCommit(dr.Signature)
+	}
+	return version
+}
@@ -0,0 +1,17 @@
+//go:build darwin
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkFile creates the target file as a copy-on-write clone of the source file with clonefile(2), which is supported by APFS
+func reflinkFile(sourceFilename string, targetFilename string, mode os.FileMode) error {
+	if err := unix.Clonefile(sourceFilename, targetFilename, unix.CLONE_NOFOLLOW); err != nil {
+		return err
+	}
+	return os.Chmod(targetFilename, mode)
+}
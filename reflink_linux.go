@@ -0,0 +1,28 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkFile creates the target file as a copy-on-write clone of the source file with the FICLONE ioctl, which is supported by e.g. btrfs and XFS
+func reflinkFile(sourceFilename string, targetFilename string, mode os.FileMode) error {
+	in, err := os.Open(sourceFilename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(targetFilename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		out.Close()
+		os.Remove(targetFilename)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflinkFile is not supported on this platform, so g10k always falls back to regular copies
+func reflinkFile(sourceFilename string, targetFilename string, mode os.FileMode) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// repairDrift restores the given drifted files of the Puppet environment from the g10k cache and removes files that were added outside of g10k.
+// It returns the number of files that were repaired, files that could not be restored to their recorded checksum are reported as warnings.
+func repairDrift(envDir string, dc DeployChecksums, drifted []DriftedFile) int {
+	manifestModules := make(map[string]ManifestModule)
+	if content, err := ioutil.ReadFile(filepath.Join(envDir, ".g10k-manifest.json")); err == nil {
+		var manifest DeployManifest
+		if err := json.Unmarshal(content, &manifest); err == nil {
+			for _, m := range manifest.Modules {
+				manifestModules[m.Path] = m
+			}
+		}
+	}
+	controlRepoGitDir := ""
+	if deployFile := filepath.Join(envDir, ".g10k-deploy.json"); fileExists(deployFile) {
+		controlRepoGitDir = readDeployResultFile(deployFile).GitDir
+	}
+
+	repaired := 0
+	for _, df := range drifted {
+		path := filepath.Join(envDir, df.Content, df.Path)
+		relPath := filepath.Join(df.Content, df.Path)
+		if df.Change == "added" {
+			if err := os.Remove(path); err != nil {
+				Warnf("WARNING: Could not remove added file " + relPath + " Error: " + err.Error())
+				continue
+			}
+			fmt.Println("  removed added file " + relPath)
+			repaired++
+			continue
+		}
+
+		recorded := dc.Content[df.Content]
+		var err error
+		source := ""
+		switch recorded.Type {
+		case "control", "local":
+			// local modules are part of the control repository
+			source = "control repository " + controlRepoGitDir + " at " + dc.Content[controlRepoContent].Resolved
+			err = restoreFromGit(controlRepoGitDir, dc.Content[controlRepoContent].Resolved, relPath, envDir)
+		case "git":
+			m := manifestModules[df.Content]
+			gitDir := filepath.Join(config.ModulesCacheDir, strings.Replace(strings.Replace(m.Source, "/", "_", -1), ":", "-", -1))
+			source = "git module cache " + gitDir + " at " + recorded.Resolved
+			err = restoreFromGit(gitDir, recorded.Resolved, df.Path, filepath.Join(envDir, df.Content))
+		case "forge":
+			m := manifestModules[df.Content]
+			forgeDir := filepath.Join(config.ForgeCacheDir, strings.Replace(m.Name, "/", "-", 1)+"-"+recorded.Resolved)
+			source = "Forge cache " + forgeDir
+			if _, err = linkFileIfChanged(filepath.Join(forgeDir, df.Path), path); err == nil {
+				applyOwnership(path)
+			}
+		}
+		if err != nil {
+			Warnf("WARNING: Could not restore " + relPath + " from " + source + " Error: " + err.Error())
+			continue
+		}
+		if checksum, ok := recorded.Files[df.Path]; !ok || !fileHasChecksum(path, checksum) {
+			Warnf("WARNING: Restored " + relPath + " from " + source + " does not match its recorded checksum, the cache might be modified as well. Use -force to redeploy the environment")
+			continue
+		}
+		fmt.Println("  restored " + df.Change + " file " + relPath + " from " + source)
+		repaired++
+	}
+	return repaired
+}
+
+// restoreFromGit extracts the given path of the given commit of the git repository into the target directory
+func restoreFromGit(gitDir string, commit string, path string, targetDir string) error {
+	if !isDir(gitDir) || len(commit) == 0 {
+		return os.ErrNotExist
+	}
+	cmd := exec.Command("git", "--git-dir", gitDir, "archive", commit, "--", path)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	unTarIncremental(cmdOut, targetDir)
+	return cmd.Wait()
+}
+
+// fileHasChecksum returns true if the given file matches the given checksum from the .g10k-checksums.json file
+func fileHasChecksum(path string, checksum string) bool {
+	if strings.HasPrefix(checksum, "symlink:") {
+		link, err := os.Readlink(path)
+		return err == nil && "symlink:"+link == checksum
+	}
+	hash, err := fileSha256(path)
+	return err == nil && hex.EncodeToString(hash) == checksum
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/xml"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reportParam is the -report, e.g. junit=g10k.xml or a comma separated list like junit=g10k.xml,markdown=summary.md
+var reportParam string
+
+// reportStart is the start of the g10k run for the duration of the report
+var reportStart = time.Now()
+
+// reportDeployFinished is set once all Puppet environments are deployed, a failure before that leaves their result unknown
+var reportDeployFinished bool
+
+// JUnitTestSuites is the JUnit XML report of a g10k run that CI systems like GitLab CI or Jenkins show in their UI
+type JUnitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Name    string           `xml:"name,attr"`
+	Time    string           `xml:"time,attr"`
+	Suites  []JUnitTestSuite `xml:"testsuite"`
+}
+
+// JUnitTestSuite contains the test cases of the validation, the environments or the modules of a g10k run
+type JUnitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []JUnitTestCase `xml:"testcase"`
+}
+
+// JUnitTestCase is a Puppet environment, a git repository or Forge module or the validation of a g10k run
+type JUnitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *JUnitFailure `xml:"failure,omitempty"`
+	Skipped   *JUnitSkipped `xml:"skipped,omitempty"`
+}
+
+// JUnitFailure is the error message of a failed test case
+type JUnitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// JUnitSkipped is the reason of a skipped test case, e.g. a held environment
+type JUnitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// validateReport exits if the -report is not supported
+func validateReport() {
+	if len(reportParam) == 0 {
+		return
+	}
+	for _, report := range strings.Split(reportParam, ",") {
+		if format, path, _ := strings.Cut(report, "="); (format != "junit" && format != "markdown") || len(path) == 0 {
+			unsupported := reportParam
+			reportParam = ""
+			Fatalf("Error: Unsupported -report " + unsupported + " Supported are junit=<file> and markdown=<file> or both separated by a comma, e.g. junit=g10k.xml,markdown=summary.md")
+		}
+	}
+}
+
+// reportFormats returns the file of every format of the -report
+func reportFormats() map[string]string {
+	formats := make(map[string]string)
+	for _, report := range strings.Split(reportParam, ",") {
+		if format, path, _ := strings.Cut(report, "="); len(path) > 0 {
+			formats[format] = path
+		}
+	}
+	return formats
+}
+
+// writeReport writes the -report of the g10k run, fatal is the error that aborted it.
+// It is called at the end of the g10k run and by Fatalf and Validatef, which exit right after it.
+func writeReport(fatal string) {
+	if len(reportParam) == 0 {
+		return
+	}
+	formats := reportFormats()
+	// a failure while writing the report must not write it again
+	reportParam = ""
+	if path, ok := formats["junit"]; ok {
+		report := junitReport(fatal)
+		content, err := xml.MarshalIndent(report, "", "  ")
+		if err == nil {
+			err = writeFileAtomic(path, append([]byte(xml.Header), append(content, '\n')...), 0644)
+		}
+		if err != nil {
+			Warnf("WARNING: Could not write the JUnit report " + path + ": " + err.Error())
+		}
+	}
+	if path, ok := formats["markdown"]; ok {
+		if err := writeMarkdownSummary(path, markdownSummary(fatal)); err != nil {
+			Warnf("WARNING: Could not write the Markdown summary " + path + ": " + err.Error())
+		}
+	}
+}
+
+// junitReport returns the JUnit report of the validation or of the environments and modules of the g10k run
+func junitReport(fatal string) JUnitTestSuites {
+	report := JUnitTestSuites{Name: "g10k", Time: junitSeconds(time.Since(reportStart).Seconds())}
+	if validate {
+		suite := JUnitTestSuite{Name: "validation"}
+		tc := JUnitTestCase{Name: configFile, Classname: "validation", Time: "0"}
+		if len(validationMessages) > 0 {
+			tc.Failure = &JUnitFailure{Message: validationMessages[0], Text: strings.Join(validationMessages, "\n")}
+		}
+		report.Suites = append(report.Suites, addJUnitTestCases(suite, tc))
+		return report
+	}
+	if len(fatal) > 0 {
+		suite := JUnitTestSuite{Name: "g10k"}
+		tc := JUnitTestCase{Name: "g10k run", Classname: "g10k", Time: report.Time, Failure: &JUnitFailure{Message: fatal, Text: fatal}}
+		report.Suites = append(report.Suites, addJUnitTestCases(suite, tc))
+	}
+
+	// no locking, as Fatalf can be called while the mutex is held
+	envFailures := make(map[string]string)
+	for env, message := range environmentFailures {
+		envFailures[env] = message
+	}
+	for _, env := range invalidHieraEnvironments {
+		if _, ok := envFailures[env]; !ok {
+			envFailures[env] = "hiera.yaml validation failed"
+		}
+	}
+	held := make(map[string]bool)
+	for _, env := range heldEnvironments {
+		held[env] = true
+	}
+	var envs []string
+	for env := range puppetEnvironments {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	envSuite := JUnitTestSuite{Name: "environments"}
+	for _, env := range envs {
+		tc := JUnitTestCase{Name: env, Classname: "environment." + puppetEnvironments[env].source, Time: "0"}
+		if message, ok := envFailures[env]; ok {
+			tc.Failure = &JUnitFailure{Message: message, Text: message}
+		} else if held[env] {
+			tc.Skipped = &JUnitSkipped{Message: "held frozen environment"}
+		} else if !reportDeployFinished {
+			// the g10k run got aborted before this environment was deployed completely
+			continue
+		}
+		envSuite = addJUnitTestCases(envSuite, tc)
+	}
+	var sources []string
+	for source := range sourceFailures {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		envSuite = addJUnitTestCases(envSuite, JUnitTestCase{Name: "source " + source, Classname: "source", Time: "0", Failure: &JUnitFailure{Message: sourceFailures[source], Text: sourceFailures[source]}})
+	}
+	if len(envSuite.Cases) > 0 {
+		report.Suites = append(report.Suites, envSuite)
+	}
+
+	moduleSuite := JUnitTestSuite{Name: "modules"}
+	reported := make(map[string]bool)
+	timings := slowestModules()
+	sort.Slice(timings, func(i, j int) bool { return timings[i].Name < timings[j].Name })
+	for _, mt := range timings {
+		tc := JUnitTestCase{Name: mt.Name, Classname: "module." + mt.Type, Time: junitSeconds(mt.Total)}
+		for module, message := range moduleFailures {
+			// the failures of Forge modules contain their author and version, e.g. puppetlabs/puppetlabs-stdlib-9.4.1
+			if module == mt.Name || (mt.Type == "forge" && strings.HasPrefix(module, strings.SplitN(mt.Name, "-", 2)[0]+"/"+mt.Name+"-")) {
+				tc.Failure = &JUnitFailure{Message: message, Text: message}
+				reported[module] = true
+				break
+			}
+		}
+		moduleSuite = addJUnitTestCases(moduleSuite, tc)
+	}
+	var failedModules []string
+	for module := range moduleFailures {
+		if !reported[module] {
+			failedModules = append(failedModules, module)
+		}
+	}
+	sort.Strings(failedModules)
+	for _, module := range failedModules {
+		moduleSuite = addJUnitTestCases(moduleSuite, JUnitTestCase{Name: module, Classname: "module", Time: "0", Failure: &JUnitFailure{Message: moduleFailures[module], Text: moduleFailures[module]}})
+	}
+	if len(moduleSuite.Cases) > 0 {
+		report.Suites = append(report.Suites, moduleSuite)
+	}
+	return report
+}
+
+// addJUnitTestCases adds the given test cases to the suite and counts them
+func addJUnitTestCases(suite JUnitTestSuite, cases ...JUnitTestCase) JUnitTestSuite {
+	total, _ := strconv.ParseFloat(suite.Time, 64)
+	for _, tc := range cases {
+		suite.Tests++
+		if tc.Failure != nil {
+			suite.Failures++
+		}
+		if tc.Skipped != nil {
+			suite.Skipped++
+		}
+		duration, _ := strconv.ParseFloat(tc.Time, 64)
+		total += duration
+		suite.Cases = append(suite.Cases, tc)
+	}
+	suite.Time = junitSeconds(total)
+	return suite
+}
+
+// junitSeconds returns the duration in seconds as JUnit time attribute
+func junitSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
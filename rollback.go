@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// rollbackCommand atomically points the symlink of a Puppet environment back to a previous successfully deployed version, e.g. g10k rollback -config test.yaml production -to 20240601T120000
+func rollbackCommand(args []string) {
+	fs := subcommandFlagSet("rollback")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	to := fs.String("to", "", "version of the environment to roll back to, defaults to the previous version")
+	list := fs.Bool("list", false, "only list the available versions of the environment")
+	fs.Parse(args)
+	// allow the flags before and after the environment name
+	env := ""
+	if fs.NArg() > 0 {
+		env = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if len(env) == 0 || fs.NArg() > 0 {
+		Fatalf("Error: you need to specify exactly one environment\nExample call: " + os.Args[0] + " rollback -config test.yaml production -to 20240601T120000")
+	}
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " rollback -config test.yaml production")
+	}
+
+	config = loadConfig(*configFileFlag)
+
+	targetDir := environmentSymlink(env)
+	currentDir, _ := filepath.EvalSymlinks(targetDir)
+	var versions []string
+	for _, version := range environmentVersions(targetDir) {
+		if successfulEnvironmentVersion(version) {
+			versions = append(versions, version)
+		}
+	}
+
+	if *list {
+		for _, version := range versions {
+			line := environmentVersionID(targetDir, version)
+			if deployFile := filepath.Join(version, ".g10k-deploy.json"); fileExists(deployFile) {
+				line += " " + readDeployResultFile(deployFile).Signature
+			}
+			if filepath.Base(version) == filepath.Base(currentDir) {
+				line += " (current)"
+			}
+			fmt.Println(line)
+		}
+		return
+	}
+
+	versionDir := ""
+	if len(*to) > 0 {
+		for _, version := range versions {
+			if environmentVersionID(targetDir, version) == *to || filepath.Base(version) == *to {
+				versionDir = version
+			}
+		}
+		if len(versionDir) == 0 {
+			Fatalf("Error: Could not find a successfully deployed version " + *to + " of environment " + env + ", use -list to show the available versions")
+		}
+	} else {
+		// the previous version is the newest successful version that is older than the current one
+		for _, version := range versions {
+			if filepath.Base(version) >= filepath.Base(currentDir) {
+				break
+			}
+			versionDir = version
+		}
+		if len(versionDir) == 0 {
+			Fatalf("Error: There is no previous version of environment " + env + " to roll back to")
+		}
+	}
+	if filepath.Base(versionDir) == filepath.Base(currentDir) {
+		fmt.Println("Environment " + env + " already is at version " + environmentVersionID(targetDir, versionDir))
+		return
+	}
+
+	pointEnvironmentSymlink(targetDir, versionDir)
+	fmt.Println("Rolled back environment " + env + " to version " + environmentVersionID(targetDir, versionDir))
+}
+
+// environmentSymlink returns the symlink of the given Puppet environment in the basedirs of the configured sources
+func environmentSymlink(env string) string {
+	for _, sa := range config.Sources {
+		targetDir := filepath.Join(sa.Basedir, env)
+		if info, err := os.Lstat(targetDir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return targetDir
+		}
+	}
+	Fatalf("Error: Could not find environment " + env + " deployed with deploy_strategy symlink or nfs in the basedir of any source")
+	return ""
+}
+
+// environmentVersionID returns the identifier of the given version directory of an environment symlink, i.e. its timestamp suffix
+func environmentVersionID(targetDir string, versionDir string) string {
+	return strings.TrimPrefix(filepath.Base(versionDir), filepath.Base(targetDir)+"-")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// runLockFile keeps the lock file of this g10k run open, the lock gets released when g10k exits
+var runLockFile *os.File
+
+// acquireRunLock takes the exclusive lock in the cachedir, so that two g10k runs can not modify the same Puppet environments at the same time.
+// With run_lock wait g10k waits for the other run, with fail it aborts and with queue it waits unless another run is already waiting, as that run deploys the latest state anyway.
+// With none no lock is taken, e.g. for g10k processes that share a cachedir but deploy different basedirs.
+// It returns false if this g10k run is not needed, because another run is already queued.
+func acquireRunLock() bool {
+	mode := config.RunLock
+	if len(runLockParam) > 0 {
+		mode = runLockParam
+	}
+	if len(mode) == 0 {
+		mode = "wait"
+	}
+	if mode != "wait" && mode != "fail" && mode != "queue" && mode != "none" {
+		Fatalf("Error: Unsupported value " + mode + " of setting run_lock or -runlock parameter. Supported values are wait, fail, queue and none")
+	}
+	if mode == "none" {
+		return true
+	}
+	lockFile := filepath.Join(config.CacheDir, "g10k.lock")
+	f := openLockFile(lockFile)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+		runLockFile = f
+		return true
+	}
+	if mode == "fail" {
+		Fatalf("Error: Another g10k run holds the lock " + lockFile + ", not deploying because of run_lock fail")
+	}
+	if mode == "queue" {
+		queueFile := openLockFile(filepath.Join(config.CacheDir, "g10k.queue.lock"))
+		if err := syscall.Flock(int(queueFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+			Infof("Not deploying, because another g10k run is already queued behind the running one and will deploy the latest state")
+			queueFile.Close()
+			f.Close()
+			return false
+		}
+		// the next invocation can queue up again once this run started
+		defer queueFile.Close()
+	}
+	Infof("Waiting for another g10k run to release the lock " + lockFile)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		Fatalf("acquireRunLock(): Could not lock " + lockFile + " Error: " + err.Error())
+	}
+	runLockFile = f
+	return true
+}
+
+// openLockFile opens or creates the given lock file
+func openLockFile(lockFile string) *os.File {
+	f, err := os.OpenFile(lockFile, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		Fatalf("openLockFile(): Could not open lock file " + lockFile + " Error: " + err.Error())
+	}
+	return f
+}
+
+// lockCacheEntry takes an exclusive lock for the given git mirror or Forge module inside of the cachedir, so that g10k processes sharing one cachedir do not update it at the same time.
+// The lock files are kept in the locks directory of the cachedir and the returned function releases the lock.
+func lockCacheEntry(cacheDir string, entry string) func() {
+	if len(cacheDir) == 0 {
+		cacheDir = filepath.Dir(entry)
+	}
+	lockDir := checkDirAndCreate(filepath.Join(cacheDir, "locks"), "cachedir/locks")
+	name, err := filepath.Rel(cacheDir, entry)
+	if err != nil || strings.HasPrefix(name, "..") {
+		name = entry
+	}
+	lockFile := filepath.Join(lockDir, strings.Replace(strings.Trim(name, "/"), "/", "_", -1)+".lock")
+	f := openLockFile(lockFile)
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		Debugf("Waiting for another g10k process to release the lock " + lockFile)
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			Fatalf("lockCacheEntry(): Could not lock " + lockFile + " Error: " + err.Error())
+		}
+	}
+	return func() {
+		f.Close()
+	}
+}
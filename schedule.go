@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronAliases are the shortcuts that can be used instead of a cron expression in the serve schedule setting
+var cronAliases = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+}
+
+// schedule is the parsed serve schedule setting, either a fixed interval or the allowed values of the five fields of a cron expression
+type schedule struct {
+	interval time.Duration
+	fields   [5]map[int]bool
+	// domStar and dowStar are set if the day of month or day of week field is *, otherwise a day matches if either field matches like with cron
+	domStar, dowStar bool
+}
+
+// parseSchedule parses an interval like 30m or a cron expression like */15 * * * * in the local time zone
+func parseSchedule(s string) (schedule, error) {
+	if interval, err := time.ParseDuration(s); err == nil {
+		if interval <= 0 {
+			return schedule{}, errors.New("the interval must be positive")
+		}
+		return schedule{interval: interval}, nil
+	}
+	if alias, ok := cronAliases[s]; ok {
+		s = alias
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 5 {
+		return schedule{}, errors.New("expected an interval like 30m or a cron expression with 5 fields")
+	}
+	sch := schedule{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	ranges := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	for i, field := range fields {
+		values, err := parseCronField(field, ranges[i][0], ranges[i][1])
+		if err != nil {
+			return schedule{}, err
+		}
+		sch.fields[i] = values
+	}
+	// both 0 and 7 are Sunday
+	if sch.fields[4][7] {
+		sch.fields[4][0] = true
+	}
+	return sch, nil
+}
+
+// parseCronField returns the values of a cron field with lists, ranges and steps, e.g. 1,15 or 8-18/2
+func parseCronField(field string, min int, max int) (map[int]bool, error) {
+	values := make(map[int]bool)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, errors.New("invalid step in cron field " + field)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, errors.New("invalid value in cron field " + field)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid range in cron field " + field)
+				}
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New("cron field " + field + " must be between " + strconv.Itoa(min) + " and " + strconv.Itoa(max))
+		}
+		for v := from; v <= to; v += step {
+			values[v] = true
+		}
+	}
+	return values, nil
+}
+
+// next returns the first time after the given time at which the schedule is due
+func (sch schedule) next(after time.Time) time.Time {
+	if sch.interval > 0 {
+		return after.Add(sch.interval)
+	}
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	// every cron expression is due at least once within 5 years, e.g. on February 29
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if sch.fields[0][t.Minute()] && sch.fields[1][t.Hour()] && sch.fields[3][int(t.Month())] && sch.dayMatches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches returns true if the day of month or day of week of the given time is allowed by the schedule
+func (sch schedule) dayMatches(t time.Time) bool {
+	dom, dow := sch.fields[2][t.Day()], sch.fields[4][int(t.Weekday())]
+	switch {
+	case sch.domStar && sch.dowStar:
+		return true
+	case sch.domStar:
+		return dow
+	case sch.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// runScheduledSyncs queues a full deploy every time the serve schedule is due, delayed by a random schedule_jitter.
+// With schedule_concurrency skip the scheduled sync is skipped while another deploy is running or waiting.
+func runScheduledSyncs() {
+	for !deployCancelled() {
+		// the config can get reloaded in the meantime and was validated by readConfigfile
+		cfg := currentConfig()
+		sch, err := parseSchedule(cfg.Serve.Schedule)
+		if err != nil {
+			return
+		}
+		due := sch.next(time.Now())
+		if jitter, _ := time.ParseDuration(cfg.Serve.ScheduleJitter); jitter > 0 {
+			due = due.Add(time.Duration(rand.Int63n(int64(jitter))))
+		}
+		Debugf("Next scheduled sync at " + due.Format(time.RFC3339))
+		time.Sleep(time.Until(due))
+		if deployCancelled() {
+			return
+		}
+		queueMutex.Lock()
+		busy := len(runningDeploy) > 0 || len(queuedDeploys) > 0
+		queueMutex.Unlock()
+		if haRole() == "follower" {
+			Debugf("Skipping scheduled sync, because another g10k serve holds the ha_lock")
+			continue
+		}
+		if busy && cfg.Serve.ScheduleConcurrency == "skip" {
+			Infof("Skipping scheduled sync, because another deploy is running or waiting")
+			continue
+		}
+		enqueueWebhookDeploy(webhookDeploy{description: "all environments (scheduled sync)"})
+	}
+}
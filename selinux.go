@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// restoreSELinuxContexts runs restorecon for every Puppet environment that was changed by this g10k run, so that puppetserver can read the deployed files on hosts with enforcing SELinux.
+// Modules that are symlinked into the environment, e.g. from the module_store, get relabeled as well. It returns the environments for which restorecon failed.
+func restoreSELinuxContexts() []string {
+	if !config.Restorecon || len(needSyncEnvs) == 0 {
+		return nil
+	}
+	var envs []string
+	for env := range needSyncEnvs {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	var failedEnvs []string
+	for _, env := range envs {
+		pe, ok := puppetEnvironments[env]
+		if !ok || !isDir(pe.targetDir) {
+			continue
+		}
+		restoreconCmd := shellquote.Join(append([]string{"restorecon", "-R"}, selinuxRelabelPaths(pe.targetDir)...)...)
+		if dryRun {
+			Infof("Would run " + restoreconCmd)
+			continue
+		}
+		Verbosef("Restoring SELinux contexts of environment " + env)
+		er := executeCommand(restoreconCmd, config.Timeout, true)
+		if er.returnCode != 0 {
+			Warnf("WARNING: " + restoreconCmd + " failed for environment " + env + ": " + er.errorOutput())
+			failedEnvs = append(failedEnvs, env)
+		}
+	}
+	return failedEnvs
+}
+
+// selinuxRelabelPaths returns the resolved directory of the given Puppet environment and the targets of all symlinks inside of it that point outside of the environment
+func selinuxRelabelPaths(envDir string) []string {
+	resolvedDir, err := filepath.EvalSymlinks(envDir)
+	if err != nil {
+		return []string{envDir}
+	}
+	paths := []string{resolvedDir}
+	seen := make(map[string]bool)
+	filepath.Walk(resolvedDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := filepath.EvalSymlinks(path)
+		if err != nil || target == resolvedDir || strings.HasPrefix(target, resolvedDir+"/") || seen[target] {
+			return nil
+		}
+		seen[target] = true
+		paths = append(paths, target)
+		return nil
+	})
+	sort.Strings(paths[1:])
+	return paths
+}
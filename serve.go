@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultServeListen is the address on which g10k serve listens if neither -listen nor serve listen is set
+const defaultServeListen = ":8088"
+
+// webhookQueueSize is how many deploys g10k serve accepts while another deploy is still running
+const webhookQueueSize = 10
+
+// reANSIColor matches the color escape sequences in the output of a g10k run
+var reANSIColor = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// reviewEnvironmentPrefix is the prefix of the review environments that g10k serve deploys for merge requests, e.g. mr_42
+const reviewEnvironmentPrefix = "mr_"
+
+// webhookDeploy is a deploy that g10k serve runs after it received a webhook, either a g10k run with the given args, which deploys the given review environment directories, or the removal of the given environment directories
+type webhookDeploy struct {
+	description string
+	args        []string
+	review      []string
+	remove      []string
+	job         *DeployJob
+}
+
+var (
+	// queueMutex protects the deploy queue of g10k serve
+	queueMutex sync.Mutex
+	// queueCond wakes up the deploy worker of g10k serve once a deploy got queued or the queue got closed
+	queueCond = sync.NewCond(&queueMutex)
+	// queuedDeploys contains the deploys that g10k serve has not started yet, oldest first
+	queuedDeploys []webhookDeploy
+	// queueClosed is set once g10k serve shuts down and does not start any further deploys
+	queueClosed bool
+	// runningDeploy is the description of the deploy that g10k serve is currently running
+	runningDeploy string
+	// deployFailures contains the last failure message of every Puppet environment whose deploy by g10k serve failed
+	deployFailures = make(map[string]string)
+	// serveDebug and serveVerbose are passed on to the g10k runs of g10k serve
+	serveDebug, serveVerbose bool
+	// serveListenParam is the -listen parameter of g10k serve
+	serveListenParam string
+)
+
+// applyServeOverrides applies the parameters of g10k serve to the given config, at the start and after every reload of the config file
+func applyServeOverrides(cs *ConfigSettings) {
+	if len(serveListenParam) > 0 {
+		cs.Serve.Listen = serveListenParam
+	}
+	if len(cs.Serve.Listen) == 0 {
+		cs.Serve.Listen = defaultServeListen
+	}
+}
+
+// key returns the identity of a deploy, two queued deploys with the same key would do the same
+func (wd webhookDeploy) key() string {
+	return strings.Join(wd.args, "\x00") + "\x00\x00" + strings.Join(wd.remove, "\x00")
+}
+
+// serveCommand runs g10k as a daemon that deploys the Puppet environments of the branches that got pushed according to the received webhooks,
+// e.g. g10k serve -config test.yaml
+func serveCommand(args []string) {
+	fs := subcommandFlagSet("serve")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	fs.StringVar(&serveListenParam, "listen", "", "address on which g10k listens for webhooks, overrides the serve listen setting (default \""+defaultServeListen+"\")")
+	fs.BoolVar(&serveDebug, "debug", false, "log debug output of the g10k runs, defaults to false")
+	fs.BoolVar(&serveVerbose, "verbose", false, "log verbose output of the g10k runs, defaults to false")
+	fs.StringVar(&logFormat, "log-format", "text", "format of the log lines of g10k serve and its g10k runs: text or json")
+	fs.Parse(args)
+	validateLogFormat()
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " serve -config test.yaml")
+	}
+	info = true
+
+	// the g10k runs create the configured directories
+	configFile = *configFileFlag
+	config = loadConfig(configFile)
+	applyServeOverrides(&config)
+	openLogOutputs()
+	if len(config.Serve.GitHubSecret)+len(config.Serve.GitLabSecret)+len(config.Serve.GiteaSecret)+len(config.Serve.BitbucketSecret)+len(config.Serve.DeployToken)+len(config.Serve.Schedule)+len(config.Serve.Socket) == 0 {
+		Fatalf("Error: you need to configure at least one of the serve github_secret, gitlab_secret, gitea_secret, bitbucket_secret, deploy_token, schedule or socket in " + configFile)
+	}
+	listen := config.Serve.Listen
+	if len(config.Serve.ProfileDir) > 0 {
+		checkDirAndCreate(config.Serve.ProfileDir, "serve profile_dir")
+	}
+	workerDone := make(chan struct{})
+	go func() {
+		for wd, ok := nextWebhookDeploy(); ok; wd, ok = nextWebhookDeploy() {
+			sdNotify("STATUS=Deploying " + wd.description)
+			runWebhookDeploy(wd)
+			queueMutex.Lock()
+			runningDeploy = ""
+			queueMutex.Unlock()
+			sdNotify("STATUS=Listening for webhooks on " + listen + ", last deploy: " + wd.description + " (" + wd.job.Status + ")")
+		}
+		close(workerDone)
+	}()
+
+	if len(config.Serve.Schedule) > 0 {
+		go runScheduledSyncs()
+	}
+
+	var lock haLock
+	if len(config.Serve.HALock) > 0 {
+		// a reload does not change the ha_lock of a running g10k serve
+		haLockSpec = config.Serve.HALock
+		ttl := haLockTTL()
+		lock, _ = newHALock(haLockSpec, ttl)
+		haFollower = true
+		Infof("Waiting for the ha_lock " + haLockSpec + " before deploying")
+		go runHALock(lock, ttl)
+	}
+
+	var socketListener net.Listener
+	if len(config.Serve.Socket) > 0 {
+		socketListener = listenDaemonSocket(config.Serve.Socket)
+		Infof("Accepting g10k -via-daemon runs on " + config.Serve.Socket)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/github", lockConfig(githubWebhookHandler))
+	mux.HandleFunc("/gitlab", lockConfig(gitlabWebhookHandler))
+	mux.HandleFunc("/gitea", lockConfig(giteaWebhookHandler))
+	mux.HandleFunc("/bitbucket", lockConfig(bitbucketCloudWebhookHandler))
+	mux.HandleFunc("/bitbucket-server", lockConfig(bitbucketServerWebhookHandler))
+	mux.HandleFunc("/deploy", lockConfig(deployHandler))
+	mux.HandleFunc("/status", lockConfig(requireAPIAuth(statusHandler)))
+	mux.HandleFunc("/jobs", lockConfig(requireAPIAuth(jobsHandler)))
+	mux.HandleFunc("/jobs/", lockConfig(requireAPIAuth(jobsHandler)))
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", lockConfig(readyzHandler))
+	if config.Serve.Pprof {
+		handlePprof(mux)
+	}
+	server := &http.Server{Addr: listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go handleServeSignals(server)
+
+	listener := sdListener()
+	if listener != nil {
+		listen = listener.Addr().String()
+		Infof("Using the socket " + listen + " passed by systemd")
+	} else {
+		var err error
+		if listener, err = net.Listen("tcp", listen); err != nil {
+			Fatalf("Error: could not listen for webhooks on " + listen + ": " + err.Error())
+		}
+	}
+	go runSdWatchdog()
+	sdNotify("READY=1\nSTATUS=Listening for webhooks on " + listen)
+
+	tlsCert, tlsKey := config.Serve.TLSCert, config.Serve.TLSKey
+	if len(tlsCert) > 0 {
+		server.TLSConfig = serveTLSConfig()
+	}
+	// from now on only the HTTP handlers, the deploy runs and the scheduled syncs read the config and they lock it against a reload
+	reloadConfigOnSIGHUP()
+
+	var err error
+	if len(tlsCert) > 0 {
+		Infof("Listening for webhooks on " + listen + " with TLS")
+		err = server.ServeTLS(listener, tlsCert, tlsKey)
+	} else {
+		Infof("Listening for webhooks on " + listen)
+		err = server.Serve(listener)
+	}
+	if err != http.ErrServerClosed {
+		Fatalf("Error: could not listen for webhooks on " + listen + ": " + err.Error())
+	}
+	if socketListener != nil {
+		socketListener.Close()
+	}
+	closeWebhookQueue()
+	<-workerDone
+	if lock != nil {
+		lock.release()
+	}
+	exitIfCancelled()
+}
+
+// handleServeSignals stops accepting webhooks once g10k serve receives a SIGINT or SIGTERM and forwards the signal to the running g10k run, so that it can finish gracefully.
+// A second signal kills the running g10k run.
+func handleServeSignals(server *http.Server) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signalMutex.Lock()
+	terminationSignal = sig
+	for cmd := range runningCommands {
+		syscall.Kill(-cmd.Process.Pid, sig.(syscall.Signal))
+	}
+	signalMutex.Unlock()
+	sdNotify("STOPPING=1\nSTATUS=Waiting for the running deploy to finish")
+	Warnf("WARNING: Received " + signalName(sig) + ", not accepting any further webhooks and waiting for the running deploy to finish. Send the signal again to abort immediately")
+	go server.Shutdown(context.Background())
+	<-signals
+	Warnf("WARNING: Killing the running deploy")
+	signalMutex.Lock()
+	for cmd := range runningCommands {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	signalMutex.Unlock()
+	os.Exit(signalExitCode(sig))
+}
+
+// serveTLSConfig returns the TLS configuration of g10k serve, which requires a client certificate signed by the tls_client_ca if it is set
+func serveTLSConfig() *tls.Config {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(config.Serve.TLSClientCA) > 0 {
+		pem, err := ioutil.ReadFile(config.Serve.TLSClientCA)
+		if err != nil {
+			Fatalf("Error: could not read tls_client_ca " + config.Serve.TLSClientCA + ": " + err.Error())
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			Fatalf("Error: could not find any certificate in tls_client_ca " + config.Serve.TLSClientCA)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig
+}
+
+// requireAPIAuth protects the given read-only handler with the api_user and api_password or the api_token of g10k serve, if they are set
+func requireAPIAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizedAPIRequest(r) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="g10k"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authorizedAPIRequest returns true if the given request has the api_user and api_password as basic auth or the api_token as bearer token, or if neither is configured
+func authorizedAPIRequest(r *http.Request) bool {
+	if len(config.Serve.APIUser) == 0 && len(config.Serve.APIToken) == 0 {
+		return true
+	}
+	if user, password, ok := r.BasicAuth(); ok && len(config.Serve.APIUser) > 0 {
+		validUser := subtle.ConstantTimeCompare([]byte(user), []byte(config.Serve.APIUser)) == 1
+		validPassword := subtle.ConstantTimeCompare([]byte(password), []byte(config.Serve.APIPassword)) == 1
+		return validUser && validPassword
+	}
+	token := r.Header.Get("Authorization")
+	return len(config.Serve.APIToken) > 0 && strings.HasPrefix(token, "Bearer ") && subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(token, "Bearer ")), []byte(config.Serve.APIToken)) == 1
+}
+
+// queueWebhookDeploy queues the given deploys and returns their deploy jobs to the webhook sender, so that it can poll them with /jobs/<id>
+func queueWebhookDeploy(w http.ResponseWriter, wds ...webhookDeploy) {
+	if deployCancelled() {
+		http.Error(w, "g10k is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	accepted := DeployJobs{Jobs: []DeployJob{}}
+	for _, wd := range wds {
+		if job := enqueueWebhookDeploy(wd); job != nil {
+			queueMutex.Lock()
+			accepted.Jobs = append(accepted.Jobs, *job)
+			queueMutex.Unlock()
+		}
+	}
+	if len(accepted.Jobs) == 0 && len(wds) > 0 {
+		http.Error(w, "too many queued deploys", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if len(accepted.Jobs) > 0 {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(accepted)
+}
+
+// enqueueWebhookDeploy adds the given deploy to the queue and returns its deploy job, or nil if the queue is full.
+// A deploy that is already waiting in the queue is not queued again, so that a push storm results in exactly one follow-up deploy. Its job is returned instead.
+func enqueueWebhookDeploy(wd webhookDeploy) *DeployJob {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for _, queued := range queuedDeploys {
+		if queued.key() == wd.key() {
+			Infof("Not queueing deploy of " + wd.description + " again, it is already waiting as job " + queued.job.ID)
+			return queued.job
+		}
+	}
+	if len(queuedDeploys) >= webhookQueueSize {
+		Warnf("WARNING: Not queueing deploy of " + wd.description + ", because " + strconv.Itoa(webhookQueueSize) + " deploys are already waiting")
+		return nil
+	}
+	wd.job = newDeployJob(wd.description)
+	queuedDeploys = append(queuedDeploys, wd)
+	queueCond.Signal()
+	Infof("Queued deploy of " + wd.description + " as job " + wd.job.ID + ", " + strconv.Itoa(len(queuedDeploys)) + " deploy(s) waiting")
+	return wd.job
+}
+
+// nextWebhookDeploy waits for the next queued deploy and, as long as this g10k serve is not a follower, marks it as running. It returns false once the queue got closed
+func nextWebhookDeploy() (webhookDeploy, bool) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for (len(queuedDeploys) == 0 || haFollower) && !queueClosed {
+		queueCond.Wait()
+	}
+	if queueClosed {
+		return webhookDeploy{}, false
+	}
+	wd := queuedDeploys[0]
+	queuedDeploys = queuedDeploys[1:]
+	runningDeploy = wd.description
+	startDeployJob(wd.job)
+	return wd, true
+}
+
+// closeWebhookQueue cancels the deploys that are still waiting and stops the deploy worker of g10k serve after the running deploy
+func closeWebhookQueue() {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	for _, wd := range queuedDeploys {
+		Warnf("WARNING: Not starting deploy of " + wd.description + ", " + cancellationMessage())
+		wd.job.Status = "cancelled"
+		wd.job.Error = cancellationMessage()
+	}
+	queuedDeploys = nil
+	queueClosed = true
+	queueCond.Broadcast()
+}
+
+// statusHandler reports the running deploy, the queue and the deployed Puppet environments of g10k serve
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	role := haRole()
+	queueMutex.Lock()
+	status := ServeStatus{Role: role, Running: runningDeploy, QueueDepth: len(queuedDeploys), Queued: []string{}, Environments: environmentStatuses()}
+	for _, wd := range queuedDeploys {
+		status.Queued = append(status.Queued, wd.description)
+	}
+	for i, es := range status.Environments {
+		status.Environments[i].LastFailure = deployFailures[es.Environment]
+	}
+	queueMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// runWebhookDeploy runs the given deploy as a separate g10k process, whose run lock serializes it with g10k runs outside of g10k serve
+func runWebhookDeploy(wd webhookDeploy) {
+	runMutex.Lock()
+	defer runMutex.Unlock()
+	if len(wd.remove) > 0 {
+		removeEnvironmentDirs(wd.remove)
+		Infof("Finished " + wd.description)
+		finishDeployJob(wd.job, "")
+		return
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		Warnf("WARNING: Not deploying " + wd.description + ", because the g10k executable could not be found: " + err.Error())
+		finishDeployJob(wd.job, "could not find the g10k executable: "+err.Error())
+		return
+	}
+	args := append([]string{"-config", configFile}, wd.args...)
+	args = append(args, deployProfileArgs(wd.job.ID)...)
+	if serveDebug {
+		args = append(args, "-debug")
+	} else if serveVerbose {
+		args = append(args, "-verbose")
+	}
+	if jsonLogging() {
+		args = append(args, "-log-format", "json")
+	}
+	Infof("Deploying " + wd.description + " as job " + wd.job.ID + " with g10k " + strings.Join(args, " "))
+	before := time.Now()
+	cmd := exec.Command(executable, args...)
+	cmd.Env = daemonCommandEnv()
+	stderr := &lastLineWriter{w: io.MultiWriter(os.Stderr, wd.job.log)}
+	cmd.Stdout = io.MultiWriter(os.Stdout, wd.job.log)
+	cmd.Stderr = stderr
+	if err := startCommand(cmd); err != nil {
+		Warnf("WARNING: Could not start deploy of " + wd.description + ": " + err.Error())
+		finishDeployJob(wd.job, "could not start g10k: "+err.Error())
+		return
+	}
+	err = waitCommand(cmd)
+	writeReviewMarkers(wd.review)
+	duration := strconv.FormatFloat(time.Since(before).Seconds(), 'f', 1, 64) + "s"
+	message := ""
+	if err != nil {
+		message = stderr.lastLine
+		if len(message) == 0 {
+			message = err.Error()
+		}
+		Warnf("WARNING: Deploy of " + wd.description + " failed after " + duration + ": " + err.Error())
+	} else {
+		Infof("Deployed " + wd.description + " in " + duration)
+	}
+	recordDeployFailures(wd, before, message)
+	finishDeployJob(wd.job, message)
+}
+
+// recordDeployFailures remembers the given failure message for the environment of a failed deploy and every environment that did not complete its deploy since the given start.
+// Environments that were deployed successfully since then are no longer failed.
+func recordDeployFailures(wd webhookDeploy, startedAt time.Time, message string) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if len(message) > 0 {
+		for _, env := range webhookDeployEnvironments(wd) {
+			deployFailures[env] = message
+		}
+	}
+	for _, es := range environmentStatuses() {
+		if es.Success && es.DeployedAt.After(startedAt) {
+			delete(deployFailures, es.Environment)
+		} else if !es.Success && len(message) > 0 {
+			deployFailures[es.Environment] = message
+		}
+	}
+}
+
+// webhookDeployEnvironments returns the names of the environment directories that the given deploy of a single environment or review environment deploys
+func webhookDeployEnvironments(wd webhookDeploy) []string {
+	var envs []string
+	for i := 0; i+1 < len(wd.args); i++ {
+		for _, source := range sortedSourceNames() {
+			prefix := resolveSourcePrefix(source, config.Sources[source])
+			switch {
+			case wd.args[i] == "-environment" && strings.HasPrefix(wd.args[i+1], source+"_"):
+				// -environment is <source>_<branch>
+				envs = append(envs, prefix+strings.TrimPrefix(wd.args[i+1], source+"_"))
+			case wd.args[i] == "-outputname":
+				envs = append(envs, prefix+wd.args[i+1])
+			}
+		}
+	}
+	return envs
+}
+
+// lastLineWriter passes everything through to the given writer and remembers the last line without colors, which is the error message of a failed g10k run
+type lastLineWriter struct {
+	w        io.Writer
+	line     []byte
+	lastLine string
+}
+
+func (llw *lastLineWriter) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\n' {
+			llw.line = append(llw.line, b)
+			continue
+		}
+		if line := strings.TrimSpace(reANSIColor.ReplaceAllString(string(llw.line), "")); len(line) > 0 {
+			llw.lastLine = line
+		}
+		llw.line = llw.line[:0]
+	}
+	return llw.w.Write(p)
+}
+
+// removeEnvironmentDirs removes the given Puppet environment directories including their versions with deploy_strategy symlink
+func removeEnvironmentDirs(envDirs []string) {
+	for _, envDir := range envDirs {
+		if _, err := os.Lstat(envDir); err != nil {
+			continue
+		}
+		Infof("Removing environment " + envDir)
+		for _, versionDir := range environmentVersions(envDir) {
+			purgeDir(versionDir, "removeEnvironmentDirs()")
+		}
+		purgeDir(envDir, "removeEnvironmentDirs()")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// signalMutex protects the state of a graceful cancellation, which must not wait for the global mutex
+	signalMutex sync.Mutex
+	// terminationSignal is the SIGINT or SIGTERM that g10k received, after which no new work is started
+	terminationSignal os.Signal
+	// runningCommands contains the subprocesses that get killed if they do not finish within the shutdown_timeout
+	runningCommands = make(map[*exec.Cmd]struct{})
+	// stagingTempDirs contains the staging directories of the environments that are not yet committed, which get removed if g10k gets killed
+	stagingTempDirs = make(map[string]struct{})
+)
+
+// handleTerminationSignals stops starting new work once g10k receives a SIGINT or SIGTERM, so that the running git commands can finish.
+// A second signal or the end of the shutdown_timeout kills the running subprocesses, removes the unfinished staging directories and exits.
+func handleTerminationSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		shutdownTimeout := config.ShutdownTimeout
+		if shutdownTimeout <= 0 {
+			shutdownTimeout = 30
+		}
+		signalMutex.Lock()
+		terminationSignal = sig
+		signalMutex.Unlock()
+		Warnf("WARNING: Received " + signalName(sig) + ", not deploying any further environments and waiting up to " + strconv.Itoa(shutdownTimeout) + "s for the running commands to finish. Send the signal again to abort immediately")
+		select {
+		case <-signals:
+		case <-time.After(time.Duration(shutdownTimeout) * time.Second):
+		}
+		Warnf("WARNING: Killing the running commands and removing unfinished staging directories")
+		signalMutex.Lock()
+		for cmd := range runningCommands {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		for tmpDir := range stagingTempDirs {
+			purgeDir(tmpDir, "handleTerminationSignals()")
+		}
+		signalMutex.Unlock()
+		stopProfiling()
+		os.Exit(signalExitCode(sig))
+	}()
+}
+
+// signalName returns the name of the given termination signal
+func signalName(sig os.Signal) string {
+	if sig == syscall.SIGINT {
+		return "SIGINT"
+	}
+	return "SIGTERM"
+}
+
+// signalExitCode returns the conventional exit code of a process that got terminated by the given signal
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 1
+}
+
+// deployCancelled returns true if g10k received a termination signal
+func deployCancelled() bool {
+	signalMutex.Lock()
+	defer signalMutex.Unlock()
+	return terminationSignal != nil
+}
+
+// cancellationMessage returns the reason for not deploying a Puppet environment or module after a termination signal
+func cancellationMessage() string {
+	signalMutex.Lock()
+	defer signalMutex.Unlock()
+	return "cancelled by " + signalName(terminationSignal)
+}
+
+// environmentCancelled returns true and marks the given Puppet environment as failed if g10k received a termination signal
+func environmentCancelled(env string) bool {
+	if !deployCancelled() {
+		return false
+	}
+	recordEnvironmentFailure(env, cancellationMessage())
+	return true
+}
+
+// moduleCancelled returns true and marks the given git repository or Forge module as failed if g10k received a termination signal
+func moduleCancelled(module string) bool {
+	if !deployCancelled() {
+		return false
+	}
+	mutex.Lock()
+	moduleFailures[module] = cancellationMessage()
+	mutex.Unlock()
+	return true
+}
+
+// exitIfCancelled exits with the exit code of the received termination signal after the completed environments were finished
+func exitIfCancelled() {
+	signalMutex.Lock()
+	sig := terminationSignal
+	signalMutex.Unlock()
+	if sig != nil {
+		os.Exit(signalExitCode(sig))
+	}
+}
+
+// startCommand starts the given command in its own process group, so that a Ctrl-C in the terminal does not interrupt it, and remembers it until waitCommand
+func startCommand(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	signalMutex.Lock()
+	defer signalMutex.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	runningCommands[cmd] = empty
+	return nil
+}
+
+// waitCommand waits for the given command that was started with startCommand
+func waitCommand(cmd *exec.Cmd) error {
+	err := cmd.Wait()
+	signalMutex.Lock()
+	delete(runningCommands, cmd)
+	signalMutex.Unlock()
+	return err
+}
+
+// trackStagingTempDir remembers the staging directory of an environment until untrackStagingTempDir once it got committed or discarded
+func trackStagingTempDir(tmpDir string) {
+	signalMutex.Lock()
+	stagingTempDirs[tmpDir] = empty
+	signalMutex.Unlock()
+}
+
+// untrackStagingTempDir forgets the staging directory of a committed or discarded environment
+func untrackStagingTempDir(tmpDir string) {
+	signalMutex.Lock()
+	delete(stagingTempDirs, tmpDir)
+	signalMutex.Unlock()
+}
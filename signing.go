@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/kballard/go-shellquote"
+)
+
+// signedManifestFiles are the files of every Puppet environment that g10k signs with manifest_signing, together they describe the resolved modules and every deployed file
+var signedManifestFiles = []string{".g10k-manifest.json", checksumsFile}
+
+// signCommand returns the command that writes a detached signature of the given file with the configured manifest_signing key
+func signCommand(file string) string {
+	if config.ManifestSigning.Method == "minisign" {
+		return shellquote.Join("minisign", "-S", "-q", "-s", config.ManifestSigning.Key, "-x", file+".sig", "-m", file)
+	}
+	return shellquote.Join("gpg", "--batch", "--yes", "--armor", "--local-user", config.ManifestSigning.Key, "--output", file+".sig", "--detach-sign", file)
+}
+
+// verifyCommand returns the command that checks the detached signature of the given file, gpg uses the public_key as keyring if it is set
+func verifyCommand(file string) string {
+	if config.ManifestSigning.Method == "minisign" {
+		return shellquote.Join("minisign", "-V", "-q", "-p", config.ManifestSigning.PublicKey, "-x", file+".sig", "-m", file)
+	}
+	if len(config.ManifestSigning.PublicKey) > 0 {
+		return shellquote.Join("gpgv", "--keyring", config.ManifestSigning.PublicKey, file+".sig", file)
+	}
+	return shellquote.Join("gpg", "--batch", "--verify", file+".sig", file)
+}
+
+// signDeployManifest writes a detached .sig signature next to the deploy manifest and the checksums file of the given Puppet environment.
+// Files whose existing signature is still valid are not signed again, so that an unchanged environment stays unchanged. It returns false if the environment could not be signed.
+func signDeployManifest(env string, envDir string) bool {
+	if len(config.ManifestSigning.Method) == 0 || dryRun {
+		return true
+	}
+	for _, name := range signedManifestFiles {
+		file := filepath.Join(envDir, name)
+		if !fileExists(file) {
+			continue
+		}
+		if fileExists(file+".sig") && executeCommand(verifyCommand(file), config.Timeout, true).returnCode == 0 {
+			continue
+		}
+		Debugf("Signing " + file)
+		er := executeCommand(signCommand(file), config.Timeout, true)
+		if er.returnCode != 0 {
+			Warnf("WARNING: Could not sign " + file + ": " + er.errorOutput())
+			recordEnvironmentFailure(env, "signing "+name+" failed")
+			return false
+		}
+		applyOwnership(file + ".sig")
+	}
+	return true
+}
+
+// verifyDeployManifest checks the signatures of the deploy manifest and checksums file of the given Puppet environment directory and compares its files with the signed checksums.
+// It returns a description of every problem that was found.
+func verifyDeployManifest(envDir string, allowList []string) []string {
+	var problems []string
+	for _, name := range signedManifestFiles {
+		file := filepath.Join(envDir, name)
+		if !fileExists(file) {
+			problems = append(problems, "missing "+name)
+		} else if !fileExists(file + ".sig") {
+			problems = append(problems, "missing signature of "+name)
+		} else if er := executeCommand(verifyCommand(file), config.Timeout, true); er.returnCode != 0 {
+			problems = append(problems, "invalid signature of "+name+": "+er.errorOutput())
+		}
+	}
+	if len(problems) > 0 {
+		// the checksums can not be trusted
+		return problems
+	}
+	dc, err := readDeployChecksums(envDir)
+	if err != nil {
+		return append(problems, "could not read "+checksumsFile+": "+err.Error())
+	}
+	for _, df := range detectDrift(envDir, dc, allowList) {
+		problems = append(problems, df.Change+" "+filepath.Join(df.Content, df.Path))
+	}
+	return problems
+}
+
+// verifyManifestCommand validates the signatures of the deploy manifests of the given Puppet environment and its files on disk against the signed checksums,
+// e.g. g10k verify-manifest -config test.yaml production
+func verifyManifestCommand(args []string) {
+	fs := subcommandFlagSet("verify-manifest")
+	configFileFlag := fs.String("config", "", "which config file to use")
+	fs.Parse(args)
+	// allow the flags before and after the environment name
+	env := ""
+	if fs.NArg() > 0 {
+		env = fs.Arg(0)
+		fs.Parse(fs.Args()[1:])
+	}
+	if len(env) == 0 || fs.NArg() > 0 {
+		Fatalf("Error: you need to specify exactly one environment\nExample call: " + os.Args[0] + " verify-manifest -config test.yaml production")
+	}
+	if len(*configFileFlag) == 0 {
+		Fatalf("Error: you need to specify a config file\nExample call: " + os.Args[0] + " verify-manifest -config test.yaml production")
+	}
+
+	config = loadConfig(*configFileFlag)
+	if len(config.ManifestSigning.Method) == 0 {
+		Fatalf("Error: you need to configure manifest_signing in " + *configFileFlag + " to verify the deploy manifest")
+	}
+
+	for _, source := range sortedSourceNames() {
+		sa := config.Sources[source]
+		envDir := filepath.Join(sa.Basedir, env)
+		if !isDir(envDir) {
+			continue
+		}
+		problems := verifyDeployManifest(envDir, resolvePurgeAllowList(sa))
+		if len(problems) == 0 {
+			fmt.Println("Environment " + env + " matches its signed deploy manifest")
+			return
+		}
+		fmt.Println("Environment " + env + " does not match its signed deploy manifest, found " + strconv.Itoa(len(problems)) + " problem(s):")
+		for _, problem := range problems {
+			fmt.Println("  " + problem)
+		}
+		os.Exit(1)
+	}
+	Fatalf("Error: Could not find environment " + env + " in the basedir of any source")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// defaultStagingDirName is the name of the staging directory inside the basedir if no staging_dir is configured
+const defaultStagingDirName = ".g10k-staging"
+
+// resolveStagingDir returns the directory in which g10k builds temporary content for the given source.
+// The staging_dir setting of the source takes precedence over the global staging_dir setting, the default is a directory inside the basedir so that it is on the same filesystem.
+func resolveStagingDir(sa Source) string {
+	if len(sa.StagingDir) > 0 {
+		return normalizeDir(sa.StagingDir)
+	} else if len(config.StagingDir) > 0 {
+		return normalizeDir(config.StagingDir)
+	}
+	return filepath.Join(sa.Basedir, defaultStagingDirName)
+}
+
+// prepareStagingDir creates the staging directory of the given source and warns if it is not on the same filesystem as the basedir, because then g10k can not atomically rename content into the basedir
+func prepareStagingDir(source string, sa Source) string {
+	stagingDir := checkDirAndCreate(resolveStagingDir(sa), "staging_dir for source "+source)
+	if !dryRun && !sameFilesystem(stagingDir, sa.Basedir) {
+		Warnf("WARNING: staging_dir " + stagingDir + " of source " + source + " is not on the same filesystem as basedir " + sa.Basedir + ", content has to be copied instead of atomically renamed")
+	}
+	return stagingDir
+}
+
+// isStagingDir returns true if the given directory is the staging directory of one of the sources and must therefore not be purged
+func isStagingDir(dir string) bool {
+	dir = normalizeDir(dir)
+	for _, sa := range config.Sources {
+		if resolveStagingDir(sa) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// sameFilesystem returns true if both paths are located on the same device
+func sameFilesystem(a string, b string) bool {
+	var statA, statB syscall.Stat_t
+	if err := syscall.Stat(a, &statA); err != nil {
+		return false
+	}
+	if err := syscall.Stat(b, &statB); err != nil {
+		return false
+	}
+	return statA.Dev == statB.Dev
+}
+
+// useStagingDirAsTempDir makes g10k and all commands executed by it (e.g. git, ssh-agent and postrun) use the global staging_dir for their temporary files instead of /tmp
+func useStagingDirAsTempDir() {
+	if len(config.StagingDir) == 0 {
+		return
+	}
+	stagingDir := checkDirAndCreate(config.StagingDir, "global staging_dir")
+	if dryRun {
+		return
+	}
+	Debugf("Setting TMPDIR to global staging_dir " + stagingDir)
+	if err := os.Setenv("TMPDIR", stagingDir); err != nil {
+		Fatalf("useStagingDirAsTempDir(): Could not set TMPDIR environment variable to " + stagingDir + " Error: " + err.Error())
+	}
+}
+
+// stagedDeploy returns true if the Puppet environments are built separately from the live environments and switched into place once they are complete
+func stagedDeploy() bool {
+	return config.DeployStrategy == "atomic" || versionedDeploy()
+}
+
+// stageEnvironment prepares the directory in which the new content of the given Puppet environment gets built for an atomic deploy.
+// The existing environment gets cloned into it with hardlinks, so that unchanged modules do not need to be synced again.
+func stageEnvironment(pe PuppetEnvironment) string {
+	if versionedDeploy() {
+		return newEnvironmentVersion(pe)
+	}
+	stagingDir := prepareStagingDir(pe.source, pe.sa)
+	if !sameFilesystem(stagingDir, pe.sa.Basedir) {
+		Fatalf("Error: deploy_strategy atomic requires the staging_dir " + stagingDir + " of source " + pe.source + " to be on the same filesystem as the basedir " + pe.sa.Basedir)
+	}
+	tmpDir, err := ioutil.TempDir(stagingDir, pe.env+".")
+	if err != nil {
+		Fatalf("stageEnvironment(): Could not create staging directory for environment " + pe.env + " in " + stagingDir + " Error: " + err.Error())
+	}
+	stagedDir := filepath.Join(tmpDir, pe.env)
+	if isDir(pe.targetDir) && !force {
+		Debugf("Cloning environment " + pe.targetDir + " to " + stagedDir)
+		hardlinkTree(pe.targetDir, stagedDir)
+	} else {
+		checkDirAndCreate(stagedDir, "staging directory for environment "+pe.env)
+	}
+	return stagedDir
+}
+
+// stagingTempDir returns the directory that has to be removed once the staged environment got committed or discarded
+func stagingTempDir(pe PuppetEnvironment) string {
+	if versionedDeploy() {
+		return pe.stagedDir
+	}
+	return filepath.Dir(pe.stagedDir)
+}
+
+// hardlinkTree recreates the directory structure of the given source directory in the target directory and hardlinks all files into it
+func hardlinkTree(sourceDir string, targetDir string) {
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(targetDir, rel)
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			applyOwnership(target)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			applyOwnership(target)
+		default:
+			if err := os.Link(path, target); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Fatalf("hardlinkTree(): Error while cloning " + sourceDir + " to " + targetDir + " Error: " + err.Error())
+	}
+}
+
+// commitStagedEnvironments swaps the staged Puppet environments into place and removes the staging directories.
+// Staged environments without any changes are discarded and the existing environment stays untouched.
+func commitStagedEnvironments(stagedEnvironments []PuppetEnvironment) {
+	for _, pe := range stagedEnvironments {
+		tmpDir := stagingTempDir(pe)
+		// with deploy_strategy symlink or nfs the staging directory becomes the live environment
+		untrackStagingTempDir(tmpDir)
+		if environmentFailed(pe.env) {
+			Warnf("WARNING: Keeping the previous state of environment " + pe.env + ", because its deploy failed")
+			purgeDir(tmpDir, "commitStagedEnvironments()")
+			continue
+		}
+		mutex.Lock()
+		_, changed := needSyncEnvs[pe.env]
+		for _, purgedPath := range purgedPaths {
+			if strings.HasPrefix(purgedPath, pe.stagedDir+"/") {
+				changed = true
+			}
+		}
+		mutex.Unlock()
+		if versionedDeploy() {
+			// replace environments that were deployed with another deploy_strategy with a symlink
+			if info, err := os.Lstat(pe.targetDir); err == nil && info.Mode()&os.ModeSymlink == 0 {
+				changed = true
+			}
+		}
+		if !changed && isDir(pe.targetDir) {
+			Debugf("Discarding staged environment " + pe.stagedDir + ", because nothing changed in " + pe.targetDir)
+			purgeDir(tmpDir, "commitStagedEnvironments()")
+			finishEnvironment(pe.env, pe.targetDir)
+			continue
+		}
+
+		if versionedDeploy() {
+			switchEnvironmentSymlink(pe)
+		} else if fileExists(pe.targetDir) {
+			Debugf("Swapping staged environment " + pe.stagedDir + " into place at " + pe.targetDir)
+			if err := exchangeDirs(pe.stagedDir, pe.targetDir); err != nil {
+				Fatalf("commitStagedEnvironments(): Could not swap staged environment " + pe.stagedDir + " with " + pe.targetDir + " Error: " + err.Error())
+			}
+			// the staging directory now contains the old content of the environment
+			purgeDir(tmpDir, "commitStagedEnvironments()")
+		} else {
+			if err := os.Rename(pe.stagedDir, pe.targetDir); err != nil {
+				Fatalf("commitStagedEnvironments(): Could not move staged environment " + pe.stagedDir + " to " + pe.targetDir + " Error: " + err.Error())
+			}
+			purgeDir(tmpDir, "commitStagedEnvironments()")
+		}
+		applyOwnership(pe.targetDir)
+
+		// report the final paths instead of the staging paths, e.g. to the postrun command
+		mutex.Lock()
+		for i, needSyncDir := range needSyncDirs {
+			if needSyncDir == pe.stagedDir || strings.HasPrefix(needSyncDir, pe.stagedDir+"/") {
+				needSyncDirs[i] = pe.targetDir + strings.TrimPrefix(needSyncDir, pe.stagedDir)
+			}
+		}
+		if postrunCommand, ok := environmentPostrunCommands[pe.stagedDir]; ok {
+			delete(environmentPostrunCommands, pe.stagedDir)
+			environmentPostrunCommands[pe.targetDir] = postrunCommand
+		}
+		mutex.Unlock()
+		finishEnvironment(pe.env, pe.targetDir)
+	}
+}
+
+// renameDirs exchanges the two given directories with two renames, during which the second directory briefly does not exist
+func renameDirs(a string, b string) error {
+	old := a + ".old"
+	if err := os.Rename(b, old); err != nil {
+		return err
+	}
+	if err := os.Rename(a, b); err != nil {
+		return err
+	}
+	return os.Rename(old, a)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"io/ioutil"
 	"path/filepath"
 	"strings"
 )
@@ -14,21 +15,29 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 	}
 	for source, sa := range config.Sources {
 		// fmt.Printf("source: %+v\n", sa)
-		prefix := resolveSourcePrefix(source, sa)
+		// environments with the {{branch}} variable in their prefix can have any prefix
+		prefix := strings.Replace(resolveSourcePrefix(source, sa), "{{branch}}", "*", -1)
 
 		if len(environmentParam) > 0 {
-			if !strings.HasPrefix(environmentParam, prefix) {
+			if matched, _ := filepath.Match(prefix+"*", environmentParam); !matched {
 				Debugf("Skipping purging unmanaged content for source '" + source + "', because -environment parameter is set to " + environmentParam)
 				continue
 			}
 		}
 
 		// Clean up unknown environment directories
-		if len(branchParam) == 0 {
+		if len(branchParam) == 0 && unresolvedSources[source] && stringSliceContains(config.PurgeLevels, "deployment") {
+			// the environments of this source are unknown, purging would remove all of them
+			Warnf("WARNING: Not purging the environments of source '" + source + "', because its control repository could not be resolved")
+			purgeRefusedSources = append(purgeRefusedSources, source)
+		} else if len(branchParam) == 0 {
 			for basedir := range allBasedirs {
 				globPath := filepath.Join(basedir, prefix+"*")
 				Debugf("Glob'ing with path " + globPath)
 				environments, _ := filepath.Glob(globPath)
+				managedEnvironments := withCanaryEnvironments(environments, allEnvironments)
+				withFrozenEnvironments(environments, managedEnvironments)
+				withReviewEnvironments(environments, managedEnvironments)
 
 				allowlistEnvironments := []string{}
 				if len(config.DeploymentPurgeAllowList) > 0 {
@@ -43,6 +52,14 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 				for _, env := range environments {
 					envPath := strings.Split(env, "/")
 					envName := envPath[len(envPath)-1]
+					if isStagingDir(env) {
+						Debugf("Not purging staging_dir " + env)
+						continue
+					}
+					if isEnvironmentVersion(envName, managedEnvironments) {
+						Debugf("Not purging version " + envName + " of a managed environment")
+						continue
+					}
 					if len(environmentParam) > 0 {
 						if envName != environmentParam {
 							Debugf("Skipping purging unmanaged content for Puppet environment '" + envName + "', because -environment parameter is set to " + environmentParam)
@@ -51,13 +68,16 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 					}
 					if stringSliceContains(config.PurgeLevels, "deployment") {
 						Debugf("Checking if environment should exist: " + envName)
-						if allEnvironments[envName] {
+						if managedEnvironments[envName] {
 							Debugf("Not purging environment " + envName)
 						} else if stringSliceContains(allowlistEnvironments, filepath.Join(basedir, envName)) {
 							Debugf("Not purging environment " + envName + " due to deployment_purge_allowlist match")
 						} else {
 							Infof("Removing unmanaged environment " + envName)
-							if !dryRun {
+							if dryRun {
+								recordDryRunChange("", "delete environment "+envName)
+								recordOrphanedContent(envName, "", "deployment")
+							} else {
 								purgeDir(filepath.Join(basedir, envName), "purgeStaleContent()")
 							}
 						}
@@ -68,20 +88,62 @@ func purgeUnmanagedContent(allBasedirs map[string]bool, allEnvironments map[stri
 	}
 }
 
-func purgeControlRepoExceptModuledir(dir string, moduleDir string) {
+func purgeControlRepoExceptModuledir(dir string, moduleDir string, allowList []string) {
 	moduleDir = filepath.Join(dir, moduleDir)
 
 	globPath := filepath.Join(dir, "*")
 	Debugf("Glob'ing with path " + globPath)
 	folders, _ := filepath.Glob(globPath)
 	for _, folder := range folders {
-		if folder == moduleDir || strings.HasPrefix(folder, moduleDir) {
-			continue
-		} else {
-			Debugf("deleting " + folder)
-			purgeDir(folder, "purgeControlRepoExceptModuledir")
-		}
+		purgeEnvironmentPath(dir, folder, moduleDir, allowList)
+	}
 
+}
+
+// purgeEnvironmentPath removes the given path inside the Puppet environment unless it is the moduledir or matches the purge_allowlist.
+// Directories that contain the moduledir or content matching the purge_allowlist are only purged partially.
+func purgeEnvironmentPath(envDir string, path string, moduleDir string, allowList []string) {
+	if path == moduleDir || strings.HasPrefix(path, moduleDir+"/") {
+		return
+	}
+	if matchesPurgeAllowList(allowList, envDir, path) {
+		Debugf("Not purging " + path + " due to purge_allowlist match")
+		return
+	}
+	if isDir(path) && (strings.HasPrefix(moduleDir, path+"/") || len(allowList) > 0) {
+		entries, _ := ioutil.ReadDir(path)
+		for _, entry := range entries {
+			purgeEnvironmentPath(envDir, filepath.Join(path, entry.Name()), moduleDir, allowList)
+		}
+		if entries, _ := ioutil.ReadDir(path); len(entries) > 0 {
+			return
+		}
 	}
+	Debugf("deleting " + path)
+	purgeDir(path, "purgeControlRepoExceptModuledir")
+}
+
+// purgeEnvironmentContent returns true if a changed control repository branch removes all content of its Puppet environment outside of the moduledir and the purge_allowlist.
+// This is the default without the purge_levels setting, otherwise only the environment purge level does that.
+func purgeEnvironmentContent() bool {
+	return !config.purgeLevelsConfigured || stringSliceContains(config.PurgeLevels, "environment")
+}
 
+// purgePreviousControlRepoContent removes all files of the previously deployed commit of the control repository that were not extracted again from the Puppet environment, but keeps everything else inside of it
+func purgePreviousControlRepoContent(srcDir string, targetDir string, deployFile string, extracted map[string]struct{}) {
+	if !fileExists(deployFile) {
+		Debugf("Not removing any content from " + targetDir + ", because the previously deployed commit is unknown")
+		return
+	}
+	previousCommit := readDeployResultFile(deployFile).Signature
+	er := executeCommand("git --git-dir "+srcDir+" ls-tree -r --name-only "+previousCommit, config.Timeout, true)
+	if er.returnCode != 0 {
+		Debugf("Not removing any content from " + targetDir + ", because the previously deployed commit " + previousCommit + " is not available anymore")
+		return
+	}
+	for _, file := range strings.Split(strings.TrimSpace(er.stdout), "\n") {
+		if _, ok := extracted[filepath.Clean(file)]; len(file) > 0 && !ok {
+			purgeDir(filepath.Join(targetDir, file), "purgePreviousControlRepoContent()")
+		}
+	}
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// storeForgeModule materializes the given Forge module version from the Forge cache in the module store unless it already exists there and returns its directory
+func storeForgeModule(forgeCacheModuleDir string) string {
+	storeDir := filepath.Join(extractedModulesDir(), "forge-"+filepath.Base(forgeCacheModuleDir))
+	if isDir(storeDir) {
+		return storeDir
+	}
+	checkDirAndCreate(extractedModulesDir(), "cachedir/extracted")
+	tmpDir, err := ioutil.TempDir(extractedModulesDir(), ".forge-"+filepath.Base(forgeCacheModuleDir)+".")
+	if err != nil {
+		Fatalf("storeForgeModule(): Could not create temporary directory in " + extractedModulesDir() + " Error: " + err.Error())
+	}
+	if err := os.Chmod(tmpDir, 0755); err != nil {
+		Fatalf("storeForgeModule(): Could not chmod " + tmpDir + " Error: " + err.Error())
+	}
+	applyOwnership(tmpDir)
+	linkTree(forgeCacheModuleDir, tmpDir, nil)
+	// another environment might have stored the same module version in the meantime
+	if err := os.Rename(tmpDir, storeDir); err != nil {
+		Debugf("Discarding " + tmpDir + ", because " + storeDir + " already exists")
+		purgeDir(tmpDir, "storeForgeModule()")
+	}
+	return storeDir
+}
+
+// linkModuleToStore atomically replaces the module directory inside of the Puppet environment with a symlink to the given directory of the module store
+func linkModuleToStore(storeDir string, targetDir string) {
+	if link, err := os.Readlink(targetDir); err == nil && link == storeDir {
+		return
+	}
+	tmpLink := filepath.Join(filepath.Dir(targetDir), "."+filepath.Base(targetDir)+".g10k-symlink")
+	purgeDir(tmpLink, "linkModuleToStore()")
+	if err := os.Symlink(storeDir, tmpLink); err != nil {
+		Fatalf("linkModuleToStore(): Could not create symlink " + tmpLink + " Error: " + err.Error())
+	}
+	applyOwnership(tmpLink)
+	if info, err := os.Lstat(targetDir); err == nil && info.IsDir() {
+		// a module that was deployed without module_store
+		purgeDir(targetDir, "linkModuleToStore()")
+	}
+	Debugf("Linking module " + targetDir + " to " + storeDir)
+	if err := os.Rename(tmpLink, targetDir); err != nil {
+		Fatalf("linkModuleToStore(): Could not rename symlink " + tmpLink + " to " + targetDir + " Error: " + err.Error())
+	}
+}
+
+// garbageCollectModuleStore counts the references from all Puppet environments to the module store and removes all modules of the store that are not referenced anymore
+func garbageCollectModuleStore() {
+	storeDir := extractedModulesDir()
+	if !isDir(storeDir) {
+		return
+	}
+	references := make(map[string]int)
+	for source, sa := range config.Sources {
+		basedir := sa.Basedir
+		if hasBranchVariable(sa) {
+			// the basedirs of all branches share the part before the {{branch}} variable
+			basedir = filepath.Dir(strings.Split(sa.Basedir, "{{branch}}")[0] + "x")
+		}
+		if !isDir(basedir) {
+			continue
+		}
+		Debugf("Counting module store references in basedir " + basedir + " of source " + source)
+		filepath.Walk(basedir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && isStagingDir(path) {
+				return filepath.SkipDir
+			}
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err := os.Readlink(path); err == nil && filepath.Dir(link) == storeDir {
+					references[link]++
+				}
+			}
+			return nil
+		})
+	}
+
+	entries, _ := ioutil.ReadDir(storeDir)
+	for _, entry := range entries {
+		entryDir := filepath.Join(storeDir, entry.Name())
+		if strings.HasPrefix(entry.Name(), ".") {
+			// temporary directories of a concurrent g10k run
+			continue
+		}
+		if count := references[entryDir]; count > 0 {
+			Debugf("Keeping " + entryDir + " with " + strconv.Itoa(count) + " references in the module store")
+			continue
+		}
+		Infof("Removing unreferenced module " + entryDir + " from the module store")
+		if !dryRun {
+			purgeDir(entryDir, "garbageCollectModuleStore()")
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// runWarnings are the warnings of this g10k run for the Markdown summary
+	runWarnings []string
+	// warningsMutex protects runWarnings, as Warnf can be called while the mutex is held
+	warningsMutex sync.Mutex
+	// quietSummaryPrinted is set once the -quiet summary line is printed, so that a failure afterwards does not print it again
+	quietSummaryPrinted bool
+)
+
+// recordWarning remembers the given warning for the Markdown summary
+func recordWarning(s string) {
+	warningsMutex.Lock()
+	runWarnings = append(runWarnings, strings.TrimSpace(s))
+	warningsMutex.Unlock()
+}
+
+// writeMarkdownSummary writes the Markdown summary to the given file, the $GITHUB_STEP_SUMMARY of a GitHub Actions step gets it appended
+func writeMarkdownSummary(path string, summary string) error {
+	if path != os.Getenv("GITHUB_STEP_SUMMARY") {
+		return writeFileAtomic(path, []byte(summary), 0644)
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(summary); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// markdownSummary returns the Markdown summary of the validation or of the changed and failed environments, the module version changes and the warnings of the g10k run, fatal is the error that aborted it
+func markdownSummary(fatal string) string {
+	var md strings.Builder
+	if validate {
+		if len(validationMessages) == 0 {
+			md.WriteString("## :white_check_mark: g10k validation of " + markdownCode(configFile) + " succeeded\n")
+			return md.String()
+		}
+		md.WriteString("## :x: g10k validation of " + markdownCode(configFile) + " failed\n\n")
+		for _, message := range validationMessages {
+			md.WriteString("- " + markdownText(message) + "\n")
+		}
+		return md.String()
+	}
+
+	output := deployOutput(fatal)
+	title := "deploy"
+	switch output.Command {
+	case "diff":
+		title = "dry run"
+	case "outdated":
+		title = "update check"
+	}
+	if output.Success {
+		md.WriteString("## :white_check_mark: g10k " + title + " succeeded")
+	} else {
+		md.WriteString("## :x: g10k " + title + " failed")
+	}
+	md.WriteString(" in " + time.Duration(output.Duration*float64(time.Second)).Round(time.Second).String() + "\n\n")
+	if len(fatal) > 0 {
+		md.WriteString("**Error:** " + markdownText(fatal) + "\n\n")
+	}
+
+	counts := make(map[string]int)
+	for _, eo := range output.Environments {
+		counts[eo.Result]++
+	}
+	if output.Command == "deploy" && len(output.Environments) > 0 {
+		var totals []string
+		for _, result := range []string{"deployed", "unchanged", "held", "failed"} {
+			if counts[result] > 0 {
+				totals = append(totals, strconv.Itoa(counts[result])+" "+result)
+			}
+		}
+		md.WriteString(strconv.Itoa(len(output.Environments)) + " environments: " + strings.Join(totals, ", ") + "\n\n")
+	}
+	if counts["deployed"]+counts["failed"] > 0 {
+		md.WriteString("| Environment | Source | Branch | Result |\n|---|---|---|---|\n")
+		for _, eo := range output.Environments {
+			if eo.Result != "deployed" && eo.Result != "failed" {
+				continue
+			}
+			result := eo.Result
+			if len(eo.Error) > 0 {
+				result += ": " + eo.Error
+			}
+			md.WriteString("| " + markdownText(eo.Environment) + " | " + markdownText(eo.Source) + " | " + markdownText(eo.Branch) + " | " + markdownText(result) + " |\n")
+		}
+		md.WriteString("\n")
+	}
+
+	var envs []string
+	for env := range moduleChanges {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+	if len(envs) > 0 {
+		md.WriteString("### Module changes\n\n| Environment | Module | Old | New |\n|---|---|---|---|\n")
+		for _, env := range envs {
+			for _, mc := range moduleChanges[env] {
+				md.WriteString("| " + markdownText(env) + " | " + markdownText(mc.Module) + " | " + markdownVersion(mc.From, "added") + " | " + markdownLink(markdownVersion(mc.To, "removed"), mc.CompareURL) + " |\n")
+			}
+		}
+		md.WriteString("\n")
+	}
+
+	if len(output.Changes) > 0 {
+		md.WriteString("### Planned changes\n\n")
+		var planned []string
+		for env := range output.Changes {
+			planned = append(planned, env)
+		}
+		sort.Strings(planned)
+		for _, env := range planned {
+			changes := append([]string{}, output.Changes[env]...)
+			sort.Strings(changes)
+			if len(env) > 0 {
+				md.WriteString("**" + markdownText(env) + "**\n\n")
+			}
+			for _, change := range changes {
+				md.WriteString("- " + markdownText(change) + "\n")
+			}
+			md.WriteString("\n")
+		}
+	} else if output.Command == "diff" {
+		md.WriteString("Nothing would be changed.\n\n")
+	}
+
+	if len(output.Outdated) > 0 {
+		md.WriteString("### Outdated Forge modules\n\n| Module | Deployed | Latest |\n|---|---|---|\n")
+		for _, om := range output.Outdated {
+			md.WriteString("| " + markdownText(om.Module) + " | " + markdownText(om.Deployed) + " | " + markdownText(om.Latest) + " |\n")
+		}
+		md.WriteString("\n")
+	}
+
+	var failures []string
+	for _, failed := range []map[string]string{output.FailedSources, output.FailedModules} {
+		var keys []string
+		for key := range failed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			failures = append(failures, markdownCode(key)+": "+markdownText(failed[key]))
+		}
+	}
+	if len(failures) > 0 {
+		md.WriteString("### Failures\n\n- " + strings.Join(failures, "\n- ") + "\n\n")
+	}
+
+	warningsMutex.Lock()
+	warnings := append([]string{}, runWarnings...)
+	warningsMutex.Unlock()
+	if len(warnings) > 0 {
+		noun := " warnings"
+		if len(warnings) == 1 {
+			noun = " warning"
+		}
+		md.WriteString("<details><summary>" + strconv.Itoa(len(warnings)) + noun + "</summary>\n\n")
+		for _, warning := range warnings {
+			md.WriteString("- " + markdownText(warning) + "\n")
+		}
+		md.WriteString("\n</details>\n")
+	}
+	return strings.TrimRight(md.String(), "\n") + "\n"
+}
+
+// printQuietSummary prints the single summary line of the g10k run with -quiet, it is left out with -log-level error and with JSON output
+func printQuietSummary(fatal string) {
+	if !quiet || quietSummaryPrinted || validate || jsonOutput() || !logLevelEnabled(logLevelWarn) {
+		return
+	}
+	quietSummaryPrinted = true
+	fmt.Println(quietSummary(fatal))
+}
+
+// quietSummary returns the summary line of the g10k run for -quiet with space separated key=value pairs, e.g.
+// g10k deploy failed: changed=2 unchanged=10 held=0 failed=1 warnings=3 duration=12.3s
+func quietSummary(fatal string) string {
+	output := deployOutput(fatal)
+	line := "g10k " + output.Command
+	if output.Success {
+		line += " succeeded:"
+	} else {
+		line += " failed:"
+	}
+	switch {
+	case output.Command == "outdated":
+		line += " outdated=" + strconv.Itoa(len(output.Outdated))
+	case pfMode:
+		line += " git=" + strconv.Itoa(output.GitRepositories) + " forge=" + strconv.Itoa(output.ForgeModules)
+	default:
+		counts := make(map[string]int)
+		for _, eo := range output.Environments {
+			counts[eo.Result]++
+		}
+		line += " changed=" + strconv.Itoa(counts["deployed"]) + " unchanged=" + strconv.Itoa(counts["unchanged"]) + " held=" + strconv.Itoa(counts["held"]) + " failed=" + strconv.Itoa(counts["failed"])
+	}
+	warningsMutex.Lock()
+	warnings := len(runWarnings)
+	warningsMutex.Unlock()
+	return line + " warnings=" + strconv.Itoa(warnings) + " duration=" + strconv.FormatFloat(output.Duration, 'f', 1, 64) + "s"
+}
+
+// markdownVersion returns the version of a module for the Markdown summary with git commits abbreviated, missing is shown if the module was added or removed
+func markdownVersion(version string, missing string) string {
+	if len(version) == 0 {
+		return "_" + missing + "_"
+	}
+	if reCommitHash.MatchString(version) {
+		version = shortCommit(version)
+	}
+	return markdownCode(version)
+}
+
+// markdownLink returns the given Markdown text as a link to the given URL, or the text itself without URL
+func markdownLink(text string, url string) string {
+	if len(url) == 0 {
+		return text
+	}
+	return "[" + text + "](" + strings.Replace(url, ")", "%29", -1) + ")"
+}
+
+// markdownCode returns the given text as Markdown inline code
+func markdownCode(s string) string {
+	return "`" + strings.Replace(s, "`", "'", -1) + "`"
+}
+
+// markdownText returns the given message on a single line with the characters escaped that Markdown or HTML would interpret
+func markdownText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	return strings.NewReplacer("\\", "\\\\", "*", "\\*", "_", "\\_", "`", "\\`", "<", "&lt;", ">", "&gt;", "|", "\\|").Replace(s)
+}
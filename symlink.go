@@ -0,0 +1,127 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// defaultSymlinkVersions is the number of versions of every Puppet environment that are kept with deploy_strategy symlink if symlink_versions is not set
+const defaultSymlinkVersions = 3
+
+// environmentVersionTimeFormat is the timestamp suffix of the versioned directories of a Puppet environment, e.g. production-20240601T120000
+const environmentVersionTimeFormat = "20060102T150405"
+
+// reEnvironmentVersion matches the versioned directories of Puppet environments, the - makes sure that Puppet does not treat them as environments
+var reEnvironmentVersion = regexp.MustCompile(`^(.+)-\d{8}T\d{6}(_\d+)?$`)
+
+// newEnvironmentVersion creates the versioned directory next to the environment symlink in which the new content of the given Puppet environment gets built.
+// The current version gets cloned into it with hardlinks, so that unchanged modules do not need to be synced again.
+func newEnvironmentVersion(pe PuppetEnvironment) string {
+	versionDir := pe.targetDir + "-" + time.Now().Format(environmentVersionTimeFormat)
+	for i := 1; fileExists(versionDir); i++ {
+		versionDir = pe.targetDir + "-" + time.Now().Format(environmentVersionTimeFormat) + "_" + strconv.Itoa(i)
+	}
+	if currentDir, err := filepath.EvalSymlinks(pe.targetDir); err == nil && isDir(currentDir) && !force {
+		Debugf("Cloning environment version " + currentDir + " to " + versionDir)
+		hardlinkTree(currentDir, versionDir)
+	} else {
+		checkDirAndCreate(versionDir, "version directory for environment "+pe.env)
+	}
+	return versionDir
+}
+
+// versionedDeploy returns true if every Puppet environment is a symlink to a versioned directory next to it, which is the case with deploy_strategy symlink and nfs
+func versionedDeploy() bool {
+	return config.DeployStrategy == "symlink" || nfsDeploy()
+}
+
+// switchEnvironmentSymlink atomically points the symlink of the given Puppet environment to its new version and removes old versions according to the symlink_versions setting
+func switchEnvironmentSymlink(pe PuppetEnvironment) {
+	if info, err := os.Lstat(pe.targetDir); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		// an environment that was deployed with another deploy_strategy becomes the previous version
+		previousDir := pe.targetDir + "-" + info.ModTime().Format(environmentVersionTimeFormat)
+		Infof("Moving environment " + pe.targetDir + " to " + previousDir + " to replace it with a symlink")
+		if err := retryOnESTALE("rename of "+pe.targetDir, func() error { return os.Rename(pe.targetDir, previousDir) }); err != nil {
+			Fatalf("switchEnvironmentSymlink(): Could not move environment " + pe.targetDir + " to " + previousDir + " Error: " + err.Error())
+		}
+	}
+	if nfsDeploy() {
+		// the new version has to be on the NFS server before other clients can follow the symlink to it
+		if err := syncTree(pe.stagedDir); err != nil {
+			Fatalf("switchEnvironmentSymlink(): Could not flush " + pe.stagedDir + " to disk Error: " + err.Error())
+		}
+	}
+
+	pointEnvironmentSymlink(pe.targetDir, pe.stagedDir)
+	removeOldEnvironmentVersions(pe.targetDir, config.SymlinkVersions)
+}
+
+// pointEnvironmentSymlink atomically points the given environment symlink to the given version directory by renaming a new symlink over it
+func pointEnvironmentSymlink(targetDir string, versionDir string) {
+	tmpLink := filepath.Join(filepath.Dir(targetDir), "."+filepath.Base(targetDir)+".g10k-symlink")
+	purgeDir(tmpLink, "pointEnvironmentSymlink()")
+	if err := retryOnESTALE("symlink "+tmpLink, func() error { return os.Symlink(filepath.Base(versionDir), tmpLink) }); err != nil {
+		Fatalf("pointEnvironmentSymlink(): Could not create symlink " + tmpLink + " Error: " + err.Error())
+	}
+	applyOwnership(tmpLink)
+	Debugf("Switching environment " + targetDir + " to version " + versionDir)
+	if err := retryOnESTALE("rename of "+tmpLink, func() error { return os.Rename(tmpLink, targetDir) }); err != nil {
+		Fatalf("pointEnvironmentSymlink(): Could not switch symlink " + targetDir + " to " + versionDir + " Error: " + err.Error())
+	}
+	if nfsDeploy() {
+		if err := syncPath(filepath.Dir(targetDir)); err != nil {
+			Fatalf("pointEnvironmentSymlink(): Could not flush " + filepath.Dir(targetDir) + " to disk Error: " + err.Error())
+		}
+	}
+}
+
+// removeOldEnvironmentVersions keeps the given number of successfully deployed versions of the given environment symlink and removes all other versions.
+// The version the symlink currently points to is never removed.
+func removeOldEnvironmentVersions(targetDir string, keep int) {
+	currentDir, _ := filepath.EvalSymlinks(targetDir)
+	versions := environmentVersions(targetDir)
+	// the current version counts as one of the kept versions
+	kept := 1
+	for i := len(versions) - 1; i >= 0; i-- {
+		if filepath.Base(versions[i]) == filepath.Base(currentDir) {
+			continue
+		}
+		if kept < keep && successfulEnvironmentVersion(versions[i]) {
+			kept++
+			continue
+		}
+		Debugf("Removing old version " + versions[i] + " of environment " + targetDir)
+		purgeDir(versions[i], "removeOldEnvironmentVersions()")
+	}
+}
+
+// successfulEnvironmentVersion returns true if the deploy of the given version directory of an environment completed successfully
+func successfulEnvironmentVersion(versionDir string) bool {
+	deployFile := filepath.Join(versionDir, ".g10k-deploy.json")
+	return fileExists(deployFile) && readDeployResultFile(deployFile).DeploySuccess
+}
+
+// environmentVersions returns all versioned directories of the given environment symlink, oldest first
+func environmentVersions(targetDir string) []string {
+	matches, _ := filepath.Glob(targetDir + "-*")
+	var versions []string
+	for _, match := range matches {
+		if m := reEnvironmentVersion.FindStringSubmatch(filepath.Base(match)); len(m) > 1 && m[1] == filepath.Base(targetDir) {
+			versions = append(versions, match)
+		}
+	}
+	sort.Strings(versions)
+	return versions
+}
+
+// isEnvironmentVersion returns true if the given directory name is a version of one of the given Puppet environments
+func isEnvironmentVersion(name string, allEnvironments map[string]bool) bool {
+	if m := reEnvironmentVersion.FindStringSubmatch(name); len(m) > 1 {
+		return allEnvironments[m[1]]
+	}
+	return false
+}
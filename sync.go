@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// writeFileIfChanged writes the content of the given reader to the target file, but only replaces an existing file if its content differs.
+// The new content is written to a temporary file next to the target file first and renamed into place, so that the target file is never missing or half-written.
+func writeFileIfChanged(targetFilename string, r io.Reader, mode os.FileMode, modTime time.Time) (bool, error) {
+	f, err := ioutil.TempFile(filepath.Dir(targetFilename), "."+filepath.Base(targetFilename)+".")
+	if err != nil {
+		return false, err
+	}
+	tmpFile := f.Name()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, hash), r); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return false, err
+	}
+
+	if info, err := os.Lstat(targetFilename); err == nil && info.Mode().IsRegular() && info.Mode().Perm() == mode.Perm() {
+		if existingHash, err := fileSha256(targetFilename); err == nil && bytes.Equal(existingHash, hash.Sum(nil)) {
+			os.Remove(tmpFile)
+			return false, nil
+		}
+	}
+
+	if err := os.Chmod(tmpFile, mode); err != nil {
+		os.Remove(tmpFile)
+		return false, err
+	}
+	if err := os.Chtimes(tmpFile, modTime, modTime); err != nil {
+		os.Remove(tmpFile)
+		return false, err
+	}
+	if isDir(targetFilename) {
+		purgeDir(targetFilename, "writeFileIfChanged()")
+	}
+	return true, os.Rename(tmpFile, targetFilename)
+}
+
+// linkFileIfChanged hardlinks (or with the reflink setting copies) the source file to the target file, but only replaces an existing target file if its content differs from the source file
+func linkFileIfChanged(sourceFilename string, targetFilename string) (bool, error) {
+	sourceInfo, err := os.Stat(sourceFilename)
+	if err != nil {
+		return false, err
+	}
+	if targetInfo, err := os.Lstat(targetFilename); err == nil && targetInfo.Mode().IsRegular() {
+		if os.SameFile(sourceInfo, targetInfo) {
+			return false, nil
+		}
+		if sourceInfo.Size() == targetInfo.Size() && sourceInfo.Mode() == targetInfo.Mode() {
+			sourceHash, sourceErr := fileSha256(sourceFilename)
+			targetHash, targetErr := fileSha256(targetFilename)
+			if sourceErr == nil && targetErr == nil && bytes.Equal(sourceHash, targetHash) {
+				return false, nil
+			}
+		}
+	}
+
+	tmpFile := filepath.Join(filepath.Dir(targetFilename), "."+filepath.Base(targetFilename)+".g10k-link")
+	os.Remove(tmpFile)
+	if config.Reflink {
+		if err := copyFile(sourceFilename, tmpFile, sourceInfo.Mode()); err != nil {
+			os.Remove(tmpFile)
+			return false, err
+		}
+	} else if err := os.Link(sourceFilename, tmpFile); err != nil {
+		// fall back to a copy if the source file is on another filesystem
+		linkErr, ok := err.(*os.LinkError)
+		if !ok || linkErr.Err != syscall.EXDEV {
+			return false, err
+		}
+		if err := copyFile(sourceFilename, tmpFile, sourceInfo.Mode()); err != nil {
+			os.Remove(tmpFile)
+			return false, err
+		}
+	}
+	if isDir(targetFilename) {
+		purgeDir(targetFilename, "linkFileIfChanged()")
+	}
+	return true, os.Rename(tmpFile, targetFilename)
+}
+
+// copyFile copies the content of the source file to the target file.
+// It tries to create a reflink first, which is near-instant and does not need any additional space, and falls back to a regular copy if the filesystem does not support it.
+func copyFile(sourceFilename string, targetFilename string, mode os.FileMode) error {
+	mutex.Lock()
+	tryReflink := !reflinkUnsupported
+	mutex.Unlock()
+	if tryReflink {
+		err := reflinkFile(sourceFilename, targetFilename, mode)
+		if err == nil {
+			return nil
+		}
+		mutex.Lock()
+		if !reflinkUnsupported {
+			Debugf("Could not reflink " + sourceFilename + " to " + targetFilename + ", falling back to regular copies Error: " + err.Error())
+			reflinkUnsupported = true
+		}
+		mutex.Unlock()
+		os.Remove(targetFilename)
+	}
+	in, err := os.Open(sourceFilename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(targetFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(targetFilename, mode)
+}
+
+// linkTree incrementally syncs the given target directory with the source directory by hardlinking all files of the source directory into it.
+// Files that do not exist in the source directory are removed from the target directory unless they are preserved.
+func linkTree(sourceDir string, targetDir string, preserved []string) {
+	synced := make(map[string]struct{})
+	err := filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(sourceDir, path)
+		if err != nil {
+			return err
+		}
+		synced[relPath] = struct{}{}
+		target := filepath.Join(targetDir, relPath)
+		switch {
+		case info.IsDir():
+			if err := ensureDir(target); err != nil {
+				return err
+			}
+			applyOwnership(target)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if existingLink, err := os.Readlink(target); err == nil && existingLink == link {
+				return nil
+			}
+			purgeDir(target, "linkTree()")
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			applyOwnership(target)
+		default:
+			changed, err := linkFileIfChanged(path, target)
+			if err != nil {
+				return err
+			}
+			if changed {
+				applyOwnership(target)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		Fatalf("linkTree(): Error while syncing " + sourceDir + " to " + targetDir + " Error: " + err.Error())
+	}
+	removeStaleContent(targetDir, synced, preserved)
+}
+
+// fileSha256 returns the SHA256 checksum of the given file
+func fileSha256(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// ensureDir creates the given directory and replaces anything else that exists at this path
+func ensureDir(dir string) error {
+	if info, err := os.Lstat(dir); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		purgeDir(dir, "ensureDir()")
+	}
+	return os.MkdirAll(dir, os.FileMode(0755))
+}
+
+// removeStaleContent removes everything inside of the given directory whose relative path is not contained in the synced paths or the preserved files and directories
+func removeStaleContent(dir string, synced map[string]struct{}, preserved []string) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == dir {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return nil
+		}
+		if stringSliceContains(preserved, relPath) && info.IsDir() {
+			// preserved directories are kept with their content
+			return filepath.SkipDir
+		}
+		if _, ok := synced[relPath]; ok || stringSliceContains(preserved, relPath) {
+			return nil
+		}
+		Debugf("Removing stale path " + path)
+		purgeDir(path, "removeStaleContent()")
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
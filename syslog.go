@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// syslogEnterpriseID is the private enterprise number of the structured data element with the fields of a log record, 32473 is reserved for documentation by RFC 5612
+const syslogEnterpriseID = "32473"
+
+// syslogFacilities maps the supported syslog facility settings to their numerical code
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// logSeverities maps the log levels to their syslog severity, which journald uses as PRIORITY as well
+var logSeverities = map[string]int{"error": 3, "warn": 4, "info": 6, "debug": 7, "trace": 7}
+
+// syslogOutput sends the log messages to the configured syslog server, it is nil if syslog is not configured
+var syslogOutput *syslogWriter
+
+// syslogWriter sends RFC 5424 messages to a syslog server over a unix socket, UDP or TCP
+type syslogWriter struct {
+	mutex    sync.Mutex
+	settings SyslogSettings
+	network  string
+	address  string
+	conn     net.Conn
+	hostname string
+	facility int
+}
+
+// newSyslogWriter returns the writer for the given syslog settings, the address is e.g. unix:///dev/log, udp://loghost:514 or tcp://loghost:601
+func newSyslogWriter(settings SyslogSettings) (*syslogWriter, error) {
+	u, err := url.Parse(settings.Address)
+	if err != nil {
+		return nil, err
+	}
+	sw := &syslogWriter{settings: settings, network: u.Scheme, facility: syslogFacilities["daemon"]}
+	switch u.Scheme {
+	case "unix", "unixgram":
+		sw.network = "unixgram"
+		sw.address = u.Path
+	case "udp", "tcp":
+		sw.address = u.Host
+	default:
+		return nil, errors.New("unsupported syslog address " + settings.Address + ", supported are unix://, udp:// and tcp://")
+	}
+	if len(sw.address) == 0 {
+		return nil, errors.New("missing path or host of syslog address " + settings.Address)
+	}
+	if len(settings.Facility) > 0 {
+		facility, ok := syslogFacilities[settings.Facility]
+		if !ok {
+			return nil, errors.New("unsupported syslog facility " + settings.Facility)
+		}
+		sw.facility = facility
+	}
+	sw.hostname, _ = os.Hostname()
+	return sw, nil
+}
+
+// openSyslog starts sending the log messages to the configured syslog server
+func openSyslog() {
+	if syslogOutput != nil {
+		syslogOutput.mutex.Lock()
+		unchanged := syslogOutput.settings == config.Syslog
+		syslogOutput.mutex.Unlock()
+		if unchanged {
+			return
+		}
+		syslogOutput.close()
+		syslogOutput = nil
+	}
+	if len(config.Syslog.Address) == 0 {
+		return
+	}
+	// the settings were validated by readConfigfile
+	syslogOutput, _ = newSyslogWriter(config.Syslog)
+}
+
+// format returns the RFC 5424 message of the given log record with its environment, module, result, phase and duration as structured data
+func (sw *syslogWriter) format(record LogRecord) string {
+	appName := sw.settings.AppName
+	if len(appName) == 0 {
+		appName = "g10k"
+	}
+	var params []string
+	for _, param := range [][]string{{"environment", record.Environment}, {"module", record.Module}, {"result", record.Result}, {"phase", record.Phase}} {
+		if len(param[1]) > 0 {
+			params = append(params, param[0]+"=\""+syslogParamValue(param[1])+"\"")
+		}
+	}
+	if record.Duration > 0 {
+		params = append(params, "duration=\""+strconv.FormatFloat(record.Duration, 'f', -1, 64)+"\"")
+	}
+	structuredData := "-"
+	if len(params) > 0 {
+		structuredData = "[g10k@" + syslogEnterpriseID + " " + strings.Join(params, " ") + "]"
+	}
+	priority := sw.facility*8 + logSeverities[record.Level]
+	return "<" + strconv.Itoa(priority) + ">1 " + time.Now().Format(time.RFC3339Nano) + " " + sw.hostname + " " + appName + " " + strconv.Itoa(os.Getpid()) + " " + record.Level + " " + structuredData + " " + record.Message
+}
+
+// syslogParamValue escapes the characters that are not allowed in an RFC 5424 structured data parameter value
+func syslogParamValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// write sends the given log record to the syslog server and reconnects once if the connection got lost.
+// Errors are ignored, as there is no other place to log them to.
+func (sw *syslogWriter) write(record LogRecord) {
+	message := sw.format(record)
+	if sw.network == "tcp" {
+		// octet counting framing of RFC 6587
+		message = strconv.Itoa(len(message)) + " " + message
+	}
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	for attempt := 0; attempt < 2; attempt++ {
+		if sw.conn == nil {
+			conn, err := net.DialTimeout(sw.network, sw.address, 5*time.Second)
+			if err != nil {
+				return
+			}
+			sw.conn = conn
+		}
+		sw.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if _, err := sw.conn.Write([]byte(message)); err == nil {
+			return
+		}
+		sw.conn.Close()
+		sw.conn = nil
+	}
+}
+
+func (sw *syslogWriter) close() {
+	sw.mutex.Lock()
+	defer sw.mutex.Unlock()
+	if sw.conn != nil {
+		sw.conn.Close()
+		sw.conn = nil
+	}
+}
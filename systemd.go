@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdListenFdsStart is the first file descriptor that systemd passes to a socket activated service
+const sdListenFdsStart = 3
+
+// sdNotify sends the given state, e.g. READY=1, to the service manager if g10k was started by systemd with Type=notify, otherwise it does nothing
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if len(socket) == 0 {
+		return
+	}
+	// an @ stands for a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		Debugf("Could not connect to the systemd notification socket " + os.Getenv("NOTIFY_SOCKET") + ": " + err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		Debugf("Could not notify systemd: " + err.Error())
+	}
+}
+
+// sdWatchdogInterval returns how often g10k has to ping the systemd watchdog, which is half of the WatchdogSec= of the service, or 0 if the watchdog is disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); len(pid) > 0 && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// runSdWatchdog pings the systemd watchdog until g10k serve shuts down, also while a long deploy is running, because the deploys run in separate g10k processes
+func runSdWatchdog() {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	Debugf("Pinging the systemd watchdog every " + interval.String())
+	for range time.Tick(interval) {
+		sdNotify("WATCHDOG=1")
+	}
+}
+
+// sdListener returns the first socket that systemd passed to g10k with socket activation, or nil if g10k was not socket activated.
+// The LISTEN_* environment variables are removed, so that the g10k runs do not pick them up.
+func sdListener() net.Listener {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	if fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err != nil || fds < 1 {
+		return nil
+	}
+	file := os.NewFile(sdListenFdsStart, "LISTEN_FD_"+strconv.Itoa(sdListenFdsStart))
+	listener, err := net.FileListener(file)
+	if err != nil {
+		Fatalf("Error: could not use the socket passed by systemd: " + err.Error())
+	}
+	file.Close()
+	return listener
+}
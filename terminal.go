@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// colorParam is the -color mode: auto, always or never
+var colorParam = "auto"
+
+// validateColor exits if the -color mode is not supported
+func validateColor() {
+	if colorParam != "auto" && colorParam != "always" && colorParam != "never" {
+		unsupported := colorParam
+		colorParam = "auto"
+		Fatalf("Error: Unsupported -color " + unsupported + " Supported are auto, always and never")
+	}
+}
+
+// colorsEnabled returns true if the messages written to the given file get ANSI colors,
+// with -color auto only if it is a terminal, NO_COLOR is not set and TERM is not dumb
+func colorsEnabled(f *os.File) bool {
+	switch colorParam {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return len(os.Getenv("NO_COLOR")) == 0 && interactiveTerminal(f)
+}
+
+// interactiveTerminal returns true if the given file is a terminal that understands ANSI escape codes, which the progress bars need to redraw themselves
+func interactiveTerminal(f *os.File) bool {
+	return os.Getenv("TERM") != "dumb" && term.IsTerminal(int(f.Fd()))
+}
+
+// printColored prints the given message in the given color to the given file if it gets colors
+func printColored(f *os.File, attribute color.Attribute, s string) {
+	c := color.New(attribute)
+	if colorsEnabled(f) {
+		c.EnableColor()
+	} else {
+		c.DisableColor()
+	}
+	// Fprintln of the color package only writes the reset code if the colors are enabled globally
+	fmt.Fprintln(f, c.Sprint(s))
+}
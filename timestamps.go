@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// commitTimestamps returns the time of the last commit that changed each file of the given commit of the git repository
+func commitTimestamps(gitDir string, commit string) map[string]time.Time {
+	files := gitTreeFiles(gitDir, commit)
+	timestamps := make(map[string]time.Time)
+	cmd := exec.Command("git", "-c", "core.quotePath=false", "--git-dir", gitDir, "log", "--format=%x00%ct", "--name-only", "--no-renames", commit)
+	Debugf("Executing git -c core.quotePath=false --git-dir " + gitDir + " log --format=%x00%ct --name-only --no-renames " + commit)
+	cmdOut, err := cmd.StdoutPipe()
+	if err != nil {
+		Warnf("WARNING: Could not read the commit timestamps of " + gitDir + " Error: " + err.Error())
+		return timestamps
+	}
+	if err := cmd.Start(); err != nil {
+		Warnf("WARNING: Could not read the commit timestamps of " + gitDir + " Error: " + err.Error())
+		return timestamps
+	}
+	var commitTime time.Time
+	scanner := bufio.NewScanner(cmdOut)
+	for scanner.Scan() && len(timestamps) < len(files) {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "\x00") {
+			seconds, _ := strconv.ParseInt(strings.TrimPrefix(line, "\x00"), 10, 64)
+			commitTime = time.Unix(seconds, 0)
+			continue
+		}
+		if _, ok := timestamps[line]; files[line] && !ok {
+			timestamps[line] = commitTime
+		}
+	}
+	// the older history is not needed once every file has its timestamp
+	cmd.Process.Kill()
+	cmd.Wait()
+	return timestamps
+}
+
+// applyCommitTimestamps sets the modification time of every file that g10k extracted from the given commit into targetDir to the time of the last commit that changed it.
+// This keeps the timestamps of identical content stable across deploys, no matter when or how often it got extracted.
+// Hardlinked files are skipped, because they share their modification time with the live environment, older environment versions or the module store.
+func applyCommitTimestamps(gitDir string, commit string, targetDir string) {
+	for file, commitTime := range commitTimestamps(gitDir, commit) {
+		path := filepath.Join(targetDir, file)
+		info, err := os.Lstat(path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if st, ok := info.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			Debugf("Not setting the commit timestamp of " + path + ", because it is hardlinked")
+			continue
+		}
+		if err := os.Chtimes(path, commitTime, commitTime); err != nil {
+			Warnf("WARNING: Could not set the commit timestamp of " + path + " Error: " + err.Error())
+		}
+	}
+}
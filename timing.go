@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// timingsParam is the number of the slowest modules and repositories that -timings prints at the end of the g10k run
+var timingsParam int
+
+// timingsFileParam is the file that -timings-file writes the durations of all modules and repositories to as JSON
+var timingsFileParam string
+
+// moduleTimings contains the durations of the phases of every git repository and Forge module of the g10k run
+var moduleTimings = struct {
+	sync.Mutex
+	m map[string]*ModuleTiming
+}{m: make(map[string]*ModuleTiming)}
+
+// ModuleTiming is the time that g10k spent on a git repository or Forge module, summed up over all environments that use it
+type ModuleTiming struct {
+	Name   string             `json:"name"`
+	Type   string             `json:"type"`
+	Total  float64            `json:"total"`
+	Phases map[string]float64 `json:"phases"`
+}
+
+// trackModuleTime adds the time since start to the given phase of the git repository or Forge module, it is used with defer like timeTrack
+func trackModuleTime(moduleType string, name string, phase string, start time.Time) {
+	duration := time.Since(start).Seconds()
+	key := moduleType + ":" + name
+	moduleTimings.Lock()
+	defer moduleTimings.Unlock()
+	mt, ok := moduleTimings.m[key]
+	if !ok {
+		mt = &ModuleTiming{Name: name, Type: moduleType, Phases: make(map[string]float64)}
+		moduleTimings.m[key] = mt
+	}
+	mt.Phases[phase] += duration
+	mt.Total += duration
+}
+
+// slowestModules returns the timings of all git repositories and Forge modules, the slowest first
+func slowestModules() []ModuleTiming {
+	moduleTimings.Lock()
+	defer moduleTimings.Unlock()
+	var timings []ModuleTiming
+	for _, mt := range moduleTimings.m {
+		timings = append(timings, *mt)
+	}
+	sort.Slice(timings, func(i, j int) bool {
+		if timings[i].Total != timings[j].Total {
+			return timings[i].Total > timings[j].Total
+		}
+		return timings[i].Name < timings[j].Name
+	})
+	return timings
+}
+
+// printTimingReport prints the -timings table of the slowest modules and repositories and writes all of them to the -timings-file
+func printTimingReport() {
+	if timingsParam <= 0 && len(timingsFileParam) == 0 {
+		return
+	}
+	timings := slowestModules()
+	if len(timingsFileParam) > 0 {
+		writeStructJSONFile(timingsFileParam, timings)
+	}
+	if timingsParam <= 0 || len(timings) == 0 {
+		return
+	}
+	if len(timings) > timingsParam {
+		timings = timings[:timingsParam]
+	}
+	nameWidth := 0
+	for _, mt := range timings {
+		if len(mt.Name) > nameWidth {
+			nameWidth = len(mt.Name)
+		}
+	}
+	fmt.Println("Slowest " + strconv.Itoa(len(timings)) + " modules and repositories:")
+	for _, mt := range timings {
+		fmt.Printf("  %8ss  %-5s  %-*s  %s\n", strconv.FormatFloat(mt.Total, 'f', 2, 64), mt.Type, nameWidth, mt.Name, formatPhases(mt.Phases))
+	}
+}
+
+// formatPhases returns the phases of a module with their durations, the slowest first
+func formatPhases(phases map[string]float64) string {
+	var names []string
+	for phase := range phases {
+		names = append(names, phase)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if phases[names[i]] != phases[names[j]] {
+			return phases[names[i]] > phases[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	var parts []string
+	for _, phase := range names {
+		parts = append(parts, phase+" "+strconv.FormatFloat(phases[phase], 'f', 2, 64)+"s")
+	}
+	return "(" + strings.Join(parts, ", ") + ")"
+}
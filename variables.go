@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// expandDeployVariables replaces the {{source}}, {{branch}}, {{environment}} and {{hostname}} variables in the given config value.
+// Variables with an empty value are left untouched, so that they can be expanded later during the deploy.
+func expandDeployVariables(value string, source string, branch string, environment string) string {
+	if !strings.Contains(value, "{{") {
+		return value
+	}
+	replacements := []string{"{{hostname}}", deployHostname()}
+	if len(source) > 0 {
+		replacements = append(replacements, "{{source}}", source)
+	}
+	if len(branch) > 0 {
+		replacements = append(replacements, "{{branch}}", branch)
+	}
+	if len(environment) > 0 {
+		replacements = append(replacements, "{{environment}}", environment)
+	}
+	return strings.NewReplacer(replacements...).Replace(value)
+}
+
+// deployHostname returns the short hostname of the host g10k is running on
+func deployHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		Fatalf("deployHostname(): Could not get hostname for {{hostname}} variable Error: " + err.Error())
+	}
+	return strings.Split(hostname, ".")[0]
+}
+
+// expandSourceVariables replaces the variables that are known when reading the g10k config file in the basedir and prefix settings of the given source
+func expandSourceVariables(source string, sa Source) Source {
+	if strings.Contains(sa.Basedir, "{{environment}}") || strings.Contains(sa.Prefix, "{{environment}}") {
+		Fatalf("Error: The {{environment}} variable can not be used in the basedir or prefix setting of source " + source + " in " + configFile + ", because the environment name is derived from them")
+	}
+	sa.Basedir = expandDeployVariables(sa.Basedir, source, "", "")
+	sa.Prefix = expandDeployVariables(sa.Prefix, source, "", "")
+	return sa
+}
+
+// hasBranchVariable returns true if the basedir or prefix setting of the given source contains the {{branch}} variable and can therefore only be resolved per branch
+func hasBranchVariable(sa Source) bool {
+	return strings.Contains(sa.Basedir, "{{branch}}") || strings.Contains(sa.Prefix, "{{branch}}")
+}
+
+// expandBranchVariables replaces the {{branch}} variable in the basedir and prefix settings of the given source.
+// Invalid characters in the branch name are replaced with _ to get a valid directory and environment name.
+func expandBranchVariables(sa Source, branch string) Source {
+	reInvalidCharacters := regexp.MustCompile(`\W`)
+	branch = reInvalidCharacters.ReplaceAllString(branch, "_")
+	sa.Basedir = normalizeDir(strings.Replace(sa.Basedir, "{{branch}}", branch, -1))
+	sa.Prefix = strings.Replace(sa.Prefix, "{{branch}}", branch, -1)
+	return sa
+}
+
+// hasEnvironmentVariables returns true if the given postrun command contains variables that need to be expanded per Puppet environment
+func hasEnvironmentVariables(command []string) bool {
+	joined := strings.Join(command, " ")
+	return strings.Contains(joined, "{{source}}") || strings.Contains(joined, "{{branch}}") || strings.Contains(joined, "{{environment}}")
+}
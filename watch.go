@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// watchPollInterval is how often g10k watch scans the checkout for changes if inotify is not available
+const watchPollInterval = time.Second
+
+// reInvalidEnvironmentChars matches the characters of a branch name that are not allowed in the name of a Puppet environment
+var reInvalidEnvironmentChars = regexp.MustCompile(`\W`)
+
+// watchCommand deploys the working tree of a local control repository checkout into a target directory and deploys it again every time a file in it changes,
+// e.g. g10k watch -dir ~/control-repo -target /etc/puppetlabs/code/environments
+func watchCommand(args []string) {
+	fs := subcommandFlagSet("watch")
+	dir := fs.String("dir", ".", "local checkout of the control repository to watch")
+	target := fs.String("target", "", "directory into which the environment gets deployed, e.g. the environmentpath of a local Puppet")
+	environment := fs.String("environment", "", "name of the deployed environment, defaults to the checked out branch")
+	moduleDir := fs.String("moduledir", "modules", "directory of the environment into which the modules of the Puppetfile get installed")
+	cacheDir := fs.String("cachedir", "", "cachedir for the modules of the Puppetfile, defaults to the g10k default cachedir")
+	debounce := fs.Duration("debounce", 500*time.Millisecond, "how long to wait for further changes before deploying")
+	fs.BoolVar(&debug, "debug", false, "log debug output, defaults to false")
+	fs.Parse(args)
+	if len(*target) == 0 {
+		Fatalf("Error: you need to specify the target directory\nExample call: " + os.Args[0] + " watch -dir ~/control-repo -target /etc/puppetlabs/code/environments")
+	}
+	info = true
+	srcDir, err := filepath.Abs(*dir)
+	if err != nil || !isDir(filepath.Join(srcDir, ".git")) {
+		Fatalf("Error: " + *dir + " is not the root of a git checkout")
+	}
+	if len(*environment) == 0 {
+		er := executeCommand("git -C "+srcDir+" rev-parse --abbrev-ref HEAD", 10, false)
+		*environment = reInvalidEnvironmentChars.ReplaceAllString(strings.TrimSpace(er.stdout), "_")
+	}
+	envDir := filepath.Join(checkDirAndCreate(*target, "watch -target"), *environment)
+
+	wd := watchDeploy{srcDir: srcDir, envDir: envDir, moduleDir: *moduleDir, cacheDir: *cacheDir}
+	wd.deploy()
+	changes := make(chan string, 100)
+	go watchTree(srcDir, changes)
+	Infof("Watching " + srcDir + " for changes, press Ctrl-C to stop")
+	for path := range changes {
+		Debugf("Detected change of " + path)
+		// wait until the changes settle, e.g. while a branch gets checked out
+		for settled := false; !settled; {
+			select {
+			case path = <-changes:
+				Debugf("Detected change of " + path)
+			case <-time.After(*debounce):
+				settled = true
+			}
+		}
+		wd.deploy()
+	}
+}
+
+// watchDeploy deploys the working tree of a control repository checkout into a Puppet environment directory
+type watchDeploy struct {
+	srcDir     string
+	envDir     string
+	moduleDir  string
+	cacheDir   string
+	puppetfile []byte
+}
+
+// deploy copies the changed files of the working tree to the environment, removes deleted files and installs the modules with -puppetfile mode if the Puppetfile changed
+func (wd *watchDeploy) deploy() {
+	before := time.Now()
+	er := executeCommand("git -C "+wd.srcDir+" ls-files -z --cached --others --exclude-standard", config.Timeout, true)
+	if er.returnCode != 0 {
+		Warnf("WARNING: Could not list the files of " + wd.srcDir + ": " + er.errorOutput())
+		return
+	}
+	if err := ensureDir(wd.envDir); err != nil {
+		Fatalf("Error: could not create " + wd.envDir + ": " + err.Error())
+	}
+	synced := make(map[string]struct{})
+	for _, file := range strings.Split(er.stdout, "\x00") {
+		src := filepath.Join(wd.srcDir, file)
+		fi, err := os.Lstat(src)
+		if len(file) == 0 || err != nil || fi.IsDir() {
+			// deleted in the working tree or a submodule
+			continue
+		}
+		for dir := filepath.Dir(file); dir != "."; dir = filepath.Dir(dir) {
+			synced[dir] = empty
+		}
+		synced[file] = empty
+		target := filepath.Join(wd.envDir, file)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			Warnf("WARNING: Could not create " + filepath.Dir(target) + ": " + err.Error())
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, _ := os.Readlink(src)
+			if existing, err := os.Readlink(target); err != nil || existing != link {
+				purgeDir(target, "watchDeploy.deploy()")
+				os.Symlink(link, target)
+			}
+			continue
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			continue
+		}
+		if changed, err := writeFileIfChanged(target, f, fi.Mode(), fi.ModTime()); err != nil {
+			Warnf("WARNING: Could not deploy " + file + ": " + err.Error())
+		} else if changed {
+			Debugf("Deployed " + file)
+		}
+		f.Close()
+	}
+	removeStaleContent(wd.envDir, synced, []string{wd.moduleDir})
+
+	puppetfile, _ := ioutil.ReadFile(filepath.Join(wd.envDir, "Puppetfile"))
+	if len(puppetfile) > 0 && (wd.puppetfile == nil || !bytes.Equal(puppetfile, wd.puppetfile)) {
+		wd.puppetfile = puppetfile
+		if !wd.installModules() {
+			// retry with the next change
+			wd.puppetfile = nil
+		}
+	}
+	Infof("Deployed " + wd.srcDir + " to " + wd.envDir + " in " + time.Since(before).Round(time.Millisecond).String())
+}
+
+// installModules runs g10k in -puppetfile mode inside of the environment directory
+func (wd *watchDeploy) installModules() bool {
+	executable, err := os.Executable()
+	if err != nil {
+		Warnf("WARNING: Not installing the modules of the Puppetfile, because the g10k executable could not be found: " + err.Error())
+		return false
+	}
+	args := []string{"-puppetfile", "-moduledir", wd.moduleDir}
+	if len(wd.cacheDir) > 0 {
+		args = append(args, "-cachedir", wd.cacheDir)
+	}
+	Infof("Installing the modules of " + filepath.Join(wd.envDir, "Puppetfile"))
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = wd.envDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		Warnf("WARNING: Could not install the modules of the Puppetfile: " + err.Error())
+		return false
+	}
+	return true
+}
+
+// pollTree sends the path of every file below dir, except for the .git directory, whose modification time or size changed since the last scan
+func pollTree(dir string, changes chan<- string) {
+	scan := func() map[string]string {
+		files := make(map[string]string)
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			if info.IsDir() && info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			files[path] = info.ModTime().String() + " " + info.Mode().String() + " " + strconv.FormatInt(info.Size(), 10)
+			return nil
+		})
+		return files
+	}
+	previous := scan()
+	for range time.Tick(watchPollInterval) {
+		current := scan()
+		for path, state := range current {
+			if previous[path] != state {
+				changes <- path
+			}
+		}
+		for path := range previous {
+			if _, ok := current[path]; !ok {
+				changes <- path
+			}
+		}
+		previous = current
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchTree sends the path of every changed file below dir, except for the .git directory, using inotify.
+// It falls back to polling if inotify is not available, e.g. because the limit of inotify watches is reached.
+func watchTree(dir string, changes chan<- string) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		Debugf("Polling for changes, because inotify is not available: " + err.Error())
+		pollTree(dir, changes)
+		return
+	}
+	defer unix.Close(fd)
+	const mask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_CLOSE_WRITE | unix.IN_MODIFY | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+	watches := make(map[int]string)
+	addWatches := func(root string) error {
+		return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			wd, err := unix.InotifyAddWatch(fd, path, mask)
+			if err != nil {
+				return err
+			}
+			watches[wd] = path
+			return nil
+		})
+	}
+	if err := addWatches(dir); err != nil {
+		Debugf("Polling for changes, because the inotify watches could not be added: " + err.Error())
+		pollTree(dir, changes)
+		return
+	}
+
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := unix.Read(fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			Fatalf("watchTree(): could not read inotify events for " + dir + " Error: " + err.Error())
+		}
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			name := string(nameBytes)
+			for len(name) > 0 && name[len(name)-1] == 0 {
+				name = name[:len(name)-1]
+			}
+			path := filepath.Join(watches[int(event.Wd)], name)
+			if name == ".git" {
+				continue
+			}
+			if event.Mask&unix.IN_ISDIR != 0 && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				addWatches(path)
+			}
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(watches, int(event.Wd))
+				continue
+			}
+			changes <- path
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// watchTree sends the path of every changed file below dir, except for the .git directory, by polling, because inotify is only available on Linux
+func watchTree(dir string, changes chan<- string) {
+	pollTree(dir, changes)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// reModuleName matches the module names that a deploy request can deploy, e.g. stdlib or puppetlabs-stdlib
+var reModuleName = regexp.MustCompile(`^[a-zA-Z0-9][\w/-]*$`)
+
+// maxWebhookPayload is the largest webhook payload g10k serve reads, which is the limit of GitHub
+const maxWebhookPayload = 25 << 20
+
+// githubWebhookHandler deploys the Puppet environments of the branch of a GitHub push event
+func githubWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readWebhook(w, r, "GitHub", validHMACSignature(r.Header.Get("X-Hub-Signature-256"), "sha256=", config.Serve.GitHubSecret))
+	if !ok {
+		return
+	}
+	switch r.Header.Get("X-GitHub-Event") {
+	case "ping":
+		w.Write([]byte("pong\n"))
+	case "push":
+		githubPush(w, payload)
+	default:
+		w.Write([]byte("ignoring " + r.Header.Get("X-GitHub-Event") + " event\n"))
+	}
+}
+
+// giteaWebhookHandler deploys the Puppet environments of the branch of a Gitea push event, whose payload is compatible with GitHub
+func giteaWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readWebhook(w, r, "Gitea", validHMACSignature(r.Header.Get("X-Gitea-Signature"), "", config.Serve.GiteaSecret))
+	if !ok {
+		return
+	}
+	if r.Header.Get("X-Gitea-Event") != "push" {
+		w.Write([]byte("ignoring " + r.Header.Get("X-Gitea-Event") + " event\n"))
+		return
+	}
+	githubPush(w, payload)
+}
+
+// githubPush queues the deploy of a GitHub or Gitea push event
+func githubPush(w http.ResponseWriter, payload []byte) {
+	var event GitHubPushEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "invalid push event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	repo := event.Repository
+	wd, ok := webhookDeployForPush(event.Ref, event.Deleted || deletedCommit(event.After), repo.CloneURL, repo.SSHURL, repo.GitURL, repo.HTMLURL)
+	if !ok {
+		Debugf("Ignoring push of " + event.Ref + " to " + repo.HTMLURL + ", which is not a branch of a configured source")
+		w.Write([]byte("ignoring push of " + event.Ref + "\n"))
+		return
+	}
+	queueWebhookDeploy(w, wd)
+}
+
+// gitlabWebhookHandler deploys the Puppet environments of the branch or tag of a GitLab push event and the review environments of GitLab merge request events
+func gitlabWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	token := []byte(r.Header.Get("X-Gitlab-Token"))
+	authorized := len(config.Serve.GitLabSecret) > 0 && subtle.ConstantTimeCompare(token, []byte(config.Serve.GitLabSecret)) == 1
+	payload, ok := readWebhook(w, r, "GitLab", func([]byte) bool { return authorized })
+	if !ok {
+		return
+	}
+	var event GitLabEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var wd webhookDeploy
+	switch r.Header.Get("X-Gitlab-Event") {
+	case "Push Hook", "Tag Push Hook":
+		p := event.Project
+		wd, ok = webhookDeployForPush(event.Ref, deletedCommit(event.After), p.GitHTTPURL, p.GitSSHURL, p.WebURL)
+	case "Merge Request Hook":
+		mr := event.ObjectAttributes
+		wd, ok = webhookDeployForMergeRequest(mr.IID, mr.Action, mr.SourceBranch, mr.Source.GitHTTPURL, mr.Source.GitSSHURL, mr.Source.WebURL)
+	default:
+		ok = false
+	}
+	if !ok {
+		Debugf("Ignoring GitLab " + r.Header.Get("X-Gitlab-Event") + " of " + event.Project.WebURL)
+		w.Write([]byte("ignoring " + r.Header.Get("X-Gitlab-Event") + "\n"))
+		return
+	}
+	queueWebhookDeploy(w, wd)
+}
+
+// bitbucketCloudWebhookHandler deploys the Puppet environments of the branches and tags of a Bitbucket Cloud push event
+func bitbucketCloudWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readWebhook(w, r, "Bitbucket Cloud", validHMACSignature(r.Header.Get("X-Hub-Signature"), "sha256=", config.Serve.BitbucketSecret))
+	if !ok {
+		return
+	}
+	if r.Header.Get("X-Event-Key") != "repo:push" {
+		w.Write([]byte("ignoring " + r.Header.Get("X-Event-Key") + " event\n"))
+		return
+	}
+	var event BitbucketCloudPushEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "invalid push event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var wds []webhookDeploy
+	for _, change := range event.Push.Changes {
+		ref, deleted := change.New, change.Closed || change.New == nil
+		if ref == nil {
+			ref = change.Old
+		}
+		if ref == nil {
+			continue
+		}
+		refPrefix := "refs/heads/"
+		if ref.Type == "tag" {
+			refPrefix = "refs/tags/"
+		}
+		if wd, ok := webhookDeployForPush(refPrefix+ref.Name, deleted, event.Repository.Links.HTML.Href); ok {
+			wds = append(wds, wd)
+		}
+	}
+	queueWebhookDeploy(w, wds...)
+}
+
+// bitbucketServerWebhookHandler deploys the Puppet environments of the branches and tags of a Bitbucket Server push event
+func bitbucketServerWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	payload, ok := readWebhook(w, r, "Bitbucket Server", validHMACSignature(r.Header.Get("X-Hub-Signature"), "sha256=", config.Serve.BitbucketSecret))
+	if !ok {
+		return
+	}
+	switch r.Header.Get("X-Event-Key") {
+	case "diagnostics:ping":
+		w.Write([]byte("pong\n"))
+		return
+	case "repo:refs_changed":
+	default:
+		w.Write([]byte("ignoring " + r.Header.Get("X-Event-Key") + " event\n"))
+		return
+	}
+	var event BitbucketServerPushEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		http.Error(w, "invalid push event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var repoURLs []string
+	for _, clone := range event.Repository.Links.Clone {
+		repoURLs = append(repoURLs, clone.Href)
+	}
+	var wds []webhookDeploy
+	for _, change := range event.Changes {
+		if wd, ok := webhookDeployForPush(change.RefID, change.Type == "DELETE", repoURLs...); ok {
+			wds = append(wds, wd)
+		}
+	}
+	queueWebhookDeploy(w, wds...)
+}
+
+// deployHandler deploys the Puppet environment and module of a deploy request, e.g. {"environment": "example_qa", "module": "stdlib"} from a CI system or chat bot
+func deployHandler(w http.ResponseWriter, r *http.Request) {
+	token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	authorized := len(config.Serve.DeployToken) > 0 && subtle.ConstantTimeCompare(token, []byte(config.Serve.DeployToken)) == 1
+	payload, ok := readWebhook(w, r, "deploy", func([]byte) bool { return authorized })
+	if !ok {
+		return
+	}
+	var dr DeployRequest
+	if len(bytes.TrimSpace(payload)) > 0 {
+		if err := json.Unmarshal(payload, &dr); err != nil {
+			http.Error(w, "invalid deploy request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	wd, err := webhookDeployForRequest(dr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	queueWebhookDeploy(w, wd)
+}
+
+// webhookDeployForRequest returns the deploy of the given deploy request, which without environment and module is a full deploy
+func webhookDeployForRequest(dr DeployRequest) (webhookDeploy, error) {
+	wd := webhookDeploy{description: "all environments"}
+	if len(dr.Environment) > 0 {
+		known := false
+		for source := range config.Sources {
+			known = known || strings.HasPrefix(dr.Environment, source+"_")
+		}
+		if !known {
+			return wd, errors.New("environment " + dr.Environment + " does not belong to any source, expected <source>_<branch>")
+		}
+		wd.description = "environment " + dr.Environment
+		wd.args = []string{"-environment", dr.Environment}
+	}
+	if len(dr.Module) > 0 {
+		if !reModuleName.MatchString(dr.Module) {
+			return wd, errors.New("invalid module name " + dr.Module)
+		}
+		wd.description = "module " + dr.Module + " in " + wd.description
+		wd.args = append(wd.args, "-module", dr.Module)
+	}
+	return wd, nil
+}
+
+// readWebhook returns the payload of the given webhook request and false if the request was rejected, because it is no POST request or the given check of the signature or token failed
+func readWebhook(w http.ResponseWriter, r *http.Request, provider string, validSignature func([]byte) bool) ([]byte, bool) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return nil, false
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayload))
+	if err != nil {
+		http.Error(w, "could not read payload", http.StatusBadRequest)
+		return nil, false
+	}
+	if !validSignature(payload) {
+		Warnf("WARNING: Ignoring " + provider + " request from " + r.RemoteAddr + " with invalid signature or token")
+		http.Error(w, "invalid signature or token", http.StatusUnauthorized)
+		return nil, false
+	}
+	return payload, true
+}
+
+// validHMACSignature returns a check if the given signature header is the given prefix followed by the hex encoded HMAC-SHA256 of the payload with the webhook secret
+func validHMACSignature(signature string, prefix string, secret string) func([]byte) bool {
+	return func(payload []byte) bool {
+		if len(secret) == 0 || !strings.HasPrefix(signature, prefix) {
+			return false
+		}
+		received, err := hex.DecodeString(strings.TrimPrefix(signature, prefix))
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(payload)
+		return hmac.Equal(received, mac.Sum(nil))
+	}
+}
+
+// deletedCommit returns true if the given commit after a push is the null commit of a deleted branch or tag
+func deletedCommit(commit string) bool {
+	return len(commit) > 0 && strings.Trim(commit, "0") == ""
+}
+
+// webhookDeployForPush returns the deploy for a push of the given ref to the repository with the given urls and false if no source uses this repository.
+// A push to a single source deploys only the Puppet environment of the branch, a deleted branch needs a full deploy to purge its Puppet environment.
+// Pushed tags are only deployed with the serve tags setting, like with -tags.
+func webhookDeployForPush(ref string, deleted bool, repoURLs ...string) (webhookDeploy, bool) {
+	var args []string
+	kind := "branch"
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+	case strings.HasPrefix(ref, "refs/tags/") && config.Serve.Tags:
+		args = []string{"-tags"}
+		kind = "tag"
+	default:
+		return webhookDeploy{}, false
+	}
+	branch := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	sources := webhookSources(repoURLs)
+	switch {
+	case len(sources) == 0:
+		return webhookDeploy{}, false
+	case deleted:
+		return webhookDeploy{description: "all environments after " + kind + " " + branch + " was deleted", args: args}, true
+	case len(sources) == 1:
+		env := sources[0] + "_" + branch
+		return webhookDeploy{description: "environment " + env, args: append(args, "-environment", env)}, true
+	}
+	return webhookDeploy{description: kind + " " + branch + " of sources " + strings.Join(sources, ", "), args: append(args, "-branch", branch)}, true
+}
+
+// webhookDeployForMergeRequest returns the deploy for the given action of a merge request from the given branch of the repository with the given urls and false if nothing needs to be done.
+// Opening or updating a merge request deploys its branch as review environment, e.g. mr_42, merging or closing it removes the review environment.
+func webhookDeployForMergeRequest(iid int, action string, branch string, repoURLs ...string) (webhookDeploy, bool) {
+	sources := webhookSources(repoURLs)
+	if len(sources) == 0 {
+		return webhookDeploy{}, false
+	}
+	env := reviewEnvironmentPrefix + strconv.Itoa(iid)
+	var envDirs []string
+	for _, source := range sources {
+		sa := config.Sources[source]
+		if hasBranchVariable(sa) {
+			sa = expandBranchVariables(sa, branch)
+		}
+		envDirs = append(envDirs, filepath.Join(sa.Basedir, resolveSourcePrefix(source, sa)+env))
+	}
+	switch action {
+	case "open", "reopen", "update":
+		return webhookDeploy{description: "review environment " + env + " of branch " + branch, args: []string{"-branch", branch, "-outputname", env}, review: envDirs}, true
+	case "merge", "close":
+		return webhookDeploy{description: "removal of review environment " + env, remove: envDirs}, true
+	}
+	return webhookDeploy{}, false
+}
+
+// reviewMarkerFile is the file inside of a review environment of an open merge request, it gets removed with the review environment once the merge request is merged or closed
+const reviewMarkerFile = ".g10k-review"
+
+// writeReviewMarkers marks the given deployed review environment directories, so that they do not get purged as unmanaged environments by later full g10k runs
+func writeReviewMarkers(envDirs []string) {
+	for _, envDir := range envDirs {
+		if !isDir(envDir) {
+			continue
+		}
+		file := filepath.Join(envDir, reviewMarkerFile)
+		if err := writeFileAtomic(file, []byte(filepath.Base(envDir)+"\n"), 0644); err != nil {
+			Warnf("WARNING: Could not mark review environment " + envDir + ", a full g10k run will purge it: " + err.Error())
+			continue
+		}
+		applyOwnership(file)
+	}
+}
+
+// withReviewEnvironments adds all review environments of open merge requests among the given environment directories to the given managed environments, so that they are not purged
+func withReviewEnvironments(environmentDirs []string, managedEnvironments map[string]bool) {
+	for _, dir := range environmentDirs {
+		env := filepath.Base(dir)
+		if managedEnvironments[env] || !fileExists(filepath.Join(dir, reviewMarkerFile)) {
+			continue
+		}
+		Debugf("Not purging review environment " + env)
+		managedEnvironments[env] = true
+	}
+}
+
+// webhookSources returns the sources whose remote is one of the given repository urls
+func webhookSources(repoURLs []string) []string {
+	var sources []string
+	for _, source := range sortedSourceNames() {
+		remote := normalizeGitURL(config.Sources[source].Remote)
+		for _, repoURL := range repoURLs {
+			if len(repoURL) > 0 && normalizeGitURL(repoURL) == remote {
+				sources = append(sources, source)
+				break
+			}
+		}
+	}
+	return sources
+}
+
+// normalizeGitURL returns the host and path of the given git url, so that the https and ssh urls of the same repository are equal, e.g. github.com/xorpaul/g10k-environment
+func normalizeGitURL(gitURL string) string {
+	gitURL = strings.TrimSuffix(strings.TrimSuffix(gitURL, "/"), ".git")
+	if u, err := url.Parse(gitURL); err == nil && len(u.Host) > 0 {
+		return strings.ToLower(u.Hostname()) + u.Path
+	}
+	// scp-like syntax, e.g. git@github.com:xorpaul/g10k-environment
+	if i := strings.Index(gitURL, ":"); i > 0 && !strings.Contains(gitURL[:i], "/") {
+		host := gitURL[:i]
+		if at := strings.LastIndex(host, "@"); at >= 0 {
+			host = host[at+1:]
+		}
+		return strings.ToLower(host) + "/" + strings.TrimPrefix(gitURL[i+1:], "/")
+	}
+	return gitURL
+}